@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"cobalt-passthru/pkg/passthru"
+)
+
+// runAnalyze is the analyze subcommand: it reports on what a storage
+// directory holds, without serving or changing it.
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	storage := fs.String("storage", passthru.DefaultConfig().StorageDir, "The storage directory to analyze")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	top := fs.Int("top", 10, "How many duplicates and domains to list")
+	fs.Parse(args)
+
+	report, err := passthru.AnalyzeStorage(*storage)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printReport(os.Stdout, report, *top)
+	return nil
+}
+
+func printReport(out io.Writer, report *passthru.StorageReport, top int) {
+	fmt.Fprintf(out, "%d entries, %s\n", report.Entries, humanBytes(report.Bytes))
+	fmt.Fprintf(out, "Deduplication would save %s, compression about %s\n\n", humanBytes(report.DedupSavings), humanBytes(report.CompressionSavings))
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SIZE\tENTRIES\tBYTES")
+	for _, bucket := range report.Sizes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", bucket.Label, bucket.Entries, humanBytes(bucket.Bytes))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "DOMAIN\tENTRIES\tBYTES")
+	for i, usage := range report.Domains {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", usage.Domain, usage.Entries, humanBytes(usage.Bytes))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "DUPLICATE\tCOPIES\tSIZE\tURLS")
+	for i, content := range report.Duplicates {
+		if i == top {
+			break
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%v\n", content.SHA256[:12], content.Copies, humanBytes(content.Size), content.URLs)
+	}
+	w.Flush()
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
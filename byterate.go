@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// byteRateUnits are what a byteRate may be given in, in bytes per second.
+var byteRateUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1e3, "kb": 1e3, "kib": 1 << 10,
+	"m": 1e6, "mb": 1e6, "mib": 1 << 20,
+	"g": 1e9, "gb": 1e9, "gib": 1 << 30,
+	"kbit": 1e3 / 8, "mbit": 1e6 / 8, "gbit": 1e9 / 8,
+}
+
+// byteRate is a flag of bytes per second, given as a plain number of bytes
+// or with a unit, as in 500KB/s, 10MB/s, 1GiB/s or 100Mbit/s.
+type byteRate struct {
+	to *int
+}
+
+func (b byteRate) String() string {
+	if b.to == nil {
+		return "0"
+	}
+	return strconv.Itoa(*b.to)
+}
+
+func (b byteRate) Set(value string) error {
+	s := strings.ToLower(strings.TrimSpace(value))
+	s = strings.TrimSuffix(s, "/s")
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := byteRateUnits[strings.TrimSpace(s[i:])]
+	if err != nil || !ok || n < 0 {
+		return fmt.Errorf("%q must be bytes per second, such as 2000000 or 10MB/s", value)
+	}
+	*b.to = int(n * unit)
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// newHTTP3Server returns an HTTP/3 server for handler on the UDP address
+// addr, and handler wrapped to advertise it through Alt-Svc on the regular
+// listener. Clients that pick it up move over to QUIC, which copes much
+// better with lossy mobile links than TCP does.
+func newHTTP3Server(addr string, handler http.Handler) (*http3.Server, http.Handler) {
+	h3 := &http3.Server{Addr: addr, Handler: handler}
+	advertised := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h3.SetQUICHeaders(w.Header())
+		handler.ServeHTTP(w, r)
+	})
+	return h3, advertised
+}
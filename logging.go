@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"cobalt-passthru/pkg/passthru"
+)
+
+// logOptions are where the logs go.
+type logOptions struct {
+	// output is where the application log goes: stderr, file (appLog),
+	// syslog (at syslogAddr, or the local daemon) or journald. Empty is
+	// file if appLog is set and stderr otherwise.
+	output     string
+	appLog     string
+	syslogAddr string
+	// accessLog is the access log file, off when empty.
+	accessLog string
+	rotation  passthru.LogRotation
+	// format is logfmt or json, and level the least severe level logged:
+	// debug, info, warn or error.
+	format string
+	level  string
+}
+
+// fatal logs msg and its key-value pairs as an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// openLogs sends the application log where opts says, as opts says, and
+// returns the access log file, if any. Log files rotate as opts.rotation
+// says, and on SIGHUP.
+func openLogs(opts logOptions) (*passthru.RotatingFile, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q (want debug, info, warn or error)", opts.level)
+	}
+	if opts.format != "logfmt" && opts.format != "json" {
+		return nil, fmt.Errorf("unknown log format %q (want logfmt or json)", opts.format)
+	}
+
+	output := opts.output
+	if output == "" {
+		output = "stderr"
+		if opts.appLog != "" {
+			output = "file"
+		}
+	}
+	if output != "file" && opts.appLog != "" {
+		return nil, fmt.Errorf("-log-file only applies to -log-output=file")
+	}
+	var files []*passthru.RotatingFile
+	var out io.Writer = os.Stderr
+	stamped := false
+	switch output {
+	case "stderr":
+	case "file":
+		if opts.appLog == "" {
+			return nil, fmt.Errorf("-log-output=file requires -log-file")
+		}
+		f, err := passthru.OpenRotatingFile(opts.appLog, opts.rotation)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+		files = append(files, f)
+	case "syslog":
+		w, err := newSyslogWriter(opts.syslogAddr, logTag())
+		if err != nil {
+			return nil, err
+		}
+		out, stamped = w, true
+	case "journald":
+		w, err := newJournaldWriter(logTag())
+		if err != nil {
+			return nil, err
+		}
+		out, stamped = w, true
+	default:
+		return nil, fmt.Errorf("unknown log output %q (want stderr, file, syslog or journald)", output)
+	}
+	if stamped && opts.format == "json" {
+		return nil, fmt.Errorf("-log-format=json only applies to -log-output=stderr or file")
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if stamped {
+		// The sink stamps every line itself
+		handlerOpts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	var handler slog.Handler
+	if opts.format == "json" {
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(out, handlerOpts)
+	}
+	slog.SetDefault(slog.New(passthru.NewLogHandler(handler)))
+	accessLog := opts.accessLog
+	var access *passthru.RotatingFile
+	if accessLog != "" {
+		var err error
+		if access, err = passthru.OpenRotatingFile(accessLog, opts.rotation); err != nil {
+			return nil, err
+		}
+		files = append(files, access)
+	}
+
+	if len(files) > 0 {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				for _, f := range files {
+					if err := f.Rotate(); err != nil {
+						slog.Error("Log_rotation_error", "error", err)
+					}
+				}
+			}
+		}()
+	}
+	return access, nil
+}
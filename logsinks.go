@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// journaldSocket is where journald takes entries in its native protocol.
+	journaldSocket = "/run/systemd/journal/socket"
+	// Syslog facility daemon, and the severities log lines are sent with.
+	syslogFacility = 3
+	syslogErr      = 3
+	syslogWarning  = 4
+	syslogInfo     = 6
+	syslogDebug    = 7
+)
+
+// localSyslogSockets are where local syslog daemons listen, on Linux and
+// the BSDs.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// logFields splits a log line of key=value pairs, values quoted where they
+// need to be, as the service writes them.
+func logFields(line string) [][2]string {
+	var fields [][2]string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimLeft(line, " ") {
+		eq := strings.IndexAny(line, "= ")
+		if eq < 0 || line[eq] == ' ' {
+			// Not a key=value pair: skip the word
+			_, line, _ = strings.Cut(line, " ")
+			continue
+		}
+		key, rest := line[:eq], line[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			if quoted, err := strconv.QuotedPrefix(rest); err == nil {
+				value, _ = strconv.Unquote(quoted)
+				rest = rest[len(quoted):]
+				fields = append(fields, [2]string{key, value})
+				line = rest
+				continue
+			}
+		}
+		// An unquoted value, such as an error, may have spaces in it: it
+		// runs up to the next key=
+		end := len(rest)
+		for i := strings.IndexByte(rest, ' '); i >= 0; {
+			if startsPair(rest[i+1:]) {
+				end = i
+				break
+			}
+			next := strings.IndexByte(rest[i+1:], ' ')
+			if next < 0 {
+				break
+			}
+			i += 1 + next
+		}
+		value, line = rest[:end], rest[end:]
+		fields = append(fields, [2]string{key, value})
+	}
+	return fields
+}
+
+// startsPair reports whether s starts with a key= of a log line.
+func startsPair(s string) bool {
+	for i, r := range s {
+		switch {
+		case r == '=':
+			return i > 0
+		case r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9'):
+			return false
+		}
+	}
+	return false
+}
+
+// logSeverity returns the syslog severity of a log line from its level.
+func logSeverity(line string) int {
+	for _, field := range logFields(line) {
+		if field[0] != "level" {
+			continue
+		}
+		switch field[1] {
+		case "ERROR":
+			return syslogErr
+		case "WARN":
+			return syslogWarning
+		case "DEBUG":
+			return syslogDebug
+		}
+	}
+	return syslogInfo
+}
+
+// syslogWriter sends each log line to a syslog daemon as an RFC 5424
+// message.
+type syslogWriter struct {
+	network string
+	addr    string
+	tag     string
+	host    string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogWriter connects to the syslog daemon at addr: udp://host:port,
+// tcp://host:port, or the local one if addr is empty.
+func newSyslogWriter(addr, tag string) (*syslogWriter, error) {
+	sw := &syslogWriter{tag: tag, host: "-"}
+	if host, err := os.Hostname(); err == nil && host != "" {
+		sw.host = host
+	}
+	if addr != "" {
+		network, hostPort, ok := strings.Cut(addr, "://")
+		if !ok || (network != "udp" && network != "tcp") {
+			return nil, fmt.Errorf("syslog address %q must be udp://host:port or tcp://host:port", addr)
+		}
+		sw.network, sw.addr = network, hostPort
+	}
+	if err := sw.connect(); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *syslogWriter) connect() error {
+	if sw.network != "" {
+		conn, err := net.DialTimeout(sw.network, sw.addr, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		sw.conn = conn
+		return nil
+	}
+	var err error
+	for _, socket := range localSyslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			if conn, err = net.Dial(network, socket); err == nil {
+				sw.conn, sw.network = conn, network
+				sw.addr = socket
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no local syslog daemon: %v", err)
+}
+
+// Write sends p, one log line, redialling once if the connection broke.
+func (sw *syslogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		syslogFacility*8+logSeverity(line), time.Now().Format(time.RFC3339Nano), sw.host, sw.tag, os.Getpid(), line)
+	if sw.network == "tcp" || sw.network == "unix" {
+		// Stream transports need framing, by octet counting (RFC 6587)
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if sw.conn != nil {
+		if _, err := io.WriteString(sw.conn, msg); err == nil {
+			return len(p), nil
+		}
+		sw.conn.Close()
+		sw.conn = nil
+	}
+	if err := sw.connect(); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(sw.conn, msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// journaldWriter sends each log line to journald in its native protocol,
+// with every key=value pair of the line as a field of its own (msg as MSG,
+// hash as HASH and so on), so entries can be matched with journalctl
+// MSG=Entry_migrated rather than grepped for.
+type journaldWriter struct {
+	tag  string
+	conn *net.UnixConn
+	mu   sync.Mutex
+}
+
+func newJournaldWriter(tag string) (*journaldWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journald: %v", err)
+	}
+	return &journaldWriter{tag: tag, conn: conn}, nil
+}
+
+// journaldField returns key as a journal field name, which may only have
+// upper case letters, digits and underscores, and not start with one.
+func journaldField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_0123456789")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+func writeJournaldField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", name, value)
+		return
+	}
+	// Values with newlines go as length-prefixed binary
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+func (jw *journaldWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	var buf bytes.Buffer
+	writeJournaldField(&buf, "MESSAGE", line)
+	writeJournaldField(&buf, "PRIORITY", strconv.Itoa(logSeverity(line)))
+	writeJournaldField(&buf, "SYSLOG_IDENTIFIER", jw.tag)
+	for _, field := range logFields(line) {
+		name := journaldField(field[0])
+		switch name {
+		case "", "TIME", "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER":
+			continue
+		}
+		writeJournaldField(&buf, name, field[1])
+	}
+
+	jw.mu.Lock()
+	defer jw.mu.Unlock()
+	if _, err := jw.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logTag is what log lines sent to syslog and journald are tagged with.
+func logTag() string {
+	return filepath.Base(os.Args[0])
+}
@@ -1,345 +1,413 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/json"
+	"context"
 	"flag"
-	"fmt"
-	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-)
-
-var (
-	client = &http.Client{}
-
-	// Define Prometheus metrics
-	httpRequestsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "cobalt_passthru_http_requests_total",
-			Help: "Total number of HTTP requests to the service",
-		},
-		[]string{"path", "cache_status"},
-	)
-
-	externalServiceRequestsTotal = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "cobalt_passthru_external_service_requests_total",
-			Help: "Total number of HTTP requests to the external service",
-		},
-	)
+	"cobalt-passthru/pkg/passthru"
 
-	cleanupsTotal = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "cobalt_passthru_cleanups_total",
-			Help: "Total number of cleanup operations run",
-		},
-	)
-
-	filesCleanedTotal = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Name: "cobalt_passthru_files_cleaned_total",
-			Help: "Total number of files cleaned up",
-		},
-	)
+	"github.com/quic-go/quic-go/http3"
 )
 
-type ExternalServiceRequest struct {
-	URL             string `json:"url"`
-	VideoQuality    string `json:"videoQuality"`
-	DisableMetadata bool   `json:"disableMetadata"`
-}
-
-type ExternalServiceResponse struct {
-	Status   string `json:"status"`
-	URL      string `json:"url"`
-	Filename string `json:"filename"`
-}
+// shutdownCleanupTimeout is how long canceled downloads get to clean up
+// after themselves before the process exits anyway.
+const shutdownCleanupTimeout = 10 * time.Second
 
-func initMetrics() {
-	paths := []string{"/"} // Add more paths if needed
-	cacheStatuses := []string{"cached", "not_cached"}
-
-	for _, path := range paths {
-		for _, cacheStatus := range cacheStatuses {
-			httpRequestsTotal.WithLabelValues(path, cacheStatus).Add(0)
+func main() {
+	// Subcommands come before the server's flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "analyze":
+			if err := runAnalyze(os.Args[2:]); err != nil {
+				fatal("Failed_to_analyze", "error", err)
+			}
+			return
+		case "mock-cobalt":
+			if err := runMockCobalt(os.Args[2:]); err != nil {
+				fatal("Mock_cobalt_failed", "error", err)
+			}
+			return
 		}
 	}
-}
 
-func main() {
-	// Register Prometheus metrics
-	prometheus.MustRegister(httpRequestsTotal)
-	prometheus.MustRegister(externalServiceRequestsTotal)
-	prometheus.MustRegister(cleanupsTotal)
-	prometheus.MustRegister(filesCleanedTotal)
-
-	// Initialize all label values
-	initMetrics()
+	cfg := passthru.DefaultConfig()
 
 	// Define command-line flags
-	endpointFlag := flag.String("endpoint", "http://external-service-endpoint", "The endpoint of the external service")
+	flag.StringVar(&cfg.Endpoint, "endpoint", cfg.Endpoint, "The endpoint of the external service, or a comma-separated list of cobalt instances to spread requests over")
+	flag.DurationVar(&cfg.UpstreamHealthInterval, "upstream-health-interval", cfg.UpstreamHealthInterval, "How often each cobalt instance of an -endpoint listing several is checked, sending requests only to healthy ones (0 to not check)")
+	flag.DurationVar(&cfg.UpstreamProbeInterval, "upstream-probe-interval", cfg.UpstreamProbeInterval, "How often to ask each cobalt endpoint for its API version, to adapt requests to pre-10 instances (0 to assume the current API)")
+	flag.StringVar(&cfg.VideoQuality, "video-quality", cfg.VideoQuality, "The video quality asked of the external service unless a request sets ?quality= (max, or a height such as 1080)")
+	flag.StringVar(&cfg.SubtitleLang, "subtitle-lang", cfg.SubtitleLang, "Two-letter language of the subtitles served for asset=subtitles unless a request sets subs")
+	flag.BoolVar(&cfg.DisableMetadata, "disable-metadata", cfg.DisableMetadata, "Ask the external service to strip metadata from media unless a request sets ?metadata=1")
 	addrFlag := flag.String("addr", ":8080", "The address and port on which the server listens")
 	metricsAddrFlag := flag.String("metrics-addr", ":8081", "The address and port for serving Prometheus metrics")
-	storageDirFlag := flag.String("storage", "./storage", "The directory to store files")
+	grpcAddrFlag := flag.String("grpc-addr", "", "The address and port for the gRPC API (off when empty)")
+	tlsCertFlag := flag.String("tls-cert", "", "The TLS certificate file the app and metrics listeners serve HTTPS and HTTP/2 with (requires -tls-key)")
+	tlsKeyFlag := flag.String("tls-key", "", "The TLS key file of -tls-cert")
+	tlsAutocertHostsFlag := flag.String("tls-autocert-hosts", "", "A comma-separated list of host names to get TLS certificates for from Let's Encrypt, instead of -tls-cert and -tls-key")
+	tlsAutocertDirFlag := flag.String("tls-autocert-dir", "", "The directory certificates from Let's Encrypt are kept in (storage/.autocert when empty)")
+	http3AddrFlag := flag.String("http3-addr", "", "The UDP address and port for an HTTP/3 (QUIC) listener advertised through Alt-Svc (off when empty; requires -http3-cert and -http3-key, or TLS on the main listener)")
+	http3CertFlag := flag.String("http3-cert", "", "The TLS certificate file of the HTTP/3 listener")
+	http3KeyFlag := flag.String("http3-key", "", "The TLS key file of the HTTP/3 listener")
+	maxHeaderBytesFlag := flag.Int("max-header-bytes", 64<<10, "The largest request header accepted, in bytes")
+	shutdownTimeoutFlag := flag.Duration("shutdown-timeout", 30*time.Second, "How long requests under way get to finish on SIGTERM before their downloads are canceled")
+	readHeaderTimeoutFlag := flag.Duration("read-header-timeout", 10*time.Second, "How long a client may take to send its request header")
+	flag.StringVar(&cfg.StorageDir, "storage", cfg.StorageDir, "The directory to store files")
+	flag.BoolVar(&cfg.DurableWrites, "durable-writes", cfg.DurableWrites, "Fsync every file of an entry, and its directory, before the entry counts as cached")
+	flag.BoolVar(&cfg.VerifyChecksums, "verify-checksums", cfg.VerifyChecksums, "Check each entry's SHA-256 the first time it's served after a start or a change, not just its size, and download corrupted ones again")
+	flag.StringVar(&cfg.DisconnectPolicy, "disconnect-policy", cfg.DisconnectPolicy, "What happens to a download when its client goes away: cancel, or finish it in the background")
+	flag.IntVar(&cfg.ServeBufferSize, "serve-buffer-size", cfg.ServeBufferSize, "Buffer size in bytes for streaming responses that aren't served from a stored file")
+	flag.IntVar(&cfg.DownloadBufferSize, "download-buffer-size", cfg.DownloadBufferSize, "Size in bytes of the buffers downloads are copied to disk with")
+	flag.Var(byteRate{&cfg.ServeRateLimit}, "serve-rate-limit", "Cap every response at this many bytes per second, such as 2MB/s (0 for no cap)")
+	flag.Var(byteRate{&cfg.FetchRateLimit}, "fetch-rate-limit", "Cap every download from upstream at this many bytes per second, such as 50MB/s (0 for no cap)")
+	flag.IntVar(&cfg.MaxQueryLength, "max-query-length", cfg.MaxQueryLength, "Refuse requests with a longer query string, in bytes (0 for no limit)")
+	flag.DurationVar(&cfg.ClientStallTimeout, "client-stall-timeout", cfg.ClientStallTimeout, "Drop clients that stop reading a response for this long (0 waits forever)")
+	flag.Var(byteRate{&cfg.EgressRateLimit}, "egress-rate-limit", "Bound the bandwidth of all responses together to this many bytes per second, such as 100Mbit/s (0 for no bound)")
+	flag.Var(byteRate{&cfg.IngressRateLimit}, "ingress-rate-limit", "Bound the bandwidth of all downloads from upstream together to this many bytes per second, such as 100Mbit/s (0 for no bound)")
+	flag.IntVar(&cfg.DownloadParallelism, "download-parallelism", cfg.DownloadParallelism, "Download big media from CDNs that serve ranges in this many chunks at a time (1 downloads in one go)")
+	flag.Int64Var(&cfg.DownloadChunkSize, "download-chunk-size", cfg.DownloadChunkSize, "The size in bytes of the chunks of a parallel download")
+	flag.DurationVar(&cfg.StaleWhileRevalidate, "stale-while-revalidate", cfg.StaleWhileRevalidate, "Keep serving expired entries for this long past their expiry, while they're downloaded again in the background (0 to download them before answering)")
+	flag.DurationVar(&cfg.MaxRequestTTL, "max-request-ttl", cfg.MaxRequestTTL, "Let clients pick how long their entries are kept, up to this long, with a ttl query parameter or an X-Cache-TTL header (0 doesn't let them)")
+	flag.BoolVar(&cfg.AllowRefresh, "allow-refresh", cfg.AllowRefresh, "Let clients have the entry they request downloaded again, replacing the cached copy, with refresh=1")
+	flag.BoolVar(&cfg.AllowNoCache, "allow-nocache", cfg.AllowNoCache, "Let clients have media streamed without it being cached, with nocache=1")
+	flag.StringVar(&cfg.BypassToken, "bypass-token", cfg.BypassToken, "Token clients must send as an X-Bypass-Token header with refresh=1 or nocache=1 (not needed when empty)")
+	flag.BoolVar(&cfg.SinglePort, "single-port", cfg.SinglePort, "Serve /metrics, /healthz and the admin API on -addr too, instead of starting the -metrics-addr server (requires -admin-token)")
+	flag.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "A bearer token required by /metrics and the admin API")
+	flag.BoolVar(&cfg.ReadOnly, "read-only", cfg.ReadOnly, "Serve hits from -storage, which another instance writes to, without ever writing to it, calling cobalt or cleaning up")
+	flag.DurationVar(&cfg.ResolveCacheTTL, "resolve-cache-ttl", cfg.ResolveCacheTTL, "How long to reuse the external service's answer for a URL (0 to ask every time)")
+	flag.DurationVar(&cfg.NegativeCacheTTL, "negative-cache-ttl", cfg.NegativeCacheTTL, "How long to answer requests for a URL the external service failed on with the same error (0 to ask every time)")
+	flag.BoolVar(&cfg.CacheOnly, "cache-only", cfg.CacheOnly, "Start in cache-only mode: serve hits and refuse misses with a 503 (switch at runtime with /admin/maintenance/on and /off)")
+	flag.StringVar(&cfg.KeyHash, "key-hash", cfg.KeyHash, "The hash entries are named after: sha256, blake3 or xxhash, optionally with :digits to keep (e.g. blake3:32)")
+	flag.IntVar(&cfg.KeyLength, "key-length", cfg.KeyLength, "How many hex digits of the key hash to keep in entry names (0 for all of them)")
+	flag.StringVar(&cfg.KeyMigrateFrom, "key-migrate-from", cfg.KeyMigrateFrom, "The -key-hash entries were stored under before, to move them over from as they're looked up")
+	flag.Int64Var(&cfg.MaxEntrySize, "max-entry-size", cfg.MaxEntrySize, "Refuse media over this many bytes (0 for no limit)")
+	flag.Int64Var(&cfg.MemoryCacheBytes, "memory-cache-bytes", cfg.MemoryCacheBytes, "Keep up to this many bytes of small, often served entries in memory (0 to keep none)")
+	flag.Int64Var(&cfg.MemoryCacheMaxItem, "memory-cache-max-item", cfg.MemoryCacheMaxItem, "The largest entry in bytes kept in memory by -memory-cache-bytes")
+	flag.StringVar(&cfg.AllowedContentTypes, "allowed-content-types", cfg.AllowedContentTypes, "Comma-separated media types entries may have, such as video/*,audio/*,image/* (any when empty)")
+	flag.BoolVar(&cfg.UpstreamPrecheck, "upstream-precheck", cfg.UpstreamPrecheck, "Ask the media host for the size and type of media with a HEAD before downloading it, to refuse media over -max-entry-size or not of -allowed-content-types up front")
+	flag.BoolVar(&cfg.StreamMisses, "stream-misses", cfg.StreamMisses, "Send a miss to the client as it downloads, rather than once it's stored")
+	flag.BoolVar(&cfg.ResumeDownloads, "resume-downloads", cfg.ResumeDownloads, "Keep the part of a download that was cut short and fetch only the rest next time, if the upstream still has the same media")
+	flag.IntVar(&cfg.UpstreamMaxIdleConns, "upstream-max-idle-conns", cfg.UpstreamMaxIdleConns, "The maximum number of idle upstream connections kept open")
+	flag.IntVar(&cfg.UpstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", cfg.UpstreamMaxIdleConnsPerHost, "The maximum number of idle connections kept open to each upstream host")
+	flag.IntVar(&cfg.UpstreamMaxConnsPerHost, "upstream-max-conns-per-host", cfg.UpstreamMaxConnsPerHost, "The maximum number of connections to each upstream host (0 for no limit)")
+	flag.DurationVar(&cfg.UpstreamIdleConnTimeout, "upstream-idle-conn-timeout", cfg.UpstreamIdleConnTimeout, "How long idle upstream connections are kept open")
+	flag.DurationVar(&cfg.UpstreamTLSHandshakeTimeout, "upstream-tls-handshake-timeout", cfg.UpstreamTLSHandshakeTimeout, "How long a TLS handshake with an upstream host may take")
+	flag.StringVar(&cfg.UpstreamAPIKey, "upstream-api-key", cfg.UpstreamAPIKey, "The API key sent to cobalt instances requiring one (better set through COBALT_PASSTHRU_UPSTREAM_API_KEY)")
+	flag.StringVar(&cfg.UpstreamTurnstileCommand, "upstream-turnstile-command", cfg.UpstreamTurnstileCommand, "A command printing a Turnstile response for the cobalt instance URL it's given, traded for a session token with instances requiring one")
+	flag.DurationVar(&cfg.UpstreamTimeout, "upstream-timeout", cfg.UpstreamTimeout, "How long an upstream host gets to start answering, and then to send each part of the body (0 for no limit)")
+	flag.IntVar(&cfg.UpstreamRetries, "upstream-retries", cfg.UpstreamRetries, "How many more times a cobalt call or media download failing with a network error, timeout, 429 or 5xx is tried")
+	flag.DurationVar(&cfg.UpstreamRetryBackoff, "upstream-retry-backoff", cfg.UpstreamRetryBackoff, "How long to wait before the first retry of an upstream request, doubled for each one after it")
+	flag.BoolVar(&cfg.UpstreamTTL, "upstream-ttl", cfg.UpstreamTTL, "Expire entries when the Cache-Control or Expires of their media response says to")
+	flag.DurationVar(&cfg.UpstreamTTLMin, "upstream-ttl-min", cfg.UpstreamTTLMin, "Shortest expiry taken from a media response")
+	flag.DurationVar(&cfg.UpstreamTTLMax, "upstream-ttl-max", cfg.UpstreamTTLMax, "Longest expiry taken from a media response")
+	flag.StringVar(&cfg.CleanupPauseWindows, "cleanup-pause-windows", cfg.CleanupPauseWindows, "Comma-separated daily HH:MM-HH:MM windows (local time) during which cleanup is skipped")
+	flag.Int64Var(&cfg.CleanupMaxInFlight, "cleanup-max-inflight", cfg.CleanupMaxInFlight, "Defer cleanup while more than this many downloads are in flight (0 disables)")
+	flag.DurationVar(&cfg.CacheTTL, "cache-ttl", cfg.CacheTTL, "How old cached files get before cleanup removes them")
+	flag.Int64Var(&cfg.CacheMaxBytes, "cache-max-bytes", cfg.CacheMaxBytes, "Once cached files take up more bytes than this, cleanup removes the least recently served entries (0 for no limit)")
+	flag.DurationVar(&cfg.CleanupTrashGrace, "cleanup-trash-grace", cfg.CleanupTrashGrace, "Move expired files to a trash directory and keep them this long before deleting them (0 deletes immediately)")
+	flag.DurationVar(&cfg.PopularityBoost, "popularity-boost", cfg.PopularityBoost, "Keep entries past their age by this much for each doubling of their hits, up to 8 doublings (0 expires by age alone)")
+	flag.IntVar(&cfg.CleanupWorkers, "cleanup-workers", cfg.CleanupWorkers, "How many files of a directory cleanup stats and expires at a time")
+	flag.IntVar(&cfg.CleanupMaxErrors, "cleanup-max-errors", cfg.CleanupMaxErrors, "End a cleanup pass early once it has run into this many errors (0 for no limit)")
+	flag.IntVar(&cfg.CleanupHistory, "cleanup-history", cfg.CleanupHistory, "The number of cleanup run summaries kept for the admin API")
+	flag.StringVar(&cfg.CleanupLock, "cleanup-lock", cfg.CleanupLock, "Elect one replica sharing the storage to run cleanup, through a lock file (file) or Redis (redis)")
+	flag.BoolVar(&cfg.StartupScan, "startup-scan", cfg.StartupScan, "Remove leftovers of a crash from the storage directory on startup")
+	flag.BoolVar(&cfg.StartupScanQuarantine, "startup-scan-quarantine", cfg.StartupScanQuarantine, "Move what the startup scan finds into storage/.quarantine instead of deleting it")
+	flag.BoolVar(&cfg.WatchStorage, "watch-storage", cfg.WatchStorage, "Track the files in storage from inotify events instead of listing them every cleanup pass (Linux only)")
+	flag.StringVar(&cfg.Peers, "peers", cfg.Peers, "Comma-separated base URLs of sibling instances to check on a cache miss before calling the external service")
+	flag.StringVar(&cfg.PeerSelf, "peer-self", cfg.PeerSelf, "This instance's own base URL as it appears in -peers")
+	flag.StringVar(&cfg.PeerSecret, "peer-secret", cfg.PeerSecret, "Shared secret required on peer-to-peer cache requests (required with -peers)")
+	flag.StringVar(&cfg.MirrorURL, "mirror-url", cfg.MirrorURL, "Base URL of a secondary instance every newly cached entry and purge is replicated to")
+	flag.StringVar(&cfg.MirrorSecret, "mirror-secret", cfg.MirrorSecret, "Shared secret authenticating replication (required on the secondary to accept entries)")
+	flag.BoolVar(&cfg.EntryLockFiles, "entry-lock-files", cfg.EntryLockFiles, "Lock entries through lock files in the storage directory too, for replicas sharing it")
+	flag.StringVar(&cfg.RedisAddr, "redis-addr", cfg.RedisAddr, "Redis address (host:port) used to coordinate replicas sharing one storage directory")
+	flag.StringVar(&cfg.RedisPassword, "redis-password", cfg.RedisPassword, "Redis password")
+	flag.IntVar(&cfg.RedisDB, "redis-db", cfg.RedisDB, "Redis database number")
+	flag.StringVar(&cfg.RedisPrefix, "redis-prefix", cfg.RedisPrefix, "Prefix for all Redis keys")
+	flag.StringVar(&cfg.ClusterRouting, "cluster-routing", cfg.ClusterRouting, "Send each URL to the instance owning it by consistent hashing: off, proxy or redirect (requires -peer-self)")
+	flag.IntVar(&cfg.PrefetchWorkers, "prefetch-workers", cfg.PrefetchWorkers, "The number of background prefetch workers")
+	flag.Float64Var(&cfg.PrefetchRate, "prefetch-rate", cfg.PrefetchRate, "The maximum number of external service calls per second made by prefetch workers")
+	flag.IntVar(&cfg.PrefetchRetries, "prefetch-retries", cfg.PrefetchRetries, "How many times a failed prefetch is retried")
+	flag.StringVar(&cfg.PrefetchQueueFile, "prefetch-queue-file", cfg.PrefetchQueueFile, "The file the prefetch queue is persisted to (defaults to .prefetch/queue.json in the storage directory)")
+	flag.StringVar(&cfg.PrefetchWatchFile, "prefetch-watch-file", cfg.PrefetchWatchFile, "A file of URLs, one per line, queued for prefetch whenever it changes")
+	flag.StringVar(&cfg.PrefetchScheduleFile, "prefetch-schedule-file", cfg.PrefetchScheduleFile, "A JSON file of schedules whose URLs are queued for prefetch on a recurring basis")
+	flag.StringVar(&cfg.PlaylistResolver, "playlist-resolver", cfg.PlaylistResolver, "A command printing the item URLs of the playlist or channel URL given as its last argument, one per line (e.g. \"yt-dlp --flat-playlist --print url\")")
+	flag.IntVar(&cfg.PlaylistMaxItems, "playlist-max-items", cfg.PlaylistMaxItems, "The maximum number of items queued from one playlist")
+	flag.IntVar(&cfg.MaxConcurrentDownloads, "max-concurrent-downloads", cfg.MaxConcurrentDownloads, "The maximum number of downloads from the external service running at once (0 is unlimited)")
+	flag.IntVar(&cfg.MaxQueuedDownloads, "max-queued-downloads", cfg.MaxQueuedDownloads, "The maximum number of downloads waiting for a slot (0 is unlimited)")
+	flag.DurationVar(&cfg.DownloadQueueTimeout, "download-queue-timeout", cfg.DownloadQueueTimeout, "How long a download waits for a slot before a 503 (0 is as long as its request lasts)")
+	flag.IntVar(&cfg.BatchMaxURLs, "batch-max-urls", cfg.BatchMaxURLs, "The maximum number of URLs accepted in one batch")
+	flag.StringVar(&cfg.BatchJournalFile, "batch-journal-file", cfg.BatchJournalFile, "The file batches are journaled to so they resume after a restart (defaults to .batch/journal.log in the storage directory)")
+	flag.StringVar(&cfg.FFmpeg, "ffmpeg", cfg.FFmpeg, "The ffmpeg binary used to transcode cached media")
+	flag.StringVar(&cfg.FFprobe, "ffprobe", cfg.FFprobe, "The ffprobe binary used to describe cached media")
+	flag.IntVar(&cfg.FFmpegWorkers, "ffmpeg-workers", cfg.FFmpegWorkers, "The number of ffmpeg processes run at once (0 disables media processing)")
+	flag.BoolVar(&cfg.MergeStreams, "merge-streams", cfg.MergeStreams, "Mux the separate video and audio streams of cobalt local-processing responses with ffmpeg and cache the result")
+	flag.StringVar(&cfg.WebhookURLs, "webhook-urls", cfg.WebhookURLs, "Comma-separated URLs notified when a prefetch or batch download completes or fails")
+	flag.StringVar(&cfg.WebhookSecret, "webhook-secret", cfg.WebhookSecret, "Secret used to sign webhook bodies with HMAC-SHA256")
+	flag.StringVar(&cfg.APIKeysFile, "api-keys-file", cfg.APIKeysFile, "A file of API keys, one per line with an optional name after it, one of which every request needs; reread on SIGHUP")
+	flag.StringVar(&cfg.TenantsFile, "tenants-file", cfg.TenantsFile, "A JSON file of tenants, each with its own API keys, cache namespace, rate limit and storage quota")
+	flag.StringVar(&cfg.HostsFile, "hosts-file", cfg.HostsFile, "A JSON file of host profiles, each with the hostnames it serves, its own cobalt endpoint, request options and cache namespace")
+	flag.StringVar(&cfg.CORSOrigins, "cors-origins", cfg.CORSOrigins, "Comma-separated origins whose scripts may call the API, such as https://example.com, https://*.example.com or * (none when empty)")
+	flag.StringVar(&cfg.CORSMethods, "cors-methods", cfg.CORSMethods, "The methods allowed origins may use")
+	flag.StringVar(&cfg.CORSHeaders, "cors-headers", cfg.CORSHeaders, "The request headers allowed origins may send")
+	flag.StringVar(&cfg.AllowedHosts, "allowed-hosts", cfg.AllowedHosts, "Comma-separated domains whose URLs are the only ones accepted, subdomains included (any when empty)")
+	flag.StringVar(&cfg.DeniedHosts, "denied-hosts", cfg.DeniedHosts, "Comma-separated domains whose URLs are refused, subdomains included")
+	flag.BoolVar(&cfg.AllowPrivateDownloads, "allow-private-downloads", cfg.AllowPrivateDownloads, "Let media links from the external service lead to private addresses, not just to the external service's own hosts")
+	flag.StringVar(&cfg.DomainsFile, "domains-file", cfg.DomainsFile, "A JSON file of per-domain policies: video quality, entry TTL, maximum entry size, resolve rate, or disabled")
+	flag.StringVar(&cfg.BlocklistFile, "blocklist-file", cfg.BlocklistFile, "A JSON file of domains whose media is refused, each with a status (451 or 403) and a reason code")
+	flag.StringVar(&cfg.UsageExportDir, "usage-export-dir", cfg.UsageExportDir, "A directory each API key's usage is exported to at the end of every -usage-export-interval (requires -tenants-file)")
+	flag.DurationVar(&cfg.UsageExportInterval, "usage-export-interval", cfg.UsageExportInterval, "How often usage is exported")
+	flag.StringVar(&cfg.UsageExportFormat, "usage-export-format", cfg.UsageExportFormat, "The format of usage exports: csv or json")
+	flag.StringVar(&cfg.QuotaStateFile, "quota-state-file", cfg.QuotaStateFile, "Where usage counted against API key quotas is kept across restarts (defaults to .usage/quotas.json in the storage directory)")
+	flag.DurationVar(&cfg.AbuseBanDuration, "abuse-ban-duration", cfg.AbuseBanDuration, "How long clients are banned for once they get too many errors (0 bans no one)")
+	flag.DurationVar(&cfg.AbuseWindow, "abuse-window", cfg.AbuseWindow, "The window errors are counted over for abuse bans")
+	flag.IntVar(&cfg.AbuseMaxErrors, "abuse-max-errors", cfg.AbuseMaxErrors, "The error responses a client may get per -abuse-window before it is banned (0 is unlimited)")
+	flag.IntVar(&cfg.AbuseMaxFailingURLs, "abuse-max-failing-urls", cfg.AbuseMaxFailingURLs, "The different failing URLs a client may request per -abuse-window before it is banned (0 is unlimited)")
+	flag.Float64Var(&cfg.ClientRateLimit, "client-rate-limit", cfg.ClientRateLimit, "Requests per second allowed from each client IP (0 is unlimited)")
+	flag.IntVar(&cfg.ClientRateBurst, "client-rate-burst", cfg.ClientRateBurst, "Requests a client IP may make at once before -client-rate-limit applies")
+	flag.BoolVar(&cfg.TrustForwardedFor, "trust-forwarded-for", cfg.TrustForwardedFor, "Tell clients apart by the last X-Forwarded-For entry, for instances behind a proxy")
+	flag.StringVar(&cfg.LinkSecret, "link-secret", cfg.LinkSecret, "Secret used to sign expiring /f/ links to cached files (signed links are off without it)")
+	flag.DurationVar(&cfg.LinkTTL, "link-ttl", cfg.LinkTTL, "How long a signed link lasts unless a ttl is given when minting it")
+	flag.StringVar(&cfg.LinkBaseURL, "link-base-url", cfg.LinkBaseURL, "The public base URL prepended to minted links (links are relative without it)")
+	flag.StringVar(&cfg.CDNUploadURL, "cdn-upload-url", cfg.CDNUploadURL, "The CDN origin bucket URL downloaded entries are uploaded to, after which requests for them redirect to the CDN")
+	flag.StringVar(&cfg.CDNPublicURL, "cdn-public-url", cfg.CDNPublicURL, "The base URL the CDN serves uploaded entries from")
+	flag.StringVar(&cfg.CDNRegion, "cdn-region", cfg.CDNRegion, "The S3 region of the CDN origin bucket")
+	flag.StringVar(&cfg.CDNAccessKey, "cdn-access-key", cfg.CDNAccessKey, "The S3 access key used to sign uploads")
+	flag.StringVar(&cfg.CDNSecretKey, "cdn-secret-key", cfg.CDNSecretKey, "The S3 secret key used to sign uploads")
+	flag.StringVar(&cfg.CDNSignKey, "cdn-sign-key", cfg.CDNSignKey, "Key used to sign CDN redirects with an expiry (unsigned without it)")
+	flag.DurationVar(&cfg.CDNSignTTL, "cdn-sign-ttl", cfg.CDNSignTTL, "How long a signed CDN redirect stays valid")
+	flag.IntVar(&cfg.CDNUploadWorkers, "cdn-upload-workers", cfg.CDNUploadWorkers, "The number of CDN uploads run at once")
+	flag.StringVar(&cfg.StorageBackend, "storage-backend", cfg.StorageBackend, "Where entries are kept besides the storage directory: local (nowhere else) or s3, a bucket shared by every replica")
+	flag.StringVar(&cfg.S3BucketURL, "s3-bucket-url", cfg.S3BucketURL, "The URL of the bucket of the s3 storage backend")
+	flag.StringVar(&cfg.S3Prefix, "s3-prefix", cfg.S3Prefix, "Prepended to the names of the objects in the s3 storage backend")
+	flag.StringVar(&cfg.S3Region, "s3-region", cfg.S3Region, "The region of the s3 storage backend's bucket")
+	flag.StringVar(&cfg.S3AccessKey, "s3-access-key", cfg.S3AccessKey, "The access key used to sign s3 storage backend requests")
+	flag.StringVar(&cfg.S3SecretKey, "s3-secret-key", cfg.S3SecretKey, "The secret key used to sign s3 storage backend requests")
+	flag.BoolVar(&cfg.Chaos, "chaos", cfg.Chaos, "Inject faults at the -chaos-* rates, to exercise retries, fallbacks and cleanup in staging (never in production)")
+	flag.Float64Var(&cfg.ChaosTimeoutRate, "chaos-timeout-rate", cfg.ChaosTimeoutRate, "The chance, from 0 to 1, of an upstream request timing out (requires -chaos)")
+	flag.Float64Var(&cfg.ChaosSlowRate, "chaos-slow-rate", cfg.ChaosSlowRate, "The chance of an upstream body trickling in (requires -chaos)")
+	flag.Float64Var(&cfg.ChaosTruncateRate, "chaos-truncate-rate", cfg.ChaosTruncateRate, "The chance of an upstream body ending early (requires -chaos)")
+	flag.Float64Var(&cfg.ChaosWriteErrorRate, "chaos-write-error-rate", cfg.ChaosWriteErrorRate, "The chance of a download failing to write to disk (requires -chaos)")
+	var logs logOptions
+	flag.StringVar(&logs.output, "log-output", "", "Where the application log goes: stderr, file (-log-file), syslog or journald (default stderr, or file with -log-file)")
+	flag.StringVar(&logs.appLog, "log-file", "", "Write the application log to this file instead of stderr")
+	flag.StringVar(&logs.syslogAddr, "syslog-addr", "", "The syslog daemon -log-output=syslog sends to, as udp://host:port or tcp://host:port (the local one when empty)")
+	flag.StringVar(&logs.accessLog, "access-log", "", "Write a line per request to this file (off when empty)")
+	flag.Int64Var(&logs.rotation.MaxSize, "log-max-size", 100<<20, "Rotate log files once they hold this many bytes (0 for no limit)")
+	flag.DurationVar(&logs.rotation.MaxAge, "log-max-age", 0, "Rotate log files once they're this old (0 for no limit)")
+	flag.IntVar(&logs.rotation.MaxBackups, "log-max-backups", 10, "How many rotated log files to keep (0 keeps them all)")
+	flag.BoolVar(&logs.rotation.Compress, "log-compress", true, "Gzip rotated log files")
+	flag.StringVar(&logs.format, "log-format", "logfmt", "The format of the application log: logfmt or json")
+	flag.StringVar(&logs.level, "log-level", "info", "The least severe level logged: debug, info, warn or error")
+	flag.StringVar(&cfg.SentryDSN, "sentry-dsn", cfg.SentryDSN, "Report panics and recurring download failures to this Sentry compatible DSN (off when empty)")
+	flag.StringVar(&cfg.SentryEnvironment, "sentry-environment", cfg.SentryEnvironment, "The environment error reports are tagged with")
+	flag.BoolVar(&cfg.CompressResponses, "compress-responses", cfg.CompressResponses, "Compress text, JSON, subtitles and playlists with zstd or gzip for clients that accept it")
+	flag.BoolVar(&cfg.Tracing, "tracing", cfg.Tracing, "Export OpenTelemetry traces over OTLP/HTTP, configured by the standard OTEL_EXPORTER_OTLP_* environment variables")
+	pluginsFlag := flag.String("plugins", "", "Comma-separated Go plugins (.so) providing hooks or middleware")
+	configFlag := flag.String("config", "", "A YAML file of flag names and values, for flags given neither on the command line nor as COBALT_PASSTHRU_* environment variables")
 	flag.Parse()
-
-	// Create the storage directory if it does not exist
-	if err := os.MkdirAll(*storageDirFlag, os.ModePerm); err != nil {
-		log.Fatalf("ts=%s msg=Failed_to_create_storage_directory error=%v\n", time.Now().Format(time.RFC3339), err)
+	if err := applySettings(flag.CommandLine, configFlag); err != nil {
+		fatal("Failed_to_load_config", "error", err)
 	}
 
-	// Start the file cleanup routine
-	go startFileCleanupRoutine(*storageDirFlag)
-
-	// Set up the router for the application server
-	router := mux.NewRouter()
-	router.HandleFunc("/", handleRequest(*endpointFlag, *storageDirFlag)).Methods("GET")
-	http.Handle("/", router)
-
-	// Start the main application server
-	go func() {
-		serverAddr := *addrFlag
-		log.Printf("ts=%s msg=Starting_server addr=%s endpoint=%s storage=%s\n", time.Now().Format(time.RFC3339), serverAddr, *endpointFlag, *storageDirFlag)
-		if err := http.ListenAndServe(serverAddr, nil); err != nil {
-			log.Printf("ts=%s msg=Server_failed_to_start error=%v\n", time.Now().Format(time.RFC3339), err)
-			os.Exit(1)
-		}
-	}()
+	accessLog, err := openLogs(logs)
+	if err != nil {
+		fatal("Failed_to_open_logs", "error", err)
+	}
+	if accessLog != nil {
+		cfg.AccessLog = accessLog
+	}
 
-	// Set up a separate server for Prometheus metrics
-	go func() {
-		metricsRouter := http.NewServeMux()
-		metricsRouter.Handle("/metrics", promhttp.Handler())
+	if err := loadPlugins(*pluginsFlag, &cfg); err != nil {
+		fatal("Failed_to_load_plugins", "error", err)
+	}
 
-		metricsAddr := *metricsAddrFlag
-		log.Printf("ts=%s msg=Starting_metrics_server addr=%s\n", time.Now().Format(time.RFC3339), metricsAddr)
-		if err := http.ListenAndServe(metricsAddr, metricsRouter); err != nil {
-			log.Printf("ts=%s msg=Metrics_server_failed_to_start error=%v\n", time.Now().Format(time.RFC3339), err)
-			os.Exit(1)
-		}
-	}()
+	srv, err := passthru.New(cfg)
+	if err != nil {
+		fatal("Failed_to_start", "error", err)
+	}
+	if cfg.APIKeysFile != "" {
+		go reloadAPIKeysOnHUP(srv)
+	}
 
-	// Block the main goroutine
-	select {}
-}
+	// Under systemd socket activation the listening sockets are handed down
+	inherited, err := systemdListeners()
+	if err != nil {
+		fatal("Failed_to_start", "error", err)
+	}
 
-func handleRequest(externalServiceEndpoint, storageDir string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
+	autocertDir := *tlsAutocertDirFlag
+	if autocertDir == "" {
+		autocertDir = filepath.Join(cfg.StorageDir, ".autocert")
+	}
+	tlsConfig, err := serverTLS(*tlsCertFlag, *tlsKeyFlag, *tlsAutocertHostsFlag, autocertDir)
+	if err != nil {
+		fatal("Failed_to_start", "error", err)
+	}
 
-		queryParams := r.URL.Query()
-		url := queryParams.Get("u")
-		if url == "" {
-			log.Printf("ts=%s msg=Missing_query_param param=u\n", time.Now().Format(time.RFC3339))
-			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
-			return
+	// Start the HTTP/3 listener first, so the main server can advertise it
+	handler := http.Handler(srv)
+	var h3 *http3.Server
+	if *http3AddrFlag != "" {
+		if (*http3CertFlag == "" || *http3KeyFlag == "") && tlsConfig == nil {
+			fatal("Failed_to_start", "error", "-http3-addr requires -http3-cert and -http3-key, or TLS on the main listener")
 		}
-
-		log.Printf("ts=%s msg=Request_received method=GET u=%s\n", start.Format(time.RFC3339), url)
-
-		// Hash the URL to create a unique file name
-		hash := sha256.Sum256([]byte(url))
-		hashStr := fmt.Sprintf("%x", hash)
-		binaryFileName := filepath.Join(storageDir, hashStr+".bin")
-		headersFileName := filepath.Join(storageDir, hashStr+".headers")
-
-		// Check if the files already exist
-		if _, err := os.Stat(binaryFileName); err == nil {
-			if _, err := os.Stat(headersFileName); err == nil {
-				// Serve files directly from disk if they exist
-				log.Printf("ts=%s msg=Serving_cached_file filename=%s\n", time.Now().Format(time.RFC3339), binaryFileName)
-				serveBinaryFile(w, r, binaryFileName, headersFileName)
-				httpRequestsTotal.WithLabelValues(r.URL.Path, "cached").Inc()
-				duration := time.Since(start)
-				log.Printf("ts=%s msg=Request_processed_from_cache duration=%s\n", time.Now().Format(time.RFC3339), duration)
-				return
+		h3, handler = newHTTP3Server(*http3AddrFlag, srv)
+		go func() {
+			slog.Info("Starting_http3_server", "addr", h3.Addr)
+			var err error
+			if *http3CertFlag != "" {
+				err = h3.ListenAndServeTLS(*http3CertFlag, *http3KeyFlag)
+			} else {
+				// Same certificates as the main listener
+				h3.TLSConfig = http3.ConfigureTLSConfig(tlsConfig)
+				err = h3.ListenAndServe()
 			}
-		}
-
-		// Increment HTTP requests metric for incoming non-cached request
-		httpRequestsTotal.WithLabelValues(r.URL.Path, "not_cached").Inc()
-
-		// Create request payload for the external service
-		requestPayload := ExternalServiceRequest{
-			URL:             url,
-			VideoQuality:    "max",
-			DisableMetadata: true,
-		}
-
-		reqBody, err := json.Marshal(requestPayload)
-		if err != nil {
-			log.Printf("ts=%s msg=Failed_JSON_marshal error=%v\n", time.Now().Format(time.RFC3339), err)
-			http.Error(w, "Failed to encode JSON", http.StatusInternalServerError)
-			return
-		}
-
-		// Increment external service requests metric
-		externalServiceRequestsTotal.Inc()
-
-		// Send POST request to the external service
-		req, err := http.NewRequest("POST", externalServiceEndpoint, strings.NewReader(string(reqBody)))
-		if err != nil {
-			log.Printf("ts=%s msg=Failed_create_request error=%v\n", time.Now().Format(time.RFC3339), err)
-			http.Error(w, "Failed to create request", http.StatusInternalServerError)
-			return
-		}
-
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/json")
-
-		log.Printf("ts=%s msg=External_service_request method=POST endpoint=%s\n", time.Now().Format(time.RFC3339), externalServiceEndpoint)
-
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("ts=%s msg=External_service_failure error=%v\n", time.Now().Format(time.RFC3339), err)
-			http.Error(w, "Failed to call external service", http.StatusInternalServerError)
-			return
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("ts=%s msg=External_service_non_200 status_code=%d\n", time.Now().Format(time.RFC3339), resp.StatusCode)
-			http.Error(w, "Error from external service", http.StatusInternalServerError)
-			return
-		}
-
-		var serviceResp ExternalServiceResponse
-		if err := json.NewDecoder(resp.Body).Decode(&serviceResp); err != nil {
-			log.Printf("ts=%s msg=Failed_JSON_decode error=%v\n", time.Now().Format(time.RFC3339), err)
-			http.Error(w, "Failed to decode JSON response", http.StatusInternalServerError)
-			return
-		}
+			if err != http.ErrServerClosed {
+				slog.Error("Http3_server_failed_to_start", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
-		// Download the binary resource
-		resourceResp, err := http.Get(serviceResp.URL)
-		if err != nil {
-			log.Printf("ts=%s msg=Download_failure error=%v\n", time.Now().Format(time.RFC3339), err)
-			http.Error(w, "Failed to download resource", http.StatusInternalServerError)
-			return
+	// Start the main application server
+	serverAddr := *addrFlag
+	lis, err := listen(inherited, "http", serverAddr)
+	if err != nil {
+		fatal("Server_failed_to_start", "error", err)
+	}
+	slog.Info("Starting_server", "addr", lis.Addr(), "endpoint", cfg.Endpoint, "storage", cfg.StorageDir, "tls", tlsConfig != nil)
+	newServer := func(handler http.Handler) *http.Server {
+		return &http.Server{Handler: handler, TLSConfig: tlsConfig, MaxHeaderBytes: *maxHeaderBytesFlag, ReadHeaderTimeout: *readHeaderTimeoutFlag}
+	}
+	servers := []*http.Server{newServer(handler)}
+	go func() {
+		if err := serve(servers[0], lis); err != http.ErrServerClosed {
+			slog.Error("Server_failed", "error", err)
+			os.Exit(1)
 		}
-		defer resourceResp.Body.Close()
+	}()
 
-		// Store the resource binary
-		binaryFile, err := os.Create(binaryFileName)
+	// Set up a separate server for Prometheus metrics, unless the main one
+	// serves them
+	if !cfg.SinglePort {
+		metricsLis, err := listen(inherited, "metrics", *metricsAddrFlag)
 		if err != nil {
-			log.Printf("ts=%s msg=Create_binary_file_error filename=%s error=%v\n", time.Now().Format(time.RFC3339), binaryFileName, err)
-			http.Error(w, "Failed to save binary file", http.StatusInternalServerError)
-			return
+			fatal("Metrics_server_failed_to_start", "error", err)
 		}
-		defer binaryFile.Close()
+		slog.Info("Starting_metrics_server", "addr", metricsLis.Addr())
+		metricsServer := newServer(srv.AdminHandler())
+		servers = append(servers, metricsServer)
+		go func() {
+			if err := serve(metricsServer, metricsLis); err != http.ErrServerClosed {
+				slog.Error("Metrics_server_failed", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
 
-		_, err = io.Copy(binaryFile, resourceResp.Body)
+	// And one for the gRPC API, if wanted
+	if *grpcAddrFlag != "" || inherited["grpc"] != nil {
+		grpcLis, err := listen(inherited, "grpc", *grpcAddrFlag)
 		if err != nil {
-			log.Printf("ts=%s msg=Write_binary_file_error filename=%s error=%v\n", time.Now().Format(time.RFC3339), binaryFileName, err)
-			http.Error(w, "Failed to write binary file", http.StatusInternalServerError)
-			return
+			fatal("Grpc_server_failed_to_start", "error", err)
 		}
-
-		// Store response headers
-		headersFile, err := os.Create(headersFileName)
-		if err != nil {
-			log.Printf("ts=%s msg=Create_headers_file_error filename=%s error=%v\n", time.Now().Format(time.RFC3339), headersFileName, err)
-			http.Error(w, "Failed to save headers file", http.StatusInternalServerError)
-			return
-		}
-		defer headersFile.Close()
-
-		for key, values := range resourceResp.Header {
-			for _, value := range values {
-				headersFile.WriteString(fmt.Sprintf("%s: %s\n", key, value))
+		slog.Info("Starting_grpc_server", "addr", grpcLis.Addr())
+		go func() {
+			if err := srv.GRPCServer().Serve(grpcLis); err != nil {
+				slog.Error("Grpc_server_failed", "error", err)
+				os.Exit(1)
 			}
-		}
-
-		log.Printf("ts=%s msg=Resource_stored binary_file=%s headers_file=%s\n", time.Now().Format(time.RFC3339), binaryFileName, headersFileName)
-
-		serveBinaryFile(w, r, binaryFileName, headersFileName)
-
-		duration := time.Since(start)
-		log.Printf("ts=%s msg=Request_processed duration=%s\n", time.Now().Format(time.RFC3339), duration)
+		}()
 	}
-}
 
-func serveBinaryFile(w http.ResponseWriter, r *http.Request, binaryFileName, headersFileName string) {
-	headersFile, err := os.Open(headersFileName)
-	if err != nil {
-		log.Printf("ts=%s msg=Open_headers_file_error filename=%s error=%v\n", time.Now().Format(time.RFC3339), headersFileName, err)
-		http.Error(w, "Failed to open headers file", http.StatusInternalServerError)
-		return
-	}
-	defer headersFile.Close()
+	// Everything is listening, so systemd can send traffic our way
+	notifyReady()
 
-	headersBuffer := make([]byte, 1024)
-	n, err := headersFile.Read(headersBuffer)
-	if err != nil && err != io.EOF {
-		log.Printf("ts=%s msg=Read_headers_file_error error=%v\n", time.Now().Format(time.RFC3339), err)
-		http.Error(w, "Failed to read headers file", http.StatusInternalServerError)
-		return
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+	shutdown(srv, servers, h3, *shutdownTimeoutFlag)
+}
 
-	headersStr := string(headersBuffer[:n])
-	headers := strings.Split(headersStr, "\n")
-	for _, header := range headers {
-		if header == "" {
-			continue
-		}
-		headerParts := strings.SplitN(header, ": ", 2)
-		if len(headerParts) == 2 {
-			w.Header().Set(headerParts[0], headerParts[1])
-		}
+// serve serves server on lis, over TLS if it has a TLS configuration.
+func serve(server *http.Server, lis net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(lis, "", "")
 	}
-
-	log.Printf("ts=%s msg=Serving_binary_file filename=%s\n", time.Now().Format(time.RFC3339), binaryFileName)
-	http.ServeFile(w, r, binaryFileName)
+	return server.Serve(lis)
 }
 
-func startFileCleanupRoutine(storageDir string) {
-	ticker := time.NewTicker(10 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			log.Printf("ts=%s msg=Starting_file_cleanup\n", time.Now().Format(time.RFC3339))
-			cleanupsTotal.Inc() // Increment cleanups metric
-			cleanupOldFiles(storageDir)
+// reloadAPIKeysOnHUP rereads the API keys file every time the process gets
+// a SIGHUP, which also rotates the log files.
+func reloadAPIKeysOnHUP(srv *passthru.Server) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := srv.ReloadAPIKeys(); err != nil {
+			slog.Error("API_keys_reload_error", "error", err)
 		}
 	}
 }
 
-func cleanupOldFiles(storageDir string) {
-	files, err := os.ReadDir(storageDir)
-	if err != nil {
-		log.Printf("ts=%s msg=Read_storage_directory_error dir=%s error=%v\n", time.Now().Format(time.RFC3339), storageDir, err)
-		return
+// shutdown stops the servers taking requests and gives the ones under way
+// up to timeout to finish. Then it cancels the downloads still running,
+// and waits a little for them to remove their partial files.
+func shutdown(srv *passthru.Server, servers []*http.Server, h3 *http3.Server, timeout time.Duration) {
+	slog.Info("Shutting_down", "timeout", timeout)
+	sdNotify("STOPPING=1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				slog.Info("Server_shutdown_timed_out", "error", err)
+			}
+		}(server)
 	}
-
-	cutoff := time.Now().Add(-720 * time.Minute)
-
-	for _, file := range files {
-		filePath := filepath.Join(storageDir, file.Name())
-		info, err := os.Stat(filePath)
-		if err != nil {
-			log.Printf("ts=%s msg=File_stat_error file=%s error=%v\n", time.Now().Format(time.RFC3339), filePath, err)
-			continue
+	if h3 != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h3.CloseGracefully(timeout)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stopped := make(chan struct{})
+		go func() {
+			srv.GRPCServer().GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			srv.GRPCServer().Stop()
 		}
+	}()
+	wg.Wait()
 
-		if info.ModTime().Before(cutoff) {
-			err = os.Remove(filePath)
-			if err != nil {
-				log.Printf("ts=%s msg=File_deletion_error file=%s error=%v\n", time.Now().Format(time.RFC3339), filePath, err)
-			} else {
-				log.Printf("ts=%s msg=File_deleted file=%s\n", time.Now().Format(time.RFC3339), filePath)
-				filesCleanedTotal.Inc() // Increment files cleaned metric
-			}
-		}
+	// Whatever is still downloading is given up on
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownCleanupTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Info("Download_cleanup_timed_out", "error", err)
+	}
+	for _, server := range servers {
+		server.Close()
 	}
+	slog.Info("Shut_down")
 }
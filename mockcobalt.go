@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"log/slog"
+	"net/http"
+
+	"cobalt-passthru/pkg/mockcobalt"
+)
+
+// runMockCobalt is the mock-cobalt subcommand: it serves a mock cobalt
+// instance until it fails.
+func runMockCobalt(args []string) error {
+	fs := flag.NewFlagSet("mock-cobalt", flag.ExitOnError)
+	addr := fs.String("addr", ":9000", "The address and port on which the mock cobalt listens")
+	fs.Parse(args)
+
+	slog.Info("Starting_mock_cobalt", "addr", *addr, "version", mockcobalt.Version)
+	return http.ListenAndServe(*addr, mockcobalt.New())
+}
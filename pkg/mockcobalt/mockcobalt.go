@@ -0,0 +1,226 @@
+// Package mockcobalt emulates the cobalt API, and serves the media it
+// points at, for end-to-end tests and local development without a real
+// cobalt instance:
+//
+//	srv := httptest.NewServer(mockcobalt.New())
+//	cfg.Endpoint = srv.URL + "/"
+//
+// What it answers is picked by a mock query parameter on the URL asked
+// for, e.g. https://example.com/clip?mock=picker:
+//
+//	success  a tunnel to the media (the default)
+//	redirect a redirect to the media
+//	error    an error response
+//	picker   a picker of two photos
+//	merge    separate video and audio streams to merge locally
+//	slow     media that trickles in over a few seconds
+//	flaky    media that fails, with a 500 or by ending early, every other
+//	         time it's asked for
+//	missing  media that's gone by the time it's downloaded (404)
+//
+// A size parameter sets the size of the media in bytes (default 1MiB).
+package mockcobalt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the cobalt version the mock claims to be.
+const Version = "10.9.0"
+
+const (
+	defaultSize = 1 << 20
+	maxSize     = 1 << 30
+	slowChunks  = 10
+	slowDelay   = 300 * time.Millisecond
+)
+
+// Server is a mock cobalt instance.
+type Server struct {
+	mux *http.ServeMux
+
+	mu    sync.Mutex
+	flaky map[string]int // requests for each flaky media so far
+}
+
+// New returns a mock cobalt instance.
+func New() *Server {
+	s := &Server{mux: http.NewServeMux(), flaky: make(map[string]int)}
+	s.mux.HandleFunc("/media/", s.handleMedia)
+	s.mux.HandleFunc("/", s.handleAPI)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+type request struct {
+	URL string `json:"url"`
+}
+
+type pickerItem struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type output struct {
+	Type     string `json:"type"`
+	Filename string `json:"filename"`
+}
+
+type response struct {
+	Status   string            `json:"status"`
+	URL      string            `json:"url,omitempty"`
+	Filename string            `json:"filename,omitempty"`
+	Picker   []pickerItem      `json:"picker,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Tunnel   []string          `json:"tunnel,omitempty"`
+	Output   *output           `json:"output,omitempty"`
+	Error    map[string]string `json:"error,omitempty"`
+}
+
+// handleAPI answers GET / with the instance's version and POST / like
+// cobalt does.
+func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"cobalt": map[string]string{"version": Version}})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URL == "" {
+		writeJSON(w, http.StatusBadRequest, response{Status: "error", Error: map[string]string{"code": "error.api.link.missing"}})
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || u.Host == "" {
+		writeJSON(w, http.StatusBadRequest, response{Status: "error", Error: map[string]string{"code": "error.api.link.invalid"}})
+		return
+	}
+	mode := u.Query().Get("mock")
+	size := u.Query().Get("size")
+	base := "http://" + r.Host + "/media/" + mediaID(req.URL)
+	media := func(kind string) string {
+		return base + "?" + url.Values{"mode": {mode}, "size": {size}, "kind": {kind}}.Encode()
+	}
+	filename := strings.Trim(strings.ReplaceAll(u.Host+u.Path, "/", "_"), "_") + ".mp4"
+
+	switch mode {
+	case "error":
+		writeJSON(w, http.StatusBadRequest, response{Status: "error", Error: map[string]string{"code": "error.api.fetch.fail"}})
+	case "picker":
+		writeJSON(w, http.StatusOK, response{Status: "picker", Picker: []pickerItem{
+			{Type: "photo", URL: media("p1")},
+			{Type: "photo", URL: media("p2")},
+		}})
+	case "merge":
+		writeJSON(w, http.StatusOK, response{
+			Status: "local-processing",
+			Type:   "merge",
+			Tunnel: []string{media("video"), media("audio")},
+			Output: &output{Type: "video/mp4", Filename: filename},
+		})
+	case "redirect":
+		writeJSON(w, http.StatusOK, response{Status: "redirect", URL: media(""), Filename: filename})
+	default:
+		writeJSON(w, http.StatusOK, response{Status: "tunnel", URL: media(""), Filename: filename})
+	}
+}
+
+// handleMedia serves the deterministic bytes of a piece of media, with
+// ranges, in the mode it was resolved in.
+func (s *Server) handleMedia(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	size := int64(defaultSize)
+	if n, err := strconv.ParseInt(q.Get("size"), 10, 64); err == nil && n >= 0 && n <= maxSize {
+		size = n
+	}
+	body := mediaBytes(r.URL.Path+q.Get("kind"), size)
+	w.Header().Set("Content-Type", "video/mp4")
+	if strings.HasPrefix(q.Get("kind"), "p") {
+		w.Header().Set("Content-Type", "image/jpeg")
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, strings.TrimPrefix(r.URL.Path, "/media/"), size))
+	w.Header().Set("Cache-Control", "max-age=3600")
+
+	switch q.Get("mode") {
+	case "missing":
+		http.NotFound(w, r)
+		return
+	case "slow":
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		for i := int64(0); i < slowChunks; i++ {
+			w.Write(body[i*size/slowChunks : (i+1)*size/slowChunks])
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			time.Sleep(slowDelay)
+		}
+		return
+	case "flaky":
+		s.mu.Lock()
+		s.flaky[r.URL.Path]++
+		n := s.flaky[r.URL.Path]
+		s.mu.Unlock()
+		switch n % 4 {
+		case 1:
+			http.Error(w, "Flaky upstream", http.StatusInternalServerError)
+			return
+		case 3:
+			// Promise all of it and send half
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			w.Write(body[:size/2])
+			return
+		}
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// mediaID names the media of a URL.
+func mediaID(rawURL string) string {
+	h := fnv.New64a()
+	h.Write([]byte(rawURL))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// mediaBytes returns size bytes that are always the same for seed, so
+// resumed and ranged downloads can be checked.
+func mediaBytes(seed string, size int64) []byte {
+	h := fnv.New32a()
+	h.Write([]byte(seed))
+	x := h.Sum32() | 1
+	b := make([]byte, size)
+	for i := range b {
+		// xorshift
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,287 @@
+package passthru
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// abuseGuard bans clients that misbehave for a while: those that keep
+// getting errors, or that try many URLs that all fail, as scanners do. Each
+// client is judged over fixed windows of its own. A nil abuseGuard bans no
+// one.
+type abuseGuard struct {
+	window         time.Duration
+	maxErrors      int // error responses per window (0 is unlimited)
+	maxFailingURLs int // distinct failing u values per window (0 is unlimited)
+	banFor         time.Duration
+	trustForwarded bool
+
+	mu      sync.Mutex
+	clients map[string]*clientWindow
+	bans    map[string]abuseBan
+}
+
+// clientWindow is what a client did in the window starting at start.
+type clientWindow struct {
+	start   time.Time
+	errors  int
+	failing map[string]bool
+}
+
+// abuseBan is a banned client, as listed by /admin/bans.
+type abuseBan struct {
+	Client string    `json:"client"`
+	Reason string    `json:"reason"` // errors or scanning
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+func newAbuseGuard(banFor, window time.Duration, maxErrors, maxFailingURLs int, trustForwarded bool) *abuseGuard {
+	if banFor <= 0 || window <= 0 || (maxErrors <= 0 && maxFailingURLs <= 0) {
+		return nil
+	}
+	for _, reason := range []string{"errors", "scanning"} {
+		abuseBansTotal.WithLabelValues(reason).Add(0)
+	}
+	return &abuseGuard{
+		window:         window,
+		maxErrors:      maxErrors,
+		maxFailingURLs: maxFailingURLs,
+		banFor:         banFor,
+		trustForwarded: trustForwarded,
+		clients:        make(map[string]*clientWindow),
+		bans:           make(map[string]abuseBan),
+	}
+}
+
+func (g *abuseGuard) enabled() bool {
+	return g != nil
+}
+
+// clientIP returns the address r came from: the last X-Forwarded-For entry,
+// the one added by the proxy in front of the instance, if trustForwarded is
+// set, and otherwise the connection's remote address.
+func clientIP(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// countsAsError reports whether a response with status is the client's
+// doing. 502, 503 and 504 are the upstream's or the instance's, and count
+// against no one.
+func countsAsError(status int) bool {
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return false
+	}
+	return status >= 400
+}
+
+// banned returns the ban on client, if there is one at now.
+func (g *abuseGuard) banned(client string, now time.Time) (abuseBan, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ban, ok := g.bans[client]
+	if ok && !now.Before(ban.Until) {
+		delete(g.bans, client)
+		activeBans.Set(float64(len(g.bans)))
+		return abuseBan{}, false
+	}
+	return ban, ok
+}
+
+// record counts a response with status to client for url (the u parameter,
+// if any), and bans the client if that puts it over a limit.
+func (g *abuseGuard) record(client, url string, status int, now time.Time) {
+	if !countsAsError(status) {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	cw := g.clients[client]
+	if cw == nil || now.Sub(cw.start) >= g.window {
+		cw = &clientWindow{start: now, failing: make(map[string]bool)}
+		g.clients[client] = cw
+	}
+	cw.errors++
+	if url != "" && g.maxFailingURLs > 0 && len(cw.failing) < g.maxFailingURLs {
+		cw.failing[url] = true
+	}
+
+	reason := ""
+	switch {
+	case g.maxFailingURLs > 0 && len(cw.failing) >= g.maxFailingURLs:
+		reason = "scanning"
+	case g.maxErrors > 0 && cw.errors >= g.maxErrors:
+		reason = "errors"
+	default:
+		return
+	}
+	delete(g.clients, client)
+	g.bans[client] = abuseBan{Client: client, Reason: reason, Since: now, Until: now.Add(g.banFor)}
+	abuseBansTotal.WithLabelValues(reason).Inc()
+	activeBans.Set(float64(len(g.bans)))
+	slog.Warn("Client_banned", "client", client, "reason", reason, "errors", cw.errors, "failing_urls", len(cw.failing), "until", now.Add(g.banFor).Format(time.RFC3339))
+}
+
+// list returns the bans in force, soonest to end first.
+func (g *abuseGuard) list() []abuseBan {
+	bans := []abuseBan{}
+	if !g.enabled() {
+		return bans
+	}
+	now := time.Now()
+	g.mu.Lock()
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// lift ends the ban on client early, and reports whether there was one.
+func (g *abuseGuard) lift(client string) bool {
+	if !g.enabled() {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.bans[client]
+	delete(g.bans, client)
+	activeBans.Set(float64(len(g.bans)))
+	return ok
+}
+
+// start forgets finished windows and bans as they go by, so clients that
+// come once don't stay in memory, until ctx is done.
+func (g *abuseGuard) start(ctx context.Context) {
+	if !g.enabled() {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(g.window)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case <-ctx.Done():
+				return
+			case now = <-ticker.C:
+			}
+			g.mu.Lock()
+			for client, cw := range g.clients {
+				if now.Sub(cw.start) >= g.window {
+					delete(g.clients, client)
+				}
+			}
+			for client, ban := range g.bans {
+				if !now.Before(ban.Until) {
+					delete(g.bans, client)
+				}
+			}
+			activeBans.Set(float64(len(g.bans)))
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// protect wraps next so banned clients are turned away and every response
+// counts towards the limits. Peer-to-peer requests are left alone, since a
+// peer asking for entries it doesn't have is how peering works.
+func (g *abuseGuard) protect(next http.Handler) http.Handler {
+	if !g.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/internal/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		client := clientIP(r, g.trustForwarded)
+		now := time.Now()
+		if ban, ok := g.banned(client, now); ok {
+			bannedRequestsTotal.Inc()
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(ban.Until.Sub(now).Seconds())+1, 10))
+			http.Error(w, "Too many failed requests, try again later", http.StatusForbidden)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		g.record(client, r.URL.Query().Get("u"), sw.status, time.Now())
+	})
+}
+
+// statusWriter remembers the status of the response written through it.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	wrote  bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.status, w.wrote = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wrote = true
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile working through the writer, as countingWriter's
+// does.
+func (w *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.wrote = true
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func handleBans(g *abuseGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, g.list())
+	}
+}
+
+func handleBanLift(g *abuseGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := mux.Vars(r)["client"]
+		if !g.lift(client) {
+			http.Error(w, "No such ban", http.StatusNotFound)
+			return
+		}
+		slog.WarnContext(r.Context(), "Client_ban_lifted", "client", client)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,71 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// accessRecord is what the access log learns of a request on its way
+// through: who it was authenticated as.
+type accessRecord struct {
+	mu  sync.Mutex
+	key string
+}
+
+type accessRecordContextKey struct{}
+
+func withAccessRecord(ctx context.Context, rec *accessRecord) context.Context {
+	return context.WithValue(ctx, accessRecordContextKey{}, rec)
+}
+
+// setAccessKey records that the request of ctx was made with the API key
+// named name, for the access log if there is one.
+func setAccessKey(ctx context.Context, name string) {
+	if rec, ok := ctx.Value(accessRecordContextKey{}).(*accessRecord); ok {
+		rec.mu.Lock()
+		rec.key = name
+		rec.mu.Unlock()
+	}
+}
+
+// accessLog wraps next so every request is written to out as a line of
+// key=value pairs, like the application log's: the client and the API key
+// it used, method, path, the URL asked for and its cache key, the
+// response's status, size and cache status, and how long it took. Keys go
+// by their name in the API keys file, or their tenant and ID, never by
+// themselves. A nil out logs nothing.
+func accessLog(out io.Writer, trustForwarded bool, next http.Handler) http.Handler {
+	if out == nil {
+		return next
+	}
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		cw := &countingWriter{ResponseWriter: sw}
+		rec := &accessRecord{key: "-"}
+		next.ServeHTTP(cw, r.WithContext(withAccessRecord(r.Context(), rec)))
+
+		cacheStatus := w.Header().Get(cacheHeader)
+		if cacheStatus == "" {
+			cacheStatus = "-"
+		}
+		hash := w.Header().Get(cacheKeyHeader)
+		if hash == "" {
+			hash = "-"
+		}
+		rec.mu.Lock()
+		key := rec.key
+		rec.mu.Unlock()
+		line := fmt.Sprintf("ts=%s client=%s key=%q method=%s path=%q url=%q hash=%s status=%d bytes=%d cache=%s duration=%s user_agent=%q\n",
+			start.Format(time.RFC3339), clientIP(r, trustForwarded), key, r.Method, r.URL.Path, r.URL.Query().Get("u"),
+			hash, sw.status, cw.n, cacheStatus, time.Since(start), r.UserAgent())
+		mu.Lock()
+		io.WriteString(out, line)
+		mu.Unlock()
+	})
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package passthru
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns when the file info describes was last read, or its
+// modification time if that isn't known.
+func accessTime(info os.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(st.Atim.Sec, st.Atim.Nsec)
+}
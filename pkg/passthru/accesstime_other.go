@@ -0,0 +1,14 @@
+//go:build !linux
+
+package passthru
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the file's modification time; access times aren't
+// read on this platform, so size eviction removes the oldest entries first.
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,144 @@
+package passthru
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// healthPath answers liveness probes, and readyPath readiness probes, on
+// the admin listener, or on the main one in single-port mode, without
+// authentication.
+const (
+	healthPath = "/healthz"
+	readyPath  = "/readyz"
+)
+
+// readyUpstreamTimeout is how long /readyz waits for cobalt to answer.
+const readyUpstreamTimeout = 2 * time.Second
+
+// adminPath reports whether path belongs to the admin listener's routes,
+// for single-port mode to hand them over.
+func adminPath(path string) bool {
+	return path == "/metrics" || path == healthPath || path == readyPath || strings.HasPrefix(path, "/admin/")
+}
+
+// requireAdminToken wraps the admin routes so every request but health and
+// readiness checks must carry token as a bearer token. An empty token lets everyone
+// in, which is only safe when the admin listener isn't reachable from
+// outside.
+func requireAdminToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != healthPath && r.URL.Path != readyPath {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				http.Error(w, "A valid admin token is required", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readinessCheck is the outcome of one of the checks of /readyz.
+type readinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+// handleReadyz answers 200 if the instance can serve: its storage takes
+// writes (or, read-only, can be read), cobalt answers, and storage isn't
+// over its quota. Otherwise it answers 503, with what failed. Unlike the
+// public API it doesn't download anything.
+func handleReadyz(c *cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := readiness{Ready: true}
+		check := func(name string, err error) {
+			result := readinessCheck{Name: name, OK: err == nil}
+			if err != nil {
+				result.Error = err.Error()
+				status.Ready = false
+			}
+			status.Checks = append(status.Checks, result)
+		}
+
+		check("storage", storageReady(c))
+		// A read-only instance never asks cobalt
+		if !c.readOnly {
+			ctx, cancel := context.WithTimeout(r.Context(), readyUpstreamTimeout)
+			check("upstream", c.upstreamReady(ctx))
+			cancel()
+		}
+		var quotaErr error
+		if c.quota.exceeded(c.storageDir) {
+			quotaErr = errors.New("storage quota exceeded")
+		}
+		check("quota", quotaErr)
+
+		code := http.StatusOK
+		if !status.Ready {
+			code = http.StatusServiceUnavailable
+			slog.WarnContext(r.Context(), "Not_ready", "checks", status.Checks)
+		}
+		writeJSON(w, code, status)
+	}
+}
+
+// storageReady writes and removes a file in c's storage directory, or for
+// a read-only instance lists it.
+func storageReady(c *cache) error {
+	if c.readOnly {
+		f, err := os.Open(c.storageDir)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Readdirnames(1)
+		if err == io.EOF {
+			err = nil
+		}
+		return err
+	}
+	probeFile := filepath.Join(c.storageDir, ".ready-probe")
+	if err := os.WriteFile(probeFile, nil, 0644); err != nil {
+		return err
+	}
+	return os.Remove(probeFile)
+}
+
+// upstreamReady reports whether a cobalt instance c sends requests to
+// answers: any of a pool's healthy ones, as last probed, or else the one
+// endpoint, asked now.
+func (c *cache) upstreamReady(ctx context.Context) error {
+	if c.upstreams != nil {
+		for _, up := range c.upstreams.upstreams {
+			if up.healthy.Load() {
+				return nil
+			}
+		}
+		return errors.New("no cobalt instance is healthy")
+	}
+	return reachable(ctx, c.client, c.hooks, c.endpoint)
+}
@@ -0,0 +1,176 @@
+package passthru
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// cacheListing is an entry as the admin API lists it.
+type cacheListing struct {
+	Hash     string    `json:"hash"`
+	Tenant   string    `json:"tenant,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Size     int64     `json:"size"`
+	StoredAt time.Time `json:"storedAt"`
+	Age      int64     `json:"age"` // in seconds
+	Hits     int64     `json:"hits"`
+}
+
+// adminCaches returns the caches an admin request is about: the one of the
+// tenant named by its tenant parameter, or the root cache and every
+// tenant's if it has none. It answers the request itself and returns nil
+// if there's no such tenant.
+func adminCaches(w http.ResponseWriter, r *http.Request, c *cache) []*cache {
+	name := r.URL.Query().Get("tenant")
+	if name == "" {
+		caches := []*cache{c}
+		if c.tenants.enabled() {
+			names := make([]string, 0, len(c.tenants.byName))
+			for name := range c.tenants.byName {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				caches = append(caches, c.tenants.byName[name].cache)
+			}
+		}
+		return caches
+	}
+	if c.tenants.enabled() {
+		if t := c.tenants.byName[name]; t != nil {
+			return []*cache{t.cache}
+		}
+	}
+	http.Error(w, "No such tenant", http.StatusNotFound)
+	return nil
+}
+
+// list calls fn with every entry stored in c, until fn returns false.
+func (c *cache) list(fn func(e cacheEntry, binary os.FileInfo) bool) error {
+	return readDirBatched(c.storageDir, func(files []os.DirEntry) bool {
+		for _, file := range files {
+			hashStr, ok := strings.CutSuffix(file.Name(), ".headers")
+			if !ok || file.IsDir() || !hashPattern.MatchString(hashStr) {
+				continue
+			}
+			e := c.entryForHash(hashStr)
+			info, err := os.Stat(e.binaryFile)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if !fn(e, info) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// handleCacheList lists the entries in the cache, newest first, 100 of them
+// unless n says otherwise.
+func handleCacheList(c *cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 100
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n <= 0 || n > 10000 {
+				http.Error(w, "'n' must be a number from 1 to 10000", http.StatusBadRequest)
+				return
+			}
+		}
+		caches := adminCaches(w, r, c)
+		if caches == nil {
+			return
+		}
+
+		now := time.Now()
+		entries := []cacheListing{}
+		for _, tc := range caches {
+			err := tc.list(func(e cacheEntry, binary os.FileInfo) bool {
+				entry := cacheListing{Hash: e.hash, Tenant: tc.namespace, Size: binary.Size(), StoredAt: binary.ModTime()}
+				if meta, err := readMeta(e.headersFile); err == nil {
+					entry.URL = meta.URL
+					if !meta.StoredAt.IsZero() {
+						entry.StoredAt = meta.StoredAt
+					}
+				}
+				entry.Age = int64(now.Sub(entry.StoredAt) / time.Second)
+				entry.Hits = c.access.hits(e.hash)
+				entries = append(entries, entry)
+				return true
+			})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Read_storage_directory_error", "dir", tc.storageDir, "error", err)
+				http.Error(w, "Failed to list cache entries", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].StoredAt.After(entries[j].StoredAt)
+		})
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
+
+// handleCacheEntryPurge purges one entry, and everything derived from it.
+func handleCacheEntryPurge(c *cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hashStr := mux.Vars(r)["hash"]
+		caches := adminCaches(w, r, c)
+		if caches == nil {
+			return
+		}
+		for _, tc := range caches {
+			if e := tc.entryForHash(hashStr); e.exists() {
+				tc.purge(e)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		http.Error(w, "No such entry", http.StatusNotFound)
+	}
+}
+
+// handleCachePurge purges every entry in the cache.
+func handleCachePurge(c *cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caches := adminCaches(w, r, c)
+		if caches == nil {
+			return
+		}
+
+		purged := 0
+		for _, tc := range caches {
+			// Collected first, so purging doesn't upset the listing
+			var entries []cacheEntry
+			err := tc.list(func(e cacheEntry, _ os.FileInfo) bool {
+				entries = append(entries, e)
+				return true
+			})
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Read_storage_directory_error", "dir", tc.storageDir, "error", err)
+			}
+			for _, e := range entries {
+				tc.purge(e)
+				purged++
+			}
+			if err != nil {
+				http.Error(w, "Failed to list cache entries", http.StatusInternalServerError)
+				return
+			}
+		}
+		slog.InfoContext(r.Context(), "Cache_purged", "tenant", r.URL.Query().Get("tenant"), "entries", purged)
+		writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+	}
+}
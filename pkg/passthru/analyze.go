@@ -0,0 +1,216 @@
+package passthru
+
+import (
+	"compress/flate"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// compressionSample is how much of each entry is compressed to estimate
+	// how well all of it would.
+	compressionSample = 1 << 20
+	// maxDuplicateURLs is how many of the URLs sharing content a report
+	// lists for each duplicate.
+	maxDuplicateURLs = 10
+)
+
+// sizeBuckets are the upper bounds of the entry sizes a report counts.
+var sizeBuckets = []struct {
+	label string
+	max   int64
+}{
+	{"<1MiB", 1 << 20},
+	{"1-10MiB", 10 << 20},
+	{"10-100MiB", 100 << 20},
+	{"100MiB-1GiB", 1 << 30},
+	{">1GiB", -1},
+}
+
+// StorageReport is what AnalyzeStorage finds in a storage directory, to
+// guide retention settings.
+type StorageReport struct {
+	Generated time.Time `json:"generated"`
+	Entries   int       `json:"entries"`
+	Bytes     int64     `json:"bytes"`
+	// Duplicates are the contents stored more than once, most wasteful
+	// first, and DedupSavings the bytes storing each once would free.
+	Duplicates   []DuplicateContent `json:"duplicates"`
+	DedupSavings int64              `json:"dedupSavings"`
+	// CompressionSavings estimates the bytes compressing every entry would
+	// free, from how well the start of each compresses.
+	CompressionSavings int64         `json:"compressionSavings"`
+	Sizes              []SizeBucket  `json:"sizes"`
+	Domains            []DomainUsage `json:"domains"`
+}
+
+// DuplicateContent is content stored under several entries.
+type DuplicateContent struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Copies int      `json:"copies"`
+	URLs   []string `json:"urls"`
+}
+
+// SizeBucket counts the entries in a range of sizes.
+type SizeBucket struct {
+	Label   string `json:"label"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// DomainUsage is the storage taken by the media of one domain.
+type DomainUsage struct {
+	Domain  string `json:"domain"`
+	Entries int    `json:"entries"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// AnalyzeStorage reads every entry in storageDir and its tenants' storage
+// directories, without changing anything, and reports duplicate content,
+// the spread of entry sizes, the storage each domain takes and what
+// deduplication and compression would save.
+func AnalyzeStorage(storageDir string) (*StorageReport, error) {
+	report := &StorageReport{Generated: time.Now()}
+	for _, bucket := range sizeBuckets {
+		report.Sizes = append(report.Sizes, SizeBucket{Label: bucket.label})
+	}
+	contents := make(map[string]*DuplicateContent)
+	domains := make(map[string]*DomainUsage)
+
+	for _, dir := range storageDirs(storageDir) {
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			if dir == storageDir {
+				return nil, err
+			}
+			slog.Error("Read_storage_directory_error", "dir", dir, "error", err)
+			continue
+		}
+		for _, file := range files {
+			hashStr, ok := strings.CutSuffix(file.Name(), ".headers")
+			if !ok || file.IsDir() {
+				continue
+			}
+			binaryFile := filepath.Join(dir, hashStr+".bin")
+			stat, err := os.Stat(binaryFile)
+			if err != nil {
+				continue
+			}
+			meta, err := readMeta(filepath.Join(dir, file.Name()))
+			if err != nil {
+				continue
+			}
+			size := stat.Size()
+			report.Entries++
+			report.Bytes += size
+
+			for i, bucket := range sizeBuckets {
+				if bucket.max < 0 || size < bucket.max {
+					report.Sizes[i].Entries++
+					report.Sizes[i].Bytes += size
+					break
+				}
+			}
+
+			domain := entryDomain(meta.URL)
+			usage := domains[domain]
+			if usage == nil {
+				usage = &DomainUsage{Domain: domain}
+				domains[domain] = usage
+			}
+			usage.Entries++
+			usage.Bytes += size
+
+			if meta.SHA256 != "" {
+				content := contents[meta.SHA256]
+				if content == nil {
+					content = &DuplicateContent{SHA256: meta.SHA256, Size: size}
+					contents[meta.SHA256] = content
+				}
+				content.Copies++
+				if len(content.URLs) < maxDuplicateURLs {
+					content.URLs = append(content.URLs, meta.URL)
+				}
+			}
+
+			report.CompressionSavings += compressionSavings(binaryFile, size)
+		}
+	}
+
+	for _, content := range contents {
+		if content.Copies > 1 {
+			report.Duplicates = append(report.Duplicates, *content)
+			report.DedupSavings += int64(content.Copies-1) * content.Size
+		}
+	}
+	sort.Slice(report.Duplicates, func(i, j int) bool {
+		a, b := report.Duplicates[i], report.Duplicates[j]
+		return int64(a.Copies-1)*a.Size > int64(b.Copies-1)*b.Size
+	})
+	for _, usage := range domains {
+		report.Domains = append(report.Domains, *usage)
+	}
+	sort.Slice(report.Domains, func(i, j int) bool {
+		return report.Domains[i].Bytes > report.Domains[j].Bytes
+	})
+	return report, nil
+}
+
+// entryDomain returns the host of an entry's URL, without a leading www.
+func entryDomain(rawURL string) string {
+	u, err := neturl.Parse(rawURL)
+	if err != nil || u.Hostname() == "" {
+		return "unknown"
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// compressionSavings estimates the bytes compressing the size-byte file at
+// path would free, from how well its first compressionSample bytes do.
+func compressionSavings(path string, size int64) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	var compressed countingDiscard
+	w, _ := flate.NewWriter(&compressed, flate.BestSpeed)
+	sampled, err := io.Copy(w, io.LimitReader(f, compressionSample))
+	if err != nil || sampled == 0 || w.Close() != nil {
+		return 0
+	}
+	ratio := float64(compressed) / float64(sampled)
+	if ratio >= 1 {
+		return 0
+	}
+	return int64(float64(size) * (1 - ratio))
+}
+
+// countingDiscard counts the bytes written to it and drops them.
+type countingDiscard int64
+
+func (c *countingDiscard) Write(b []byte) (int, error) {
+	*c += countingDiscard(len(b))
+	return len(b), nil
+}
+
+// handleAnalyze runs AnalyzeStorage over storageDir for the admin API.
+func handleAnalyze(storageDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := AnalyzeStorage(storageDir)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Storage_analysis_error", "dir", storageDir, "error", err)
+			http.Error(w, "Failed to analyze storage", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,247 @@
+package passthru
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// apiKeySet is the API keys in an API keys file, every request needs one
+// of. Unlike tenants' keys they share a single namespace, and the only
+// limit they can have is a daily byte quota. A nil apiKeySet lets every
+// request through.
+type apiKeySet struct {
+	path string
+
+	mu   sync.RWMutex
+	keys []apiKey
+}
+
+// apiKey is a key, the name it has in metrics and its daily byte quota,
+// if it has one.
+type apiKey struct {
+	key   []byte
+	name  string
+	quota *keyQuota
+}
+
+// loadAPIKeys reads the API keys file at path.
+func loadAPIKeys(path string) (*apiKeySet, error) {
+	ks := &apiKeySet{path: path}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *apiKeySet) enabled() bool {
+	return ks != nil
+}
+
+// reload reads the keys file again, and replaces the keys with the ones in
+// it. If the file can't be read or is broken, the keys stay as they were.
+func (ks *apiKeySet) reload() error {
+	data, err := os.ReadFile(ks.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseAPIKeys(data)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	carryQuotas(ks.keys, keys)
+	ks.keys = keys
+	ks.mu.Unlock()
+	for _, k := range keys {
+		apiKeyRequestsTotal.WithLabelValues(k.name, "allowed").Add(0)
+		if k.quota != nil {
+			apiKeyRequestsTotal.WithLabelValues(k.name, "quota_exceeded").Add(0)
+		}
+	}
+	slog.Info("API_keys_loaded", "file", ks.path, "keys", len(keys))
+	return nil
+}
+
+// parseAPIKeys reads a keys file: a key per line, optionally followed by
+// whitespace and a name for it in metrics, which defaults to the key's
+// ID, and then by the bytes it may be served per day. Blank lines and
+// lines starting with # are skipped.
+func parseAPIKeys(data []byte) ([]apiKey, error) {
+	var keys []apiKey
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected a key, an optional name and an optional daily byte quota", n)
+		}
+		k := apiKey{key: []byte(fields[0]), name: keyID(fields[0])}
+		if len(fields) >= 2 {
+			k.name = fields[1]
+		}
+		if len(fields) == 3 {
+			dailyBytes, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil || dailyBytes <= 0 {
+				return nil, fmt.Errorf("line %d: invalid daily byte quota %q", n, fields[2])
+			}
+			k.quota = newKeyQuota(usageQuotas{DailyBytes: dailyBytes})
+		}
+		if seen[fields[0]] {
+			return nil, fmt.Errorf("line %d: duplicate key", n)
+		}
+		seen[fields[0]] = true
+		keys = append(keys, k)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys")
+	}
+	return keys, nil
+}
+
+// carryQuotas moves the usage counted against the quotas of old keys on to
+// the same keys in keys, so rereading the file doesn't start anyone's day
+// over. The caller holds ks.mu.
+func carryQuotas(old, keys []apiKey) {
+	for _, k := range keys {
+		if k.quota == nil {
+			continue
+		}
+		for _, o := range old {
+			if o.quota != nil && bytes.Equal(o.key, k.key) {
+				o.quota.mu.Lock()
+				k.quota.day, k.quota.month = o.quota.day, o.quota.month
+				o.quota.mu.Unlock()
+			}
+		}
+	}
+}
+
+// quotas returns the keys with quotas by ID, for quotaState to save.
+func (ks *apiKeySet) quotas() map[string]*keyQuota {
+	quotas := make(map[string]*keyQuota)
+	if !ks.enabled() {
+		return quotas
+	}
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+	for _, k := range ks.keys {
+		if k.quota != nil {
+			quotas[keyID(string(k.key))] = k.quota
+		}
+	}
+	return quotas
+}
+
+// admit checks key and its quota and counts the result: allowed,
+// unauthorized or quota_exceeded. It returns the key, unless it's
+// unauthorized, along with the quota used up by a quota_exceeded one.
+func (ks *apiKeySet) admit(key string) (apiKey, string, quotaBreach) {
+	ks.mu.RLock()
+	var found apiKey
+	for _, k := range ks.keys {
+		if subtle.ConstantTimeCompare(k.key, []byte(key)) == 1 {
+			found = k
+		}
+	}
+	ks.mu.RUnlock()
+	if found.name == "" {
+		apiKeyRequestsTotal.WithLabelValues("", "unauthorized").Inc()
+		return found, "unauthorized", quotaBreach{}
+	}
+	if breach, over := found.quota.exceeded(time.Now()); over {
+		apiKeyRequestsTotal.WithLabelValues(found.name, "quota_exceeded").Inc()
+		return found, "quota_exceeded", breach
+	}
+	apiKeyRequestsTotal.WithLabelValues(found.name, "allowed").Inc()
+	return found, "allowed", quotaBreach{}
+}
+
+// authenticate wraps next so every request must carry one of the keys,
+// within its daily byte quota if it has one, and charges what's served to
+// the quota. Peer-to-peer requests, signed links and short links have
+// their own authentication and skip this, as they do with tenants.
+func (ks *apiKeySet) authenticate(next http.Handler) http.Handler {
+	if !ks.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/internal/") || strings.HasPrefix(r.URL.Path, "/f/") || strings.HasPrefix(r.URL.Path, "/s/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		k, result, breach := ks.admit(requestKey(r))
+		switch result {
+		case "unauthorized":
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		case "quota_exceeded":
+			breach.setHeaders(w.Header(), time.Now())
+			http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		setAccessKey(r.Context(), k.name)
+		if k.quota == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if b, ok := k.quota.tightest(time.Now()); ok {
+			b.setUsageHeaders(w.Header())
+		}
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+		k.quota.served(cw.n)
+	})
+}
+
+// authenticateRPC is the gRPC counterpart of authenticate. It returns a
+// context carrying the key's quota, for what's streamed to be charged to.
+func (ks *apiKeySet) authenticateRPC(ctx context.Context) (context.Context, error) {
+	if !ks.enabled() {
+		return ctx, nil
+	}
+	k, result, breach := ks.admit(rpcKey(ctx))
+	switch result {
+	case "unauthorized":
+		return nil, status.Error(codes.Unauthenticated, "A valid API key is required")
+	case "quota_exceeded":
+		return nil, status.Errorf(codes.ResourceExhausted, "Quota exceeded: %s (limit %d, resets %s)", breach.name, breach.limit, breach.reset.Format(time.RFC3339))
+	}
+	return withKeyQuota(ctx, k.quota), nil
+}
+
+type keyQuotaContextKey struct{}
+
+// withKeyQuota returns a copy of ctx charging the bytes served under it to
+// q, an API key's quota.
+func withKeyQuota(ctx context.Context, q *keyQuota) context.Context {
+	if q == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, keyQuotaContextKey{}, q)
+}
+
+// keyQuotaFrom returns the API key quota of ctx, or nil.
+func keyQuotaFrom(ctx context.Context) *keyQuota {
+	q, _ := ctx.Value(keyQuotaContextKey{}).(*keyQuota)
+	return q
+}
@@ -0,0 +1,117 @@
+package passthru
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseAPIKeysQuotas(t *testing.T) {
+	keys, err := parseAPIKeys([]byte("# key name dailyBytes\nk1\nk2 app\nk3 friend 1000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(keys))
+	}
+	if keys[0].quota != nil || keys[1].quota != nil {
+		t.Error("keys without a quota got one")
+	}
+	if q := keys[2].quota; q == nil || q.limits != (usageQuotas{DailyBytes: 1000}) {
+		t.Errorf("k3's quota = %+v, want 1000 bytes a day", q)
+	}
+
+	for _, file := range []string{"k1 name 0\n", "k1 name -5\n", "k1 name 1GB\n", "k1 name 1000 extra\n"} {
+		if _, err := parseAPIKeys([]byte(file)); err == nil {
+			t.Errorf("%q was accepted", file)
+		}
+	}
+}
+
+func writeAPIKeys(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAPIKeyDailyByteQuota(t *testing.T) {
+	registerMetrics()
+	path := filepath.Join(t.TempDir(), "keys")
+	writeAPIKeys(t, path, "k1 friend 1000\nk2 me\n")
+	ks, err := loadAPIKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ks.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 600)))
+	}))
+	get := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/?u=https://example.com/clip", nil)
+		r.Header.Set(apiKeyHeader, key)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// The request that goes over is served in full, and the next refused
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := get("k1")
+		if rec.Code != want {
+			t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+		if i == 1 && rec.Header().Get("X-Quota-Remaining") != "400" {
+			t.Errorf("X-Quota-Remaining = %q before the second request, want 400", rec.Header().Get("X-Quota-Remaining"))
+		}
+	}
+	if rec := get("k1"); rec.Header().Get("X-Quota-Exceeded") != "daily_bytes" || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("refused without saying why: %v", rec.Header())
+	}
+	if rec := get("k2"); rec.Code != http.StatusOK {
+		t.Errorf("a key without a quota got %d", rec.Code)
+	}
+
+	// Rereading the file keeps what was used, and applies the new limit
+	writeAPIKeys(t, path, "k1 friend 2000\nk2 me\n")
+	if err := ks.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get("k1"); rec.Code != http.StatusOK || rec.Header().Get("X-Quota-Used") != "1200" {
+		t.Errorf("after raising the quota: status %d, X-Quota-Used %q, want 200 and 1200", rec.Code, rec.Header().Get("X-Quota-Used"))
+	}
+}
+
+func TestQuotaStateSavesAPIKeyQuotas(t *testing.T) {
+	dir := t.TempDir()
+	keysFile := filepath.Join(dir, "keys")
+	stateFile := filepath.Join(dir, "quotas.json")
+	writeAPIKeys(t, keysFile, "k1 friend 1000\n")
+
+	ks, err := loadAPIKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := loadQuotaState(stateFile, false, nil, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.keys[0].quota.served(700)
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// As after a restart
+	ks, err = loadAPIKeys(keysFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadQuotaState(stateFile, false, nil, ks); err != nil {
+		t.Fatal(err)
+	}
+	if used := ks.keys[0].quota.day.Bytes; used != 700 {
+		t.Errorf("restored %d bytes used today, want 700", used)
+	}
+}
@@ -0,0 +1,204 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cobalt changed its API in version 10: requests go to / instead of
+// /api/json, and videoQuality replaced vQuality. Each endpoint is probed
+// for the version it runs so requests to it can be shaped accordingly.
+const (
+	legacyAPIMajor       = 7  // the oldest API version requests are adapted to
+	currentAPIMajor      = 10 // the first version with the current API
+	legacyRequestPath    = "/api/json"
+	legacyInfoPath       = "/api/serverInfo"
+	upstreamProbeTimeout = 10 * time.Second
+)
+
+// upstreamAPI is what's known of the API an endpoint speaks.
+type upstreamAPI struct {
+	endpoint string
+
+	mu      sync.Mutex
+	version string // "" until a probe succeeds
+	major   int
+}
+
+// upstreamAPIs tracks the API version of every endpoint requests go to. A
+// nil upstreamAPIs, or an endpoint not probed yet, is assumed to speak the
+// current API.
+type upstreamAPIs struct {
+	hooks  hookChain
+	client *http.Client
+	apis   map[string]*upstreamAPI
+}
+
+func newUpstreamAPIs(hooks hookChain, client *http.Client) *upstreamAPIs {
+	return &upstreamAPIs{hooks: hooks, client: client, apis: make(map[string]*upstreamAPI)}
+}
+
+// watch probes endpoints now and then every interval, until ctx is done.
+func (ua *upstreamAPIs) watch(ctx context.Context, endpoints []string, interval time.Duration) {
+	for _, endpoint := range endpoints {
+		if ua.apis[endpoint] == nil {
+			ua.apis[endpoint] = &upstreamAPI{endpoint: endpoint}
+		}
+	}
+	go func() {
+		ua.probeAll()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				ua.probeAll()
+			}
+		}
+	}()
+}
+
+func (ua *upstreamAPIs) probeAll() {
+	for _, api := range ua.apis {
+		api.probe(ua.client, ua.hooks)
+	}
+}
+
+// get returns what's known of endpoint's API, or nil if it isn't probed.
+func (ua *upstreamAPIs) get(endpoint string) *upstreamAPI {
+	if ua == nil {
+		return nil
+	}
+	return ua.apis[endpoint]
+}
+
+// probe asks the endpoint's info route for its version: / for the current
+// API, /api/serverInfo for the legacy one. The last known version is kept
+// if neither answers.
+func (api *upstreamAPI) probe(client *http.Client, hooks hookChain) {
+	version, err := api.fetchVersion(client, hooks, strings.TrimSuffix(api.endpoint, legacyRequestPath), func(data []byte) string {
+		var info struct {
+			Cobalt struct {
+				Version string `json:"version"`
+			} `json:"cobalt"`
+		}
+		json.Unmarshal(data, &info)
+		return info.Cobalt.Version
+	})
+	if err != nil || version == "" {
+		version, err = api.fetchVersion(client, hooks, strings.TrimSuffix(strings.TrimSuffix(api.endpoint, "/"), legacyRequestPath)+legacyInfoPath, func(data []byte) string {
+			var info struct {
+				Version string `json:"version"`
+			}
+			json.Unmarshal(data, &info)
+			return info.Version
+		})
+	}
+	if err != nil || version == "" {
+		slog.Error("Upstream_api_probe_failed", "endpoint", api.endpoint, "error", err)
+		return
+	}
+
+	major, _ := strconv.Atoi(strings.SplitN(strings.TrimPrefix(version, "v"), ".", 2)[0])
+	api.mu.Lock()
+	changed := version != api.version
+	api.version, api.major = version, major
+	api.mu.Unlock()
+
+	upstreamAPIVersion.WithLabelValues(api.endpoint).Set(float64(major))
+	if !api.supportedMajor(major) {
+		upstreamAPIUnsupported.WithLabelValues(api.endpoint).Set(1)
+		slog.Info("Unsupported_upstream_api", "endpoint", api.endpoint, "version", version)
+		return
+	}
+	upstreamAPIUnsupported.WithLabelValues(api.endpoint).Set(0)
+	if changed {
+		slog.Info("Upstream_api_detected", "endpoint", api.endpoint, "version", version, "legacy", major < currentAPIMajor)
+	}
+}
+
+// fetchVersion GETs url and reads the version out of its JSON body with
+// parse.
+func (api *upstreamAPI) fetchVersion(client *http.Client, hooks hookChain, url string, parse func([]byte) string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	hooks.beforeUpstream(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	var data json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	return parse(data), nil
+}
+
+func (api *upstreamAPI) supportedMajor(major int) bool {
+	return major >= legacyAPIMajor
+}
+
+// state returns the endpoint's version and whether requests to it can be
+// made; a nil api, not probed yet, is assumed to speak the current API.
+func (api *upstreamAPI) state() (version string, major int, supported bool) {
+	if api == nil {
+		return "", currentAPIMajor, true
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.version == "" {
+		return "", currentAPIMajor, true
+	}
+	return api.version, api.major, api.supportedMajor(api.major)
+}
+
+// shapeRequest returns where the request for req goes on endpoint and its
+// body, for an endpoint speaking the given major API version.
+func shapeRequest(endpoint string, major int, req ExternalServiceRequest, options map[string]interface{}) (string, interface{}) {
+	if major >= currentAPIMajor {
+		return endpoint, withOptions(req, options)
+	}
+	if !strings.HasSuffix(endpoint, legacyRequestPath) {
+		endpoint = strings.TrimSuffix(endpoint, "/") + legacyRequestPath
+	}
+	body := map[string]interface{}{
+		"url":             req.URL,
+		"vQuality":        req.VideoQuality,
+		"disableMetadata": req.DisableMetadata,
+	}
+	// The pre-10 API's names for the same options
+	switch req.DownloadMode {
+	case "audio":
+		body["isAudioOnly"] = true
+	case "mute":
+		body["isAudioMuted"] = true
+	}
+	if req.AudioFormat != "" {
+		body["aFormat"] = req.AudioFormat
+	}
+	if req.FilenameStyle != "" {
+		body["filenamePattern"] = req.FilenameStyle
+	}
+	for name, value := range options {
+		body[name] = value
+	}
+	return endpoint, body
+}
@@ -0,0 +1,278 @@
+package passthru
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// archiveFile is a cached entry and the name it gets in an archive.
+type archiveFile struct {
+	name  string
+	entry cacheEntry
+}
+
+// archiveFormat returns the archive format asked for with ?format= (zip by
+// default), or "" after answering 400 for anything but zip and tar.
+func archiveFormat(w http.ResponseWriter, r *http.Request) string {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	if format != "zip" && format != "tar" {
+		http.Error(w, "'format' must be zip or tar", http.StatusBadRequest)
+		return ""
+	}
+	return format
+}
+
+func setArchiveHeaders(w http.ResponseWriter, format, name string) {
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.%s\"", name, format))
+}
+
+// writeArchive streams files to w as a zip or a tar.
+func writeArchive(w io.Writer, format string, files []archiveFile) error {
+	var zw *zip.Writer
+	var tw *tar.Writer
+	if format == "zip" {
+		zw = zip.NewWriter(w)
+	} else {
+		tw = tar.NewWriter(w)
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file.entry.binaryFile)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		if zw != nil {
+			// Media doesn't compress, so store it as-is
+			var entry io.Writer
+			entry, err = zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Store, Modified: info.ModTime()})
+			if err == nil {
+				_, err = io.Copy(entry, f)
+			}
+		} else {
+			err = tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()})
+			if err == nil {
+				_, err = io.Copy(tw, f)
+			}
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if zw != nil {
+		return zw.Close()
+	}
+	return tw.Close()
+}
+
+// storedFilename returns the filename cobalt gave an entry, or failing that
+// the one in its Content-Disposition, if any, reduced to a plain file name.
+func storedFilename(headersFileName string) string {
+	meta, err := readMeta(headersFileName)
+	if err != nil {
+		return ""
+	}
+	name := meta.Filename
+	if name == "" {
+		_, params, err := mime.ParseMediaType(meta.Headers.Get("Content-Disposition"))
+		if err != nil {
+			return ""
+		}
+		name = params["filename"]
+	}
+	return plainFilename(name)
+}
+
+// plainFilename reduces name to a file name without any directories, or
+// "" if there's nothing left of it.
+func plainFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// archiveNames names each entry after its cobalt filename, falling back to
+// its hash, and numbers repeated names so none overwrites another when the
+// archive is unpacked.
+func archiveNames(entries []cacheEntry) []archiveFile {
+	files := make([]archiveFile, 0, len(entries))
+	seen := make(map[string]int)
+	for _, e := range entries {
+		name := storedFilename(e.headersFile)
+		if name == "" {
+			name = e.hash[:12] + storedExtension(e.headersFile)
+		}
+		if n := seen[name]; n > 0 {
+			ext := path.Ext(name)
+			seen[name]++
+			name = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext)
+		} else {
+			seen[name] = 1
+		}
+		files = append(files, archiveFile{name: name, entry: e})
+	}
+	return files
+}
+
+// withSubtitles returns files with each one followed by its subtitles, from
+// subs, named after it.
+func withSubtitles(files []archiveFile, subs []cacheEntry, subtitles *subtitleOptions) []archiveFile {
+	withSubs := make([]archiveFile, 0, 2*len(files))
+	for i, file := range files {
+		withSubs = append(withSubs, file, archiveFile{name: subtitles.name(file.name), entry: subs[i]})
+	}
+	return withSubs
+}
+
+// archiveURLs returns the URLs r asks to archive: its u parameters, and
+// for a POST those of its JSON body, a list of URLs or {"urls": [...]}.
+func archiveURLs(r *http.Request) ([]string, error) {
+	urls := r.URL.Query()["u"]
+	if r.Method != http.MethodPost {
+		return urls, nil
+	}
+	var body json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	var list []string
+	if err := json.Unmarshal(body, &list); err == nil {
+		return append(urls, list...), nil
+	}
+	var req prefetchRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	return append(urls, req.URLs...), nil
+}
+
+// handleArchive streams the media at every u (or, POSTed, every URL in the
+// body) as one zip (or, with ?format=tar, tar) archive, downloading the
+// ones that aren't cached first. With ?subs=<lang> each media file is
+// followed by its subtitles.
+func handleArchive(c *cache, media *mediaProcessor, maxURLs int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requested, err := archiveURLs(r)
+		if err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		var urls []string
+		seen := make(map[string]bool)
+		for _, u := range requested {
+			if !seen[u] {
+				seen[u] = true
+				urls = append(urls, u)
+			}
+		}
+		if len(urls) == 0 {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+		if len(urls) > maxURLs {
+			http.Error(w, fmt.Sprintf("At most %d URLs are allowed", maxURLs), http.StatusBadRequest)
+			return
+		}
+		format := archiveFormat(w, r)
+		if format == "" {
+			return
+		}
+		subtitles, err := parseSubtitleOptions(r.URL.Query(), c.subtitleLang)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var derived *derivation
+		if subtitles != nil {
+			if media == nil {
+				http.Error(w, "Media processing is not available", http.StatusNotImplemented)
+				return
+			}
+			derived = subtitles.derivation()
+		}
+		options, err := parseRequestOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Fetch the misses concurrently, like a batch, before anything is
+		// written, so a failure can still get a proper status
+		c := c.forRequest(r)
+		options.subtitleLang = subtitles.language()
+		entries := make([]cacheEntry, len(urls))
+		subs := make([]cacheEntry, len(urls))
+		errs := make([]error, len(urls))
+		var wg sync.WaitGroup
+		for i, u := range urls {
+			// What's a default differs by domain
+			ctx := withRequestOptions(r.Context(), options.relativeTo(c, u))
+			entries[i] = c.mediaEntry(ctx, u)
+			wg.Add(1)
+			go func(i int, u string) {
+				defer wg.Done()
+				status, err := c.ensure(ctx, u, entries[i])
+				httpRequestsTotal.WithLabelValues("/archive", status).Inc()
+				if status == statusCached {
+					usageFrom(ctx).hit()
+				}
+				if err == nil && derived != nil {
+					subs[i], err = media.produce(ctx, c, u, entries[i], derived)
+				}
+				errs[i] = err
+			}(i, u)
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err == nil {
+				continue
+			}
+			status, message := http.StatusInternalServerError, "Failed to fetch resource"
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				status, message = fe.status, fe.message
+			}
+			http.Error(w, fmt.Sprintf("%s: %s", urls[i], message), status)
+			return
+		}
+
+		files := archiveNames(entries)
+		if derived != nil {
+			files = withSubtitles(files, subs, subtitles)
+		}
+		setArchiveHeaders(w, format, "archive")
+		if err := writeArchive(w, format, files); err != nil {
+			slog.ErrorContext(r.Context(), "Archive_error", "count", len(urls), "error", err)
+			return
+		}
+		slog.InfoContext(r.Context(), "Archive_served", "count", len(urls), "format", format)
+	}
+}
@@ -0,0 +1,514 @@
+package passthru
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// preferredExtensions overrides mime.ExtensionsByType for common media types,
+// which would otherwise pick e.g. ".f4v" for video/mp4.
+var preferredExtensions = map[string]string{
+	"video/mp4":  ".mp4",
+	"video/webm": ".webm",
+	"audio/mp4":  ".m4a",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/webm": ".weba",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+// batchRetention is how long a batch's status stays queryable after it was
+// created.
+const batchRetention = 24 * time.Hour
+
+// Batch item states.
+const (
+	batchPending     = "pending"
+	batchDownloading = "downloading"
+	batchReady       = "ready"
+	batchFailed      = "failed"
+)
+
+type batchItem struct {
+	URL         string `json:"url"`
+	Hash        string `json:"hash"`
+	Status      string `json:"status"`
+	CacheStatus string `json:"cacheStatus,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// batch is a set of URLs submitted together through POST /batch.
+type batch struct {
+	mu      sync.Mutex
+	ID      string       `json:"id"`
+	Created time.Time    `json:"created"`
+	Items   []*batchItem `json:"items"`
+
+	// tenant submitted the batch ("" without multi-tenancy), with the
+	// namespace of the cache its items go into (see forTenant), and the API
+	// key its downloads are charged to
+	tenant string
+	cache  *cache
+	usage  *keyUsage
+	// callback is where the batch's events are posted, besides the webhook
+	// URLs, if anywhere.
+	callback string
+
+	// remaining counts the items still pending or downloading
+	remaining int
+	failed    int
+}
+
+type batchStatus struct {
+	ID       string      `json:"id"`
+	Created  time.Time   `json:"created"`
+	Complete bool        `json:"complete"`
+	Items    []batchItem `json:"items"`
+}
+
+// keyID returns the ID of the API key the batch is charged to, if any.
+func (b *batch) keyID() string {
+	if b.usage == nil {
+		return ""
+	}
+	return b.usage.key
+}
+
+func (b *batch) status() batchStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := batchStatus{ID: b.ID, Created: b.Created, Complete: true}
+	for _, item := range b.Items {
+		if item.Status == batchPending || item.Status == batchDownloading {
+			status.Complete = false
+		}
+		status.Items = append(status.Items, *item)
+	}
+	return status
+}
+
+// index returns item's position in the batch. It must be called with b.mu
+// held.
+func (b *batch) index(item *batchItem) int {
+	for n, it := range b.Items {
+		if it == item {
+			return n
+		}
+	}
+	return -1
+}
+
+func (b *batch) update(item *batchItem, fn func(*batchItem)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fn(item)
+}
+
+// batchStore keeps submitted batches in memory and runs their downloads.
+// Batches and the outcome of each item are recorded in a journal, so a
+// restart picks up every batch that was still downloading.
+type batchStore struct {
+	mu       sync.Mutex
+	batches  map[string]*batch
+	cache    *cache
+	maxURLs  int
+	notifier *notifier
+	journal  *journal
+}
+
+// batchRecord is a line of the batch journal: either a submitted batch or
+// the final state of one of its items.
+type batchRecord struct {
+	Op          string     `json:"op"` // submit or item
+	ID          string     `json:"id"`
+	Tenant      string     `json:"tenant,omitempty"`
+	Key         string     `json:"key,omitempty"`
+	Callback    string     `json:"callback,omitempty"`
+	Created     *time.Time `json:"created,omitempty"`
+	URLs        []string   `json:"urls,omitempty"`
+	Item        int        `json:"item"`
+	Status      string     `json:"status,omitempty"`
+	CacheStatus string     `json:"cacheStatus,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// newBatchStore creates a store journaled at journalPath, which forgets old
+// batches until ctx is done. Batches found in the journal are restored, and
+// their unfinished items are started again.
+func newBatchStore(ctx context.Context, c *cache, maxURLs int, n *notifier, journalPath string) (*batchStore, error) {
+	j, err := openJournal(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	bs := &batchStore{
+		batches:  make(map[string]*batch),
+		cache:    c,
+		maxURLs:  maxURLs,
+		notifier: n,
+		journal:  j,
+	}
+	if err := bs.restore(); err != nil {
+		return nil, err
+	}
+	go bs.expire(ctx)
+	return bs, nil
+}
+
+// restore replays the journal, compacts it down to the live batches and
+// resumes their unfinished items.
+func (bs *batchStore) restore() error {
+	err := bs.journal.replay(func(data json.RawMessage) error {
+		var rec batchRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil
+		}
+		switch rec.Op {
+		case "submit":
+			if rec.Created == nil {
+				return nil
+			}
+			if b := bs.newBatch(rec.ID, rec.Tenant, rec.Key, rec.Callback, *rec.Created, rec.URLs); b != nil {
+				bs.batches[rec.ID] = b
+			} else {
+				slog.Info("Batch_unknown_tenant", "batch", rec.ID, "tenant", rec.Tenant)
+			}
+		case "item":
+			if b := bs.batches[rec.ID]; b != nil && rec.Item >= 0 && rec.Item < len(b.Items) {
+				item := b.Items[rec.Item]
+				item.Status, item.CacheStatus, item.Error = rec.Status, rec.CacheStatus, rec.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-batchRetention)
+	resumed := 0
+	for id, b := range bs.batches {
+		if b.Created.Before(cutoff) {
+			delete(bs.batches, id)
+			continue
+		}
+		b.remaining, b.failed = 0, 0
+		for _, item := range b.Items {
+			switch item.Status {
+			case batchFailed:
+				b.failed++
+			case batchReady:
+			default:
+				item.Status = batchPending
+				b.remaining++
+			}
+		}
+	}
+	if err := bs.compact(); err != nil {
+		return err
+	}
+
+	for _, b := range bs.batches {
+		for _, item := range b.Items {
+			if item.Status == batchPending {
+				go bs.run(b, item)
+				resumed++
+			}
+		}
+	}
+	if len(bs.batches) > 0 {
+		slog.Info("Batches_restored", "count", len(bs.batches), "resumed_items", resumed)
+	}
+	return nil
+}
+
+// compact rewrites the journal to hold just the batches in memory.
+func (bs *batchStore) compact() error {
+	var records []interface{}
+	for _, b := range bs.batches {
+		b.mu.Lock()
+		rec := batchRecord{Op: "submit", ID: b.ID, Tenant: b.tenant, Key: b.keyID(), Callback: b.callback, Created: &b.Created}
+		for _, item := range b.Items {
+			rec.URLs = append(rec.URLs, item.URL)
+		}
+		records = append(records, rec)
+		for n, item := range b.Items {
+			if item.Status == batchReady || item.Status == batchFailed {
+				records = append(records, batchRecord{Op: "item", ID: b.ID, Item: n, Status: item.Status, CacheStatus: item.CacheStatus, Error: item.Error})
+			}
+		}
+		b.mu.Unlock()
+	}
+	return bs.journal.compact(records)
+}
+
+// newBatch returns a batch of urls for tenant, charged to the API key with
+// ID key and reporting to callback, or nil if there's no such tenant.
+func (bs *batchStore) newBatch(id, tenant, key, callback string, created time.Time, urls []string) *batch {
+	c := bs.cache.forTenant(tenant)
+	if c == nil {
+		return nil
+	}
+	b := &batch{ID: id, Created: created, tenant: tenant, cache: c, usage: bs.cache.tenants.usageFor(key), callback: callback}
+	for _, url := range urls {
+		b.Items = append(b.Items, &batchItem{URL: url, Hash: c.entry(url).hash, Status: batchPending})
+	}
+	b.remaining = len(b.Items)
+	return b
+}
+
+// submit registers a batch of urls for the cache of the tenant or host
+// profile ctx belongs to, charged to its API key, and starts downloading
+// them. The downloads run concurrently, bounded by the cache's download
+// limit. Their events are posted to callback too, if it isn't "".
+func (bs *batchStore) submit(ctx context.Context, urls []string, callback string) *batch {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	var key string
+	if usage := usageFrom(ctx); usage != nil {
+		key = usage.key
+	}
+	b := bs.newBatch(hex.EncodeToString(id), bs.cache.forContext(ctx).namespace, key, callback, time.Now(), urls)
+	if err := bs.journal.append(batchRecord{Op: "submit", ID: b.ID, Tenant: b.tenant, Key: key, Callback: callback, Created: &b.Created, URLs: urls}); err != nil {
+		slog.ErrorContext(ctx, "Batch_journal_error", "batch", b.ID, "error", err)
+	}
+
+	bs.mu.Lock()
+	bs.batches[b.ID] = b
+	bs.mu.Unlock()
+
+	for _, item := range b.Items {
+		go bs.run(b, item)
+	}
+	return b
+}
+
+func (bs *batchStore) run(b *batch, item *batchItem) {
+	b.update(item, func(item *batchItem) { item.Status = batchDownloading })
+
+	ctx := withUsage(context.Background(), b.usage)
+	cacheStatus, err := b.cache.ensure(ctx, item.URL, b.cache.entry(item.URL))
+	var complete bool
+	var failed int
+	var rec batchRecord
+	b.update(item, func(item *batchItem) {
+		item.CacheStatus = cacheStatus
+		if err != nil {
+			item.Status = batchFailed
+			item.Error = err.Error()
+			b.failed++
+		} else {
+			item.Status = batchReady
+		}
+		b.remaining--
+		complete, failed = b.remaining == 0, b.failed
+		rec = batchRecord{Op: "item", ID: b.ID, Item: b.index(item), Status: item.Status, CacheStatus: item.CacheStatus, Error: item.Error}
+	})
+	if jerr := bs.journal.append(rec); jerr != nil {
+		slog.Error("Batch_journal_error", "batch", b.ID, "error", jerr)
+	}
+
+	event := webhookEvent{Event: eventDownloadCompleted, Source: "batch", URL: item.URL, Hash: item.Hash, CacheStatus: cacheStatus, Batch: b.ID}
+	if err != nil {
+		slog.Error("Batch_item_failed", "batch", b.ID, "u", item.URL, "error", err)
+		batchItemsTotal.WithLabelValues(batchFailed).Inc()
+		event.Event, event.CacheStatus, event.Error = eventDownloadFailed, "", err.Error()
+	} else {
+		batchItemsTotal.WithLabelValues(batchReady).Inc()
+		bs.notifier.describe(&event, b.cache, b.cache.entry(item.URL))
+	}
+	bs.notifier.notify(event, b.callback)
+	if complete {
+		bs.notifier.notify(webhookEvent{Event: eventBatchCompleted, Source: "batch", Batch: b.ID, Failed: failed}, b.callback)
+	}
+}
+
+// get returns the batch named in r's path, provided it was submitted by the
+// tenant r was authenticated as, or for the host profile r is for.
+func (bs *batchStore) get(r *http.Request) *batch {
+	bs.mu.Lock()
+	b := bs.batches[mux.Vars(r)["id"]]
+	bs.mu.Unlock()
+
+	if b == nil || b.tenant != bs.cache.forRequest(r).namespace {
+		return nil
+	}
+	return b
+}
+
+// expire forgets batches older than batchRetention and compacts the journal.
+func (bs *batchStore) expire(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-batchRetention)
+		bs.mu.Lock()
+		for id, b := range bs.batches {
+			if b.Created.Before(cutoff) {
+				delete(bs.batches, id)
+			}
+		}
+		err := bs.compact()
+		bs.mu.Unlock()
+		if err != nil {
+			slog.Error("Batch_journal_error", "error", err)
+		}
+	}
+}
+
+// handleBatchSubmit accepts a JSON body of the form {"urls": [...]} (or
+// repeated "u" query parameters), with an optional "callback" URL, and
+// answers 202 with the batch ID.
+func handleBatchSubmit(bs *batchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urls := r.URL.Query()["u"]
+		callback := r.URL.Query().Get("callback")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body prefetchRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			urls = append(urls, body.URLs...)
+			if body.Callback != "" {
+				callback = body.Callback
+			}
+		}
+		if len(urls) == 0 {
+			http.Error(w, "At least one URL is required", http.StatusBadRequest)
+			return
+		}
+		if callback != "" {
+			if fe := checkCallback(callback); fe != nil {
+				http.Error(w, fe.message, fe.status)
+				return
+			}
+		}
+		if len(urls) > bs.maxURLs {
+			http.Error(w, fmt.Sprintf("A batch can hold at most %d URLs", bs.maxURLs), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		b := bs.submit(r.Context(), urls, callback)
+		slog.InfoContext(r.Context(), "Batch_submitted", "batch", b.ID, "count", len(urls))
+		w.Header().Set("Location", "/batch/"+b.ID)
+		writeJSON(w, http.StatusAccepted, b.status())
+	}
+}
+
+func handleBatchStatus(bs *batchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := bs.get(r)
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, b.status())
+	}
+}
+
+// handleBatchItem serves a single ready item of a batch by its position.
+func handleBatchItem(bs *batchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := bs.get(r)
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		status := b.status()
+		n, err := strconv.Atoi(mux.Vars(r)["item"])
+		if err != nil || n < 0 || n >= len(status.Items) {
+			http.NotFound(w, r)
+			return
+		}
+		if status.Items[n].Status != batchReady {
+			http.Error(w, "Item is not ready", http.StatusConflict)
+			return
+		}
+		e := b.cache.entry(status.Items[n].URL)
+		setCacheHeaders(w, e, statusCached)
+		b.cache.serve(w, r, e)
+	}
+}
+
+// handleBatchArchive streams every ready item of a complete batch as a zip
+// (the default) or, with ?format=tar, a tar archive.
+func handleBatchArchive(bs *batchStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := bs.get(r)
+		if b == nil {
+			http.NotFound(w, r)
+			return
+		}
+		status := b.status()
+		if !status.Complete {
+			http.Error(w, "Batch is still downloading", http.StatusConflict)
+			return
+		}
+
+		format := archiveFormat(w, r)
+		if format == "" {
+			return
+		}
+		setArchiveHeaders(w, format, "batch-"+b.ID)
+
+		if err := writeBatchArchive(w, format, b.cache, status.Items); err != nil {
+			slog.ErrorContext(r.Context(), "Batch_archive_error", "batch", b.ID, "error", err)
+		}
+	}
+}
+
+func writeBatchArchive(w io.Writer, format string, c *cache, items []batchItem) error {
+	var files []archiveFile
+	for n, item := range items {
+		if item.Status != batchReady {
+			continue
+		}
+		e := c.entry(item.URL)
+		files = append(files, archiveFile{name: fmt.Sprintf("%d-%s%s", n, item.Hash[:12], storedExtension(e.headersFile)), entry: e})
+	}
+	return writeArchive(w, format, files)
+}
+
+// storedExtension guesses a file extension from the Content-Type stored with
+// an entry.
+func storedExtension(headersFileName string) string {
+	headers, err := readStoredHeaders(headersFileName)
+	if err != nil {
+		return ""
+	}
+	mediaType, _, err := mime.ParseMediaType(headers.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	if ext, ok := preferredExtensions[mediaType]; ok {
+		return ext
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
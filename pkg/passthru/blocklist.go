@@ -0,0 +1,120 @@
+package passthru
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// blockRule forbids the media of a domain and its subdomains, for policy
+// reasons, telling clients why in a machine-readable Reason.
+type blockRule struct {
+	Domain string `json:"domain"`
+	// Reason is a code clients can act on (defaults to blocked_domain).
+	Reason string `json:"reason"`
+	// Status is 451 (the default) or 403.
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// blockedResponse is the body of a rejected request.
+type blockedResponse struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	Domain string `json:"domain"`
+}
+
+// blocklist refuses the URLs on blocked domains, both to clients asking
+// for them and to the external service. A nil blocklist blocks nothing.
+type blocklist struct {
+	rules map[string]*blockRule
+}
+
+// loadBlocklist reads a JSON list of block rules.
+func loadBlocklist(path string) (*blocklist, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*blockRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+
+	bl := &blocklist{rules: make(map[string]*blockRule)}
+	for _, rule := range rules {
+		rule.Domain = strings.TrimSuffix(strings.ToLower(rule.Domain), ".")
+		if rule.Domain == "" || strings.ContainsAny(rule.Domain, "/:") {
+			return nil, fmt.Errorf("block rule domain %q must be a bare domain name", rule.Domain)
+		}
+		if bl.rules[rule.Domain] != nil {
+			return nil, fmt.Errorf("duplicate block rule for %s", rule.Domain)
+		}
+		switch rule.Status {
+		case 0:
+			rule.Status = http.StatusUnavailableForLegalReasons
+		case http.StatusUnavailableForLegalReasons, http.StatusForbidden:
+		default:
+			return nil, fmt.Errorf("block rule for %s has status %d, expected 451 or 403", rule.Domain, rule.Status)
+		}
+		if rule.Reason == "" {
+			rule.Reason = "blocked_domain"
+		}
+		if rule.Message == "" {
+			rule.Message = "Media from " + rule.Domain + " is not served here"
+		}
+		bl.rules[rule.Domain] = rule
+		blockedRequestsTotal.WithLabelValues(rule.Domain).Add(0)
+	}
+	return bl, nil
+}
+
+// match returns the rule blocking rawURL, if any: that of its host or of
+// the closest parent domain with one.
+func (bl *blocklist) match(rawURL string) *blockRule {
+	if bl == nil {
+		return nil
+	}
+	for _, domain := range urlDomains(rawURL) {
+		if rule := bl.rules[domain]; rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// check returns the rule refusing rawURL, counting the refusal, or nil if
+// it isn't blocked.
+func (bl *blocklist) check(rawURL string) *blockRule {
+	rule := bl.match(rawURL)
+	if rule == nil {
+		return nil
+	}
+	blockedRequestsTotal.WithLabelValues(rule.Domain).Inc()
+	slog.Info("Blocked_domain", "domain", rule.Domain, "reason", rule.Reason, "url", rawURL)
+	return rule
+}
+
+func (rule *blockRule) err() error {
+	return &fetchError{rule.Status, rule.Message}
+}
+
+// protect wraps next so requests for a blocked URL in their u parameters
+// get a JSON body saying why instead.
+func (bl *blocklist) protect(next http.Handler) http.Handler {
+	if bl == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, u := range r.URL.Query()["u"] {
+			if rule := bl.check(u); rule != nil {
+				writeJSON(w, rule.Status, blockedResponse{Error: rule.Message, Reason: rule.Reason, Domain: rule.Domain})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
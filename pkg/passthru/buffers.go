@@ -0,0 +1,29 @@
+package passthru
+
+import (
+	"io"
+	"sync"
+)
+
+// bufferPool hands out copy buffers of one size, so multi-GB transfers
+// don't allocate a buffer each and copy in as few syscalls as the size
+// allows.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}}
+}
+
+// copy copies src to dst like io.Copy, through one of the pool's buffers.
+// The writer's ReadFrom and the reader's WriteTo are hidden, as they'd copy
+// in chunks of their own choosing.
+func (p *bufferPool) copy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := p.pool.Get().(*[]byte)
+	defer p.pool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
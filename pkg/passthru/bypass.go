@@ -0,0 +1,24 @@
+package passthru
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+)
+
+// bypassTokenHeader carries the token refresh=1 and nocache=1 need, when
+// one is configured.
+const bypassTokenHeader = "X-Bypass-Token"
+
+// checkBypass returns the error refusing r's param, refresh or nocache,
+// unless allowed is set and r has the bypass token, if one is needed.
+func (c *cache) checkBypass(r *http.Request, param string, allowed bool) error {
+	if !allowed {
+		return &fetchError{http.StatusForbidden, "'" + param + "' is not accepted"}
+	}
+	if c.bypassToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(bypassTokenHeader)), []byte(c.bypassToken)) != 1 {
+		slog.WarnContext(r.Context(), "Cache_bypass_refused", "param", param)
+		return &fetchError{http.StatusUnauthorized, "'" + param + "' requires a valid " + bypassTokenHeader + " header"}
+	}
+	return nil
+}
@@ -0,0 +1,1144 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+// Cache statuses, used as the cache_status metric label.
+const (
+	statusCached    = "cached"
+	statusPeer      = "peer"
+	statusShared    = "shared"
+	statusNotCached = "not_cached"
+
+	// statusUncacheable is a download a hook kept out of the cache
+	statusUncacheable = "uncacheable"
+
+	// statusPassthrough is a miss streamed uncached because storage is
+	// unwritable
+	statusPassthrough = "passthrough"
+
+	// statusStale is an expired entry served while it's downloaded again
+	statusStale = "stale"
+
+	// statusRefreshed is an entry downloaded again for refresh=1, and
+	// statusBypass a download streamed uncached for nocache=1
+	statusRefreshed = "refreshed"
+	statusBypass    = "bypass"
+)
+
+// What happens to a download when whoever asked for it goes away.
+const (
+	disconnectCancel = "cancel" // stop downloading
+	disconnectFinish = "finish" // finish populating the cache in the background
+)
+
+// cache is the on-disk cache of downloaded resources together with
+// everything used to populate it on a miss.
+type cache struct {
+	// endpoint is the external service, one or more comma-separated
+	// instances of it, which upstreams spreads requests over.
+	endpoint   string
+	upstreams  *upstreamPool
+	storageDir string
+	// shutdown is done once the server shuts down, which cancels every
+	// download, and stop shuts it down.
+	shutdown context.Context
+	stop     context.CancelFunc
+	// inFlight counts upstream downloads in progress, for cleanup to back
+	// off and Shutdown to wait for.
+	inFlight *atomic.Int64
+	peers    *peerSet
+	index    *sharedIndex
+	hooks    hookChain
+	client   *http.Client // for cobalt and the resources it points at
+	cdn      *cdnPusher
+	shared   *sharedStorage
+	mirror   *mirror
+	locks    *entryLocks
+	// flights coalesces concurrent misses on the same entry into one
+	// download.
+	flights    *downloadFlights
+	durable    bool
+	disconnect string
+	// integrity keeps corrupted entries from being served.
+	integrity *integrity
+	storage   *storageHealth
+	ttl       *upstreamTTL
+
+	// downloadBuffers are the buffers downloads are copied to disk with,
+	// and serveBuffers the ones for streaming responses that aren't a
+	// stored file, which can't go through sendfile.
+	downloadBuffers *bufferPool
+	serveBuffers    *bufferPool
+	chunks          *chunkedDownloads
+	// retry retries failed upstream requests, and upstreamTimeout fails
+	// downloads that stop sending.
+	retry           upstreamRetry
+	upstreamTimeout time.Duration
+	// resume keeps what arrived of a download that fails, to fetch only the
+	// rest on the next attempt.
+	resume bool
+	// maxRetention is the longest a client may ask for its entry to be
+	// kept (0 if clients can't pick).
+	maxRetention time.Duration
+	// staleWindow is how long past its expiry an entry is still served
+	// while it's downloaded again (0 for not at all), and revalidating has
+	// the hashes of those being downloaded.
+	staleWindow  time.Duration
+	revalidating *sync.Map
+	// allowRefresh lets clients have an entry downloaded again with
+	// refresh=1, and allowNoCache streamed without storing it with
+	// nocache=1. With a bypassToken, either needs it too.
+	allowRefresh bool
+	allowNoCache bool
+	bypassToken  string
+	// maintenance refuses everything that would go upstream while
+	// cache-only mode is on.
+	maintenance *maintenanceMode
+	// videoQuality and disableMetadata are asked of the external service
+	// unless a request asks otherwise.
+	videoQuality    string
+	disableMetadata bool
+	// subtitleLang is the language of the subtitles asset=subtitles serves
+	// unless a request sets subs.
+	subtitleLang string
+	// resolutions keeps the external service's answers for a short while,
+	// shared by every namespace.
+	resolutions *resolveCache
+	// failures keeps the external service's failures for a short while,
+	// so URLs it can't do anything with aren't asked about again and
+	// again.
+	failures *failureCache
+	// merger muxes the streams of local-processing responses, which are
+	// refused when it's nil.
+	merger *mediaProcessor
+	// urls refuses URLs that aren't to be asked for at all.
+	urls *urlPolicy
+	// blocklist refuses the URLs of blocked domains.
+	blocklist *blocklist
+	// domains overrides settings for the URLs of some domains.
+	domains *domainPolicies
+	// apis is the API version each external service endpoint speaks.
+	apis *upstreamAPIs
+	// auth authenticates requests to the external service.
+	auth *upstreamAuth
+	// chaos injects faults into downloads, in chaos mode only.
+	chaos *chaos
+	// progress saves how the downloads of entries are going.
+	progress *progressTracker
+	// keys names entries after their URLs, and previousKeys is how they
+	// were named before, to move them over from (nil if they weren't).
+	keys         *keyHasher
+	previousKeys *keyHasher
+	// access counts the hits of every entry, shared by every namespace.
+	access *accessCounters
+	// top counts the requests for each URL over the last day, also shared.
+	top *requestTop
+	// reporter reports panics and recurring download failures, if set up.
+	reporter *errorReporter
+	// maxEntrySize is the most bytes an entry may take, 0 for no limit.
+	maxEntrySize int64
+	// contentTypes are the media types entries may have, any if empty.
+	contentTypes []string
+	// memory keeps small entries served as plain hits in memory, if set.
+	memory *memoryCache
+	// streamMisses sends a miss to its client as it downloads, rather than
+	// once it's stored.
+	streamMisses bool
+	// upstreamPrecheck asks the media host what media is before
+	// downloading it.
+	upstreamPrecheck bool
+	// readOnly serves hits only and never writes to storage.
+	readOnly bool
+
+	// serveRate caps each response, and fetchRate each download, at this
+	// many bytes per second when positive. egress and ingress, when
+	// non-nil, bound the bandwidth all responses and all downloads take
+	// together.
+	serveRate int
+	fetchRate int
+	egress    *rate.Limiter
+	ingress   *rate.Limiter
+
+	// downloads bounds concurrent downloads when non-nil; each download
+	// holds one slot.
+	downloads *downloadLimiter
+
+	// namespace is mixed into every key of a tenant's cache, and quota caps
+	// what the tenant can store. tenants is every tenant's cache, when
+	// multi-tenancy is on.
+	namespace string
+	quota     *storageQuota
+	tenants   *tenantSet
+	// options are added to every request to the external service, and hosts
+	// is every host profile's cache, when there are any.
+	options map[string]interface{}
+	hosts   *hostRouter
+	// apiKeys is the keys requests need when there's an API keys file.
+	apiKeys *apiKeySet
+}
+
+// cacheEntry locates the files making up a cached resource.
+type cacheEntry struct {
+	hash        string
+	binaryFile  string
+	headersFile string
+}
+
+// entry returns the cache entry for url, named after the URL's hash.
+func (c *cache) entry(url string) cacheEntry {
+	key := url
+	if c.namespace != "" {
+		key = c.namespace + "\x00" + url
+	}
+	e := c.entryForHash(c.keys.hash(key))
+	c.migrate(key, e)
+	return e
+}
+
+// entryForHash returns the cache entry with the given hash.
+func (c *cache) entryForHash(hashStr string) cacheEntry {
+	return cacheEntry{
+		hash:        hashStr,
+		binaryFile:  filepath.Join(c.storageDir, hashStr+".bin"),
+		headersFile: filepath.Join(c.storageDir, hashStr+".headers"),
+	}
+}
+
+// namespaced returns a copy of c storing its entries in storageDir under
+// keys of their own. Peers only serve the root storage directory, so the
+// copy doesn't use them.
+func (c *cache) namespaced(namespace, storageDir string) *cache {
+	nc := *c
+	nc.namespace = namespace
+	nc.storageDir = storageDir
+	nc.peers = nil
+	return &nc
+}
+
+// forRequest returns the cache of the tenant r was authenticated as, or c
+// when multi-tenancy is off.
+func (c *cache) forRequest(r *http.Request) *cache {
+	return c.forContext(r.Context())
+}
+
+// forContext is forRequest for work running under ctx, such as a gRPC call.
+func (c *cache) forContext(ctx context.Context) *cache {
+	if t := tenantFrom(ctx); t != nil {
+		return t.cache
+	}
+	if p := profileFrom(ctx); p != nil {
+		return p.cache
+	}
+	return c
+}
+
+// forTenant returns the cache with the given namespace, that of a tenant or
+// a host profile: c for the empty name, or nil if there's no such tenant or
+// profile (any more). Work done later on behalf of a request, such as a
+// prefetch, records the namespace to find its cache again.
+func (c *cache) forTenant(name string) *cache {
+	if name == "" {
+		return c
+	}
+	if c.tenants.enabled() {
+		if t := c.tenants.byName[name]; t != nil {
+			return t.cache
+		}
+	}
+	if c.hosts.enabled() {
+		if p := c.hosts.byName[name]; p != nil {
+			return p.cache
+		}
+	}
+	return nil
+}
+
+// variant returns the cache entry for a rendition of url derived from the
+// original (a transcode, an audio track, ...), named after both the URL and
+// the variant.
+func (c *cache) variant(url, variant string) cacheEntry {
+	return c.entry(url + "#" + variant)
+}
+
+func (e cacheEntry) exists() bool {
+	return fileExists(e.binaryFile) && fileExists(e.headersFile)
+}
+
+// cached reports whether e is stored and hasn't expired.
+func (c *cache) cached(e cacheEntry) bool {
+	return e.exists() && !c.expired(e)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// fetchError is a failed fetch along with the response the client should get.
+type fetchError struct {
+	status  int
+	message string
+}
+
+func (e *fetchError) Error() string {
+	return e.message
+}
+
+// ensure makes sure url is in the local cache, copying it from a peer or
+// downloading it through the external service if needed. It returns the
+// cache status describing where the entry came from.
+func (c *cache) ensure(ctx context.Context, url string, e cacheEntry) (string, error) {
+	status, err := c.obtain(ctx, url, e)
+	if status == statusUncacheable {
+		discardUncacheable(e)
+		return status, &fetchError{http.StatusUnprocessableEntity, "Resource can't be cached"}
+	}
+	return status, err
+}
+
+// obtain is ensure for callers that serve the entry straight away: an entry
+// a hook kept out of the cache is set aside at e.uncacheable() with
+// statusUncacheable, and the caller must serve it from there and discard it
+// once it has been served.
+func (c *cache) obtain(ctx context.Context, url string, e cacheEntry) (string, error) {
+	key := e.lockKey()
+	_, span := tracer.Start(ctx, "cache.lookup")
+	c.verify(ctx, e)
+	span.SetAttributes(attribute.Bool("cache.hit", c.cached(e)))
+	span.End()
+	for {
+		if c.cached(e) {
+			c.access.hit(e)
+			return statusCached, nil
+		}
+		if c.stale(e) {
+			c.revalidate(ctx, url, e)
+			c.access.hit(e)
+			return statusStale, nil
+		}
+		fl, leader := c.flights.join(key)
+		if leader {
+			return c.lead(ctx, url, e, fl)
+		}
+		select {
+		case <-fl.done:
+		case <-ctx.Done():
+			return statusNotCached, &fetchError{http.StatusServiceUnavailable, "Request canceled"}
+		}
+		// A download that failed fails everyone who waited on it; one that
+		// succeeded is a hit the next time round
+		if !fl.retry && fl.err != nil {
+			return fl.status, fl.err
+		}
+	}
+}
+
+// lead downloads e for obtain as the leader of its flight, landing the
+// flight with the result.
+func (c *cache) lead(ctx context.Context, url string, e cacheEntry, fl *downloadFlight) (string, error) {
+	key := e.lockKey()
+	unlock := c.locks.lock(e)
+	if c.cached(e) {
+		// Stored by another request while we waited for the lock
+		unlock()
+		c.flights.land(key, fl, statusCached, nil, false)
+		c.access.hit(e)
+		return statusCached, nil
+	}
+	if c.disconnect != disconnectFinish {
+		defer unlock()
+		// The flight lands even if fill panics, set to retry, so its
+		// waiters aren't left hanging: they go round again and one of them
+		// downloads the entry instead
+		status, err, retry := statusNotCached, error(nil), true
+		defer func() { c.flights.land(key, fl, status, err, retry) }()
+		status, err = c.fill(ctx, url, e)
+		retry = ctx.Err() != nil || status == statusUncacheable
+		c.reporter.downloadFailed(ctx, url, e, status, err)
+		return status, err
+	}
+
+	// Carry on without the caller if it goes away, so the download isn't
+	// wasted and the next request is a hit
+	type result struct {
+		status string
+		err    error
+	}
+	done := make(chan result)
+	go func() {
+		status, err := c.fill(detachedContext{ctx}, url, e)
+		unlock()
+		c.flights.land(key, fl, status, err, status == statusUncacheable)
+		c.reporter.downloadFailed(detachedContext{ctx}, url, e, status, err)
+		select {
+		case done <- result{status, err}:
+		case <-ctx.Done():
+			switch {
+			case err != nil:
+				detachedDownloadsTotal.WithLabelValues("failed").Inc()
+			case status == statusUncacheable:
+				c.discard(e)
+				detachedDownloadsTotal.WithLabelValues("uncacheable").Inc()
+			default:
+				detachedDownloadsTotal.WithLabelValues("cached").Inc()
+			}
+			slog.InfoContext(ctx, "Detached_download_finished", "hash", e.hash, "status", status, "error", err)
+		}
+	}()
+	select {
+	case res := <-done:
+		return res.status, res.err
+	case <-ctx.Done():
+		slog.InfoContext(ctx, "Download_detached", "hash", e.hash, "error", ctx.Err())
+		return statusNotCached, &fetchError{http.StatusServiceUnavailable, "Request canceled"}
+	}
+}
+
+// indexed consults the shared index on a miss of e. An entry the index has
+// but the shared storage doesn't show yet is waited for, for up to
+// indexSettleTimeout, and one that doesn't show up by then is dropped from
+// the index, having been removed without it hearing of it. It reports
+// whether e is now cached and hasn't expired.
+func (c *cache) indexed(ctx context.Context, e cacheEntry) bool {
+	if !c.index.has(e.hash) {
+		return false
+	}
+	ticker := time.NewTicker(redisPollInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(indexSettleTimeout)
+	for !e.exists() {
+		if time.Now().After(deadline) {
+			slog.InfoContext(ctx, "Stale_index_entry", "hash", e.hash)
+			c.index.remove(e.hash)
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+	return !c.expired(e)
+}
+
+// fill populates the cache with the missing entry e, from a peer or the
+// external service. The caller holds e's write lock.
+func (c *cache) fill(ctx context.Context, url string, e cacheEntry) (string, error) {
+	if c.readOnly {
+		return statusNotCached, errReadOnly
+	}
+
+	// Ask the rest of the cluster before going to the external service,
+	// unless the peer's copy has expired too
+	if c.peers.enabled() && c.peers.fetch(e.hash, e.binaryFile, e.headersFile) && !c.expired(e) {
+		c.mirror.put(c.namespace, e)
+		return statusPeer, nil
+	}
+	if c.shared.fetch(ctx, e) && !c.expired(e) {
+		c.mirror.put(c.namespace, e)
+		return statusShared, nil
+	}
+	if c.indexed(ctx, e) {
+		c.access.hit(e)
+		return statusCached, nil
+	}
+
+	// Make sure no other replica is downloading the same URL into the
+	// shared storage. If one is, wait for it and use its copy, or if it
+	// failed take over, unless yet another replica got there first.
+	for !c.index.acquire(e.hash) {
+		slog.InfoContext(ctx, "Waiting_for_replica_download", "hash", e.hash)
+		waitCtx, cancel := context.WithTimeout(ctx, redisLockTTL)
+		released := c.index.waitForRelease(waitCtx, e.hash)
+		cancel()
+		if ctx.Err() != nil {
+			return statusNotCached, &fetchError{http.StatusServiceUnavailable, "Request canceled"}
+		}
+		if released && c.cached(e) {
+			c.access.hit(e)
+			return statusCached, nil
+		}
+		if !released {
+			// Redis can't be asked, or the lock outlived its TTL, so
+			// download it ourselves as acquire does with Redis down
+			break
+		}
+	}
+	defer c.index.release(e.hash)
+
+	if c.quota.exceeded(c.storageDir) {
+		return statusNotCached, &fetchError{http.StatusInsufficientStorage, "Storage quota exceeded"}
+	}
+
+	release, err := c.downloads.acquire(ctx)
+	if err != nil {
+		return statusNotCached, err
+	}
+	defer release()
+
+	keep, err := c.download(ctx, url, e)
+	if err == nil && !keep {
+		return statusUncacheable, nil
+	}
+	if err == nil {
+		c.cdn.push(e)
+		c.mirror.put(c.namespace, e)
+		c.shared.put(e)
+	}
+	return statusNotCached, err
+}
+
+// detachedContext carries the values of the context it wraps but is never
+// done, for work that should outlive its caller.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// discard removes e from the cache.
+func (c *cache) discard(e cacheEntry) {
+	unlock := c.locks.lock(e)
+	defer unlock()
+	c.remove(e)
+}
+
+// remove deletes e's files. The caller holds e's write lock.
+func (c *cache) remove(e cacheEntry) {
+	os.Remove(e.binaryFile)
+	os.Remove(e.headersFile)
+	os.Remove(cdnMarker(e))
+	c.integrity.forget(e.binaryFile)
+	c.memory.forget(e.binaryFile)
+	c.index.remove(e.hash)
+	c.access.forget(e.hash)
+}
+
+// purge removes e and everything derived from it from the cache, on request.
+// Unlike discard it is replicated to a mirror.
+func (c *cache) purge(e cacheEntry) {
+	unlock := c.locks.lock(e)
+	c.remove(e)
+	os.RemoveAll(hlsDir(c.storageDir, e.hash))
+	unlock()
+	c.mirror.purge(c.namespace, e)
+	c.shared.purge(e)
+	slog.Info("Entry_purged", "hash", e.hash)
+}
+
+// serveHit serves e if it is a fresh hit, and reports whether it did. It's
+// the fast path for plain hits: one open of each file, with the headers
+// read once and the binary's size and time taken from the open file, where
+// the regular path stats both files first and then opens them again. It
+// gives up before writing anything on whatever the regular path handles
+// (misses, expired entries, broken or legacy headers files, binaries yet
+// to be checked, CDN redirects).
+func (c *cache) serveHit(w http.ResponseWriter, r *http.Request, e cacheEntry) bool {
+	if c.cdn.enabled() {
+		return false
+	}
+	// Once it's found, span moves on to serving it
+	_, span := tracer.Start(r.Context(), "cache.lookup")
+	defer func() { span.End() }()
+	if item := c.memory.get(e.binaryFile, time.Now(), c.checksExpiry()); item != nil {
+		span.SetAttributes(attribute.Bool("cache.hit", true), attribute.Bool("cache.memory", true))
+		span.End()
+
+		_, span = tracer.Start(r.Context(), "serve")
+		w = throttle(w, r, c.serveRate, c.egress)
+		setEntryHeaders(w.Header(), item.meta, filenameFrom(r.Context()))
+		slog.InfoContext(r.Context(), "Serving_cached_file", "filename", e.binaryFile, "memory", true)
+		http.ServeContent(w, r, "", lastModified(item.meta, item.info), bytes.NewReader(item.data))
+		return true
+	}
+	unlock := c.locks.rlock(e)
+	defer unlock()
+
+	f, err := os.Open(e.binaryFile)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	data, err := os.ReadFile(e.headersFile)
+	if err != nil || len(data) > maxHeadersFileSize {
+		return false
+	}
+	meta, ok := parseMeta(data)
+	if !ok || len(meta.Headers) == 0 || meta.Version == 0 {
+		return false
+	}
+	now := time.Now()
+	stale := c.checksExpiry() && meta.expired(now)
+	if stale && !c.servableStale(meta, now) {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil || !c.integrity.trusted(e.binaryFile, info, meta) {
+		return false
+	}
+
+	// Keep it in memory for next time, if it's small enough
+	var content io.ReadSeeker = f
+	if c.memory.fits(info.Size()) {
+		data := make([]byte, info.Size())
+		if _, err := io.ReadFull(f, data); err != nil {
+			return false
+		}
+		c.memory.put(e.binaryFile, data, meta, info)
+		content = bytes.NewReader(data)
+	}
+	span.SetAttributes(attribute.Bool("cache.hit", true))
+	span.End()
+
+	if stale {
+		w.Header().Set(cacheHeader, "STALE")
+		c.revalidate(r.Context(), meta.URL, e)
+	}
+
+	_, span = tracer.Start(r.Context(), "serve")
+	w = throttle(w, r, c.serveRate, c.egress)
+	setEntryHeaders(w.Header(), meta, filenameFrom(r.Context()))
+	slog.InfoContext(r.Context(), "Serving_cached_file", "filename", e.binaryFile, "stale", stale)
+	http.ServeContent(w, r, "", lastModified(meta, info), content)
+	return true
+}
+
+// serve sends e to the client, running any BeforeServe hooks, or redirects
+// the client to the CDN if e has been pushed there.
+func (c *cache) serve(w http.ResponseWriter, r *http.Request, e cacheEntry) {
+	if location := c.cdn.location(e); location != "" {
+		cdnRedirectsTotal.Inc()
+		http.Redirect(w, r, location, http.StatusFound)
+		return
+	}
+	_, span := tracer.Start(r.Context(), "serve")
+	defer span.End()
+	unlock := c.locks.rlock(e)
+	defer unlock()
+	serveBinaryFile(c.hooks.wrapServe(throttle(w, r, c.serveRate, c.egress), r), r, e.binaryFile, e.headersFile, !c.readOnly)
+}
+
+// resolve asks the external service where the resource behind url can be
+// downloaded from. The call is abandoned when ctx is done.
+func (c *cache) resolve(ctx context.Context, url string) (*ExternalServiceResponse, error) {
+	if c.readOnly {
+		return nil, errReadOnly
+	}
+	if err := c.maintenance.refuse(); err != nil {
+		return nil, err
+	}
+	if err := c.urls.check(url); err != nil {
+		return nil, err
+	}
+	if err := c.domains.refuse(url); err != nil {
+		return nil, err
+	}
+	if rule := c.blocklist.check(url); rule != nil {
+		return nil, rule.err()
+	}
+
+	key := c.resolveKey(ctx, url)
+	if serviceResp, ok := c.resolutions.get(key); ok {
+		return serviceResp, nil
+	}
+	if fe := c.failures.get(key); fe != nil {
+		return nil, fe
+	}
+	if err := c.domains.allow(url); err != nil {
+		return nil, err
+	}
+	serviceResp, err := c.callExternalService(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	c.resolutions.put(key, serviceResp)
+	return serviceResp, nil
+}
+
+// callExternalService asks the external service for the media behind url,
+// trying the next of its instances while they fail.
+func (c *cache) callExternalService(ctx context.Context, url string) (*ExternalServiceResponse, error) {
+	// Create request payload for the external service
+	requestPayload := requestOptionsFrom(ctx).request(c, url)
+
+	var failure *upstreamFailure
+	var failed string
+	for i, up := range c.upstreams.order(c.endpoint) {
+		if i > 0 {
+			upstreamFailoversTotal.Inc()
+			slog.WarnContext(ctx, "Upstream_failover", "failed", failed, "error", failure, "endpoint", up.endpoint)
+		}
+		failed = up.endpoint
+		serviceResp, err := c.askUpstream(ctx, url, up, requestPayload)
+		if !errors.As(err, &failure) {
+			return serviceResp, err
+		}
+		if ctx.Err() != nil {
+			return nil, failure.err
+		}
+	}
+	if failure.answered {
+		c.failures.put(c.resolveKey(ctx, url), failure.err)
+	}
+	return nil, failure.err
+}
+
+// askUpstream asks the instance up for the media behind url. It fails with
+// an *upstreamFailure if up is what failed, rather than the request.
+func (c *cache) askUpstream(ctx context.Context, url string, up *upstream, requestPayload ExternalServiceRequest) (*ExternalServiceResponse, error) {
+	up.inFlight.Add(1)
+	defer up.inFlight.Add(-1)
+	ctx, span := tracer.Start(ctx, "cobalt.request", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("cobalt.endpoint", up.endpoint)))
+	defer span.End()
+
+	// Speak the endpoint's version of the API, if it has one we know
+	version, major, supported := c.apis.get(up.endpoint).state()
+	if !supported {
+		slog.InfoContext(ctx, "Unsupported_upstream_api", "endpoint", up.endpoint, "version", version)
+		return nil, &fetchError{http.StatusBadGateway, fmt.Sprintf("External service API version %s is not supported", version)}
+	}
+	endpoint, payload := shapeRequest(up.endpoint, major, requestPayload, c.options)
+
+	reqBody, err := json.Marshal(payload)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed_JSON_marshal", "error", err)
+		return nil, &fetchError{http.StatusInternalServerError, "Failed to encode JSON"}
+	}
+
+	authorization, err := c.auth.authorization(ctx, up.endpoint)
+	if err != nil {
+		return nil, &upstreamFailure{err: &fetchError{http.StatusBadGateway, "Failed to authenticate with external service"}}
+	}
+
+	// Increment external service requests metric
+	externalServiceRequestsTotal.Inc()
+
+	// Send POST request to the external service
+	start := time.Now()
+	resp, err := c.retry.do(ctx, "resolve", func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(reqBody))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		setRequestID(ctx, req)
+		injectTrace(ctx, req)
+		c.hooks.beforeUpstream(req)
+
+		slog.InfoContext(ctx, "External_service_request", "method", "POST", "endpoint", endpoint)
+		return c.client.Do(req)
+	})
+	upstreamRequestDuration.WithLabelValues(up.endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "External_service_failure", "error", err)
+		if timedOut(err) {
+			return nil, &upstreamFailure{err: &fetchError{http.StatusGatewayTimeout, "Timed out calling external service"}}
+		}
+		return nil, &upstreamFailure{err: &fetchError{http.StatusInternalServerError, "Failed to call external service"}}
+	}
+	resp.Body = newStallReader(resp.Body, c.upstreamTimeout, "resolve")
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	var serviceResp ExternalServiceResponse
+	if resp.StatusCode != http.StatusOK {
+		slog.InfoContext(ctx, "External_service_non_200", "status_code", resp.StatusCode)
+		if resp.StatusCode == http.StatusUnauthorized {
+			// Not the URL's fault, so not remembered as its failure
+			c.auth.rejected(ctx, up.endpoint)
+			return nil, &upstreamFailure{err: &fetchError{http.StatusBadGateway, "External service refused our credentials"}}
+		}
+		// cobalt explains what's wrong with the URL in an error answer
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&serviceResp)
+		if serviceResp.Status == statusError {
+			return nil, c.refused(ctx, url, &serviceResp)
+		}
+		fe := &fetchError{http.StatusBadGateway, "Error from external service"}
+		if resp.StatusCode >= 500 {
+			return nil, &upstreamFailure{err: fe, answered: true}
+		}
+		return nil, fe
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&serviceResp); err != nil {
+		slog.ErrorContext(ctx, "Failed_JSON_decode", "endpoint", endpoint, "version", version, "error", err)
+		return nil, &fetchError{http.StatusInternalServerError, "Failed to decode JSON response"}
+	}
+	if serviceResp.Status == statusError {
+		return nil, c.refused(ctx, url, &serviceResp)
+	}
+	// Tunnel and redirect responses, and older versions' stream ones, all
+	// have the media at URL
+	if serviceResp.URL == "" && serviceResp.Status != statusLocalProcessing && serviceResp.Status != statusPicker {
+		slog.InfoContext(ctx, "External_service_no_media", "status", serviceResp.Status)
+		return nil, &fetchError{http.StatusBadGateway, "External service returned no media"}
+	}
+
+	return &serviceResp, nil
+}
+
+// refused turns the external service's error answer for url into the
+// error requests for it get, and keeps it for the ones to come.
+func (c *cache) refused(ctx context.Context, url string, serviceResp *ExternalServiceResponse) *fetchError {
+	reason := serviceResp.Text
+	if serviceResp.Error != nil {
+		reason = serviceResp.Error.Code
+	}
+	if reason == "" {
+		reason = "unknown error"
+	}
+	slog.InfoContext(ctx, "External_service_refused", "reason", reason)
+	fe := &fetchError{http.StatusUnprocessableEntity, "External service can't fetch this URL: " + reason}
+	c.failures.put(c.resolveKey(ctx, url), fe)
+	return fe
+}
+
+// download resolves url through the external service and stores the
+// resulting resource and its response headers in the cache. It reports
+// whether the AfterDownload hooks let the resource stay in the cache. The
+// bytes downloaded are charged to the API key in ctx, if any.
+func (c *cache) download(ctx context.Context, url string, e cacheEntry) (bool, error) {
+	// Track the download so cleanup can back off while we're busy
+	c.inFlight.Add(1)
+	downloadsInFlight.Inc()
+	defer func() {
+		c.inFlight.Add(-1)
+		downloadsInFlight.Dec()
+	}()
+
+	// Stop along with the server, even if whoever wants it doesn't
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(c.shutdown, cancel)()
+	ctx = withMediaDownload(ctx)
+
+	progress := c.progress.start(e.hash, url)
+	keep, err := c.store(ctx, url, e, progress)
+	for attempt := 0; errors.Is(err, errDownloadInterrupted) && attempt < c.retry.retries; attempt++ {
+		if !c.retry.wait(ctx, attempt) {
+			break
+		}
+		slog.InfoContext(ctx, "Download_resuming", "attempt", attempt+1)
+		keep, err = c.store(ctx, url, e, progress)
+	}
+	progress.finish(err)
+	return keep, err
+}
+
+// store is download once its progress is being tracked.
+func (c *cache) store(ctx context.Context, url string, e cacheEntry, progress *downloadProgress) (bool, error) {
+	serviceResp, err := c.resolve(ctx, url)
+	if err != nil {
+		return false, err
+	}
+	switch serviceResp.Status {
+	case statusLocalProcessing:
+		return c.mergeStreams(ctx, url, e, serviceResp, progress)
+	case statusPicker:
+		return c.storePicker(ctx, url, e, serviceResp, progress)
+	}
+
+	// Find out what the media is before committing to all of it
+	info := upstreamMedia{size: -1}
+	if c.upstreamPrecheck {
+		info = c.precheck(ctx, serviceResp.URL)
+		if err := c.tooLarge(url, info.size); err != nil {
+			slog.InfoContext(ctx, "Entry_too_large", "url", url, "size", info.size, "content_type", info.contentType)
+			return false, err
+		}
+		if err := c.wrongType(info.contentType); err != nil {
+			slog.InfoContext(ctx, "Entry_wrong_type", "url", url, "content_type", info.contentType)
+			c.resolutions.forget(c.resolveKey(ctx, url))
+			return false, err
+		}
+	}
+
+	// Pick up what an earlier attempt left off, if the media hasn't changed
+	tmp := e.binaryFile + ".tmp"
+	var offset int64
+	var resume *resumeState
+	if c.resume {
+		offset, resume = c.resumable(ctx, serviceResp.URL, e)
+	}
+
+	// Download the binary resource, for as long as whoever wants it does.
+	// Once it's all here, span moves on to writing it to disk
+	_, span := tracer.Start(ctx, "download", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.Int64("download.offset", offset)))
+	defer func() { span.End() }()
+	req, err := http.NewRequestWithContext(ctx, "GET", serviceResp.URL, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed_create_request", "error", err)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to download resource"}
+	}
+	setRequestID(ctx, req)
+	if resume != nil {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	start := time.Now()
+	resourceResp, err := c.retry.do(ctx, "download", func() (*http.Response, error) {
+		return c.client.Do(req)
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Download_failure", "error", err)
+		c.resolutions.forget(c.resolveKey(ctx, url))
+		if timedOut(err) {
+			return false, &fetchError{http.StatusGatewayTimeout, "Timed out downloading resource"}
+		}
+		if errors.Is(err, errPrivateAddress) {
+			return false, &fetchError{http.StatusBadGateway, "Media link leads to a private address"}
+		}
+		return false, &fetchError{http.StatusInternalServerError, "Failed to download resource"}
+	}
+	resourceResp.Body = newStallReader(resourceResp.Body, c.upstreamTimeout, "download")
+	defer resourceResp.Body.Close()
+
+	// An error page is not the media, and storing it would serve it until
+	// it expires
+	if resourceResp.StatusCode < 200 || resourceResp.StatusCode > 299 {
+		slog.ErrorContext(ctx, "Download_failure", "status", resourceResp.StatusCode)
+		c.resolutions.forget(c.resolveKey(ctx, url))
+		return false, &fetchError{http.StatusBadGateway, fmt.Sprintf("Resource download returned %d", resourceResp.StatusCode)}
+	}
+	if resume != nil && !resume.continues(resourceResp, offset) {
+		os.Remove(tmp)
+		os.Remove(tmp + resumeSuffix)
+		if resourceResp.StatusCode != http.StatusOK {
+			slog.ErrorContext(ctx, "Download_failure", "status", resourceResp.StatusCode, "content_range", resourceResp.Header.Get("Content-Range"))
+			return false, &fetchError{http.StatusBadGateway, "Resource download returned the wrong range"}
+		}
+		// The whole media came back instead, which will do
+		offset, resume = 0, nil
+	}
+	if err := decodeContent(resourceResp); err != nil {
+		slog.ErrorContext(ctx, "Download_failure", "content_encoding", resourceResp.Header.Get("Content-Encoding"), "error", err)
+		return false, &fetchError{http.StatusBadGateway, "Resource has a broken Content-Encoding"}
+	}
+	if resourceResp.ContentLength > 0 {
+		if err := c.tooLarge(url, offset+resourceResp.ContentLength); err != nil {
+			os.Remove(tmp)
+			os.Remove(tmp + resumeSuffix)
+			slog.InfoContext(ctx, "Entry_too_large", "url", url, "size", offset+resourceResp.ContentLength)
+			return false, err
+		}
+	}
+	if err := c.wrongType(resourceResp.Header.Get("Content-Type")); err != nil {
+		os.Remove(tmp)
+		os.Remove(tmp + resumeSuffix)
+		slog.InfoContext(ctx, "Entry_wrong_type", "url", url, "content_type", resourceResp.Header.Get("Content-Type"))
+		c.resolutions.forget(c.resolveKey(ctx, url))
+		return false, err
+	}
+	// Store the resource binary under a temporary name, and commit it to
+	// its real one only once all of it has arrived, so a download cut short
+	// (or still running in the background) never looks like an entry
+	chunked := resume == nil && c.chunks.applies(resourceResp)
+	size := resourceResp.ContentLength
+	checksum := sha256.New()
+	var binaryFile *os.File
+	if resume != nil {
+		binaryFile, err = os.OpenFile(tmp, os.O_RDWR, 0)
+		if err == nil {
+			_, err = io.Copy(checksum, io.LimitReader(binaryFile, offset))
+		}
+		if err != nil {
+			if binaryFile != nil {
+				binaryFile.Close()
+			}
+			os.Remove(tmp)
+			os.Remove(tmp + resumeSuffix)
+			slog.ErrorContext(ctx, "Resume_binary_file_error", "filename", tmp, "error", err)
+			return false, &fetchError{http.StatusInternalServerError, "Failed to write binary file"}
+		}
+		size = resume.Size
+		slog.InfoContext(ctx, "Download_resumed", "filename", tmp, "offset", offset, "size", size)
+		downloadsResumedTotal.Inc()
+		resumedBytesTotal.Add(float64(offset))
+	} else {
+		binaryFile, err = os.Create(tmp)
+		if err != nil {
+			slog.ErrorContext(ctx, "Create_binary_file_error", "filename", tmp, "error", err)
+			c.storage.failed(err)
+			return false, errStorageUnwritable
+		}
+		// Chunks arrive out of order, so only a download in one go can be
+		// resumed
+		if c.resume && !chunked {
+			resume = newResumeState(resourceResp)
+		}
+		if resume != nil {
+			if err := resume.save(tmp + resumeSuffix); err != nil {
+				slog.ErrorContext(ctx, "Save_resume_state_error", "filename", tmp+resumeSuffix, "error", err)
+				resume = nil
+			}
+		}
+	}
+	// Without a length of its own, the media likely has the one the
+	// pre-check found
+	expected := size
+	if expected < 0 && resume == nil {
+		expected = info.size
+	}
+	progress.at(offset, expected)
+	if expected > 0 {
+		if err := preallocate(binaryFile, expected); err != nil {
+			binaryFile.Close()
+			os.Remove(tmp)
+			os.Remove(tmp + resumeSuffix)
+			slog.ErrorContext(ctx, "Preallocate_binary_file_error", "filename", tmp, "size", expected, "error", err)
+			return false, &fetchError{http.StatusInsufficientStorage, "Not enough storage space"}
+		}
+	}
+
+	var written int64
+	if chunked {
+		written, err = c.chunks.download(ctx, serviceResp.URL, resourceResp, binaryFile, checksum, c.chaos.writer(progress), c.downloadBuffers, c.fetchLimiters()...)
+	} else {
+		// Send the media on to the client waiting for it as it arrives, if
+		// it's to be streamed and this is all of it from the start
+		out := io.MultiWriter(binaryFile, checksum, progress)
+		if offset == 0 {
+			if stream := missStreamFrom(ctx).start(resourceResp.Header); stream != nil {
+				out = io.MultiWriter(out, stream)
+			}
+		}
+		written, err = c.downloadBuffers.copy(c.chaos.writer(out), c.capSize(url, throttleReader(ctx, resourceResp.Body, c.fetchLimiters()...), offset))
+	}
+	c.quota.add(written)
+	usageFrom(ctx).upstream(written)
+	span.SetAttributes(attribute.Int64("download.bytes", written))
+	endSpan(span, err)
+	_, span = tracer.Start(ctx, "disk.write")
+	if err == nil && size > 0 && offset+written != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, errEntryTooLarge) {
+		binaryFile.Close()
+		os.Remove(tmp)
+		os.Remove(tmp + resumeSuffix)
+		slog.InfoContext(ctx, "Entry_too_large", "url", url, "stored", offset+written)
+		return false, c.tooLarge(url, offset+written)
+	}
+	if err != nil && resume != nil && offset+written > 0 {
+		// Leave what arrived for the next attempt
+		binaryFile.Close()
+		slog.InfoContext(ctx, "Download_interrupted", "filename", tmp, "stored", offset+written, "size", size, "error", err)
+		return false, errDownloadInterrupted
+	}
+	if err == nil {
+		err = syncFile(binaryFile, c.durable)
+	}
+	if closeErr := binaryFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	// Hooks, and the tenant's storage quota, get their say before the media
+	// takes the entry's place, and what they keep out is set aside to be
+	// served once
+	keep := true
+	if err == nil {
+		keep, err = c.afterDownload(url, resourceResp, tmp)
+	}
+	if err == nil && keep {
+		keep = c.quota.keeps(tmp)
+	}
+	if !keep {
+		e = e.uncacheable()
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.binaryFile)
+	}
+	os.Remove(tmp + resumeSuffix)
+	if err != nil {
+		os.Remove(tmp)
+		slog.ErrorContext(ctx, "Write_binary_file_error", "filename", e.binaryFile, "error", err)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to write binary file"}
+	}
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		downloadThroughput.Observe(float64(written) / elapsed)
+	}
+	written += offset
+
+	// A resumed download's headers are those of the response it started
+	// with, not of the range that finished it
+	mediaHeaders := resourceResp.Header
+	if offset > 0 {
+		mediaHeaders = resume.Headers
+	}
+
+	// Store response headers, along with what we know about the entry
+	headers, dropped := sanitizeHeaders(mediaHeaders)
+	if dropped > 0 {
+		slog.InfoContext(ctx, "Stored_headers_truncated", "url", url, "dropped", dropped)
+	}
+	meta := newMeta(headers)
+	meta.URL = url
+	meta.Filename = serviceResp.Filename
+	meta.ContentLength = written
+	meta.Status = http.StatusOK
+	if offset == 0 {
+		meta.Status = resourceResp.StatusCode
+	}
+	meta.Options = requestOptionsFrom(ctx).meta()
+	meta.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	meta.ExpiresAt = c.expiry(url, mediaHeaders, meta.StoredAt)
+	if ttl := retentionFrom(ctx); ttl > 0 {
+		until := meta.StoredAt.Add(ttl)
+		meta.RetainUntil = &until
+	}
+	headersFile, err := os.Create(e.headersFile)
+	if err != nil {
+		slog.ErrorContext(ctx, "Create_headers_file_error", "filename", e.headersFile, "error", err)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to save headers file"}
+	}
+	defer headersFile.Close()
+
+	_, err = headersFile.Write(meta.encode())
+	if err == nil {
+		err = syncFile(headersFile, c.durable)
+	}
+	if err == nil {
+		err = syncPath(c.storageDir, c.durable)
+	}
+	if err != nil {
+		// Without its headers file the entry isn't cached
+		slog.ErrorContext(ctx, "Sync_headers_file_error", "filename", e.headersFile, "error", err)
+		os.Remove(e.headersFile)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to save headers file"}
+	}
+
+	slog.InfoContext(ctx, "Resource_stored", "binary_file", e.binaryFile, "headers_file", e.headersFile)
+
+	if keep && c.index.enabled() {
+		c.index.put(e.hash, indexEntry{URL: url, Size: written, StoredAt: time.Now()})
+	}
+
+	return keep, nil
+}
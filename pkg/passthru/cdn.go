@@ -0,0 +1,220 @@
+package passthru
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// cdnMarkerSuffix names the file recording that an entry has been pushed
+	// to the CDN, next to the entry's .bin and .headers files. It holds the
+	// object's name.
+	cdnMarkerSuffix = ".cdn"
+
+	cdnUploadTimeout = 10 * time.Minute
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+)
+
+// cdnPusher uploads freshly downloaded entries to a CDN origin bucket and
+// redirects clients to the CDN for entries that made it there, so repeat
+// requests don't go through this process at all. A nil cdnPusher means CDN
+// push is off.
+type cdnPusher struct {
+	uploadURL string // objects are PUT to uploadURL/<name>
+	publicURL string // and served from publicURL/<name>
+
+	// S3 credentials. Without them uploads are plain PUTs.
+	region    string
+	accessKey string
+	secretKey string
+
+	// signKey, when set, signs redirects with an expiry signTTL away
+	signKey []byte
+	signTTL time.Duration
+
+	client *http.Client
+	slots  chan struct{}
+}
+
+// newCDNPusher returns a pusher for the CDN settings of cfg, or nil if
+// cfg.CDNUploadURL isn't set.
+func newCDNPusher(cfg Config) (*cdnPusher, error) {
+	if cfg.CDNUploadURL == "" {
+		return nil, nil
+	}
+	if cfg.CDNPublicURL == "" {
+		return nil, fmt.Errorf("a public URL is required")
+	}
+	if (cfg.CDNAccessKey != "") != (cfg.CDNSecretKey != "") || (cfg.CDNAccessKey != "" && cfg.CDNRegion == "") {
+		return nil, fmt.Errorf("signed uploads need a region, an access key and a secret key")
+	}
+	if _, err := url.Parse(cfg.CDNUploadURL); err != nil {
+		return nil, err
+	}
+	workers := cfg.CDNUploadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	return &cdnPusher{
+		uploadURL: strings.TrimSuffix(cfg.CDNUploadURL, "/"),
+		publicURL: strings.TrimSuffix(cfg.CDNPublicURL, "/"),
+		region:    cfg.CDNRegion,
+		accessKey: cfg.CDNAccessKey,
+		secretKey: cfg.CDNSecretKey,
+		signKey:   []byte(cfg.CDNSignKey),
+		signTTL:   cfg.CDNSignTTL,
+		client:    &http.Client{Timeout: cdnUploadTimeout},
+		slots:     make(chan struct{}, workers),
+	}, nil
+}
+
+func (p *cdnPusher) enabled() bool {
+	return p != nil
+}
+
+func cdnMarker(e cacheEntry) string {
+	return strings.TrimSuffix(e.binaryFile, ".bin") + cdnMarkerSuffix
+}
+
+// push uploads e in the background. Once it is up, requests for it are
+// redirected to the CDN.
+func (p *cdnPusher) push(e cacheEntry) {
+	if !p.enabled() {
+		return
+	}
+	go func() {
+		p.slots <- struct{}{}
+		defer func() { <-p.slots }()
+
+		name := e.hash + storedExtension(e.headersFile)
+		if err := p.upload(e, name); err != nil {
+			slog.Error("CDN_upload_failed", "hash", e.hash, "error", err)
+			cdnUploadsTotal.WithLabelValues("failed").Inc()
+			return
+		}
+		if err := os.WriteFile(cdnMarker(e), []byte(name), 0644); err != nil {
+			slog.Error("CDN_marker_error", "hash", e.hash, "error", err)
+			cdnUploadsTotal.WithLabelValues("failed").Inc()
+			return
+		}
+		slog.Info("CDN_upload_finished", "hash", e.hash, "object", name)
+		cdnUploadsTotal.WithLabelValues("uploaded").Inc()
+	}()
+}
+
+func (p *cdnPusher) upload(e cacheEntry, name string) error {
+	headers, err := readStoredHeaders(e.headersFile)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(e.binaryFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", p.uploadURL+"/"+name, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	for _, h := range []string{"Content-Type", "Content-Disposition"} {
+		if v := headers.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+	if p.accessKey != "" {
+		p.signV4(req, time.Now().UTC())
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload answered %s", resp.Status)
+	}
+	return nil
+}
+
+// signV4 signs req for S3 with the pusher's credentials.
+func (p *cdnPusher) signV4(req *http.Request, now time.Time) {
+	signS3(req, p.region, p.accessKey, p.secretKey, now)
+}
+
+// signS3 signs req for S3 with AWS Signature Version 4, leaving the payload
+// unsigned so the file can be streamed. req's query, if any, must already be
+// in canonical form: sorted by key, and with spaces escaped as %20.
+func signS3(req *http.Request, region, accessKey, secretKey string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := date + "/" + region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// location returns the CDN URL of e, or "" if it hasn't been pushed.
+func (p *cdnPusher) location(e cacheEntry) string {
+	if !p.enabled() {
+		return ""
+	}
+	name, err := os.ReadFile(cdnMarker(e))
+	if err != nil {
+		return ""
+	}
+	location := p.publicURL + "/" + string(name)
+	if len(p.signKey) > 0 {
+		u, err := url.Parse(location)
+		if err != nil {
+			return ""
+		}
+		expires := strconv.FormatInt(time.Now().Add(p.signTTL).Unix(), 10)
+		signature := hex.EncodeToString(hmacSHA256(p.signKey, u.Path+"\n"+expires))
+		location += "?expires=" + expires + "&signature=" + signature
+	}
+	return location
+}
@@ -0,0 +1,165 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// chaosSlowDelay is how long every read of a slowed down body waits.
+	chaosSlowDelay = 100 * time.Millisecond
+	// chaosMaxWriteBytes bounds how much a download writes before its
+	// injected write error.
+	chaosMaxWriteBytes = 1 << 20
+)
+
+// chaosRates are the chances, from 0 to 1, of each fault -chaos injects.
+type chaosRates struct {
+	timeout    float64 // an upstream request times out
+	slow       float64 // an upstream body trickles in
+	truncate   float64 // an upstream body ends early
+	writeError float64 // a download fails to write to disk
+}
+
+// chaos injects faults into upstream requests and storage writes at
+// random, so the retry, fallback and cleanup paths can be exercised in
+// staging. It's for development only. A nil chaos injects nothing.
+type chaos struct {
+	rates chaosRates
+}
+
+// newChaos returns the fault injector of cfg, or nil if -chaos is off.
+// Rates given without it are an error rather than silently ignored.
+func newChaos(cfg Config) (*chaos, error) {
+	rates := chaosRates{
+		timeout:    cfg.ChaosTimeoutRate,
+		slow:       cfg.ChaosSlowRate,
+		truncate:   cfg.ChaosTruncateRate,
+		writeError: cfg.ChaosWriteErrorRate,
+	}
+	for _, rate := range []float64{rates.timeout, rates.slow, rates.truncate, rates.writeError} {
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("chaos rates must be between 0 and 1")
+		}
+		if rate > 0 && !cfg.Chaos {
+			return nil, fmt.Errorf("chaos rates require chaos mode to be enabled")
+		}
+	}
+	if !cfg.Chaos {
+		return nil, nil
+	}
+	slog.Info("Chaos_mode_enabled", "timeout_rate", rates.timeout, "slow_rate", rates.slow, "truncate_rate", rates.truncate, "write_error_rate", rates.writeError)
+	return &chaos{rates: rates}, nil
+}
+
+// inject reports whether a fault of the given rate happens this time, and
+// counts it if so.
+func (ch *chaos) inject(fault string, rate float64) bool {
+	if rate <= 0 || rand.Float64() >= rate {
+		return false
+	}
+	chaosInjectionsTotal.WithLabelValues(fault).Inc()
+	return true
+}
+
+// transport returns next with upstream faults injected.
+func (ch *chaos) transport(next http.RoundTripper) http.RoundTripper {
+	if ch == nil {
+		return next
+	}
+	return &chaosTransport{chaos: ch, next: next}
+}
+
+type chaosTransport struct {
+	chaos *chaos
+	next  http.RoundTripper
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.chaos.inject("timeout", t.chaos.rates.timeout) {
+		slog.Info("Chaos_injected", "fault", "timeout", "url", req.URL)
+		return nil, fmt.Errorf("chaos: %w", context.DeadlineExceeded)
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || req.Method == "HEAD" {
+		return resp, err
+	}
+	if t.chaos.inject("slow", t.chaos.rates.slow) {
+		slog.Info("Chaos_injected", "fault", "slow", "url", req.URL)
+		resp.Body = &slowBody{ReadCloser: resp.Body}
+	}
+	if resp.ContentLength > 0 && t.chaos.inject("truncate", t.chaos.rates.truncate) {
+		slog.Info("Chaos_injected", "fault", "truncate", "url", req.URL)
+		resp.Body = &truncatedBody{ReadCloser: resp.Body, left: rand.Int63n(resp.ContentLength)}
+	}
+	return resp, nil
+}
+
+// slowBody waits before every read.
+type slowBody struct {
+	io.ReadCloser
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	time.Sleep(chaosSlowDelay)
+	return b.ReadCloser.Read(p)
+}
+
+// truncatedBody ends after left bytes, whatever Content-Length said.
+type truncatedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+// errChaosWrite is the disk error chaos fails writes with.
+var errChaosWrite = fmt.Errorf("chaos: %w", syscall.EIO)
+
+// writer returns w failing, now and then, part way through a download as
+// a disk would.
+func (ch *chaos) writer(w io.Writer) io.Writer {
+	if ch == nil || !ch.inject("write_error", ch.rates.writeError) {
+		return w
+	}
+	slog.Info("Chaos_injected", "fault", "write_error")
+	return &failingWriter{w: w, left: rand.Int63n(chaosMaxWriteBytes)}
+}
+
+// failingWriter fails once left more bytes have been written to it, from
+// however many goroutines.
+type failingWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	left int64
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if int64(len(p)) > fw.left {
+		n, _ := fw.w.Write(p[:fw.left])
+		fw.left = 0
+		return n, errChaosWrite
+	}
+	n, err := fw.w.Write(p)
+	fw.left -= int64(n)
+	return n, err
+}
@@ -0,0 +1,165 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// chunkedDownloads splits big downloads from CDNs that serve ranges into
+// chunks fetched in parallel, which gets multi-GB files over high-latency
+// links much faster than one connection does. A nil chunkedDownloads
+// downloads everything in one go.
+type chunkedDownloads struct {
+	chunkSize   int64
+	parallelism int
+	retry       upstreamRetry
+	stall       time.Duration
+	client      *http.Client
+}
+
+func newChunkedDownloads(chunkSize int64, parallelism int, retry upstreamRetry, stall time.Duration, client *http.Client) *chunkedDownloads {
+	if chunkSize <= 0 || parallelism <= 1 {
+		return nil
+	}
+	return &chunkedDownloads{chunkSize: chunkSize, parallelism: parallelism, retry: retry, stall: stall, client: client}
+}
+
+// applies reports whether the download answered with resp is worth
+// splitting into chunks.
+func (cd *chunkedDownloads) applies(resp *http.Response) bool {
+	return cd != nil &&
+		resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		resp.Header.Get("Content-Encoding") == "" &&
+		!resp.Uncompressed &&
+		resp.ContentLength > cd.chunkSize
+}
+
+// download writes the media at mediaURL to f, in chunks fetched in parallel.
+// The first chunk comes from resp, the response that's already under way;
+// the others are range requests. The checksum is of the whole file once it
+// is assembled, and progress counts the bytes as they arrive.
+func (cd *chunkedDownloads) download(ctx context.Context, mediaURL string, resp *http.Response, f *os.File, checksum hash.Hash, progress io.Writer, buffers *bufferPool, limiters ...*rate.Limiter) (int64, error) {
+	size := resp.ContentLength
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var written int64
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	fetched := func(n int64) {
+		mu.Lock()
+		written += n
+		mu.Unlock()
+	}
+
+	offsets := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < cd.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range offsets {
+				n, err := cd.fetchChunk(ctx, mediaURL, start, min64(start+cd.chunkSize, size)-1, f, progress, buffers, limiters...)
+				fetched(n)
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	// Meanwhile the first chunk comes off the response we have
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		n, err := buffers.copy(io.MultiWriter(io.NewOffsetWriter(f, 0), progress), io.LimitReader(throttleReader(ctx, resp.Body, limiters...), cd.chunkSize))
+		fetched(n)
+		if err == nil && n != cd.chunkSize {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			fail(err)
+		}
+		resp.Body.Close()
+	}()
+
+feed:
+	for start := cd.chunkSize; start < size; start += cd.chunkSize {
+		select {
+		case offsets <- start:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(offsets)
+	wg.Wait()
+	if firstErr != nil {
+		return written, firstErr
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return written, err
+	}
+	if _, err := io.Copy(checksum, f); err != nil {
+		return written, err
+	}
+	slog.InfoContext(ctx, "Chunked_download_done", "size", size, "chunks", (size+cd.chunkSize-1)/cd.chunkSize)
+	return written, nil
+}
+
+// fetchChunk writes bytes first to last of the media at mediaURL to f at
+// the same offset.
+func (cd *chunkedDownloads) fetchChunk(ctx context.Context, mediaURL string, first, last int64, f *os.File, progress io.Writer, buffers *bufferPool, limiters ...*rate.Limiter) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", mediaURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	setRequestID(ctx, req)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, last))
+	resp, err := cd.retry.do(ctx, "download", func() (*http.Response, error) {
+		return cd.client.Do(req)
+	})
+	if err != nil {
+		return 0, err
+	}
+	resp.Body = newStallReader(resp.Body, cd.stall, "download")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("range request for bytes %d-%d returned %d", first, last, resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", first, last)) {
+		return 0, fmt.Errorf("range request for bytes %d-%d returned range %q", first, last, resp.Header.Get("Content-Range"))
+	}
+
+	n, err := buffers.copy(io.MultiWriter(io.NewOffsetWriter(f, first), progress), io.LimitReader(throttleReader(ctx, resp.Body, limiters...), last-first+1))
+	if err == nil && n != last-first+1 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,712 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cleanupInterval      = 10 * time.Minute
+	cleanupRetryInterval = time.Minute
+
+	// cleanupBatchSize is how many directory entries a cleanup pass reads
+	// at a time.
+	cleanupBatchSize = 1000
+
+	// trashDirName is the storage subdirectory expired files are moved to
+	// when two-phase deletion is enabled.
+	trashDirName = ".trash"
+
+	// maxReportErrors bounds how many error messages a single cleanup report
+	// keeps; the total is always available in ErrorCount.
+	maxReportErrors = 10
+)
+
+// pauseWindow is a daily time-of-day range during which cleanup is skipped.
+// Windows where end is before start wrap around midnight.
+type pauseWindow struct {
+	start, end time.Duration
+}
+
+func (pw pauseWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if pw.start <= pw.end {
+		return offset >= pw.start && offset < pw.end
+	}
+	return offset >= pw.start || offset < pw.end
+}
+
+func (pw pauseWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", int(pw.start.Hours()), int(pw.start.Minutes())%60, int(pw.end.Hours()), int(pw.end.Minutes())%60)
+}
+
+// parsePauseWindows parses a comma-separated list of HH:MM-HH:MM windows.
+func parsePauseWindows(spec string) ([]pauseWindow, error) {
+	var windows []pauseWindow
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid pause window %q, expected HH:MM-HH:MM", part)
+		}
+		start, err := parseTimeOfDay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, pauseWindow{start: start, end: end})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %v", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// cleanupController decides whether a scheduled cleanup pass may run. Cleanup
+// can be paused manually through the admin API, skipped during configured
+// daily windows, or deferred while too many downloads are in flight.
+type cleanupController struct {
+	mu          sync.Mutex
+	paused      bool
+	pausedUntil time.Time
+
+	windows     []pauseWindow
+	maxInFlight int64
+	// inFlight counts the server's upstream downloads in progress, which
+	// cleanup stays out of the way of.
+	inFlight *atomic.Int64
+
+	historySize int
+	history     []cleanupReport
+
+	// lock, if set, elects the one replica sharing the storage that cleans
+	// up; leader is whether this one was at the last attempt.
+	lock   *cleanupLock
+	leader bool
+}
+
+// cleanupReport summarises a single cleanup pass.
+type cleanupReport struct {
+	Start          time.Time     `json:"start"`
+	Duration       time.Duration `json:"duration"`
+	FilesRemoved   int           `json:"filesRemoved"`
+	FilesTrashed   int           `json:"filesTrashed"`
+	BytesReclaimed int64         `json:"bytesReclaimed"`
+	EntriesEvicted int           `json:"entriesEvicted"`
+	ErrorCount     int           `json:"errorCount"`
+	Errors         []string      `json:"errors,omitempty"`
+}
+
+func (r *cleanupReport) addError(err error) {
+	r.ErrorCount++
+	if len(r.Errors) < maxReportErrors {
+		r.Errors = append(r.Errors, err.Error())
+	}
+}
+
+// merge adds the counts and errors of other, a report on part of the same
+// pass, to r.
+func (r *cleanupReport) merge(other cleanupReport) {
+	r.FilesRemoved += other.FilesRemoved
+	r.FilesTrashed += other.FilesTrashed
+	r.BytesReclaimed += other.BytesReclaimed
+	r.EntriesEvicted += other.EntriesEvicted
+	r.ErrorCount += other.ErrorCount
+	for _, msg := range other.Errors {
+		if len(r.Errors) < maxReportErrors {
+			r.Errors = append(r.Errors, msg)
+		}
+	}
+}
+
+// record appends a report to the history, dropping the oldest once more than
+// historySize reports are kept.
+func (c *cleanupController) record(report cleanupReport) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.historySize <= 0 {
+		return
+	}
+	c.history = append(c.history, report)
+	if len(c.history) > c.historySize {
+		c.history = append([]cleanupReport(nil), c.history[len(c.history)-c.historySize:]...)
+	}
+}
+
+// recentReports returns the kept reports, newest first.
+func (c *cleanupController) recentReports() []cleanupReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	reports := make([]cleanupReport, 0, len(c.history))
+	for i := len(c.history) - 1; i >= 0; i-- {
+		reports = append(reports, c.history[i])
+	}
+	return reports
+}
+
+// deferReason returns a non-empty reason when cleanup should not run now.
+func (c *cleanupController) deferReason(now time.Time) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.paused {
+		if c.pausedUntil.IsZero() || now.Before(c.pausedUntil) {
+			return "paused"
+		}
+		c.paused = false
+		c.pausedUntil = time.Time{}
+	}
+
+	for _, window := range c.windows {
+		if window.contains(now) {
+			return "schedule"
+		}
+	}
+
+	if c.maxInFlight > 0 && c.inFlight.Load() > c.maxInFlight {
+		return "load"
+	}
+
+	return ""
+}
+
+// pause stops cleanup until resume is called, or for the given duration if it
+// is positive.
+func (c *cleanupController) pause(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.paused = true
+	c.pausedUntil = time.Time{}
+	if d > 0 {
+		c.pausedUntil = time.Now().Add(d)
+	}
+}
+
+func (c *cleanupController) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.paused = false
+	c.pausedUntil = time.Time{}
+}
+
+type cleanupStatus struct {
+	Paused            bool       `json:"paused"`
+	PausedUntil       *time.Time `json:"pausedUntil,omitempty"`
+	PauseWindows      []string   `json:"pauseWindows"`
+	MaxInFlight       int64      `json:"maxInFlight"`
+	InFlightDownloads int64      `json:"inFlightDownloads"`
+	DeferReason       string     `json:"deferReason,omitempty"`
+	Lock              string     `json:"lock,omitempty"`
+	Leader            bool       `json:"leader"`
+}
+
+func (c *cleanupController) status() cleanupStatus {
+	reason := c.deferReason(time.Now())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := cleanupStatus{
+		Paused:            c.paused,
+		PauseWindows:      []string{},
+		MaxInFlight:       c.maxInFlight,
+		InFlightDownloads: c.inFlight.Load(),
+		DeferReason:       reason,
+		Leader:            c.leader || c.lock == nil,
+	}
+	if c.lock != nil {
+		status.Lock = c.lock.kind
+	}
+	if !c.pausedUntil.IsZero() {
+		until := c.pausedUntil
+		status.PausedUntil = &until
+	}
+	for _, window := range c.windows {
+		status.PauseWindows = append(status.PauseWindows, window.String())
+	}
+	return status
+}
+
+// elect takes or renews the cleanup lease, returning whether this replica
+// leads cleanup.
+func (c *cleanupController) elect() bool {
+	leader := c.lock.acquire()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.leader = leader
+	return leader
+}
+
+func handleCleanupStatus(c *cleanupController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.status())
+	}
+}
+
+// handleCleanupPause pauses cleanup, optionally for a limited time given by
+// the "for" query parameter (e.g. ?for=2h).
+func handleCleanupPause(c *cleanupController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d time.Duration
+		if v := r.URL.Query().Get("for"); v != "" {
+			var err error
+			d, err = time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "'for' must be a positive duration", http.StatusBadRequest)
+				return
+			}
+		}
+		c.pause(d)
+		slog.InfoContext(r.Context(), "Cleanup_paused", "for", d)
+		writeJSON(w, http.StatusOK, c.status())
+	}
+}
+
+func handleCleanupHistory(c *cleanupController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, c.recentReports())
+	}
+}
+
+func handleCleanupResume(c *cleanupController) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.resume()
+		slog.InfoContext(r.Context(), "Cleanup_resumed")
+		writeJSON(w, http.StatusOK, c.status())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("Failed_JSON_encode", "error", err)
+	}
+}
+
+// cleaner runs cleanup passes over a storage directory and those of its
+// tenants.
+type cleaner struct {
+	storageDir string
+	trashGrace time.Duration
+	index      *sharedIndex
+	shared     *sharedStorage
+	access     *accessCounters
+	locks      *entryLocks
+	tracker    *storageTracker
+
+	// ttl is the age files expire at, and once the entries take up more
+	// than maxBytes (0 for no limit) the least recently served go too.
+	ttl      time.Duration
+	maxBytes int64
+
+	// workers stat and expire the files of a directory this many at a
+	// time, and a pass gives up once it has run into maxErrors errors (0
+	// for no limit), which usually means the disk is in trouble.
+	workers   int
+	maxErrors int
+}
+
+// startFileCleanupRoutine runs cleanup passes until ctx is done.
+func startFileCleanupRoutine(ctx context.Context, controller *cleanupController, cl *cleaner) {
+	// The size metrics are kept up to date by the passes, from the start
+	cl.measureStorage()
+	timer := time.NewTimer(cleanupInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if reason := controller.deferReason(time.Now()); reason != "" {
+			slog.Info("File_cleanup_deferred", "reason", reason)
+			cleanupsDeferredTotal.WithLabelValues(reason).Inc()
+			timer.Reset(cleanupRetryInterval)
+			continue
+		}
+		if !controller.elect() {
+			slog.Info("File_cleanup_deferred", "reason", "follower")
+			cleanupsDeferredTotal.WithLabelValues("follower").Inc()
+			cl.measureStorage()
+			timer.Reset(cleanupInterval)
+			continue
+		}
+
+		slog.Info("Starting_file_cleanup")
+		cleanupsTotal.Inc() // Increment cleanups metric
+		report := cl.cleanupOldFiles()
+		controller.record(report)
+		slog.Info("File_cleanup_finished", "duration", report.Duration, "files_removed", report.FilesRemoved, "files_trashed", report.FilesTrashed, "entries_evicted", report.EntriesEvicted, "bytes_reclaimed", report.BytesReclaimed, "errors", report.ErrorCount)
+		timer.Reset(cleanupInterval)
+	}
+}
+
+// cleanupOldFiles removes expired files from the storage directory and every
+// tenant's storage directory, and then evicts entries if they still take up
+// too much space. When trashGrace is positive, expired files are
+// first moved into the trash directory and only deleted once they have sat
+// there for trashGrace.
+//
+// Entries whose binary goes away are dropped from the shared index, if any,
+// and files in the shared storage past the TTL are deleted from it too.
+// With a tracker only the files it has seen age past the TTL are looked at.
+func (cl *cleaner) cleanupOldFiles() (report cleanupReport) {
+	report.Start = time.Now()
+	defer func() { report.Duration = time.Since(report.Start) }()
+
+	for _, dir := range storageDirs(cl.storageDir) {
+		if cl.exhausted(&report) {
+			slog.Info("File_cleanup_aborted", "errors", report.ErrorCount)
+			break
+		}
+		cl.cleanupDir(dir, &report)
+	}
+	if !cl.exhausted(&report) {
+		cl.sweepShared(&report)
+	}
+	if cl.maxBytes > 0 && !cl.exhausted(&report) {
+		cl.evictLeastRecentlyUsed(&report)
+	} else {
+		cl.measureStorage()
+	}
+	return report
+}
+
+// sweepShared deletes the files in the shared storage that have outlived
+// the TTL.
+func (cl *cleaner) sweepShared(report *cleanupReport) {
+	if !cl.shared.enabled() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sharedStorageTimeout)
+	defer cancel()
+	deleted, err := cl.shared.sweep(ctx, time.Now().Add(-cl.ttl))
+	sharedStorageRequestsTotal.WithLabelValues("sweep", "done").Add(float64(deleted))
+	if err != nil {
+		slog.Error("Shared_storage_error", "op", "sweep", "error", err)
+		sharedStorageRequestsTotal.WithLabelValues("sweep", "error").Inc()
+		report.addError(err)
+	}
+	if deleted > 0 {
+		slog.Info("Shared_storage_swept", "files", deleted)
+	}
+}
+
+// exhausted reports whether the pass behind report has run into too many
+// errors to go on.
+func (cl *cleaner) exhausted(report *cleanupReport) bool {
+	return cl.maxErrors > 0 && report.ErrorCount >= cl.maxErrors
+}
+
+// cleanupDir runs a cleanup pass over a single storage directory.
+func (cl *cleaner) cleanupDir(storageDir string, report *cleanupReport) {
+	// Empty the trash first so files trashed by this pass get their full grace
+	// period. This also drains a leftover trash directory once trashing has
+	// been switched off.
+	trashDir := filepath.Join(storageDir, trashDirName)
+	if _, err := os.Stat(trashDir); err == nil {
+		cl.removeExpiredFiles(trashDir, time.Now().Add(-cl.trashGrace), "", nil, nil, nil, report)
+	}
+
+	moveTo := ""
+	if cl.trashGrace > 0 {
+		if err := os.MkdirAll(trashDir, os.ModePerm); err != nil {
+			slog.Error("Create_trash_directory_error", "dir", trashDir, "error", err)
+			report.addError(err)
+			return
+		}
+		moveTo = trashDir
+	}
+
+	cutoff := time.Now().Add(-cl.ttl)
+	cl.removeExpiredFiles(storageDir, cutoff, moveTo, cl.index, cl.access, cl.locks, report)
+	cl.locks.removeStaleLockFiles(storageDir, cutoff, report)
+
+	// HLS renditions can be made again from their entry, so they skip the
+	// trash
+	hlsRoot := filepath.Join(storageDir, hlsDirName)
+	if _, err := os.Stat(hlsRoot); err == nil {
+		removeExpiredDirs(hlsRoot, cutoff, report)
+	}
+}
+
+// removeExpiredDirs deletes the subdirectories of dir, and everything in
+// them, last modified before cutoff.
+func removeExpiredDirs(dir string, cutoff time.Time, report *cleanupReport) {
+	dirs, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Read_storage_directory_error", "dir", dir, "error", err)
+		report.addError(err)
+		return
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dirPath := filepath.Join(dir, d.Name())
+		info, err := d.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+
+		size := dirSize(dirPath)
+		if err := os.RemoveAll(dirPath); err != nil {
+			slog.Error("File_deletion_error", "file", dirPath, "error", err)
+			report.addError(err)
+			continue
+		}
+		slog.Info("File_deleted", "file", dirPath)
+		filesCleanedTotal.Inc()
+		report.FilesRemoved++
+		report.BytesReclaimed += size
+	}
+}
+
+// dirSize adds up the sizes of the regular files in dir and its
+// subdirectories.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// removeExpiredFiles deletes the regular files in dir last modified before
+// cutoff, or moves them into trashDir if it is set. Files of entries that are
+// locked, here or (with a shared index) by another replica's download, are
+// skipped, and with access counters popular entries get longer.
+func (cl *cleaner) removeExpiredFiles(dir string, cutoff time.Time, trashDir string, index *sharedIndex, access *accessCounters, locks *entryLocks, report *cleanupReport) {
+	// Each worker keeps its own report, added to report once they're done;
+	// errCount is the pass's running error count for the error budget
+	var errCount atomic.Int64
+	errCount.Store(int64(report.ErrorCount))
+	names := make(chan string)
+	reports := make([]cleanupReport, cl.workers)
+	var wg sync.WaitGroup
+	for i := range reports {
+		wg.Add(1)
+		go func(workerReport *cleanupReport) {
+			defer wg.Done()
+			for name := range names {
+				before := workerReport.ErrorCount
+				expireCandidate(dir, name, cutoff, trashDir, index, access, locks, cl.tracker != nil, workerReport)
+				errCount.Add(int64(workerReport.ErrorCount - before))
+			}
+		}(&reports[i])
+	}
+
+	err := cl.tracker.eachCandidate(dir, cutoff, func(name string) bool {
+		if cl.maxErrors > 0 && errCount.Load() >= int64(cl.maxErrors) {
+			return false
+		}
+		names <- name
+		return true
+	})
+	close(names)
+	wg.Wait()
+	for _, workerReport := range reports {
+		report.merge(workerReport)
+	}
+	if err != nil {
+		slog.Error("Read_storage_directory_error", "dir", dir, "error", err)
+		report.addError(err)
+	}
+}
+
+// expireCandidate expires the file name in dir if it was last modified
+// before cutoff, as removeExpiredFiles does. Files the tracker knew of that
+// have gone since aren't an error.
+func expireCandidate(dir, name string, cutoff time.Time, trashDir string, index *sharedIndex, access *accessCounters, locks *entryLocks, tracked bool, report *cleanupReport) {
+	filePath := filepath.Join(dir, name)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		if tracked && os.IsNotExist(err) {
+			return
+		}
+		slog.Error("File_stat_error", "file", filePath, "error", err)
+		report.addError(err)
+		return
+	}
+
+	if !info.ModTime().Before(cutoff) {
+		return
+	}
+
+	// Popular entries are kept longer than their age alone allows
+	base, _, _ := strings.Cut(name, ".")
+	if bonus := access.bonus(base); bonus > 0 && !info.ModTime().Before(cutoff.Add(-bonus)) {
+		return
+	}
+
+	// Clients may have asked for the entry to be kept longer
+	if meta, err := readMeta(filepath.Join(dir, base+".headers")); err == nil && meta.retained(time.Now()) {
+		return
+	}
+
+	// Leave entries being stored, deleted or served alone until the next
+	// pass
+	unlock, ok := locks.tryLock(filepath.Join(dir, base))
+	if !ok {
+		slog.Info("File_cleanup_skipped_in_use", "file", filePath)
+		return
+	}
+	defer unlock()
+	if index.locked(base) {
+		slog.Info("File_cleanup_skipped_in_use", "file", filePath)
+		return
+	}
+	expireFile(filePath, info, trashDir, index, report)
+	if strings.HasSuffix(name, ".bin") && !fileExists(filePath) {
+		access.forget(base)
+		if filepath.Base(dir) != trashDirName {
+			evictionsTotal.WithLabelValues("ttl").Inc()
+		}
+	}
+}
+
+// readDirBatched calls fn with the entries of dir, cleanupBatchSize at a
+// time, until fn returns false, so huge directories are never held in memory
+// whole. Entries come in directory order, and files removed by fn don't upset
+// the iteration.
+func readDirBatched(dir string, fn func(files []os.DirEntry) bool) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	for {
+		files, err := d.ReadDir(cleanupBatchSize)
+		if len(files) > 0 && !fn(files) {
+			return nil
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// expireFile deletes the expired file at filePath, or moves it into trashDir
+// if it is set.
+func expireFile(filePath string, info os.FileInfo, trashDir string, index *sharedIndex, report *cleanupReport) {
+	if trashDir != "" {
+		if err := moveFileTouched(filePath, filepath.Join(trashDir, info.Name())); err != nil {
+			slog.Error("File_trash_error", "file", filePath, "error", err)
+			report.addError(err)
+		} else {
+			slog.Info("File_trashed", "file", filePath)
+			filesTrashedTotal.Inc()
+			report.FilesTrashed++
+			removeFromIndex(index, info.Name())
+		}
+		return
+	}
+
+	if err := os.Remove(filePath); err != nil {
+		slog.Error("File_deletion_error", "file", filePath, "error", err)
+		report.addError(err)
+	} else {
+		slog.Info("File_deleted", "file", filePath)
+		filesCleanedTotal.Inc() // Increment files cleaned metric
+		report.FilesRemoved++
+		report.BytesReclaimed += info.Size()
+		removeFromIndex(index, info.Name())
+	}
+}
+
+// removeFromIndex drops the entry whose binary is fileName from the index.
+func removeFromIndex(index *sharedIndex, fileName string) {
+	if hashStr := strings.TrimSuffix(fileName, ".bin"); hashStr != fileName {
+		index.remove(hashStr)
+	}
+}
+
+// moveFileTouched renames src to dst and resets its modification time, so the
+// file's age is measured from the move.
+func moveFileTouched(src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	now := time.Now()
+	return os.Chtimes(dst, now, now)
+}
+
+// restoreTrash moves every file in the trash of storageDir, and of each
+// tenant's storage directory, back where it came from. Restored files start
+// a fresh TTL.
+func restoreTrash(storageDir string) (int, error) {
+	restored := 0
+	for _, dir := range storageDirs(storageDir) {
+		trashDir := filepath.Join(dir, trashDirName)
+		files, err := os.ReadDir(trashDir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return restored, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			if err := moveFileTouched(filepath.Join(trashDir, file.Name()), filepath.Join(dir, file.Name())); err != nil {
+				return restored, err
+			}
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+func handleTrashRestore(storageDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		restored, err := restoreTrash(storageDir)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Trash_restore_error", "restored", restored, "error", err)
+			http.Error(w, "Failed to restore trash", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Trash_restored", "restored", restored)
+		writeJSON(w, http.StatusOK, map[string]int{"restored": restored})
+	}
+}
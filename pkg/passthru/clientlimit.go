@@ -0,0 +1,126 @@
+package passthru
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientLimitPruneInterval is how often clients whose bucket has filled up
+// again are forgotten.
+const clientLimitPruneInterval = time.Minute
+
+// clientLimiter caps the request rate of each client IP with a token bucket
+// of its own, so whoever finds the instance can't have it download
+// whatever they like as fast as it will. A nil clientLimiter limits no one.
+type clientLimiter struct {
+	rate           rate.Limit
+	burst          int
+	trustForwarded bool
+
+	mu      sync.Mutex
+	clients map[string]*clientBucket
+}
+
+type clientBucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newClientLimiter returns a limiter allowing each client perSecond
+// requests a second, in bursts of up to burst, or nil if perSecond is 0.
+func newClientLimiter(perSecond float64, burst int, trustForwarded bool) *clientLimiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &clientLimiter{
+		rate:           rate.Limit(perSecond),
+		burst:          burst,
+		trustForwarded: trustForwarded,
+		clients:        make(map[string]*clientBucket),
+	}
+}
+
+func (l *clientLimiter) enabled() bool {
+	return l != nil
+}
+
+// allow takes a token from client's bucket at now, and if there's none
+// returns how long until there is.
+func (l *clientLimiter) allow(client string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	b := l.clients[client]
+	if b == nil {
+		b = &clientBucket{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.clients[client] = b
+	}
+	b.lastSeen = now
+	l.mu.Unlock()
+
+	r := b.limiter.ReserveN(now, 1)
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return delay, false
+	}
+	return 0, true
+}
+
+// start forgets clients that have been away long enough for their bucket
+// to be full again, so clients that come once don't stay in memory, until
+// ctx is done.
+func (l *clientLimiter) start(ctx context.Context) {
+	if !l.enabled() {
+		return
+	}
+	refill := time.Duration(float64(l.burst) / float64(l.rate) * float64(time.Second))
+	go func() {
+		ticker := time.NewTicker(clientLimitPruneInterval)
+		defer ticker.Stop()
+		for {
+			var now time.Time
+			select {
+			case <-ctx.Done():
+				return
+			case now = <-ticker.C:
+			}
+			l.mu.Lock()
+			for client, b := range l.clients {
+				if now.Sub(b.lastSeen) >= refill {
+					delete(l.clients, client)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+}
+
+// protect wraps next so clients over their rate get a 429 with a
+// Retry-After instead. Peer-to-peer requests are left alone, as they are
+// by the abuse guard.
+func (l *clientLimiter) protect(next http.Handler) http.Handler {
+	if !l.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/internal/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if delay, ok := l.allow(clientIP(r, l.trustForwarded), time.Now()); !ok {
+			rateLimitedTotal.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too many requests, slow down", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
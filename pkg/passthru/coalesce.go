@@ -0,0 +1,57 @@
+package passthru
+
+import "sync"
+
+// downloadFlights coalesces concurrent misses on the same entry: the first
+// request to miss leads the download, and every request missing it while
+// it's under way waits for the leader and gets its result, instead of
+// asking the external service again once it has the entry's lock.
+type downloadFlights struct {
+	mu      sync.Mutex
+	flights map[string]*downloadFlight
+}
+
+// downloadFlight is one download under way, and once done is closed, how
+// it ended.
+type downloadFlight struct {
+	done    chan struct{}
+	waiters int
+	status  string
+	err     error
+	// retry is set when the result isn't one to share: the leader was
+	// canceled, or the entry was kept out of the cache and is the leader's
+	// to discard. Whoever waited downloads it again themselves.
+	retry bool
+}
+
+func newDownloadFlights() *downloadFlights {
+	return &downloadFlights{flights: make(map[string]*downloadFlight)}
+}
+
+// join returns the flight of the entry with key, and whether the caller
+// leads it, starting it if there's none under way. The leader must land it.
+func (f *downloadFlights) join(key string) (*downloadFlight, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if fl := f.flights[key]; fl != nil {
+		fl.waiters++
+		return fl, false
+	}
+	fl := &downloadFlight{done: make(chan struct{})}
+	f.flights[key] = fl
+	return fl, true
+}
+
+// land ends the flight of the entry with key with status and err, handing
+// them to whoever waited on it.
+func (f *downloadFlights) land(key string, fl *downloadFlight, status string, err error, retry bool) {
+	f.mu.Lock()
+	delete(f.flights, key)
+	waiters := fl.waiters
+	f.mu.Unlock()
+	fl.status, fl.err, fl.retry = status, err, retry
+	close(fl.done)
+	if waiters > 0 {
+		coalescedRequestsTotal.Add(float64(waiters))
+	}
+}
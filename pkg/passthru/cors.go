@@ -0,0 +1,116 @@
+package passthru
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// corsMaxAge is how long, in seconds, browsers may keep a preflight's
+// answer.
+const corsMaxAge = "600"
+
+// corsExposedHeaders are the response headers scripts on allowed origins
+// get to read, besides the ones browsers always let them.
+var corsExposedHeaders = strings.Join([]string{
+	cacheHeader, cacheKeyHeader, requestIDHeader, "Content-Disposition",
+	"Content-Length", "Content-Range", "Accept-Ranges", "ETag", "Retry-After",
+}, ", ")
+
+// corsPolicy lets scripts on other origins, such as a browser frontend,
+// call the API: it answers their preflights and marks responses to them as
+// readable. An origin is a scheme, host and port (https://example.com), *
+// for any, or one with a wildcard first label (https://*.example.com) for
+// any subdomain. A nil corsPolicy lets no other origin in.
+type corsPolicy struct {
+	origins []string
+	any     bool
+	methods string
+	headers string
+}
+
+// newCORSPolicy reads comma-separated lists of the allowed origins, and
+// of the methods and request headers they may use. It returns nil without
+// origins.
+func newCORSPolicy(origins, methods, headers string) (*corsPolicy, error) {
+	p := &corsPolicy{methods: methods, headers: headers}
+	for _, origin := range strings.Split(origins, ",") {
+		origin = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			p.any = true
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "*.", "", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("%q must be an origin such as https://example.com", origin)
+		}
+		p.origins = append(p.origins, origin)
+	}
+	if !p.any && len(p.origins) == 0 {
+		return nil, nil
+	}
+	return p, nil
+}
+
+// allows reports whether scripts on origin may call the API.
+func (p *corsPolicy) allows(origin string) bool {
+	if p == nil || origin == "" {
+		return false
+	}
+	if p.any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.origins {
+		if origin == allowed {
+			return true
+		}
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			if rest, ok := strings.CutPrefix(origin, scheme+"://"); ok && strings.HasSuffix(rest, "."+domain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handle wraps next so preflights from allowed origins are answered, before
+// anything else could refuse them for lacking an API key, and responses to
+// those origins say they may be read.
+func (p *corsPolicy) handle(next http.Handler) http.Handler {
+	if p == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		h := w.Header()
+		if !p.any {
+			h.Add("Vary", "Origin")
+		}
+		if !p.allows(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p.any {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", p.methods)
+			h.Set("Access-Control-Allow-Headers", p.headers)
+			h.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
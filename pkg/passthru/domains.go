@@ -0,0 +1,189 @@
+package passthru
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// domainPolicy overrides the instance's settings for the media of some
+// domains and their subdomains, since platforms differ a lot in how big
+// their media is and how long it stays the same.
+type domainPolicy struct {
+	Domains []string `json:"domains"`
+	// Quality is the videoQuality asked of cobalt unless a request sets
+	// ?quality= (defaults to the instance's).
+	Quality string `json:"quality"`
+	// TTL is how long entries last, a duration such as 6h. Cleanup still
+	// removes them at the cache TTL if that comes first.
+	TTL string `json:"ttl"`
+	// MaxSize is the most bytes an entry may take (defaults to the
+	// instance's maximum entry size).
+	MaxSize int64 `json:"maxSize"`
+	// Rate is how many URLs a second may be resolved through cobalt, for
+	// platforms quick to block instances that ask too often (0 for no
+	// limit). Requests over it get a 429.
+	Rate float64 `json:"rate"`
+	// Disabled refuses the media of the domains with a 403.
+	Disabled bool `json:"disabled"`
+
+	ttl     time.Duration
+	limiter *rate.Limiter
+}
+
+// domainPolicies finds the policy of each URL by its host. A nil
+// domainPolicies leaves every URL to the instance's settings.
+type domainPolicies struct {
+	byDomain map[string]*domainPolicy
+	expires  bool
+}
+
+// loadDomainPolicies reads a JSON list of domain policies.
+func loadDomainPolicies(path string) (*domainPolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policies []*domainPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+
+	dp := &domainPolicies{byDomain: make(map[string]*domainPolicy)}
+	for _, p := range policies {
+		if len(p.Domains) == 0 {
+			return nil, fmt.Errorf("domain policy has no domains")
+		}
+		for i, domain := range p.Domains {
+			domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+			if domain == "" || strings.ContainsAny(domain, "/:") {
+				return nil, fmt.Errorf("domain policy domain %q must be a bare domain name", domain)
+			}
+			if dp.byDomain[domain] != nil {
+				return nil, fmt.Errorf("duplicate domain policy for %s", domain)
+			}
+			p.Domains[i] = domain
+			dp.byDomain[domain] = p
+		}
+		if p.Quality != "" {
+			if err := checkVideoQuality(p.Quality); err != nil {
+				return nil, fmt.Errorf("domain policy for %s: %v", p.Domains[0], err)
+			}
+		}
+		if p.TTL != "" {
+			p.ttl, err = time.ParseDuration(p.TTL)
+			if err != nil || p.ttl <= 0 {
+				return nil, fmt.Errorf("domain policy for %s has ttl %q, expected a positive duration such as 6h", p.Domains[0], p.TTL)
+			}
+			dp.expires = true
+		}
+		if p.MaxSize < 0 || p.Rate < 0 {
+			return nil, fmt.Errorf("domain policy for %s can't have a negative maxSize or rate", p.Domains[0])
+		}
+		if p.Rate > 0 {
+			p.limiter = rate.NewLimiter(rate.Limit(p.Rate), 1)
+		}
+		for _, reason := range []string{"disabled", "rate"} {
+			domainRefusalsTotal.WithLabelValues(p.Domains[0], reason).Add(0)
+		}
+	}
+	return dp, nil
+}
+
+func (dp *domainPolicies) enabled() bool {
+	return dp != nil
+}
+
+// match returns the policy of rawURL, if any: that of its host or of the
+// closest parent domain with one.
+func (dp *domainPolicies) match(rawURL string) *domainPolicy {
+	if dp == nil {
+		return nil
+	}
+	for _, domain := range urlDomains(rawURL) {
+		if p := dp.byDomain[domain]; p != nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// urlDomains returns the host of rawURL and its parent domains, closest
+// first.
+func urlDomains(rawURL string) []string {
+	u, err := neturl.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil
+	}
+	var domains []string
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	for host != "" {
+		domains = append(domains, host)
+		_, parent, ok := strings.Cut(host, ".")
+		if !ok {
+			break
+		}
+		host = parent
+	}
+	return domains
+}
+
+// refuse returns the error refusing rawURL, counting the refusal, if its
+// domain is disabled.
+func (dp *domainPolicies) refuse(rawURL string) error {
+	p := dp.match(rawURL)
+	if p == nil || !p.Disabled {
+		return nil
+	}
+	domainRefusalsTotal.WithLabelValues(p.Domains[0], "disabled").Inc()
+	slog.Info("Domain_disabled", "domain", p.Domains[0], "url", rawURL)
+	return &fetchError{http.StatusForbidden, "Media from " + p.Domains[0] + " is not served here"}
+}
+
+// allow returns the error refusing to resolve rawURL now, counting the
+// refusal, if its domain is over its rate.
+func (dp *domainPolicies) allow(rawURL string) error {
+	p := dp.match(rawURL)
+	if p == nil || p.limiter == nil || p.limiter.Allow() {
+		return nil
+	}
+	domainRefusalsTotal.WithLabelValues(p.Domains[0], "rate").Inc()
+	slog.Warn("Domain_rate_exceeded", "domain", p.Domains[0], "url", rawURL)
+	return &fetchError{http.StatusTooManyRequests, "Too many requests for media from " + p.Domains[0] + ", try again later"}
+}
+
+// videoQualityFor returns the videoQuality asked of cobalt for url unless
+// a request sets its own.
+func (c *cache) videoQualityFor(url string) string {
+	if p := c.domains.match(url); p != nil && p.Quality != "" {
+		return p.Quality
+	}
+	return c.videoQuality
+}
+
+// maxEntrySizeFor returns the most bytes the entry of url may take, 0 for
+// no limit.
+func (c *cache) maxEntrySizeFor(url string) int64 {
+	if p := c.domains.match(url); p != nil && p.MaxSize > 0 {
+		return p.MaxSize
+	}
+	return c.maxEntrySize
+}
+
+// expiry returns when the entry of url, downloaded now with the given
+// response headers, expires: after its domain's TTL if it has one, or else
+// as c.ttl has it.
+func (c *cache) expiry(url string, headers http.Header, now time.Time) *time.Time {
+	if p := c.domains.match(url); p != nil && p.ttl > 0 {
+		at := now.Add(p.ttl).UTC()
+		return &at
+	}
+	return c.ttl.expiry(headers, now)
+}
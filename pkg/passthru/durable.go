@@ -0,0 +1,48 @@
+package passthru
+
+import "os"
+
+// With durable writes on, every file making up an entry is flushed to stable
+// storage, and its directory after it, before the entry counts as cached: the
+// binary before the headers file is created, since a headers file is what
+// marks an entry complete. Otherwise a power loss can leave entries whose
+// files exist but are empty or cut short.
+
+// syncFile flushes f to stable storage if durable is set.
+func syncFile(f *os.File, durable bool) error {
+	if !durable {
+		return nil
+	}
+	return f.Sync()
+}
+
+// syncPath is syncFile for the file or directory at name.
+func syncPath(name string, durable bool) error {
+	if !durable {
+		return nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// writeFile is os.WriteFile, flushing the file to stable storage if durable
+// is set.
+func writeFile(name string, data []byte, durable bool) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncFile(f, durable); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
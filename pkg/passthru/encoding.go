@@ -0,0 +1,235 @@
+package passthru
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// decodeContent undoes the Content-Encoding of a media response, if it's
+// one we know (gzip, deflate or zstd), so what's stored and served is the
+// media itself and its headers say so. Go's transport already does this
+// for the gzip it asks for, but hosts send encodings unasked too. A body
+// in an encoding we don't know is kept as it is, along with the header
+// saying what it is. Either way a decoded response has Uncompressed set,
+// since ranges of it can't be asked for.
+func decodeContent(resp *http.Response) error {
+	var decoded io.Reader
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		resp.Header.Del("Content-Encoding")
+		return nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		decoded = zr
+	case "deflate":
+		// HTTP's deflate is zlib's format
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return err
+		}
+		decoded = zr
+	case "zstd":
+		zr, err := zstd.NewReader(resp.Body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		decoded = zr.IOReadCloser()
+	default:
+		return nil
+	}
+	resp.Body = &decodedBody{Reader: decoded, body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// decodedBody is a response body read through its decoder.
+type decodedBody struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	if c, ok := b.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return b.body.Close()
+}
+
+// compressMinSize is the smallest response worth compressing, when its
+// length is known up front.
+const compressMinSize = 1024
+
+// compressible reports whether a response of contentType is worth
+// compressing: text, JSON, subtitles and playlists are, media isn't.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"),
+		strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-subrip", "application/vnd.apple.mpegurl",
+		"application/x-mpegurl", "application/dash+xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// acceptedEncoding returns the encoding to compress a response to r in:
+// zstd or gzip, whichever r accepts, preferring zstd at equal weights, or
+// "" for none.
+func acceptedEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(strings.Join(r.Header.Values("Accept-Encoding"), ","), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "zstd" && name != "gzip" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > bestQ || q == bestQ && name == "zstd" {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWith is compressResponses if on, or else leaves next as it is.
+func compressWith(on bool, next http.Handler) http.Handler {
+	if !on {
+		return next
+	}
+	return compressResponses(next)
+}
+
+// compressResponses wraps next so responses that are worth it (see
+// compressible) are compressed with zstd or gzip, as the client's
+// Accept-Encoding allows. Media, ranges and responses already encoded go
+// out as they are, by sendfile where they would have.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := acceptedEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter compresses the response it writes, once its headers show
+// it's worth it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	wroteHeader bool
+	// enc compresses the body, if it's being compressed.
+	enc io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if !compressible(h.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	size, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	if !bodyAllowed(status) || status == http.StatusPartialContent || h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" || err == nil && size < compressMinSize {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	// The compressed bytes aren't the stored ones, but still mean the same
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	if w.encoding == "zstd" {
+		w.enc, _ = zstd.NewWriter(w.ResponseWriter, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	} else {
+		w.enc = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// bodyAllowed reports whether a response with status has a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return w.enc.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile working for what isn't compressed.
+func (w *compressWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.enc != nil {
+		return io.Copy(w.enc, r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+// Flush sends what's compressed so far, for responses streamed bit by bit.
+func (w *compressWriter) Flush() {
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close finishes the compressed body, if there is one.
+func (w *compressWriter) close() {
+	if w.enc != nil {
+		w.enc.Close()
+	}
+}
@@ -0,0 +1,317 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// An error pattern is reported once it has happened errorReportThreshold
+	// times in an errorReportWindow, and then at most once a window while it
+	// keeps happening.
+	errorReportThreshold = 3
+	errorReportWindow    = time.Hour
+	// errorReportQueue bounds the reports waiting to be sent; more are
+	// dropped rather than held up.
+	errorReportQueue   = 100
+	errorReportTimeout = 10 * time.Second
+)
+
+// errorReporter sends panics and recurring download failures to a Sentry
+// compatible error tracker, so new failure modes raise an alert rather than
+// waiting to be found in the logs. A single failure is noise: a download
+// failure is only reported once the same kind of failure happens
+// errorReportThreshold times in a window. A nil errorReporter reports
+// nothing.
+type errorReporter struct {
+	endpoint    string // the project's envelope endpoint
+	dsn         string
+	auth        string
+	environment string
+	serverName  string
+	client      *http.Client
+	queue       chan []byte
+
+	mu       sync.Mutex
+	patterns map[string]*errorPattern
+}
+
+// errorPattern counts the failures of one kind in the current window.
+type errorPattern struct {
+	windowStart time.Time
+	count       int
+	reported    bool
+}
+
+// newErrorReporter returns the reporter sending to the project of dsn, e.g.
+// https://<key>@o1.ingest.sentry.io/42, or nil if dsn is empty. It sends
+// reports until ctx is done.
+func newErrorReporter(ctx context.Context, dsn, environment string) (*errorReporter, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := neturl.Parse(dsn)
+	if err != nil || u.User == nil || u.User.Username() == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid DSN: want scheme://key@host/project")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return nil, fmt.Errorf("invalid DSN: no project ID")
+	}
+	er := &errorReporter{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path[:slash], project),
+		dsn:         dsn,
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=cobalt-passthru/1.0, sentry_key=%s", u.User.Username()),
+		environment: environment,
+		client:      &http.Client{Timeout: errorReportTimeout},
+		queue:       make(chan []byte, errorReportQueue),
+		patterns:    make(map[string]*errorPattern),
+	}
+	er.serverName, _ = os.Hostname()
+	go er.send(ctx)
+	return er, nil
+}
+
+// errorEvent is the part of a Sentry event the reporter fills in.
+type errorEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message"`
+	Exception   *errorExceptions  `json:"exception,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+	Fingerprint []string          `json:"fingerprint,omitempty"`
+}
+
+type errorExceptions struct {
+	Values []errorException `json:"values"`
+}
+
+type errorException struct {
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Stacktrace *errorStacktrace `json:"stacktrace,omitempty"`
+}
+
+type errorStacktrace struct {
+	Frames []errorFrame `json:"frames"`
+}
+
+type errorFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// stacktrace returns the stack of the caller skip frames up, outermost
+// frame first as Sentry has them.
+func stacktrace(skip int) *errorStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var st errorStacktrace
+	for {
+		frame, more := frames.Next()
+		module, function := "", frame.Function
+		if dot := strings.LastIndex(function, "/"); dot >= 0 {
+			if i := strings.Index(function[dot:], "."); i >= 0 {
+				module, function = function[:dot+i], function[dot+i+1:]
+			}
+		} else if i := strings.Index(function, "."); i >= 0 {
+			module, function = function[:i], function[i+1:]
+		}
+		st.Frames = append([]errorFrame{{
+			Function: function,
+			Module:   module,
+			Filename: frame.File,
+			Lineno:   frame.Line,
+			InApp:    strings.HasPrefix(module, "cobalt-passthru"),
+		}}, st.Frames...)
+		if !more {
+			break
+		}
+	}
+	return &st
+}
+
+// panicked reports a panic while handling r, with the stack that panicked.
+// It's called from the deferred function that recovered it.
+func (er *errorReporter) panicked(server string, r *http.Request, p interface{}) {
+	if er == nil {
+		return
+	}
+	er.enqueue(errorEvent{
+		Level:   "fatal",
+		Message: fmt.Sprintf("panic: %v", p),
+		Exception: &errorExceptions{Values: []errorException{{
+			Type:       "panic",
+			Value:      fmt.Sprint(p),
+			Stacktrace: stacktrace(2),
+		}}},
+		Tags: map[string]string{
+			"server": server,
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"domain": entryDomain(r.URL.Query().Get("u")),
+		},
+	})
+}
+
+// failureKind returns what failed for a download to end in err, and the
+// message failures like it share: upstream (the external service or the
+// media host), storage or internal. Failures that are the client's doing,
+// or about load rather than a fault, such as a canceled request, have no
+// kind.
+func failureKind(err error) (kind, message string) {
+	var fe *fetchError
+	if !errors.As(err, &fe) {
+		return "internal", err.Error()
+	}
+	switch fe.status {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return "upstream", fe.message
+	case http.StatusInsufficientStorage:
+		return "storage", fe.message
+	case http.StatusInternalServerError:
+		switch msg := strings.ToLower(fe.message); {
+		case strings.Contains(msg, "external service") || strings.Contains(msg, "download"):
+			return "upstream", fe.message
+		case strings.Contains(msg, "write") || strings.Contains(msg, "save"):
+			return "storage", fe.message
+		}
+		return "internal", fe.message
+	}
+	return "", ""
+}
+
+// downloadFailed counts a failure to get url into the cache as e, which
+// ended with cacheStatus, and reports it once failures like it recur. A
+// download that failed because ctx was canceled isn't counted.
+func (er *errorReporter) downloadFailed(ctx context.Context, url string, e cacheEntry, cacheStatus string, err error) {
+	if er == nil || err == nil || ctx.Err() != nil {
+		return
+	}
+	kind, message := failureKind(err)
+	if kind == "" {
+		return
+	}
+	fingerprint := []string{kind, message}
+	key := strings.Join(fingerprint, "\x00")
+
+	now := time.Now()
+	er.mu.Lock()
+	p := er.patterns[key]
+	if p == nil || now.Sub(p.windowStart) >= errorReportWindow {
+		p = &errorPattern{windowStart: now}
+		er.patterns[key] = p
+	}
+	p.count++
+	report := !p.reported && p.count >= errorReportThreshold
+	if report {
+		p.reported = true
+	}
+	count := p.count
+	er.mu.Unlock()
+	if !report {
+		return
+	}
+
+	er.enqueue(errorEvent{
+		Level:   "error",
+		Message: fmt.Sprintf("%s failure: %s", kind, message),
+		Exception: &errorExceptions{Values: []errorException{{
+			Type:  kind + "_failure",
+			Value: err.Error(),
+		}}},
+		Tags: map[string]string{
+			"kind":         kind,
+			"hash":         e.hash,
+			"domain":       entryDomain(url),
+			"cache_status": cacheStatus,
+		},
+		Extra: map[string]any{
+			"url":         url,
+			"occurrences": count,
+			"window":      errorReportWindow.String(),
+		},
+		Fingerprint: fingerprint,
+	})
+}
+
+func (er *errorReporter) enqueue(event errorEvent) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event.EventID = hex.EncodeToString(id)
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339Nano)
+	event.Platform = "go"
+	event.Logger = "cobalt-passthru"
+	event.ServerName = er.serverName
+	event.Environment = er.environment
+
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": event.EventID, "sent_at": event.Timestamp, "dsn": er.dsn})
+	envelope := bytes.Join([][]byte{header, []byte(`{"type":"event"}`), eventJSON}, []byte("\n"))
+	select {
+	case er.queue <- envelope:
+		errorReportsTotal.WithLabelValues("queued").Inc()
+	default:
+		errorReportsTotal.WithLabelValues("dropped").Inc()
+	}
+}
+
+// send delivers the queued reports, one at a time. One that fails is
+// logged and dropped.
+func (er *errorReporter) send(ctx context.Context) {
+	for {
+		var envelope []byte
+		select {
+		case <-ctx.Done():
+			return
+		case envelope = <-er.queue:
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, er.endpoint, bytes.NewReader(envelope))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/x-sentry-envelope")
+		req.Header.Set("X-Sentry-Auth", er.auth)
+		resp, err := er.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		if err != nil {
+			errorReportsTotal.WithLabelValues("failed").Inc()
+			slog.Error("Error_report_failed", "error", err)
+			continue
+		}
+		errorReportsTotal.WithLabelValues("sent").Inc()
+	}
+}
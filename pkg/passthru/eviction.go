@@ -0,0 +1,160 @@
+package passthru
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lruCandidate is an entry size eviction may remove, with what it takes up
+// and when it was last served.
+type lruCandidate struct {
+	dir        string
+	hash       string
+	size       int64
+	lastAccess time.Time
+}
+
+// touchAccessTime records that the binary at path was just served in its
+// access time, leaving its modification time, which its age is measured
+// by, alone. Filesystems mounted noatime or relatime don't keep that up to
+// date themselves.
+func touchAccessTime(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	os.Chtimes(path, time.Now(), info.ModTime())
+}
+
+// evictLeastRecentlyUsed removes the least recently served entries of the
+// storage directory and its tenants' until their files take up no more than
+// maxBytes. Entries in use, or that clients asked to be kept, are skipped.
+// Evicted entries are deleted straight away rather than trashed, since the
+// point is to free the space now, and from the shared storage as well.
+func (cl *cleaner) evictLeastRecentlyUsed(report *cleanupReport) {
+	var total int64
+	var candidates []lruCandidate
+	for _, dir := range storageDirs(cl.storageDir) {
+		sizes := make(map[string]int64)
+		var binaries []lruCandidate
+		err := readDirBatched(dir, func(files []os.DirEntry) bool {
+			for _, file := range files {
+				info, err := file.Info()
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				total += info.Size()
+				base, _, _ := strings.Cut(file.Name(), ".")
+				sizes[base] += info.Size()
+				if strings.HasSuffix(file.Name(), ".bin") {
+					binaries = append(binaries, lruCandidate{dir: dir, hash: base, lastAccess: accessTime(info)})
+				}
+			}
+			return true
+		})
+		if err != nil {
+			slog.Error("Read_storage_directory_error", "dir", dir, "error", err)
+			report.addError(err)
+			continue
+		}
+		for _, candidate := range binaries {
+			candidate.size = sizes[candidate.hash]
+			candidates = append(candidates, candidate)
+		}
+	}
+	storageBytes.Set(float64(total))
+	cacheEntries.Set(float64(len(candidates)))
+	if total <= cl.maxBytes {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].lastAccess.Before(candidates[j].lastAccess)
+	})
+	slog.Info("Size_eviction_started", "bytes", total, "max_bytes", cl.maxBytes)
+	for _, candidate := range candidates {
+		if total <= cl.maxBytes || cl.exhausted(report) {
+			break
+		}
+		if freed, ok := cl.evict(candidate, report); ok {
+			total -= freed
+			cacheEntries.Dec()
+		}
+	}
+	storageBytes.Set(float64(total))
+}
+
+// measureStorage sets the storage size and entry count metrics from the
+// files of the storage directory and its tenants', for passes that don't
+// evict, which would have counted them anyway.
+func (cl *cleaner) measureStorage() {
+	var total, entries int64
+	for _, dir := range storageDirs(cl.storageDir) {
+		readDirBatched(dir, func(files []os.DirEntry) bool {
+			for _, file := range files {
+				info, err := file.Info()
+				if err != nil || !info.Mode().IsRegular() {
+					continue
+				}
+				total += info.Size()
+				if strings.HasSuffix(file.Name(), ".bin") {
+					entries++
+				}
+			}
+			return true
+		})
+	}
+	storageBytes.Set(float64(total))
+	cacheEntries.Set(float64(entries))
+}
+
+// evict removes every file of the entry candidate, and reports whether it
+// did and how many bytes that freed.
+func (cl *cleaner) evict(candidate lruCandidate, report *cleanupReport) (int64, bool) {
+	key := filepath.Join(candidate.dir, candidate.hash)
+	if meta, err := readMeta(key + ".headers"); err == nil && meta.retained(time.Now()) {
+		return 0, false
+	}
+	unlock, ok := cl.locks.tryLock(key)
+	if !ok {
+		slog.Info("File_cleanup_skipped_in_use", "file", key+".bin")
+		return 0, false
+	}
+	defer unlock()
+	if cl.index.locked(candidate.hash) {
+		slog.Info("File_cleanup_skipped_in_use", "file", key+".bin")
+		return 0, false
+	}
+
+	files, err := filepath.Glob(key + ".*")
+	if err != nil {
+		return 0, false
+	}
+	var freed int64
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			slog.Error("File_deletion_error", "file", file, "error", err)
+			report.addError(err)
+			continue
+		}
+		filesCleanedTotal.Inc()
+		report.FilesRemoved++
+		report.BytesReclaimed += info.Size()
+		freed += info.Size()
+	}
+	cl.index.remove(candidate.hash)
+	cl.shared.purge(cacheEntry{hash: candidate.hash, binaryFile: key + ".bin", headersFile: key + ".headers"})
+	cl.access.forget(candidate.hash)
+	slog.Info("Entry_evicted", "reason", "size", "hash", candidate.hash, "bytes", freed)
+	evictionsTotal.WithLabelValues("size").Inc()
+	report.EntriesEvicted++
+	return freed, true
+}
@@ -0,0 +1,81 @@
+package passthru
+
+import (
+	"sync"
+	"time"
+)
+
+// failureCache keeps the external service's failures for a URL for a
+// short while, so a URL it can't do anything with (an unsupported site, a
+// geo-blocked or deleted video) isn't asked about again by every request
+// for it. A nil failureCache asks every time.
+type failureCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	failures map[string]cachedFailure
+}
+
+type cachedFailure struct {
+	err     *fetchError
+	expires time.Time
+}
+
+func newFailureCache(ttl time.Duration) *failureCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &failureCache{ttl: ttl, failures: make(map[string]cachedFailure)}
+}
+
+// get returns the failure kept for key, if it hasn't expired.
+func (fc *failureCache) get(key string) *fetchError {
+	if fc == nil {
+		return nil
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	failure, ok := fc.failures[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(failure.expires) {
+		delete(fc.failures, key)
+		return nil
+	}
+	failureCacheHitsTotal.Inc()
+	return failure.err
+}
+
+// put keeps err as the failure for key. Like the resolve cache, it's
+// bounded, and once full new failures aren't kept until old ones expire.
+func (fc *failureCache) put(key string, err *fetchError) {
+	if fc == nil {
+		return
+	}
+	now := time.Now()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if len(fc.failures) >= maxCachedResolutions {
+		for k, failure := range fc.failures {
+			if now.After(failure.expires) {
+				delete(fc.failures, k)
+			}
+		}
+		if len(fc.failures) >= maxCachedResolutions {
+			return
+		}
+	}
+	fc.failures[key] = cachedFailure{err: err, expires: now.Add(fc.ttl)}
+}
+
+// forget drops the failure for key, for a request that wants a fresh
+// answer.
+func (fc *failureCache) forget(key string) {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	delete(fc.failures, key)
+}
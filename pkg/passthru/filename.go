@@ -0,0 +1,130 @@
+package passthru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// filenameInfo is what GET /filename says about the media at a URL.
+type filenameInfo struct {
+	URL      string `json:"url"`
+	Hash     string `json:"hash"`
+	Cache    string `json:"cache"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// handleFilename tells download managers what the media at u will be
+// called, its cache key, whether it's cached and its size, without sending
+// any of it. A miss is only resolved, not downloaded, and only has a size
+// if upstream pre-checks are on.
+func handleFilename(c *cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := c.forRequest(r)
+		url := r.URL.Query().Get("u")
+		if url == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+		options, err := parseRequestOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx := withRequestOptions(r.Context(), options.relativeTo(c, url))
+
+		e := c.mediaEntry(ctx, url)
+		info := filenameInfo{URL: url, Hash: e.hash, Cache: "MISS"}
+		if c.cached(e) {
+			info.Cache = "HIT"
+			info.Filename = storedFilename(e.headersFile)
+			if stat, err := os.Stat(e.binaryFile); err == nil {
+				info.Size = stat.Size()
+			}
+			writeJSON(w, http.StatusOK, info)
+			return
+		}
+
+		serviceResp, err := c.resolve(ctx, url)
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to resolve resource", http.StatusInternalServerError)
+			}
+			return
+		}
+		info.Filename = plainFilename(serviceResp.Filename)
+		if serviceResp.Status == statusLocalProcessing {
+			info.Filename = plainFilename(serviceResp.Output.Filename)
+		} else if serviceResp.Status == statusPicker {
+			info.Filename = e.hash[:12] + ".zip"
+		} else if c.upstreamPrecheck {
+			if media := c.precheck(ctx, serviceResp.URL); media.size > 0 {
+				info.Size = media.size
+			}
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
+
+// requestFilename returns the file name r asks the media be saved as with
+// a filename query parameter, or "" if it doesn't. It's an error to ask for
+// something that isn't a file name.
+func requestFilename(r *http.Request) (string, error) {
+	value := r.URL.Query().Get("filename")
+	if value == "" {
+		return "", nil
+	}
+	name := plainFilename(value)
+	if name != value || strings.ContainsFunc(name, unicode.IsControl) {
+		return "", fmt.Errorf("'filename' must be a file name, without directories")
+	}
+	return name, nil
+}
+
+type filenameContextKey struct{}
+
+// withFilename returns a copy of ctx under which media is served to be
+// saved as name.
+func withFilename(ctx context.Context, name string) context.Context {
+	if name == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, filenameContextKey{}, name)
+}
+
+// filenameFrom returns the name media served under ctx is to be saved as,
+// or "" for the one it has.
+func filenameFrom(ctx context.Context) string {
+	name, _ := ctx.Value(filenameContextKey{}).(string)
+	return name
+}
+
+// contentDisposition returns a Content-Disposition saving media as name:
+// the name itself, RFC 5987 encoded, for clients that read filename*, and
+// one with anything but printable ASCII replaced for those that don't.
+func contentDisposition(name string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0 {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, fallback.String(), encoded.String())
+}
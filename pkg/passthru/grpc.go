@@ -0,0 +1,360 @@
+package passthru
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"cobalt-passthru/pkg/passthru/passthrupb"
+)
+
+// grpcChunkSize is the size of the body chunks sent by Fetch.
+const grpcChunkSize = 64 * 1024
+
+var hashPattern = regexp.MustCompile(`^[0-9a-f]{16,64}$`)
+
+// grpcServer implements the gRPC API on top of the same cache and prefetch
+// queue as the HTTP API.
+type grpcServer struct {
+	passthrupb.UnimplementedPassthruServer
+	cache *cache
+	queue *prefetchQueue
+	// adminToken is what Purge, which the HTTP API only has on the admin
+	// listener, needs in x-admin-token metadata. Without one it's refused.
+	adminToken string
+}
+
+// newGRPCServer returns a gRPC server for the API. With multi-tenancy or an
+// API keys file, calls must carry an API key in their x-api-key or
+// authorization metadata. A panic in a call is logged and answered with
+// Internal, as the HTTP handlers' are with a 500.
+func newGRPCServer(c *cache, q *prefetchQueue, adminToken string) *grpc.Server {
+	s := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(recoverUnaryPanics, func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			id := rpcRequestID(ctx)
+			grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+			ctx = withRequestID(ctx, id)
+			ctx, err := c.apiKeys.authenticateRPC(ctx)
+			if err != nil {
+				return nil, err
+			}
+			ctx, err = c.tenants.authenticateRPC(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(recoverStreamPanics, func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			id := rpcRequestID(ss.Context())
+			ss.SetHeader(metadata.Pairs("x-request-id", id))
+			ctx := withRequestID(ss.Context(), id)
+			ctx, err := c.apiKeys.authenticateRPC(ctx)
+			if err != nil {
+				return err
+			}
+			ctx, err = c.tenants.authenticateRPC(ctx)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+		}),
+	)
+	passthrupb.RegisterPassthruServer(s, &grpcServer{cache: c, queue: q, adminToken: adminToken})
+	return s
+}
+
+func recoverUnaryPanics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = rpcPanicked(ctx, info.FullMethod, p)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func recoverStreamPanics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = rpcPanicked(ss.Context(), info.FullMethod, p)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// rpcPanicked logs a panic p in a call to method with its stack, and
+// returns the error the call is answered with.
+func rpcPanicked(ctx context.Context, method string, p any) error {
+	panicTotal.WithLabelValues("grpc").Inc()
+	slog.ErrorContext(ctx, "Handler_panic", "server", "grpc", "method", method, "panic", p, "stack", strconv.Quote(string(debug.Stack())))
+	return status.Error(codes.Internal, "Internal server error")
+}
+
+// requireAdmin returns the error refusing a call in ctx unless its
+// x-admin-token metadata is the admin token.
+func (s *grpcServer) requireAdmin(ctx context.Context) error {
+	if s.adminToken == "" {
+		return status.Error(codes.PermissionDenied, "Not available without an admin token")
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-admin-token"); len(values) > 0 {
+			token = values[0]
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+		return status.Error(codes.Unauthenticated, "A valid admin token is required")
+	}
+	return nil
+}
+
+// authenticatedStream is a server stream carrying the tenant it was
+// authenticated as in its context.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateRPC is the gRPC counterpart of authenticate: it checks the API
+// key in ctx's metadata, the tenant's rate limit and the key's quotas, and
+// returns a context carrying the tenant and the key usage is charged to.
+func (ts *tenantSet) authenticateRPC(ctx context.Context) (context.Context, error) {
+	if !ts.enabled() {
+		return ctx, nil
+	}
+
+	k, result, breach := ts.admit(rpcKey(ctx))
+	switch result {
+	case "unauthorized":
+		return nil, status.Error(codes.Unauthenticated, "A valid API key is required")
+	case "rate_limited":
+		return nil, status.Error(codes.ResourceExhausted, "Rate limit exceeded")
+	case "quota_exceeded":
+		return nil, status.Errorf(codes.ResourceExhausted, "Quota exceeded: %s (limit %d, resets %s)", breach.name, breach.limit, breach.reset.Format(time.RFC3339))
+	}
+	return withUsage(context.WithValue(ctx, tenantContextKey{}, k.tenant), k.usage), nil
+}
+
+// rpcKey returns the API key in ctx's metadata, from x-api-key or a bearer
+// token in authorization.
+func rpcKey(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-api-key"); len(values) > 0 {
+			return values[0]
+		}
+		if values := md.Get("authorization"); len(values) > 0 && strings.HasPrefix(values[0], "Bearer ") {
+			return strings.TrimPrefix(values[0], "Bearer ")
+		}
+	}
+	return ""
+}
+
+// rpcRequestID returns the ID of an RPC: the one in its x-request-id
+// metadata if it has a sensible one, a new one otherwise.
+func rpcRequestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("x-request-id"); len(values) > 0 && requestIDPattern.MatchString(values[0]) {
+			return values[0]
+		}
+	}
+	return newRequestID()
+}
+
+// rpcError turns an error from the cache into a gRPC status, mapping the
+// HTTP status of a fetchError to the closest code.
+func rpcError(err error) error {
+	var fe *fetchError
+	if !errors.As(err, &fe) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	code := codes.Internal
+	switch fe.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusUnprocessableEntity:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests, http.StatusInsufficientStorage:
+		code = codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		code = codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	}
+	return status.Error(code, fe.message)
+}
+
+func (s *grpcServer) Resolve(ctx context.Context, req *passthrupb.ResolveRequest) (*passthrupb.ResolveResponse, error) {
+	if req.Url == "" {
+		return nil, status.Error(codes.InvalidArgument, "url is required")
+	}
+	c := s.cache.forContext(ctx)
+	e := c.entry(req.Url)
+	serviceResp, err := c.resolve(ctx, req.Url)
+	if err != nil {
+		return nil, rpcError(err)
+	}
+	return &passthrupb.ResolveResponse{
+		Url:      req.Url,
+		Hash:     e.hash,
+		Cached:   e.exists(),
+		MediaUrl: serviceResp.URL,
+		Filename: serviceResp.Filename,
+	}, nil
+}
+
+func (s *grpcServer) Fetch(req *passthrupb.FetchRequest, stream passthrupb.Passthru_FetchServer) error {
+	if req.Url == "" {
+		return status.Error(codes.InvalidArgument, "url is required")
+	}
+	ctx := stream.Context()
+	c := s.cache.forContext(ctx)
+	e := c.entry(req.Url)
+	cacheStatus, err := c.ensure(ctx, req.Url, e)
+	httpRequestsTotal.WithLabelValues("grpc:Fetch", cacheStatus).Inc()
+	if err != nil {
+		return rpcError(err)
+	}
+	if cacheStatus == statusCached {
+		usageFrom(ctx).hit()
+	}
+
+	unlock := c.locks.rlock(e)
+	defer unlock()
+	stored, err := readStoredHeaders(e.headersFile)
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to read headers file")
+	}
+	f, err := os.Open(e.binaryFile)
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to open binary file")
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return status.Error(codes.Internal, "Failed to open binary file")
+	}
+
+	headers := &passthrupb.FetchHeaders{Hash: e.hash, CacheStatus: cacheStatus, Size: info.Size()}
+	for name, values := range stored {
+		headers.Headers = append(headers.Headers, &passthrupb.Header{Name: name, Values: values})
+	}
+	if err := stream.Send(&passthrupb.FetchResponse{Part: &passthrupb.FetchResponse_Headers{Headers: headers}}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, grpcChunkSize)
+	var sent int64
+	defer func() {
+		usageFrom(ctx).served(sent)
+		keyQuotaFrom(ctx).served(sent)
+	}()
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := stream.Send(&passthrupb.FetchResponse{Part: &passthrupb.FetchResponse_Data{Data: buf[:n]}}); err != nil {
+				return err
+			}
+			sent += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			slog.Error("Read_binary_file_error", "filename", e.binaryFile, "error", err)
+			return status.Error(codes.Internal, "Failed to read binary file")
+		}
+	}
+}
+
+func (s *grpcServer) Prefetch(ctx context.Context, req *passthrupb.PrefetchRequest) (*passthrupb.PrefetchResponse, error) {
+	if len(req.Urls) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "urls are required")
+	}
+	if s.queue == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Not available on a read-only instance")
+	}
+	c := s.cache.forContext(ctx)
+	usage := usageFrom(ctx)
+	resp := &passthrupb.PrefetchResponse{}
+	for _, url := range req.Urls {
+		job := &prefetchJob{URL: url, Tenant: c.namespace}
+		if usage != nil {
+			job.Key = usage.key
+		}
+		resp.Results = append(resp.Results, &passthrupb.PrefetchResult{
+			Url:    url,
+			Hash:   c.entry(url).hash,
+			Queued: s.queue.add(job),
+		})
+	}
+	slog.InfoContext(ctx, "Prefetch_requested", "count", len(req.Urls))
+	return resp, nil
+}
+
+func (s *grpcServer) Purge(ctx context.Context, req *passthrupb.PurgeRequest) (*passthrupb.PurgeResponse, error) {
+	if err := s.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	c := s.cache.forContext(ctx)
+	var e cacheEntry
+	switch {
+	case req.GetUrl() != "":
+		e = c.entry(req.GetUrl())
+	case hashPattern.MatchString(req.GetHash()):
+		e = c.entryForHash(req.GetHash())
+	default:
+		return nil, status.Error(codes.InvalidArgument, "a url or a hash is required")
+	}
+
+	if c.readOnly {
+		return nil, status.Error(codes.FailedPrecondition, "Not available on a read-only instance")
+	}
+	purged := e.exists()
+	if purged {
+		c.purge(e)
+	}
+	return &passthrupb.PurgeResponse{Hash: e.hash, Purged: purged}, nil
+}
+
+func (s *grpcServer) Stats(ctx context.Context, req *passthrupb.StatsRequest) (*passthrupb.StatsResponse, error) {
+	c := s.cache.forContext(ctx)
+	resp := &passthrupb.StatsResponse{
+		DownloadsInFlight: c.inFlight.Load(),
+	}
+	if s.queue != nil {
+		resp.PrefetchQueueDepth = int64(s.queue.depth())
+	}
+	files, err := os.ReadDir(c.storageDir)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to read storage directory")
+	}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".bin") {
+			continue
+		}
+		if info, err := file.Info(); err == nil && info.Mode().IsRegular() {
+			resp.Entries++
+			resp.Bytes += info.Size()
+		}
+	}
+	return resp, nil
+}
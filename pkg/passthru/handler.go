@@ -0,0 +1,522 @@
+package passthru
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamTransport returns the transport of the client making every
+// request to the external service and the resources it points at, which is
+// http.DefaultTransport dialing through guard, with the connection limits
+// from cfg. The default of
+// 2 idle connections per host makes concurrent downloads from one CDN host
+// keep opening new ones.
+func upstreamTransport(cfg Config, guard *downloadGuard) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = guard.dialContext
+	t.MaxIdleConns = cfg.UpstreamMaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.UpstreamMaxIdleConnsPerHost
+	t.MaxConnsPerHost = cfg.UpstreamMaxConnsPerHost
+	t.IdleConnTimeout = cfg.UpstreamIdleConnTimeout
+	t.TLSHandshakeTimeout = cfg.UpstreamTLSHandshakeTimeout
+	t.ResponseHeaderTimeout = cfg.UpstreamTimeout
+	return t
+}
+
+type ExternalServiceRequest struct {
+	URL             string `json:"url"`
+	VideoQuality    string `json:"videoQuality"`
+	DisableMetadata bool   `json:"disableMetadata"`
+	SubtitleLang    string `json:"subtitleLang,omitempty"`
+	DownloadMode    string `json:"downloadMode,omitempty"`
+	AudioFormat     string `json:"audioFormat,omitempty"`
+	FilenameStyle   string `json:"filenameStyle,omitempty"`
+}
+
+// statusError is the status of an external service response that
+// couldn't get the media.
+const statusError = "error"
+
+type ExternalServiceResponse struct {
+	Status   string `json:"status"`
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+
+	// Type, Tunnel and Output describe a local-processing response: what
+	// to do with the streams in Tunnel, and the file that should come out.
+	Type   string   `json:"type"`
+	Tunnel []string `json:"tunnel"`
+	Output struct {
+		Type     string `json:"type"`
+		Filename string `json:"filename"`
+	} `json:"output"`
+
+	// Error (or, before cobalt 10, Text) says why an error response
+	// couldn't get the media.
+	Error *struct {
+		Code string `json:"code"`
+	} `json:"error"`
+	Text string `json:"text"`
+
+	// Picker, Audio and AudioFilename describe a picker response: the
+	// media to pick from, and the audio that goes with them, if any.
+	Picker        []PickerItem `json:"picker"`
+	Audio         string       `json:"audio"`
+	AudioFilename string       `json:"audioFilename"`
+}
+
+func handleRequest(c *cache, media *mediaProcessor) http.HandlerFunc {
+	var handler http.HandlerFunc
+	handler = func(w http.ResponseWriter, r *http.Request) {
+		if !c.hooks.requestReceived(w, r) {
+			return
+		}
+		c := c.forRequest(r)
+
+		queryParams := r.URL.Query()
+		url := queryParams.Get("u")
+		if url == "" {
+			slog.InfoContext(r.Context(), "Missing_query_param", "param", "u")
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		slog.InfoContext(r.Context(), "Request_received", "method", "GET", "u", url)
+
+		derived, err := parseDerivation(queryParams, c.subtitleLang)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		retention, err := requestRetention(r, c.maxRetention)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filename, err := requestFilename(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r = r.WithContext(withFilename(withRetention(r.Context(), retention), filename))
+		refresh, nocache := queryParams.Get("refresh") == "1", queryParams.Get("nocache") == "1"
+		if refresh && nocache {
+			http.Error(w, "'refresh' and 'nocache' can't be combined", http.StatusBadRequest)
+			return
+		}
+		if nocache && (derived != nil || retention > 0) {
+			http.Error(w, "'nocache' can't be combined with derived media or a ttl", http.StatusBadRequest)
+			return
+		}
+		if refresh {
+			err = c.checkBypass(r, "refresh", c.allowRefresh)
+		} else if nocache {
+			err = c.checkBypass(r, "nocache", c.allowNoCache)
+		}
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to check request", http.StatusInternalServerError)
+			}
+			return
+		}
+		if derived != nil && media == nil {
+			http.Error(w, "Media processing is not available", http.StatusNotImplemented)
+			return
+		}
+
+		options, err := parseRequestOptions(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		options = options.relativeTo(c, url)
+		if derived != nil {
+			options.subtitleLang = derived.subtitleLang
+		}
+		r = r.WithContext(withRequestOptions(r.Context(), options))
+
+		// A picker's items can be had as they are instead of archived
+		listPicker, err := wantsPickerList(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if listPicker && c.servePickerList(w, r, url) {
+			return
+		}
+		e := c.mediaEntry(r.Context(), url)
+		addLogFields(r.Context(), "hash", e.hash)
+
+		// Media not to be kept is streamed from wherever cobalt points,
+		// never looked up or stored, nor recorded among the top URLs
+		if nocache {
+			httpRequestsTotal.WithLabelValues(r.URL.Path, statusBypass).Inc()
+			setCacheHeaders(w, e, statusBypass)
+			c.passthrough(r.Context(), w, r, url)
+			return
+		}
+
+		// Hand the request to the instance owning this URL, unless another
+		// instance already routed it here
+		if owner := c.peers.owner(e.hash); owner != "" && !c.peers.routed(r, e.hash) {
+			slog.InfoContext(r.Context(), "Routing_to_owner", "owner", owner, "hash", e.hash)
+			c.peers.route(w, r, e.hash, owner, handler)
+			return
+		}
+
+		// Plain hits, with no hooks to run, take the fast path
+		setCacheHeaders(w, e, statusCached)
+		if derived == nil && retention == 0 && !refresh && len(c.hooks) == 0 && c.serveHit(w, r, e) {
+			c.access.hit(e)
+			c.top.record(url, true)
+			httpRequestsTotal.WithLabelValues(r.URL.Path, statusCached).Inc()
+			usageFrom(r.Context()).hit()
+			return
+		}
+
+		if len(c.hooks) > 0 {
+			c.hooks.cacheLookup(r, url, e.hash, c.cached(e))
+		}
+
+		// With storage unwritable a miss can't be cached, but it can still
+		// be passed through
+		if derived == nil && !c.storage.writable() && !e.exists() {
+			httpRequestsTotal.WithLabelValues(r.URL.Path, statusPassthrough).Inc()
+			c.top.record(url, false)
+			setCacheHeaders(w, e, statusPassthrough)
+			c.passthrough(r.Context(), w, r, url)
+			return
+		}
+		var cacheStatus string
+		if refresh {
+			cacheStatus, err = c.refresh(r.Context(), url, e)
+		} else if c.streamMisses && derived == nil && len(c.hooks) == 0 && r.Method == http.MethodGet && r.Header.Get("Range") == "" {
+			ctx, stream := withMissStream(r.Context(), throttle(w, r, c.serveRate, c.egress), e)
+			cacheStatus, err = c.obtain(ctx, url, e)
+			if stream.finish() {
+				// The response went out with the download, and all that's
+				// left is to tell the client if it was cut short
+				httpRequestsTotal.WithLabelValues(r.URL.Path, cacheStatus).Inc()
+				c.top.record(url, false)
+				if err != nil {
+					streamedMissesTotal.WithLabelValues("failed").Inc()
+					slog.ErrorContext(r.Context(), "Streamed_download_failed", "hash", e.hash, "error", err)
+					panic(http.ErrAbortHandler)
+				}
+				streamedMissesTotal.WithLabelValues("completed").Inc()
+				return
+			}
+		} else {
+			cacheStatus, err = c.obtain(r.Context(), url, e)
+		}
+		if derived == nil && errors.Is(err, errStorageUnwritable) {
+			httpRequestsTotal.WithLabelValues(r.URL.Path, statusPassthrough).Inc()
+			c.top.record(url, false)
+			setCacheHeaders(w, e, statusPassthrough)
+			c.passthrough(r.Context(), w, r, url)
+			return
+		}
+		if cacheStatus == statusUncacheable {
+			// Serve it this once from where it was set aside, unless it
+			// was only wanted to derive something else from, which would
+			// end up cached
+			defer discardUncacheable(e)
+			e = e.uncacheable()
+			if derived != nil {
+				err = &fetchError{http.StatusUnprocessableEntity, "Resource can't be cached"}
+			}
+		}
+		httpRequestsTotal.WithLabelValues(r.URL.Path, cacheStatus).Inc()
+		c.top.record(url, cacheStatus == statusCached)
+		setCacheHeaders(w, e, cacheStatus)
+		if cacheStatus == statusCached {
+			usageFrom(r.Context()).hit()
+			if retention > 0 {
+				// Only a fresh download records it by itself
+				unlock := c.locks.lock(e)
+				if err := c.retain(e, retention); err != nil {
+					slog.ErrorContext(r.Context(), "Entry_retention_error", "hash", e.hash, "error", err)
+				}
+				unlock()
+			}
+		}
+		if err != nil {
+			status, message := http.StatusInternalServerError, "Failed to fetch resource"
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				status, message = fe.status, fe.message
+			}
+			http.Error(w, message, status)
+			return
+		}
+
+		if derived != nil {
+			e, err = media.produce(r.Context(), c, url, e, derived)
+			if err != nil {
+				var fe *fetchError
+				if errors.As(err, &fe) {
+					http.Error(w, fe.message, fe.status)
+				} else {
+					http.Error(w, "Failed to process resource", http.StatusInternalServerError)
+				}
+				return
+			}
+		}
+
+		if cacheStatus == statusCached {
+			// Serve files directly from disk if they exist
+			slog.InfoContext(r.Context(), "Serving_cached_file", "filename", e.binaryFile)
+		}
+		c.serve(w, r, e)
+	}
+	return handler
+}
+
+// Headers telling clients how a response was served and under which cache
+// key, so they can check what the cache does without scraping metrics.
+const (
+	cacheHeader    = "X-Cache"
+	cacheKeyHeader = "X-Cache-Key"
+)
+
+// setCacheHeaders sets X-Cache and X-Cache-Key on w for e, served with the
+// given cache status.
+func setCacheHeaders(w http.ResponseWriter, e cacheEntry, status string) {
+	value := "MISS"
+	switch status {
+	case statusCached:
+		value = "HIT"
+	case statusPeer:
+		value = "PEER"
+	case statusShared:
+		value = "SHARED"
+	case statusPassthrough:
+		value = "PASSTHROUGH"
+	case statusStale:
+		value = "STALE"
+	case statusRefreshed:
+		value = "REFRESHED"
+	case statusBypass:
+		value = "BYPASS"
+	}
+	w.Header().Set(cacheHeader, value)
+	w.Header().Set(cacheKeyHeader, e.hash)
+}
+
+// addStoredHeaders adds the stored headers of an entry to h, but for the
+// ones set on every response here, which an upstream cache may have sent
+// too.
+func addStoredHeaders(h http.Header, stored http.Header) {
+	for name, values := range stored {
+		if name == cacheHeader || name == cacheKeyHeader {
+			continue
+		}
+		for _, value := range values {
+			h.Add(name, value)
+		}
+	}
+}
+
+// rangeHeaders describe the one response upstream sent, which may have
+// been a range of the media, rather than the media. They're worked out
+// again for every response from the binary on disk and the request.
+var rangeHeaders = []string{"Accept-Ranges", "Content-Length", "Content-Range", "Last-Modified"}
+
+// setEntryHeaders sets the headers of a response with the entry m describes
+// on h: its stored headers, its Age and its ETag. http.ServeContent then
+// answers conditional and range requests from them. Without a
+// Content-Disposition from upstream the media is saved under cobalt's name
+// for it, and filename, if set, overrides either.
+func setEntryHeaders(h http.Header, m entryMeta, filename string) {
+	addStoredHeaders(h, m.Headers)
+	for _, name := range rangeHeaders {
+		h.Del(name)
+	}
+	if filename == "" && h.Get("Content-Disposition") == "" {
+		filename = plainFilename(m.Filename)
+	}
+	if filename != "" {
+		h.Set("Content-Disposition", contentDisposition(filename))
+	}
+	setAge(h, m, time.Now())
+	setETag(h, m)
+}
+
+// lastModified returns the modification time of the entry m describes, for
+// Last-Modified and If-Modified-Since: upstream's if it sent one, or else
+// when the entry was stored. The binary's own time is the last resort, as
+// it differs between replicas and changes when the entry is fetched again.
+func lastModified(m entryMeta, info os.FileInfo) time.Time {
+	if t, err := http.ParseTime(m.Headers.Get("Last-Modified")); err == nil {
+		return t
+	}
+	if !m.StoredAt.IsZero() {
+		return m.StoredAt
+	}
+	return info.ModTime()
+}
+
+// serveBinaryFile serves an entry's binary with its stored headers,
+// answering conditional and range requests. A broken headers file is
+// repaired, and one in a legacy format migrated, if repair is set.
+func serveBinaryFile(w http.ResponseWriter, r *http.Request, binaryFileName, headersFileName string, repair bool) {
+	f, err := os.Open(binaryFileName)
+	if err == nil {
+		defer f.Close()
+	}
+	var info os.FileInfo
+	if err == nil {
+		info, err = f.Stat()
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Open_binary_file_error", "filename", binaryFileName, "error", err)
+		http.Error(w, "Failed to open binary file", http.StatusInternalServerError)
+		return
+	}
+
+	// A broken headers file costs the entry its headers, not the request
+	meta, reason := loadMeta(headersFileName)
+	if reason != "" {
+		repairHeadersFile(w, binaryFileName, headersFileName, reason, repair)
+	} else {
+		if meta.Version == 0 {
+			meta = migrateMeta(headersFileName, meta, info, repair)
+		}
+		setEntryHeaders(w.Header(), meta, filenameFrom(r.Context()))
+	}
+
+	slog.InfoContext(r.Context(), "Serving_binary_file", "filename", binaryFileName)
+	http.ServeContent(w, r, "", lastModified(meta, info), f)
+}
+
+// maxHeadersFileSize caps how much of a headers file is read; a larger one
+// counts as corrupted.
+const maxHeadersFileSize = 1 << 20
+
+// loadMeta reads what the headers file headersFileName records. If the
+// file can't be read or isn't a headers file it returns why (unreadable or
+// invalid).
+func loadMeta(headersFileName string) (entryMeta, string) {
+	headersFile, err := os.Open(headersFileName)
+	if err != nil {
+		slog.Error("Open_headers_file_error", "filename", headersFileName, "error", err)
+		return entryMeta{}, "unreadable"
+	}
+	defer headersFile.Close()
+
+	// Header sets from CDNs can run to several KB (long CSPs, cookies), so
+	// read the whole file, up to a limit that only a runaway one hits
+	data, err := io.ReadAll(io.LimitReader(headersFile, maxHeadersFileSize+1))
+	if err != nil {
+		slog.Error("Read_headers_file_error", "error", err)
+		return entryMeta{}, "unreadable"
+	}
+	var meta entryMeta
+	if len(data) <= maxHeadersFileSize {
+		meta, _ = parseMeta(data)
+	}
+	if len(meta.Headers) == 0 {
+		slog.Info("Corrupted_headers_file", "filename", headersFileName)
+		return entryMeta{}, "invalid"
+	}
+	return meta, ""
+}
+
+// setETag gives the response an entry m describes a strong ETag that
+// changes when the entry's content does, so clients resuming a download
+// with If-Range get the rest of it (a 206) only if it's the same file, and
+// all of the new one (a 200) if it has been refreshed since. It's the
+// content's checksum when known, which survives refreshes that don't change
+// anything and is the same on every replica. Otherwise, or if the recorded
+// checksum is too short to be one (a corrupted headers file, or one from
+// elsewhere), it's a strong ETag from upstream, if any, or else the time the
+// entry was stored and its size.
+func setETag(h http.Header, m entryMeta) {
+	switch {
+	case len(m.SHA256) >= 32:
+		h.Set("ETag", `"`+m.SHA256[:32]+`"`)
+	case h.Get("ETag") != "" && !strings.HasPrefix(h.Get("ETag"), "W/"):
+	case !m.StoredAt.IsZero():
+		h.Set("ETag", fmt.Sprintf(`"%x-%x"`, m.StoredAt.UnixNano(), m.ContentLength))
+	}
+}
+
+// setAge sets the Age of a response from the entry m describes at now: the
+// age upstream gave it plus how long it has been stored, in whole seconds as
+// RFC 9111 has it. Entries stored before their time was recorded get none.
+func setAge(h http.Header, m entryMeta, now time.Time) {
+	if m.StoredAt.IsZero() {
+		return
+	}
+	age := int64(now.Sub(m.StoredAt) / time.Second)
+	if age < 0 {
+		age = 0
+	}
+	if upstream, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && upstream > 0 {
+		age += upstream
+	}
+	h.Set("Age", strconv.FormatInt(age, 10))
+}
+
+// validHeaderName reports whether name is a plausible HTTP header name, to
+// tell a headers file apart from garbage.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// repairHeadersFile replaces the unreadable or corrupted headers file of an
+// entry with one holding just the Content-Type sniffed from its binary, and
+// sets that on w. The response goes ahead either way; a failed repair is
+// only logged. Without write only w gets the Content-Type, leaving the file
+// for an instance that may write to it.
+func repairHeadersFile(w http.ResponseWriter, binaryFileName, headersFileName, reason string, write bool) {
+	headersCorruptedTotal.WithLabelValues(reason).Inc()
+
+	f, err := os.Open(binaryFileName)
+	if err != nil {
+		return
+	}
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(f, sniff)
+	meta := newMeta(http.Header{})
+	if info, err := f.Stat(); err == nil {
+		meta.ContentLength = info.Size()
+	}
+	f.Close()
+	contentType := http.DetectContentType(sniff[:n])
+	meta.Headers.Set("Content-Type", contentType)
+	meta.ContentType = contentType
+	w.Header().Set("Content-Type", contentType)
+	if !write {
+		return
+	}
+
+	tmp := headersFileName + ".repair"
+	if err := os.WriteFile(tmp, meta.encode(), 0644); err == nil {
+		err = os.Rename(tmp, headersFileName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		slog.Error("Headers_file_repair_error", "filename", headersFileName, "error", err)
+		return
+	}
+	slog.Info("Headers_file_repaired", "filename", headersFileName, "content_type", contentType)
+}
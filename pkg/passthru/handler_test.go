@@ -0,0 +1,149 @@
+package passthru
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// longHeaders is a header set of the size some CDNs send: a CSP and
+// cookies of several KB each.
+func longHeaders() http.Header {
+	h := make(http.Header)
+	h.Set("Content-Type", "video/mp4")
+	var csp []string
+	for i := 0; i < 200; i++ {
+		csp = append(csp, fmt.Sprintf("https://cdn%d.example.com", i))
+	}
+	h.Set("Content-Security-Policy", "default-src 'self' "+strings.Join(csp, " "))
+	for i := 0; i < 3; i++ {
+		h.Add("Set-Cookie", fmt.Sprintf("session%d=%s; Path=/; Secure", i, strings.Repeat("x", 2000)))
+	}
+	h.Set("X-Last-Header", "end")
+	return h
+}
+
+func writeEntry(t *testing.T, headersFile []byte) (binaryFile, headersFileName string) {
+	t.Helper()
+	dir := t.TempDir()
+	binaryFile = filepath.Join(dir, "entry.bin")
+	headersFileName = filepath.Join(dir, "entry.headers")
+	if err := os.WriteFile(binaryFile, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(headersFileName, headersFile, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return binaryFile, headersFileName
+}
+
+func TestServeBinaryFileServesLongHeaderSets(t *testing.T) {
+	headers := longHeaders()
+
+	current, err := json.Marshal(entryMeta{Version: metaVersion, ContentLength: 5, StoredAt: time.Now().UTC(), Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyJSON, err := json.Marshal(map[string][]string(headers))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var legacyLines strings.Builder
+	for name, values := range headers {
+		for _, value := range values {
+			fmt.Fprintf(&legacyLines, "%s: %s\n", name, value)
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		file []byte
+	}{
+		{"current", current},
+		{"legacy JSON", legacyJSON},
+		{"legacy lines", []byte(legacyLines.String())},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.file) < 8<<10 {
+				t.Fatalf("headers file is only %d bytes, want several KB", len(tc.file))
+			}
+			binaryFile, headersFile := writeEntry(t, tc.file)
+
+			rec := httptest.NewRecorder()
+			serveBinaryFile(rec, httptest.NewRequest("GET", "/", nil), binaryFile, headersFile, false)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if body := rec.Body.String(); body != "media" {
+				t.Errorf("body = %q, want %q", body, "media")
+			}
+			for _, name := range []string{"Content-Security-Policy", "X-Last-Header"} {
+				if got, want := rec.Header().Get(name), headers.Get(name); got != want {
+					t.Errorf("%s is %d bytes, want %d", name, len(got), len(want))
+				}
+			}
+			if got, want := rec.Header().Values("Set-Cookie"), headers.Values("Set-Cookie"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got %d Set-Cookie headers of %d bytes, want %d of %d", len(got), len(strings.Join(got, "")), len(want), len(strings.Join(want, "")))
+			}
+		})
+	}
+}
+
+func TestLoadMetaReadsWholeFile(t *testing.T) {
+	headers := longHeaders()
+	data, err := json.Marshal(entryMeta{Version: metaVersion, Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, headersFile := writeEntry(t, data)
+
+	meta, reason := loadMeta(headersFile)
+	if reason != "" {
+		t.Fatalf("loadMeta reason = %q, want none", reason)
+	}
+	if got := meta.Headers.Get("X-Last-Header"); got != "end" {
+		t.Errorf("last header = %q, want it read in full", got)
+	}
+}
+
+func TestLoadMetaRefusesRunawayFiles(t *testing.T) {
+	headers := make(http.Header)
+	headers.Set("Content-Type", "video/mp4")
+	headers.Set("X-Huge", strings.Repeat("x", maxHeadersFileSize))
+	data, err := json.Marshal(entryMeta{Version: metaVersion, Headers: headers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, headersFile := writeEntry(t, data)
+
+	if _, reason := loadMeta(headersFile); reason != "invalid" {
+		t.Errorf("loadMeta reason = %q, want invalid", reason)
+	}
+}
+
+func TestSetETagIgnoresShortChecksums(t *testing.T) {
+	storedAt := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name string
+		meta entryMeta
+		want string
+	}{
+		{"checksum", entryMeta{SHA256: strings.Repeat("ab", 32)}, `"` + strings.Repeat("ab", 16) + `"`},
+		{"empty checksum", entryMeta{StoredAt: storedAt, ContentLength: 5}, fmt.Sprintf(`"%x-5"`, storedAt.UnixNano())},
+		{"short checksum", entryMeta{SHA256: "abc", StoredAt: storedAt, ContentLength: 5}, fmt.Sprintf(`"%x-5"`, storedAt.UnixNano())},
+		{"short checksum alone", entryMeta{SHA256: "abc"}, ""},
+	} {
+		h := make(http.Header)
+		setETag(h, tc.meta)
+		if got := h.Get("ETag"); got != tc.want {
+			t.Errorf("%s: ETag = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
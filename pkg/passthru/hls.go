@@ -0,0 +1,190 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// hlsDirName is the storage subdirectory holding one directory of HLS
+	// segments per repackaged entry.
+	hlsDirName = ".hls"
+
+	hlsPlaylist        = "index.m3u8"
+	hlsSegmentDuration = 6 // seconds
+)
+
+// hlsDir returns the directory holding the HLS rendition of the entry with
+// the given hash.
+func hlsDir(storageDir, hash string) string {
+	return filepath.Join(storageDir, hlsDirName, hash)
+}
+
+// packageHLS segments src's binary into an HLS playlist and MPEG-TS segments
+// in dir, without re-encoding. The segments are written to a temporary
+// directory that is renamed into place once ffmpeg has finished, so dir only
+// ever holds a complete rendition. Concurrent calls for the same entry share
+// one ffmpeg run.
+func (mp *mediaProcessor) packageHLS(ctx context.Context, src cacheEntry, dir string) error {
+	if fileExists(filepath.Join(dir, hlsPlaylist)) {
+		return nil
+	}
+	return mp.once(ctx, "hls:"+src.hash, func() error {
+		if fileExists(filepath.Join(dir, hlsPlaylist)) {
+			return nil
+		}
+
+		mp.slots <- struct{}{}
+		defer func() { <-mp.slots }()
+
+		const kind = "hls"
+		start := time.Now()
+		tmp := dir + ".tmp"
+		os.RemoveAll(tmp)
+		err := os.MkdirAll(tmp, os.ModePerm)
+
+		var stderr bytes.Buffer
+		if err == nil {
+			slog.InfoContext(ctx, "Ffmpeg_started", "kind", kind, "src", src.hash)
+			cmd := exec.Command(mp.ffmpeg,
+				"-hide_banner", "-loglevel", "error", "-y",
+				"-i", src.binaryFile,
+				"-c", "copy", "-f", "hls",
+				"-hls_time", fmt.Sprint(hlsSegmentDuration),
+				"-hls_playlist_type", "vod",
+				"-hls_segment_filename", filepath.Join(tmp, "seg%d.ts"),
+				filepath.Join(tmp, hlsPlaylist))
+			cmd.Stderr = &stderr
+			err = cmd.Run()
+		}
+		if err == nil {
+			os.RemoveAll(dir)
+			err = os.Rename(tmp, dir)
+		}
+
+		mediaJobDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+		if err != nil {
+			os.RemoveAll(tmp)
+			slog.ErrorContext(ctx, "Ffmpeg_failed", "kind", kind, "src", src.hash, "error", err, "stderr", stderr.String())
+			mediaJobsTotal.WithLabelValues(kind, "failed").Inc()
+			return fmt.Errorf("ffmpeg %s: %v", kind, err)
+		}
+
+		slog.InfoContext(ctx, "Ffmpeg_finished", "kind", kind, "src", src.hash, "duration", time.Since(start))
+		mediaJobsTotal.WithLabelValues(kind, "done").Inc()
+		return nil
+	})
+}
+
+// handleHLSRequest makes sure the video at u is cached and redirects to its
+// HLS playlist.
+func handleHLSRequest(c *cache, media *mediaProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if media == nil {
+			http.Error(w, "Media processing is not available", http.StatusNotImplemented)
+			return
+		}
+
+		url := r.URL.Query().Get("u")
+		if url == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		c := c.forRequest(r)
+		e := c.entry(url)
+		if _, err := c.ensure(r.Context(), url, e); err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+			}
+			return
+		}
+		location := "/hls/" + e.hash + "/" + hlsPlaylist
+		if key := r.URL.Query().Get("key"); key != "" {
+			location += "?key=" + neturl.QueryEscape(key)
+		}
+		http.Redirect(w, r, location, http.StatusFound)
+	}
+}
+
+// handleHLSFile serves the playlist or a segment of a cached entry's HLS
+// rendition, repackaging the entry on the first request.
+func handleHLSFile(c *cache, media *mediaProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if media == nil {
+			http.Error(w, "Media processing is not available", http.StatusNotImplemented)
+			return
+		}
+
+		c := c.forRequest(r)
+		vars := mux.Vars(r)
+		src := c.entryForHash(vars["hash"])
+		if !src.exists() {
+			http.NotFound(w, r)
+			return
+		}
+
+		dir := hlsDir(c.storageDir, src.hash)
+		if err := media.packageHLS(r.Context(), src, dir); err != nil {
+			http.Error(w, "Failed to process resource", http.StatusInternalServerError)
+			return
+		}
+
+		file := filepath.Join(dir, vars["file"])
+		if !fileExists(file) {
+			http.NotFound(w, r)
+			return
+		}
+		if vars["file"] != hlsPlaylist {
+			w.Header().Set("Content-Type", "video/mp2t")
+			http.ServeFile(w, r, file)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			key = r.URL.Query().Get("apikey")
+		}
+		if key == "" {
+			http.ServeFile(w, r, file)
+			return
+		}
+		// Players resolve the segments against the playlist's URL without
+		// its query, so a key given there has to be added to each of them
+		playlist, err := os.ReadFile(file)
+		if err != nil {
+			http.Error(w, "Failed to read playlist", http.StatusInternalServerError)
+			return
+		}
+		w.Write(keyedPlaylist(playlist, key))
+	}
+}
+
+// keyedPlaylist returns playlist with key added as a key query parameter to
+// each segment URI.
+func keyedPlaylist(playlist []byte, key string) []byte {
+	query := "?key=" + neturl.QueryEscape(key)
+	lines := bytes.Split(playlist, []byte("\n"))
+	for i, line := range lines {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		lines[i] = append(line[:len(line):len(line)], query...)
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
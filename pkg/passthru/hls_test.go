@@ -0,0 +1,11 @@
+package passthru
+
+import "testing"
+
+func TestKeyedPlaylistAddsKeyToSegments(t *testing.T) {
+	playlist := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg0.ts\n#EXTINF:2.5,\r\nseg1.ts\r\n#EXT-X-ENDLIST\n"
+	want := "#EXTM3U\n#EXT-X-TARGETDURATION:6\n#EXTINF:6.0,\nseg0.ts?key=a+b%2Fc\n#EXTINF:2.5,\r\nseg1.ts?key=a+b%2Fc\n#EXT-X-ENDLIST\n"
+	if got := string(keyedPlaylist([]byte(playlist), "a b/c")); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,171 @@
+package passthru
+
+import (
+	"io"
+	"net/http"
+	"os"
+)
+
+// Hooks are callbacks run at fixed points of a request's life. Every field
+// is optional. Several sets of hooks can be configured (see Config.Hooks);
+// they run in order, and for the hooks that can stop or veto something the
+// first one to do so wins.
+//
+// Hooks run on the request's goroutine, so slow hooks slow down requests.
+type Hooks struct {
+	// RequestReceived runs when a request for a cached resource (/?u=...)
+	// arrives, before it is looked at. It may change r, e.g. rewrite its
+	// query. Returning false stops the request; the hook must have written
+	// a response to w.
+	RequestReceived func(w http.ResponseWriter, r *http.Request) bool
+
+	// CacheHit and CacheMiss run once the local cache has been checked for
+	// url.
+	CacheHit  func(r *http.Request, url, hash string)
+	CacheMiss func(r *http.Request, url, hash string)
+
+	// BeforeUpstream runs before a request is sent to the external service,
+	// and may change it, e.g. to add authentication headers.
+	BeforeUpstream func(req *http.Request)
+
+	// AfterDownload runs once the resource behind url has been fetched in
+	// full, before it takes its place in the cache. resp is the response it
+	// came in, and its Body reads the media as it will be stored (merged
+	// streams and picker zips included) from a file of its own, so hooks
+	// may read as much of it as they like. Returning false keeps it out of
+	// the cache: it is set aside instead, a client waiting on it still gets
+	// it once from there, and it is deleted afterwards.
+	AfterDownload func(url string, resp *http.Response) bool
+
+	// BeforeServe runs just before a cached resource is sent, after its
+	// stored headers have been set on w, so it can add or change headers.
+	BeforeServe func(w http.ResponseWriter, r *http.Request)
+}
+
+// uncacheableSuffix is added to the names of a download a hook kept out of
+// the cache (see cacheEntry.uncacheable).
+const uncacheableSuffix = ".uncacheable"
+
+// hookChain is every configured set of hooks, in order.
+type hookChain []Hooks
+
+func (hc hookChain) requestReceived(w http.ResponseWriter, r *http.Request) bool {
+	for _, h := range hc {
+		if h.RequestReceived != nil && !h.RequestReceived(w, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hc hookChain) cacheLookup(r *http.Request, url, hash string, hit bool) {
+	for _, h := range hc {
+		if hit && h.CacheHit != nil {
+			h.CacheHit(r, url, hash)
+		} else if !hit && h.CacheMiss != nil {
+			h.CacheMiss(r, url, hash)
+		}
+	}
+}
+
+func (hc hookChain) beforeUpstream(req *http.Request) {
+	for _, h := range hc {
+		if h.BeforeUpstream != nil {
+			h.BeforeUpstream(req)
+		}
+	}
+}
+
+func (hc hookChain) afterDownload(url string, resp *http.Response) bool {
+	for _, h := range hc {
+		if h.AfterDownload != nil && !h.AfterDownload(url, resp) {
+			return false
+		}
+	}
+	return true
+}
+
+// afterDownload runs the AfterDownload hooks on resp, with the media
+// downloaded to name, not yet in the cache, as its body.
+func (c *cache) afterDownload(url string, resp *http.Response, name string) (bool, error) {
+	if len(c.hooks) == 0 {
+		return true, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	hookResp := *resp
+	hookResp.Body = f
+	if info, err := f.Stat(); err == nil {
+		hookResp.ContentLength = info.Size()
+	}
+	return c.hooks.afterDownload(url, &hookResp), nil
+}
+
+// uncacheable returns where a download of e that a hook kept out of the
+// cache is set aside until it has been served once, under names nothing
+// looks e up by.
+func (e cacheEntry) uncacheable() cacheEntry {
+	return cacheEntry{
+		hash:        e.hash,
+		binaryFile:  e.binaryFile + uncacheableSuffix,
+		headersFile: e.headersFile + uncacheableSuffix,
+	}
+}
+
+// discardUncacheable deletes e's download set aside by uncacheable, once it
+// has been served.
+func discardUncacheable(e cacheEntry) {
+	u := e.uncacheable()
+	os.Remove(u.binaryFile)
+	os.Remove(u.headersFile)
+}
+
+// wrapServe returns w unchanged when no BeforeServe hook is set, or a writer
+// running them right before the response header goes out.
+func (hc hookChain) wrapServe(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var hooks []func(http.ResponseWriter, *http.Request)
+	for _, h := range hc {
+		if h.BeforeServe != nil {
+			hooks = append(hooks, h.BeforeServe)
+		}
+	}
+	if len(hooks) == 0 {
+		return w
+	}
+	return &beforeServeWriter{ResponseWriter: w, r: r, hooks: hooks}
+}
+
+type beforeServeWriter struct {
+	http.ResponseWriter
+	r       *http.Request
+	hooks   []func(http.ResponseWriter, *http.Request)
+	started bool
+}
+
+func (w *beforeServeWriter) WriteHeader(status int) {
+	if !w.started {
+		w.started = true
+		for _, hook := range w.hooks {
+			hook(w.ResponseWriter, w.r)
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *beforeServeWriter) Write(b []byte) (int, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// ReadFrom keeps sendfile available to http.ServeFile through the writer.
+func (w *beforeServeWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.started {
+		w.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
@@ -0,0 +1,65 @@
+package passthru
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// getMedia fetches u through srv, and returns the response with the size
+// of its body.
+func getMedia(t *testing.T, srvURL, u string) (*http.Response, int64) {
+	t.Helper()
+	resp, err := http.Get(srvURL + "/?u=" + url.QueryEscape(u))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	n, _ := io.Copy(io.Discard, resp.Body)
+	return resp, n
+}
+
+func TestAfterDownloadHooksReadTheStoredMedia(t *testing.T) {
+	for _, keep := range []bool{true, false} {
+		var storageDir string
+		var read int64
+		var stored []string
+		srv := newTestServer(t, func(cfg *Config) {
+			storageDir = cfg.StorageDir
+			cfg.Hooks = []Hooks{{AfterDownload: func(url string, resp *http.Response) bool {
+				read, _ = io.Copy(io.Discard, resp.Body)
+				stored, _ = filepath.Glob(filepath.Join(storageDir, "*.bin"))
+				return keep
+			}}}
+		})
+
+		resp, n := getMedia(t, srv.URL, "https://example.com/clip?size=5000")
+		if resp.StatusCode != http.StatusOK || n != 5000 {
+			t.Fatalf("keep=%v: got %d with %d bytes, want 200 with 5000", keep, resp.StatusCode, n)
+		}
+		if read != 5000 {
+			t.Errorf("keep=%v: the hook read %d bytes, want 5000", keep, read)
+		}
+		if len(stored) != 0 {
+			t.Errorf("keep=%v: %v was in place before the hook had its say", keep, stored)
+		}
+
+		// Reading the body took nothing from the entry, and a veto leaves
+		// nothing behind once the client has it
+		want := "HIT"
+		if !keep {
+			want = "MISS"
+		}
+		resp, n = getMedia(t, srv.URL, "https://example.com/clip?size=5000")
+		if got := resp.Header.Get(cacheHeader); got != want || n != 5000 {
+			t.Errorf("keep=%v: second request was a %s with %d bytes, want a %s with 5000", keep, got, n, want)
+		}
+		if !keep {
+			if left, _ := filepath.Glob(filepath.Join(storageDir, "*"+uncacheableSuffix)); len(left) != 0 {
+				t.Errorf("vetoed downloads left behind: %v", left)
+			}
+		}
+	}
+}
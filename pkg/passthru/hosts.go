@@ -0,0 +1,158 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// hostProfile is the configuration requests for some hostnames get, so one
+// instance can back several frontends: its own cobalt endpoint and request
+// options, and a cache namespace of its own.
+type hostProfile struct {
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+	// Endpoint is the cobalt instance asked, or a comma-separated list of
+	// several (defaults to the instance's).
+	Endpoint string `json:"endpoint"`
+	// Options are added to, or replace, the fields of every request to
+	// cobalt (e.g. {"videoQuality": "720", "downloadMode": "audio"}).
+	Options map[string]interface{} `json:"options"`
+
+	cache *cache
+}
+
+// hostRouter picks the profile of each request by its Host header. A nil
+// hostRouter serves every host the same.
+type hostRouter struct {
+	byHost map[string]*hostProfile
+	byName map[string]*hostProfile
+}
+
+// loadHostProfiles reads a JSON list of host profiles, giving each one a
+// cache of its own derived from root. Profiles share root's storage
+// directory, cleanup and limits; only their keys differ.
+func loadHostProfiles(path string, root *cache) (*hostRouter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profiles []*hostProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, err
+	}
+
+	hr := &hostRouter{byHost: make(map[string]*hostProfile), byName: make(map[string]*hostProfile)}
+	for _, p := range profiles {
+		if p.Name == "" || strings.ContainsAny(p.Name, `/\.`) {
+			return nil, fmt.Errorf("profile name %q must be non-empty and can't contain '/', '\\' or '.'", p.Name)
+		}
+		if hr.byName[p.Name] != nil {
+			return nil, fmt.Errorf("duplicate profile %q", p.Name)
+		}
+		if len(p.Hosts) == 0 {
+			return nil, fmt.Errorf("profile %q has no hosts", p.Name)
+		}
+		for _, host := range p.Hosts {
+			host = strings.ToLower(host)
+			if host == "" || hr.byHost[host] != nil {
+				return nil, fmt.Errorf("profile %q has an empty host or one another profile has", p.Name)
+			}
+			hr.byHost[host] = p
+		}
+		if _, ok := p.Options["url"]; ok {
+			return nil, fmt.Errorf("profile %q can't set the url option", p.Name)
+		}
+
+		p.cache = root.namespaced(p.Name, root.storageDir)
+		if p.Endpoint != "" {
+			p.cache.endpoint = p.Endpoint
+			p.cache.upstreams = newUpstreamPool(p.Endpoint, root.hooks, root.client)
+		}
+		p.cache.options = p.Options
+		hr.byName[p.Name] = p
+	}
+	return hr, nil
+}
+
+func (hr *hostRouter) enabled() bool {
+	return hr != nil
+}
+
+// endpoints returns every cobalt endpoint requests go to: root's, and
+// those of the profiles with one of their own, each instance of the ones
+// listing several.
+func (hr *hostRouter) endpoints(root string) []string {
+	endpoints := splitEndpoints(root)
+	if !hr.enabled() {
+		return endpoints
+	}
+	for _, p := range hr.byName {
+		if p.cache.endpoint != root {
+			endpoints = append(endpoints, splitEndpoints(p.cache.endpoint)...)
+		}
+	}
+	return endpoints
+}
+
+// requestHost returns r's hostname, lowercased and without a port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+type profileContextKey struct{}
+
+// profileFrom returns the host profile a request was routed to, if any.
+func profileFrom(ctx context.Context) *hostProfile {
+	p, _ := ctx.Value(profileContextKey{}).(*hostProfile)
+	return p
+}
+
+// route wraps next so requests for a profile's hosts are served from its
+// cache. Requests for other hosts get the instance's own.
+func (hr *hostRouter) route(next http.Handler) http.Handler {
+	if !hr.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := hr.byHost[requestHost(r)]; p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), profileContextKey{}, p))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withOptions returns the body of a request to cobalt: req, with options
+// added on top.
+func withOptions(req ExternalServiceRequest, options map[string]interface{}) interface{} {
+	if len(options) == 0 {
+		return req
+	}
+	body := map[string]interface{}{
+		"url":             req.URL,
+		"videoQuality":    req.VideoQuality,
+		"disableMetadata": req.DisableMetadata,
+	}
+	for name, value := range map[string]string{
+		"subtitleLang":  req.SubtitleLang,
+		"downloadMode":  req.DownloadMode,
+		"audioFormat":   req.AudioFormat,
+		"filenameStyle": req.FilenameStyle,
+	} {
+		if value != "" {
+			body[name] = value
+		}
+	}
+	for name, value := range options {
+		body[name] = value
+	}
+	return body
+}
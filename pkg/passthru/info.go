@@ -0,0 +1,156 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// mediaInfo is the metadata served by GET /info.
+type mediaInfo struct {
+	URL         string         `json:"url"`
+	Hash        string         `json:"hash"`
+	Cached      bool           `json:"cached"`
+	Size        int64          `json:"size,omitempty"`
+	ContentType string         `json:"contentType,omitempty"`
+	Container   string         `json:"container,omitempty"`
+	Duration    float64        `json:"duration,omitempty"`
+	Bitrate     int64          `json:"bitrate,omitempty"`
+	Streams     []streamInfo   `json:"streams,omitempty"`
+	Resolved    *resolvedMedia `json:"resolved,omitempty"`
+}
+
+type streamInfo struct {
+	Type       string `json:"type"`
+	Codec      string `json:"codec"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	FrameRate  string `json:"frameRate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	SampleRate int    `json:"sampleRate,omitempty"`
+	Bitrate    int64  `json:"bitrate,omitempty"`
+}
+
+// resolvedMedia is what the external service said about an entry that isn't
+// cached yet.
+type resolvedMedia struct {
+	Status   string       `json:"status"`
+	Filename string       `json:"filename,omitempty"`
+	Picker   []PickerItem `json:"picker,omitempty"`
+}
+
+// ffprobeOutput is the subset of `ffprobe -print_format json` output we use.
+type ffprobeOutput struct {
+	Format struct {
+		FormatName string `json:"format_name"`
+		Duration   string `json:"duration"`
+		BitRate    string `json:"bit_rate"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		Channels     int    `json:"channels"`
+		SampleRate   string `json:"sample_rate"`
+		BitRate      string `json:"bit_rate"`
+	} `json:"streams"`
+}
+
+// probe fills info with what ffprobe reports about the file at path.
+func (mp *mediaProcessor) probe(ctx context.Context, path string, info *mediaInfo) error {
+	select {
+	case mp.slots <- struct{}{}:
+		defer func() { <-mp.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, mp.ffprobe, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffprobe: %v: %s", err, stderr.String())
+	}
+
+	var out ffprobeOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return fmt.Errorf("decoding ffprobe output: %v", err)
+	}
+
+	info.Container = out.Format.FormatName
+	info.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+	for _, s := range out.Streams {
+		stream := streamInfo{
+			Type:     s.CodecType,
+			Codec:    s.CodecName,
+			Width:    s.Width,
+			Height:   s.Height,
+			Channels: s.Channels,
+		}
+		if s.CodecType == "video" {
+			stream.FrameRate = s.AvgFrameRate
+		}
+		stream.SampleRate, _ = strconv.Atoi(s.SampleRate)
+		stream.Bitrate, _ = strconv.ParseInt(s.BitRate, 10, 64)
+		info.Streams = append(info.Streams, stream)
+	}
+	return nil
+}
+
+// handleInfo describes the media at u without sending its bytes. Cached
+// entries are probed with ffprobe when it is available; otherwise the
+// external service is asked to resolve the URL, without downloading it.
+func handleInfo(c *cache, media *mediaProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := c.forRequest(r)
+		url := r.URL.Query().Get("u")
+		if url == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		e := c.entry(url)
+		info := mediaInfo{URL: url, Hash: e.hash}
+
+		if !e.exists() {
+			serviceResp, err := c.resolve(r.Context(), url)
+			if err != nil {
+				var fe *fetchError
+				if errors.As(err, &fe) {
+					http.Error(w, fe.message, fe.status)
+				} else {
+					http.Error(w, "Failed to resolve resource", http.StatusInternalServerError)
+				}
+				return
+			}
+			info.Resolved = &resolvedMedia{Status: serviceResp.Status, Filename: serviceResp.Filename, Picker: serviceResp.Picker}
+			writeJSON(w, http.StatusOK, info)
+			return
+		}
+
+		info.Cached = true
+		if stat, err := os.Stat(e.binaryFile); err == nil {
+			info.Size = stat.Size()
+		}
+		if headers, err := readStoredHeaders(e.headersFile); err == nil {
+			info.ContentType = headers.Get("Content-Type")
+		}
+		if media != nil && media.ffprobe != "" {
+			if err := media.probe(r.Context(), e.binaryFile, &info); err != nil {
+				slog.ErrorContext(r.Context(), "Probe_error", "hash", e.hash, "error", err)
+			}
+		}
+		writeJSON(w, http.StatusOK, info)
+	}
+}
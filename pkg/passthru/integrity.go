@@ -0,0 +1,125 @@
+package passthru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// integrity checks entries before they're served as hits, so a binary cut
+// short or damaged on disk is downloaded again instead of served for as
+// long as the entry lives. Every entry's size is checked against the one
+// recorded when it was stored, and with checksums on its SHA-256 is too.
+// An entry that passes isn't checked again until its binary changes.
+type integrity struct {
+	checksums bool
+
+	mu sync.Mutex
+	// verified are the binaries that passed, by name, as they were then.
+	verified map[string]verifiedBinary
+}
+
+type verifiedBinary struct {
+	size    int64
+	modTime time.Time
+}
+
+func newIntegrity(checksums bool) *integrity {
+	return &integrity{checksums: checksums, verified: make(map[string]verifiedBinary)}
+}
+
+// known reports whether the binary name, as info describes it, has passed.
+func (in *integrity) known(name string, info os.FileInfo) bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	v, ok := in.verified[name]
+	return ok && v.size == info.Size() && v.modTime.Equal(info.ModTime())
+}
+
+// trusted reports whether the binary meta describes, as info describes it,
+// can be served without a check: one whose size is right, and that has
+// passed already if checksums are on.
+func (in *integrity) trusted(name string, info os.FileInfo, meta entryMeta) bool {
+	if meta.ContentLength > 0 && info.Size() != meta.ContentLength {
+		return false
+	}
+	return !in.checksums || in.known(name, info)
+}
+
+// check returns why e's binary doesn't match its headers file (size or
+// checksum), or "" if it does. Missing files and unreadable headers files
+// are for the rest of the cache to deal with, and pass. The caller holds a
+// lock on e.
+func (in *integrity) check(e cacheEntry) string {
+	f, err := os.Open(e.binaryFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || in.known(e.binaryFile, info) {
+		return ""
+	}
+	data, err := os.ReadFile(e.headersFile)
+	if err != nil || len(data) > maxHeadersFileSize {
+		return ""
+	}
+	meta, ok := parseMeta(data)
+	if !ok || meta.ContentLength <= 0 {
+		return ""
+	}
+	if info.Size() != meta.ContentLength {
+		return "size"
+	}
+	if in.checksums && meta.SHA256 != "" {
+		checksum := sha256.New()
+		if _, err := io.Copy(checksum, f); err != nil {
+			return ""
+		}
+		if hex.EncodeToString(checksum.Sum(nil)) != meta.SHA256 {
+			return "checksum"
+		}
+	}
+	in.mu.Lock()
+	in.verified[e.binaryFile] = verifiedBinary{size: info.Size(), modTime: info.ModTime()}
+	in.mu.Unlock()
+	return ""
+}
+
+// forget drops what's known of the binary name, once it's gone.
+func (in *integrity) forget(name string) {
+	in.mu.Lock()
+	delete(in.verified, name)
+	in.mu.Unlock()
+}
+
+// verify removes e from the cache if it's corrupted, so it's downloaded
+// again rather than served. A read-only cache only reports it.
+func (c *cache) verify(ctx context.Context, e cacheEntry) {
+	unlock := c.locks.rlock(e)
+	reason := c.integrity.check(e)
+	unlock()
+	if reason == "" {
+		return
+	}
+
+	unlock = c.locks.lock(e)
+	defer unlock()
+	// It may have been replaced while unlocked
+	if c.integrity.check(e) == "" {
+		return
+	}
+	corruptedEntriesTotal.WithLabelValues(reason).Inc()
+	if c.readOnly {
+		// The instance writing to the storage will download it again
+		slog.WarnContext(ctx, "Corrupted_entry", "hash", e.hash, "reason", reason)
+		return
+	}
+	slog.WarnContext(ctx, "Corrupted_entry_removed", "hash", e.hash, "reason", reason)
+	c.remove(e)
+}
@@ -0,0 +1,108 @@
+package passthru
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// minKeyLength is the shortest a truncated key may be, in hex digits: 64
+// bits, which keeps collisions out of reach of any one storage directory.
+const minKeyLength = 16
+
+// keyHashes are the hashes entry keys can be made with, each giving a hex
+// string of length digits.
+var keyHashes = map[string]struct {
+	sum    func([]byte) string
+	length int
+}{
+	"sha256": {func(b []byte) string { sum := sha256.Sum256(b); return hex.EncodeToString(sum[:]) }, 64},
+	"blake3": {func(b []byte) string { sum := blake3.Sum256(b); return hex.EncodeToString(sum[:]) }, 64},
+	"xxhash": {func(b []byte) string { return fmt.Sprintf("%016x", xxhash.Sum64(b)) }, 16},
+}
+
+// keyHasher names entries after the hash of their key, cut down to length
+// hex digits. xxhash is the fastest, and blake3 is cheaper than sha256
+// while as hard to collide on purpose.
+type keyHasher struct {
+	name   string
+	sum    func([]byte) string
+	length int
+}
+
+// newKeyHasher returns the hasher spec describes: a hash, optionally
+// followed by a colon and the number of hex digits to keep (e.g.
+// sha256:32). length, if non-zero, overrides the one in spec.
+func newKeyHasher(spec string, length int) (*keyHasher, error) {
+	name, lengthStr, cut := strings.Cut(spec, ":")
+	h, ok := keyHashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown key hash %q (want sha256, blake3 or xxhash)", name)
+	}
+	if cut && length == 0 {
+		var err error
+		if length, err = strconv.Atoi(lengthStr); err != nil {
+			return nil, fmt.Errorf("invalid key length %q", lengthStr)
+		}
+	}
+	if length == 0 {
+		length = h.length
+	}
+	if length < minKeyLength || length > h.length {
+		return nil, fmt.Errorf("%s keys must be %d to %d hex digits long", name, minKeyLength, h.length)
+	}
+	return &keyHasher{name: name, sum: h.sum, length: length}, nil
+}
+
+// hash returns the entry name of key.
+func (kh *keyHasher) hash(key string) string {
+	return kh.sum([]byte(key))[:kh.length]
+}
+
+// migrate moves the entry previous names key, if there is one, to e, the
+// name the current hasher gives it, so changing hashes doesn't empty the
+// cache: each entry moves over the first time it's looked up. It reports
+// whether it moved one.
+func (c *cache) migrate(key string, e cacheEntry) bool {
+	if c.previousKeys == nil || c.readOnly || e.exists() {
+		return false
+	}
+	old := c.entryForHash(c.previousKeys.hash(key))
+	if old.hash == e.hash || !old.exists() {
+		return false
+	}
+	unlock := c.locks.lock(e)
+	defer unlock()
+	unlockOld := c.locks.lock(old)
+	defer unlockOld()
+	if e.exists() || !old.exists() {
+		return false
+	}
+
+	err := os.Rename(old.binaryFile, e.binaryFile)
+	if err == nil {
+		if err = os.Rename(old.headersFile, e.headersFile); err != nil {
+			os.Rename(e.binaryFile, old.binaryFile)
+		}
+	}
+	if err != nil {
+		slog.Error("Entry_migration_error", "from", old.hash, "to", e.hash, "error", err)
+		return false
+	}
+	os.Rename(cdnMarker(old), cdnMarker(e))
+	c.index.remove(old.hash)
+	c.access.forget(old.hash)
+	if meta, err := readMeta(e.headersFile); err == nil {
+		c.index.put(e.hash, indexEntry{URL: meta.URL, Size: meta.ContentLength, StoredAt: meta.StoredAt})
+	}
+	entriesMigratedTotal.Inc()
+	slog.Info("Entry_migrated", "from", old.hash, "to", e.hash)
+	return true
+}
@@ -0,0 +1,160 @@
+package passthru
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	cleanupLockFile = ".cleanup.lock"
+	cleanupLockKey  = "cleanup-leader"
+
+	// cleanupLeaseTTL is how long a replica stays cleanup leader without
+	// renewing. A leader renews before every pass, so this outlives the
+	// interval between passes; a leader that dies hands over once it runs
+	// out.
+	cleanupLeaseTTL = 2*cleanupInterval + cleanupRetryInterval
+
+	// cleanupLockSettle is how long a replica taking over the lock file
+	// waits before checking it won, since others may be taking it over at
+	// the same time.
+	cleanupLockSettle = time.Second
+
+	lockKindFile  = "file"
+	lockKindRedis = "redis"
+)
+
+// renewLeaseScript takes the cleanup lease if it is free or already held by
+// the caller, and extends it.
+var renewLeaseScript = redis.NewScript(`
+local holder = redis.call("get", KEYS[1])
+if holder == false or holder == ARGV[1] then
+	redis.call("set", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// cleanupLock elects the one replica that runs cleanup when several share a
+// storage directory, through a lease in a lock file on the shared storage or
+// in Redis. A nil cleanupLock makes every instance its own leader.
+type cleanupLock struct {
+	kind  string // lockKindFile or lockKindRedis
+	path  string
+	index *sharedIndex
+	owner string
+}
+
+func newCleanupLock(kind, storageDir string, index *sharedIndex) (*cleanupLock, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case lockKindFile:
+		return &cleanupLock{kind: kind, path: filepath.Join(storageDir, cleanupLockFile), owner: replicaID()}, nil
+	case lockKindRedis:
+		if !index.enabled() {
+			return nil, fmt.Errorf("a redis cleanup lock needs a redis address")
+		}
+		return &cleanupLock{kind: kind, index: index, owner: index.owner}, nil
+	}
+	return nil, fmt.Errorf("unknown cleanup lock %q, expected file or redis", kind)
+}
+
+// replicaID returns an identifier for this process that is unique among
+// replicas.
+func replicaID() string {
+	hostname, _ := os.Hostname()
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// acquire takes or renews the cleanup lease and reports whether this replica
+// is the leader. Errors are logged and count as not leading: a skipped pass
+// only delays cleanup, while two replicas cleaning at once race on the same
+// files.
+func (l *cleanupLock) acquire() bool {
+	if l == nil {
+		return true
+	}
+	var leader bool
+	var err error
+	if l.kind == lockKindRedis {
+		leader, err = l.acquireRedis()
+	} else {
+		leader, err = l.acquireFile()
+	}
+	if err != nil {
+		slog.Error("Cleanup_lock_error", "lock", l.kind, "error", err)
+		return false
+	}
+	return leader
+}
+
+func (l *cleanupLock) acquireRedis() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return renewLeaseScript.Run(ctx, l.index.client, []string{l.index.prefix + cleanupLockKey}, l.owner, cleanupLeaseTTL.Milliseconds()).Bool()
+}
+
+// acquireFile holds the lease in a lock file naming its holder, expiring
+// cleanupLeaseTTL after it was last touched.
+func (l *cleanupLock) acquireFile() (bool, error) {
+	holder, modTime, err := l.readLockFile()
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		if holder == l.owner {
+			now := time.Now()
+			return true, os.Chtimes(l.path, now, now)
+		}
+		if time.Since(modTime) < cleanupLeaseTTL {
+			return false, nil
+		}
+	}
+
+	// Free or expired: swap in our own lock file, then make sure no one
+	// else's replaced it in the meantime
+	tmp := l.path + "." + l.owner
+	if err := os.WriteFile(tmp, []byte(l.owner+"\n"), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	time.Sleep(cleanupLockSettle)
+	holder, _, err = l.readLockFile()
+	if err != nil {
+		return false, err
+	}
+	if holder == l.owner {
+		slog.Info("Cleanup_leadership_taken", "lock", l.kind, "owner", l.owner)
+	}
+	return holder == l.owner, nil
+}
+
+func (l *cleanupLock) readLockFile() (string, time.Time, error) {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	data := make([]byte, 256)
+	n, _ := f.Read(data)
+	return strings.TrimSpace(string(data[:n])), info.ModTime(), nil
+}
@@ -0,0 +1,94 @@
+package passthru
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// stallChunk is how much a client has to take within each stall timeout,
+// which sets the slowest rate at which it still gets the whole response.
+const stallChunk = 128 << 10
+
+// limitRequests wraps next so requests with a query string over maxQuery
+// bytes are refused, and clients that stop reading a response for longer
+// than stall are dropped instead of holding a file and a goroutine open
+// forever. Either is off at 0.
+func limitRequests(maxQuery int, stall time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxQuery > 0 && len(r.URL.RawQuery) > maxQuery {
+			http.Error(w, "Query string too long", http.StatusRequestURITooLong)
+			return
+		}
+		if stall > 0 {
+			sw := &stallWriter{ResponseWriter: w, rc: http.NewResponseController(w), stall: stall}
+			// The deadline would outlive the response on a kept-alive
+			// connection
+			defer sw.rc.SetWriteDeadline(time.Time{})
+			w = sw
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// stallWriter gives every write to the client stall to complete, so a
+// client that doesn't read fails the write rather than blocking it.
+type stallWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	stall   time.Duration
+	stalled bool
+}
+
+func (w *stallWriter) extend() {
+	w.rc.SetWriteDeadline(time.Now().Add(w.stall))
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > stallChunk {
+			chunk = chunk[:stallChunk]
+		}
+		w.extend()
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, w.check(err)
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ReadFrom keeps sendfile working through the writer, a chunk at a time.
+func (w *stallWriter) ReadFrom(r io.Reader) (int64, error) {
+	var written int64
+	for {
+		w.extend()
+		n, err := io.Copy(w.ResponseWriter, io.LimitReader(r, stallChunk))
+		written += n
+		if err != nil {
+			return written, w.check(err)
+		}
+		if n < stallChunk {
+			return written, nil
+		}
+	}
+}
+
+// check counts err against the client if it's a stall.
+func (w *stallWriter) check(err error) error {
+	if !w.stalled && errors.Is(err, os.ErrDeadlineExceeded) {
+		w.stalled = true
+		clientStallsTotal.Inc()
+	}
+	return err
+}
+
+func (w *stallWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
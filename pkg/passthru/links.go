@@ -0,0 +1,171 @@
+package passthru
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// linkSigner mints and checks signed, expiring links to cached files, which
+// can be handed to end users without giving them the open /?u= interface. A
+// nil linkSigner means signed links are off.
+type linkSigner struct {
+	secret  []byte
+	ttl     time.Duration // the default lifetime of a link
+	baseURL string
+}
+
+func newLinkSigner(secret string, ttl time.Duration, baseURL string) *linkSigner {
+	if secret == "" {
+		return nil
+	}
+	return &linkSigner{secret: []byte(secret), ttl: ttl, baseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+func (ls *linkSigner) enabled() bool {
+	return ls != nil
+}
+
+// sign returns the hex HMAC-SHA256 of a link to the entry hash of tenant ("" for
+// none) expiring at exp.
+func (ls *linkSigner) sign(tenant, hash string, exp int64) string {
+	mac := hmac.New(sha256.New, ls.secret)
+	fmt.Fprintf(mac, "%s\x00%s\x00%d", tenant, hash, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link returns a signed link to the entry hash of tenant, valid until exp.
+func (ls *linkSigner) link(tenant, hash string, exp time.Time) string {
+	link := fmt.Sprintf("%s/f/%s?exp=%d&sig=%s", ls.baseURL, hash, exp.Unix(), ls.sign(tenant, hash, exp.Unix()))
+	if tenant != "" {
+		link += "&t=" + tenant
+	}
+	return link
+}
+
+// verify checks the signature and expiry of a link request.
+func (ls *linkSigner) verify(r *http.Request) *fetchError {
+	query := r.URL.Query()
+	exp, err := strconv.ParseInt(query.Get("exp"), 10, 64)
+	sig, sigErr := hex.DecodeString(query.Get("sig"))
+	if err != nil || sigErr != nil {
+		return &fetchError{http.StatusForbidden, "Invalid link"}
+	}
+	want, _ := hex.DecodeString(ls.sign(query.Get("t"), mux.Vars(r)["hash"], exp))
+	if !hmac.Equal(sig, want) {
+		return &fetchError{http.StatusForbidden, "Invalid link"}
+	}
+	if time.Now().Unix() > exp {
+		return &fetchError{http.StatusGone, "Link has expired"}
+	}
+	return nil
+}
+
+type linkRequest struct {
+	URL string `json:"url"`
+	TTL string `json:"ttl"`
+}
+
+type linkResponse struct {
+	URL     string    `json:"url"`
+	Hash    string    `json:"hash"`
+	Link    string    `json:"link"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleLinkCreate mints a signed link to the media at u (or the "url" of a
+// JSON body), downloading it first if it isn't cached. The link lasts for
+// ttl, or the default link lifetime.
+func handleLinkCreate(c *cache, ls *linkSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ls.enabled() {
+			http.Error(w, "Signed links are not enabled", http.StatusNotImplemented)
+			return
+		}
+
+		req := linkRequest{URL: r.URL.Query().Get("u"), TTL: r.URL.Query().Get("ttl")}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.URL == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+		ttl := ls.ttl
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+				http.Error(w, "'ttl' must be a positive duration such as 1h", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c := c.forRequest(r)
+		tenant := c.namespace
+		e := c.entry(req.URL)
+		if _, err := c.ensure(r.Context(), req.URL, e); err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		exp := time.Now().Add(ttl).Truncate(time.Second)
+		slog.InfoContext(r.Context(), "Link_created", "hash", e.hash, "expires", exp.Format(time.RFC3339))
+		writeJSON(w, http.StatusCreated, linkResponse{
+			URL:     req.URL,
+			Hash:    e.hash,
+			Link:    ls.link(tenant, e.hash, exp),
+			Expires: exp,
+		})
+	}
+}
+
+// handleLink serves the cached file behind a signed link.
+func handleLink(c *cache, ls *linkSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ls.enabled() {
+			http.NotFound(w, r)
+			return
+		}
+		if fe := ls.verify(r); fe != nil {
+			http.Error(w, fe.message, fe.status)
+			return
+		}
+
+		c := c.forTenant(r.URL.Query().Get("t"))
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+		e := c.entryForHash(mux.Vars(r)["hash"])
+		if !e.exists() {
+			http.NotFound(w, r)
+			return
+		}
+		filename, err := requestFilename(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpRequestsTotal.WithLabelValues("/f", statusCached).Inc()
+		setCacheHeaders(w, e, statusCached)
+		c.serve(w, r.WithContext(withFilename(r.Context(), filename)), e)
+	}
+}
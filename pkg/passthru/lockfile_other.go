@@ -0,0 +1,18 @@
+//go:build !unix
+
+package passthru
+
+import (
+	"errors"
+	"os"
+)
+
+const lockFilesSupported = false
+
+func lockFile(path string, exclusive, wait bool) (*os.File, error) {
+	return nil, errors.New("lock files are not supported on this platform")
+}
+
+func unlockFile(f *os.File) {
+	f.Close()
+}
@@ -0,0 +1,60 @@
+//go:build unix
+
+package passthru
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const lockFilesSupported = true
+
+// lockFile opens and flocks the lock file at path, shared or exclusive,
+// creating it and its directory as needed. Unless wait is set it fails
+// straight away when the lock is held. The lock is released by unlockFile.
+func lockFile(path string, exclusive, wait bool) (*os.File, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				return nil, err
+			}
+			f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(f.Fd()), how); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		// Cleanup may have removed the file between our open and flock, in
+		// which case we hold a lock nobody else can see; start over
+		held, err1 := f.Stat()
+		current, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(held, current) {
+			return f, nil
+		}
+		f.Close()
+		if err1 != nil {
+			return nil, err1
+		}
+		if err2 != nil && !os.IsNotExist(err2) {
+			return nil, err2
+		}
+	}
+}
+
+func unlockFile(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
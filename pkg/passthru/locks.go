@@ -0,0 +1,174 @@
+package passthru
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockDirName is the storage subdirectory holding entry lock files.
+const lockDirName = ".locks"
+
+// entryLocks serialises work on each cache entry: storing or deleting an
+// entry takes its write lock and serving it a read lock, so an entry is
+// never deleted or rewritten while it's being written or served. With lock
+// files on, the locks also hold between replicas sharing the storage.
+type entryLocks struct {
+	mu    sync.Mutex
+	locks map[string]*entryLock
+	files bool
+}
+
+type entryLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newEntryLocks(files bool) *entryLocks {
+	return &entryLocks{locks: make(map[string]*entryLock), files: files}
+}
+
+// lockKey names e's lock after the path its files share, minus their
+// extensions (.bin, .headers, ...).
+func (e cacheEntry) lockKey() string {
+	return strings.TrimSuffix(e.binaryFile, ".bin")
+}
+
+// lockFilePath returns the lock file of the entry with the given key, in the
+// lock directory of the entry's storage directory.
+func lockFilePath(key string) string {
+	return filepath.Join(filepath.Dir(key), lockDirName, filepath.Base(key)+".lock")
+}
+
+func (l *entryLocks) get(key string) *entryLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el := l.locks[key]
+	if el == nil {
+		el = &entryLock{}
+		l.locks[key] = el
+	}
+	el.refs++
+	return el
+}
+
+func (l *entryLocks) put(key string, el *entryLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el.refs--; el.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// lock takes e's write lock, waiting for it, and returns the function that
+// releases it.
+func (l *entryLocks) lock(e cacheEntry) func() {
+	return l.acquire(e.lockKey(), true)
+}
+
+// rlock takes e's read lock, waiting for it, and returns the function that
+// releases it.
+func (l *entryLocks) rlock(e cacheEntry) func() {
+	return l.acquire(e.lockKey(), false)
+}
+
+func (l *entryLocks) acquire(key string, exclusive bool) func() {
+	el := l.get(key)
+	if exclusive {
+		el.Lock()
+	} else {
+		el.RLock()
+	}
+	release := func() {
+		if exclusive {
+			el.Unlock()
+		} else {
+			el.RUnlock()
+		}
+		l.put(key, el)
+	}
+	if !l.files {
+		return release
+	}
+
+	// A lock file that can't be taken is logged and done without, so a
+	// storage hiccup degrades to in-process locking rather than failing
+	// requests
+	f, err := lockFile(lockFilePath(key), exclusive, true)
+	if err != nil {
+		slog.Error("Entry_lock_file_error", "key", key, "error", err)
+		return release
+	}
+	return func() {
+		unlockFile(f)
+		release()
+	}
+}
+
+// tryLock takes the write lock of the entry with key if it is free right
+// now, returning the function that releases it and whether it did. It's for
+// cleanup, which comes back later for entries in use. A nil entryLocks
+// locks nothing.
+func (l *entryLocks) tryLock(key string) (func(), bool) {
+	if l == nil {
+		return func() {}, true
+	}
+	el := l.get(key)
+	if !el.TryLock() {
+		l.put(key, el)
+		return nil, false
+	}
+	release := func() {
+		el.Unlock()
+		l.put(key, el)
+	}
+	if !l.files {
+		return release, true
+	}
+
+	f, err := lockFile(lockFilePath(key), true, false)
+	if err != nil {
+		release()
+		return nil, false
+	}
+	return func() {
+		unlockFile(f)
+		release()
+	}, true
+}
+
+// removeStaleLockFiles deletes the lock files in the lock directory of
+// storageDir left over by entries that are gone, once they're older than
+// cutoff and nobody holds them.
+func (l *entryLocks) removeStaleLockFiles(storageDir string, cutoff time.Time, report *cleanupReport) {
+	if !l.files {
+		return
+	}
+	lockDir := filepath.Join(storageDir, lockDirName)
+	err := readDirBatched(lockDir, func(files []os.DirEntry) bool {
+		for _, file := range files {
+			base := strings.TrimSuffix(file.Name(), ".lock")
+			if base == file.Name() || fileExists(filepath.Join(storageDir, base+".bin")) {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue
+			}
+			key := filepath.Join(storageDir, base)
+			unlock, ok := l.tryLock(key)
+			if !ok {
+				continue
+			}
+			os.Remove(lockFilePath(key))
+			unlock()
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		report.addError(err)
+	}
+}
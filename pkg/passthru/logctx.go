@@ -0,0 +1,159 @@
+package passthru
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestIDHeader carries a request's ID, from a client or proxy that gave
+// it one, back to the client, and on to peers the request is handed to.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDPattern is what a request ID taken from a client may look like.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// logFields are the fields every line logged for a request carries: its ID
+// from the start, and what's learned along the way, such as its entry's
+// hash.
+type logFields struct {
+	requestID string
+
+	mu    sync.Mutex
+	attrs []slog.Attr
+}
+
+type logFieldsContextKey struct{}
+
+// newRequestID returns a random ID for a request that came without one.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID returns ctx for a request with id, which every line logged
+// with it carries.
+func withRequestID(ctx context.Context, id string) context.Context {
+	fields := &logFields{requestID: id, attrs: []slog.Attr{slog.String("request_id", id)}}
+	return context.WithValue(ctx, logFieldsContextKey{}, fields)
+}
+
+// requestIDFrom returns the ID of the request in ctx, if any.
+func requestIDFrom(ctx context.Context) string {
+	if fields, ok := ctx.Value(logFieldsContextKey{}).(*logFields); ok {
+		return fields.requestID
+	}
+	return ""
+}
+
+// setRequestID passes the ID of the request in ctx on with req, a request
+// upstream made for it, so upstream's logs can be matched with ours.
+func setRequestID(ctx context.Context, req *http.Request) {
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// addLogFields adds key-value pairs to the fields of the request in ctx,
+// replacing any it has under the same keys. Without a request it does
+// nothing.
+func addLogFields(ctx context.Context, args ...any) {
+	fields, ok := ctx.Value(logFieldsContextKey{}).(*logFields)
+	if !ok {
+		return
+	}
+	record := slog.NewRecord(time.Time{}, 0, "", 0)
+	record.Add(args...)
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+	record.Attrs(func(a slog.Attr) bool {
+		for i := range fields.attrs {
+			if fields.attrs[i].Key == a.Key {
+				fields.attrs[i] = a
+				return true
+			}
+		}
+		fields.attrs = append(fields.attrs, a)
+		return true
+	})
+}
+
+// logHandler adds the fields of the request being logged for to every
+// line.
+type logHandler struct {
+	slog.Handler
+}
+
+// NewLogHandler wraps h so every line logged for a request carries the
+// request's ID, and what's known of it so far, such as the hash of the
+// entry it's for. Set it as the default logger's handler to get them:
+//
+//	slog.SetDefault(slog.New(passthru.NewLogHandler(slog.NewJSONHandler(os.Stderr, nil))))
+func NewLogHandler(h slog.Handler) slog.Handler {
+	return logHandler{h}
+}
+
+func (h logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields, ok := ctx.Value(logFieldsContextKey{}).(*logFields); ok {
+		// A line's own value for a key wins over the request's
+		own := make(map[string]bool, record.NumAttrs())
+		record.Attrs(func(a slog.Attr) bool {
+			own[a.Key] = true
+			return true
+		})
+		fields.mu.Lock()
+		for _, a := range fields.attrs {
+			if !own[a.Key] {
+				record.AddAttrs(a)
+			}
+		}
+		fields.mu.Unlock()
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{h.Handler.WithGroup(name)}
+}
+
+// logRequests wraps next so each request has an ID, taken from its
+// X-Request-ID if it has a usable one, on every line logged for it, and
+// so it ends with a line saying how it went: its status, cache status,
+// bytes sent and duration. Media requests' durations are observed by cache
+// status too.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		cw := &countingWriter{ResponseWriter: sw}
+		next.ServeHTTP(cw, r)
+
+		duration := time.Since(start)
+		cacheStatus := w.Header().Get(cacheHeader)
+		if cacheStatus == "" {
+			cacheStatus = "-"
+		} else {
+			requestDuration.WithLabelValues(strings.ToLower(cacheStatus)).Observe(duration.Seconds())
+		}
+		slog.InfoContext(r.Context(), "Request_completed", "method", r.Method, "path", r.URL.Path, "status", sw.status, "cache_status", cacheStatus, "bytes", cw.n, "duration", duration)
+	})
+}
@@ -0,0 +1,203 @@
+package passthru
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedTimeFormat names rotated log files after when they were rotated.
+const rotatedTimeFormat = "20060102T150405.000"
+
+// LogRotation is when a log file is rotated and how many of the rotated
+// ones are kept. Zero fields turn that part off.
+type LogRotation struct {
+	// MaxSize rotates the file once it holds this many bytes, and MaxAge
+	// once it's this old.
+	MaxSize int64
+	MaxAge  time.Duration
+	// MaxBackups is how many rotated files are kept, the oldest going
+	// first.
+	MaxBackups int
+	// Compress gzips rotated files.
+	Compress bool
+}
+
+// RotatingFile is a log file that rotates itself: once it's too big or too
+// old it's renamed after the time, optionally compressed in the
+// background, and a new one started in its place. It's safe for
+// concurrent use, so it can back both log.SetOutput and the access log.
+type RotatingFile struct {
+	path     string
+	rotation LogRotation
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	opened  time.Time
+	pending sync.WaitGroup // compressions running
+}
+
+// OpenRotatingFile opens the log file at path for appending, creating it
+// and its directory if need be.
+func OpenRotatingFile(path string, rotation LogRotation) (*RotatingFile, error) {
+	if rotation.MaxSize < 0 || rotation.MaxAge < 0 || rotation.MaxBackups < 0 {
+		return nil, fmt.Errorf("log rotation settings can't be negative")
+	}
+	rf := &RotatingFile{path: path, rotation: rotation}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// A file left by the last run is carried on with, its age counted from
+	// now
+	rf.f, rf.size, rf.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// MaxSize or it's older than MaxAge. A line is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := rf.rotation.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.rotation.MaxSize
+	tooOld := rf.rotation.MaxAge > 0 && time.Since(rf.opened) >= rf.rotation.MaxAge
+	if tooBig || tooOld {
+		if err := rf.rotateLocked(); err != nil {
+			// Keep logging to the file we have rather than lose lines
+			fmt.Fprintf(os.Stderr, "ts=%s msg=Log_rotation_error file=%s error=%v\n", time.Now().Format(time.RFC3339), rf.path, err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file now, e.g. on SIGHUP.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rotateLocked()
+}
+
+func (rf *RotatingFile) rotateLocked() error {
+	rotated := rf.path + "." + time.Now().Format(rotatedTimeFormat)
+	if err := os.Rename(rf.path, rotated); err != nil {
+		return err
+	}
+	old := rf.f
+	if err := rf.open(); err != nil {
+		// Nowhere new to write to, so put the old file back
+		os.Rename(rotated, rf.path)
+		return err
+	}
+	old.Close()
+
+	if rf.rotation.Compress {
+		rf.pending.Add(1)
+		go func() {
+			defer rf.pending.Done()
+			compressLogFile(rotated)
+			rf.prune()
+		}()
+	} else {
+		rf.prune()
+	}
+	return nil
+}
+
+// compressLogFile gzips the rotated log file at path, replacing it.
+func compressLogFile(path string) {
+	err := func() error {
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		dst, err := os.Create(path + ".gz.tmp")
+		if err != nil {
+			return err
+		}
+		zw := gzip.NewWriter(dst)
+		_, err = io.Copy(zw, src)
+		if closeErr := zw.Close(); err == nil {
+			err = closeErr
+		}
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(path+".gz.tmp", path+".gz")
+		}
+		if err != nil {
+			os.Remove(path + ".gz.tmp")
+		}
+		return err
+	}()
+	if err != nil {
+		slog.Error("Log_compression_error", "file", path, "error", err)
+		return
+	}
+	os.Remove(path)
+}
+
+// prune removes the oldest rotated files over MaxBackups.
+func (rf *RotatingFile) prune() {
+	if rf.rotation.MaxBackups <= 0 {
+		return
+	}
+	matches, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return
+	}
+	var rotated []string
+	for _, match := range matches {
+		if !strings.HasSuffix(match, ".tmp") {
+			rotated = append(rotated, match)
+		}
+	}
+	// The names sort by when they were rotated, newest last
+	sort.Strings(rotated)
+	for len(rotated) > rf.rotation.MaxBackups {
+		os.Remove(rotated[0])
+		rotated = rotated[1:]
+	}
+}
+
+// Close closes the file, once any compressions running are done.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	f := rf.f
+	rf.f = nil
+	rf.mu.Unlock()
+	rf.pending.Wait()
+	if f == nil {
+		return nil
+	}
+	return f.Close()
+}
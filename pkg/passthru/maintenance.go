@@ -0,0 +1,192 @@
+package passthru
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maintenanceRetryAfter is the Retry-After sent with misses refused in
+// cache-only mode when it wasn't turned on for a set time.
+const maintenanceRetryAfter = 5 * time.Minute
+
+// errMaintenance is returned for anything that would have to go upstream
+// while in cache-only mode.
+var errMaintenance = &fetchError{http.StatusServiceUnavailable, "Only cached media is being served right now"}
+
+// maintenanceMode is cache-only mode: while it is on, hits are served as
+// usual but nothing goes to the external service, so cobalt can be taken
+// down or egress frozen without the instance going down with it. Every
+// tenant's cache shares the one switch.
+type maintenanceMode struct {
+	mu    sync.Mutex
+	on    bool
+	since time.Time
+	until time.Time // zero until turned off
+}
+
+func newMaintenanceMode(on bool) *maintenanceMode {
+	m := &maintenanceMode{}
+	if on {
+		m.enable(0)
+	} else {
+		maintenanceActive.Set(0)
+	}
+	return m
+}
+
+// active reports whether cache-only mode is on at now, turning it off if
+// its time is up.
+func (m *maintenanceMode) active(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.on && !m.until.IsZero() && !now.Before(m.until) {
+		m.disableLocked()
+	}
+	return m.on
+}
+
+// enable turns cache-only mode on, for d if positive and otherwise until
+// disable is called.
+func (m *maintenanceMode) enable(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if !m.on {
+		m.since = now
+	}
+	m.on = true
+	m.until = time.Time{}
+	if d > 0 {
+		m.until = now.Add(d)
+	}
+	maintenanceActive.Set(1)
+	slog.Info("Cache_only_mode_on", "for", d)
+}
+
+func (m *maintenanceMode) disable() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.disableLocked()
+}
+
+func (m *maintenanceMode) disableLocked() {
+	if !m.on {
+		return
+	}
+	m.on = false
+	m.since, m.until = time.Time{}, time.Time{}
+	maintenanceActive.Set(0)
+	slog.Info("Cache_only_mode_off")
+}
+
+// refuse returns errMaintenance if cache-only mode is on, counting the
+// refusal.
+func (m *maintenanceMode) refuse() error {
+	if !m.active(time.Now()) {
+		return nil
+	}
+	maintenanceRefusedTotal.Inc()
+	return errMaintenance
+}
+
+// retryAfter is how long clients refused now should wait before trying
+// again.
+func (m *maintenanceMode) retryAfter(now time.Time) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.until.IsZero() {
+		return maintenanceRetryAfter
+	}
+	return m.until.Sub(now)
+}
+
+type maintenanceStatus struct {
+	CacheOnly bool       `json:"cacheOnly"`
+	Since     *time.Time `json:"since,omitempty"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+func (m *maintenanceMode) status() maintenanceStatus {
+	on := m.active(time.Now())
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := maintenanceStatus{CacheOnly: on}
+	if on {
+		since := m.since
+		s.Since = &since
+		if !m.until.IsZero() {
+			until := m.until
+			s.Until = &until
+		}
+	}
+	return s
+}
+
+// annotate wraps next so the 503s sent while in cache-only mode say when to
+// come back. The handlers refusing misses don't know they're in a web
+// request, let alone which one.
+func (m *maintenanceMode) annotate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m.active(time.Now()) {
+			w = &retryAfterWriter{ResponseWriter: w, mode: m}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// retryAfterWriter adds a Retry-After to 503 responses that lack one.
+type retryAfterWriter struct {
+	http.ResponseWriter
+	mode *maintenanceMode
+}
+
+func (w *retryAfterWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(w.mode.retryAfter(time.Now()).Seconds())+1, 10))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom keeps sendfile working through the writer.
+func (w *retryAfterWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *retryAfterWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func handleMaintenanceStatus(m *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, m.status())
+	}
+}
+
+// handleMaintenanceOn turns cache-only mode on, optionally for a limited
+// time given by the "for" query parameter (e.g. ?for=30m).
+func handleMaintenanceOn(m *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var d time.Duration
+		if v := r.URL.Query().Get("for"); v != "" {
+			var err error
+			d, err = time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "'for' must be a positive duration", http.StatusBadRequest)
+				return
+			}
+		}
+		m.enable(d)
+		writeJSON(w, http.StatusOK, m.status())
+	}
+}
+
+func handleMaintenanceOff(m *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.disable()
+		writeJSON(w, http.StatusOK, m.status())
+	}
+}
@@ -0,0 +1,438 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mediaProcessor runs ffmpeg on cached entries with a bounded pool of
+// workers and stores each result as a cache entry of its own, so derived
+// renditions are produced once and then served like any other hit.
+type mediaProcessor struct {
+	ffmpeg  string
+	ffprobe string // empty when ffprobe isn't available
+	slots   chan struct{}
+	durable bool
+
+	mu      sync.Mutex
+	running map[string]*mediaCall
+}
+
+// mediaCall is an ffmpeg run in progress that other requests for the same
+// output can wait on.
+type mediaCall struct {
+	done chan struct{}
+	err  error
+}
+
+// newMediaProcessor returns a processor running at most workers ffmpeg (or
+// ffprobe) processes at once, or nil if ffmpeg can't be found. Probing is
+// left disabled if ffprobe can't be found. With durable set, results are
+// flushed to stable storage before they count as cached.
+func newMediaProcessor(ffmpeg, ffprobe string, workers int, durable bool) *mediaProcessor {
+	path, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		slog.Info("Ffmpeg_not_found", "ffmpeg", ffmpeg, "error", err)
+		return nil
+	}
+	probePath, err := exec.LookPath(ffprobe)
+	if err != nil {
+		slog.Info("Ffprobe_not_found", "ffprobe", ffprobe, "error", err)
+		probePath = ""
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	return &mediaProcessor{
+		ffmpeg:  path,
+		ffprobe: probePath,
+		slots:   make(chan struct{}, workers),
+		durable: durable,
+		running: make(map[string]*mediaCall),
+	}
+}
+
+// errNoSuchStream is returned when ffmpeg finds no stream of the kind it
+// was asked to map, such as subtitles the media doesn't have.
+var errNoSuchStream = errors.New("no such stream")
+
+// derive makes dst by running ffmpeg on src's binary as described by d, and
+// stores d's content type as dst's headers. Concurrent calls for the same dst
+// share one ffmpeg run.
+func (mp *mediaProcessor) derive(ctx context.Context, src, dst cacheEntry, d *derivation) error {
+	if dst.exists() {
+		return nil
+	}
+	return mp.once(ctx, dst.hash, func() error {
+		return mp.run(src, dst, d)
+	})
+}
+
+// once runs fn unless a call for the same key is already running, in which
+// case it waits for that call and returns its result instead.
+func (mp *mediaProcessor) once(ctx context.Context, key string, fn func() error) error {
+	mp.mu.Lock()
+	if call, ok := mp.running[key]; ok {
+		mp.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	call := &mediaCall{done: make(chan struct{})}
+	mp.running[key] = call
+	mp.mu.Unlock()
+
+	call.err = fn()
+
+	mp.mu.Lock()
+	delete(mp.running, key)
+	mp.mu.Unlock()
+	close(call.done)
+
+	return call.err
+}
+
+func (mp *mediaProcessor) run(src, dst cacheEntry, d *derivation) error {
+	mp.slots <- struct{}{}
+	defer func() { <-mp.slots }()
+
+	start := time.Now()
+	kind := d.kind
+	tmp := dst.binaryFile + ".tmp"
+	cmdArgs := append([]string{"-hide_banner", "-loglevel", "error", "-y"}, d.inputArgs...)
+	cmdArgs = append(cmdArgs, "-i", src.binaryFile)
+	cmdArgs = append(cmdArgs, d.args...)
+	cmdArgs = append(cmdArgs, tmp)
+
+	slog.Info("Ffmpeg_started", "kind", kind, "src", src.hash, "dst", dst.hash)
+	var stderr bytes.Buffer
+	cmd := exec.Command(mp.ffmpeg, cmdArgs...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		err = syncPath(tmp, mp.durable)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst.binaryFile)
+	}
+	if err == nil {
+		meta := newMeta(http.Header{"Content-Type": {d.contentType}})
+		if info, statErr := os.Stat(dst.binaryFile); statErr == nil {
+			meta.ContentLength = info.Size()
+		}
+		err = writeFile(dst.headersFile, meta.encode(), mp.durable)
+	}
+	if err == nil {
+		err = syncPath(filepath.Dir(dst.headersFile), mp.durable)
+	}
+
+	mediaJobDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	if err != nil {
+		os.Remove(tmp)
+		slog.Error("Ffmpeg_failed", "kind", kind, "src", src.hash, "error", err, "stderr", stderr.String())
+		mediaJobsTotal.WithLabelValues(kind, "failed").Inc()
+		if strings.Contains(stderr.String(), "matches no streams") {
+			return errNoSuchStream
+		}
+		return fmt.Errorf("ffmpeg %s: %v", kind, err)
+	}
+
+	slog.Info("Ffmpeg_finished", "kind", kind, "dst", dst.hash, "duration", time.Since(start))
+	mediaJobsTotal.WithLabelValues(kind, "done").Inc()
+	return nil
+}
+
+// derivation describes a rendition derived from a cached entry by ffmpeg.
+type derivation struct {
+	key         string // mixed into the derived entry's cache key
+	kind        string // metrics label
+	contentType string
+	inputArgs   []string // placed before -i
+	args        []string // placed between the input and output files
+	// subtitleLang is asked of the external service for the media this is
+	// derived from, which is then an entry of its own.
+	subtitleLang string
+}
+
+// parseDerivation reads the query parameters asking for a derived rendition
+// (format/maxheight for a transcode, extract for an audio track, subs or
+// asset=subtitles for subtitles, those in defaultSubs for the latter
+// unless subs is set). It returns nil if none is set.
+func parseDerivation(query url.Values, defaultSubs string) (*derivation, error) {
+	transcode, err := parseTranscodeOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	audio, err := parseAudioOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	subtitles, err := parseSubtitleOptions(query, defaultSubs)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case transcode != nil && audio != nil:
+		return nil, fmt.Errorf("'extract' can't be combined with 'format' or 'maxheight'")
+	case subtitles != nil && (transcode != nil || audio != nil):
+		return nil, fmt.Errorf("subtitles can't be combined with 'format', 'maxheight' or 'extract'")
+	case transcode != nil:
+		return transcode.derivation(), nil
+	case audio != nil:
+		return audio.derivation(), nil
+	case subtitles != nil:
+		return subtitles.derivation(), nil
+	}
+	return nil, nil
+}
+
+// produce returns the entry holding the rendition of src described by d,
+// running ffmpeg first if it isn't cached yet.
+func (mp *mediaProcessor) produce(ctx context.Context, c *cache, url string, src cacheEntry, d *derivation) (cacheEntry, error) {
+	dst := c.variant(url, d.key)
+	if err := mp.derive(ctx, src, dst, d); err != nil {
+		if errors.Is(err, errNoSuchStream) {
+			return dst, &fetchError{http.StatusNotFound, "The media has no such stream"}
+		}
+		return dst, &fetchError{http.StatusInternalServerError, "Failed to process resource"}
+	}
+	return dst, nil
+}
+
+// transcodeOptions is a requested transcoded variant of an entry.
+type transcodeOptions struct {
+	format    string
+	maxHeight int
+}
+
+var transcodeFormats = map[string]string{
+	"mp4":  "video/mp4",
+	"webm": "video/webm",
+}
+
+// parseTranscodeOptions reads the format and maxheight query parameters. It
+// returns nil if neither is set.
+func parseTranscodeOptions(query url.Values) (*transcodeOptions, error) {
+	format, maxHeight := query.Get("format"), query.Get("maxheight")
+	if format == "" && maxHeight == "" {
+		return nil, nil
+	}
+
+	opts := &transcodeOptions{format: format}
+	if opts.format == "" {
+		opts.format = "mp4"
+	}
+	if _, ok := transcodeFormats[opts.format]; !ok {
+		return nil, fmt.Errorf("'format' must be mp4 or webm")
+	}
+	if maxHeight != "" {
+		h, err := strconv.Atoi(maxHeight)
+		if err != nil || h < 144 || h > 4320 {
+			return nil, fmt.Errorf("'maxheight' must be a number between 144 and 4320")
+		}
+		opts.maxHeight = h
+	}
+	return opts, nil
+}
+
+func (o *transcodeOptions) derivation() *derivation {
+	var args []string
+	if o.maxHeight > 0 {
+		// Never upscale, and keep the width even as the encoders require
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:'min(%d,ih)'", o.maxHeight))
+	}
+	switch o.format {
+	case "webm":
+		args = append(args, "-c:v", "libvpx-vp9", "-b:v", "0", "-crf", "32", "-c:a", "libopus", "-f", "webm")
+	default:
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-c:a", "aac", "-movflags", "+faststart", "-f", "mp4")
+	}
+	return &derivation{
+		key:         fmt.Sprintf("format=%s&maxheight=%d", o.format, o.maxHeight),
+		kind:        "transcode_" + o.format,
+		contentType: transcodeFormats[o.format],
+		args:        args,
+	}
+}
+
+// audioOptions is a requested audio-only rendition of an entry.
+type audioOptions struct {
+	format string
+}
+
+var audioFormats = map[string]string{
+	"m4a":  "audio/mp4",
+	"mp3":  "audio/mpeg",
+	"opus": "audio/ogg",
+}
+
+// parseAudioOptions reads the extract and audioformat query parameters. It
+// returns nil unless extract=audio is set, or audioformat is on a request
+// for cobalt's audio alone.
+func parseAudioOptions(query url.Values) (*audioOptions, error) {
+	extract := query.Get("extract")
+	if extract == "" && query.Get("audioformat") != "" && wantsAudioOnly(query) {
+		// cobalt's audio, remuxed to the format asked for
+		extract = "audio"
+	}
+	if extract == "" {
+		return nil, nil
+	}
+	if extract != "audio" {
+		return nil, fmt.Errorf("'extract' must be audio")
+	}
+
+	opts := &audioOptions{format: query.Get("audioformat")}
+	if opts.format == "" {
+		opts.format = "m4a"
+	}
+	if _, ok := audioFormats[opts.format]; !ok {
+		return nil, fmt.Errorf("'audioformat' must be m4a, mp3 or opus")
+	}
+	return opts, nil
+}
+
+func (o *audioOptions) derivation() *derivation {
+	args := []string{"-vn"}
+	switch o.format {
+	case "mp3":
+		args = append(args, "-c:a", "libmp3lame", "-q:a", "2", "-f", "mp3")
+	case "opus":
+		args = append(args, "-c:a", "libopus", "-b:a", "128k", "-f", "ogg")
+	default:
+		args = append(args, "-c:a", "aac", "-b:a", "192k", "-movflags", "+faststart", "-f", "ipod")
+	}
+	return &derivation{
+		key:         "extract=audio&audioformat=" + o.format,
+		kind:        "audio_" + o.format,
+		contentType: audioFormats[o.format],
+		args:        args,
+	}
+}
+
+// thumbnailOptions is a requested still frame of a video entry.
+type thumbnailOptions struct {
+	at     time.Duration
+	width  int
+	format string
+}
+
+var thumbnailFormats = map[string]string{
+	"jpg":  "image/jpeg",
+	"webp": "image/webp",
+}
+
+// parseThumbnailOptions reads the t (offset, e.g. 5s), w (width in pixels)
+// and fmt (jpg or webp) query parameters.
+func parseThumbnailOptions(query url.Values) (*thumbnailOptions, error) {
+	opts := &thumbnailOptions{format: query.Get("fmt")}
+	if v := query.Get("t"); v != "" {
+		at, err := time.ParseDuration(v)
+		if err != nil {
+			secs, ferr := strconv.ParseFloat(v, 64)
+			if ferr != nil {
+				return nil, fmt.Errorf("'t' must be a duration such as 5s")
+			}
+			at = time.Duration(secs * float64(time.Second))
+		}
+		if at < 0 {
+			return nil, fmt.Errorf("'t' can't be negative")
+		}
+		opts.at = at
+	}
+	if v := query.Get("w"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil || width < 16 || width > 3840 {
+			return nil, fmt.Errorf("'w' must be a number between 16 and 3840")
+		}
+		opts.width = width
+	}
+	if opts.format == "" {
+		opts.format = "jpg"
+	}
+	if _, ok := thumbnailFormats[opts.format]; !ok {
+		return nil, fmt.Errorf("'fmt' must be jpg or webp")
+	}
+	return opts, nil
+}
+
+func (o *thumbnailOptions) derivation() *derivation {
+	args := []string{"-frames:v", "1", "-an"}
+	if o.width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", o.width))
+	}
+	if o.format == "webp" {
+		args = append(args, "-c:v", "libwebp", "-f", "webp")
+	} else {
+		args = append(args, "-c:v", "mjpeg", "-q:v", "3", "-f", "image2")
+	}
+	return &derivation{
+		key:         fmt.Sprintf("thumbnail&t=%s&w=%d&fmt=%s", o.at, o.width, o.format),
+		kind:        "thumbnail_" + o.format,
+		contentType: thumbnailFormats[o.format],
+		inputArgs:   []string{"-ss", strconv.FormatFloat(o.at.Seconds(), 'f', 3, 64)},
+		args:        args,
+	}
+}
+
+// handleThumbnail serves a still frame of the video at u, downloading the
+// video first if it isn't cached.
+func handleThumbnail(c *cache, media *mediaProcessor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if media == nil {
+			http.Error(w, "Media processing is not available", http.StatusNotImplemented)
+			return
+		}
+
+		queryParams := r.URL.Query()
+		url := queryParams.Get("u")
+		if url == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+		opts, err := parseThumbnailOptions(queryParams)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c := c.forRequest(r)
+		e := c.entry(url)
+		cacheStatus, err := c.ensure(r.Context(), url, e)
+		setCacheHeaders(w, e, cacheStatus)
+		if err == nil {
+			e, err = media.produce(r.Context(), c, url, e, opts.derivation())
+		}
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to create thumbnail", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		if cacheStatus == statusCached {
+			usageFrom(r.Context()).hit()
+		}
+		slog.InfoContext(r.Context(), "Serving_thumbnail", "u", url, "cache_status", cacheStatus)
+		c.serve(w, r, e)
+	}
+}
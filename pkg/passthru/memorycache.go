@@ -0,0 +1,119 @@
+package passthru
+
+import (
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// memoryCache keeps small entries in memory, up to a budget in bytes, so
+// the ones served over and over (thumbnails, audio clips, subtitles) are
+// served without opening their files. Entries get in when they're served
+// from disk, and the least recently served go once it's full. A copy is
+// checked against its binary's size and time before it's served, so one
+// that's been replaced or removed is dropped rather than served. A nil
+// memoryCache keeps nothing.
+type memoryCache struct {
+	budget  int64
+	maxItem int64
+
+	mu    sync.Mutex
+	size  int64
+	items map[string]*list.Element
+	// order has the most recently served item first.
+	order *list.List
+}
+
+// memoryItem is an entry kept in memory, by the name of its binary.
+type memoryItem struct {
+	name string
+	data []byte
+	meta entryMeta
+	info os.FileInfo
+}
+
+// newMemoryCache returns a memory cache of budget bytes taking entries of
+// up to maxItem bytes, or nil if budget is 0.
+func newMemoryCache(budget, maxItem int64) *memoryCache {
+	if budget <= 0 {
+		return nil
+	}
+	if maxItem <= 0 || maxItem > budget {
+		maxItem = budget
+	}
+	memoryCacheBytes.Set(0)
+	return &memoryCache{budget: budget, maxItem: maxItem, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (mc *memoryCache) enabled() bool {
+	return mc != nil
+}
+
+// fits reports whether an entry of size bytes may be kept.
+func (mc *memoryCache) fits(size int64) bool {
+	return mc != nil && size <= mc.maxItem
+}
+
+// get returns the copy of the binary name, if there's one that's current
+// and not expired.
+func (mc *memoryCache) get(name string, now time.Time, checkExpiry bool) *memoryItem {
+	if mc == nil {
+		return nil
+	}
+	mc.mu.Lock()
+	el := mc.items[name]
+	if el != nil {
+		mc.order.MoveToFront(el)
+	}
+	mc.mu.Unlock()
+	if el == nil {
+		return nil
+	}
+	item := el.Value.(*memoryItem)
+	info, err := os.Stat(name)
+	if err != nil || info.Size() != item.info.Size() || !info.ModTime().Equal(item.info.ModTime()) || checkExpiry && item.meta.expired(now) {
+		mc.forget(name)
+		return nil
+	}
+	memoryCacheHitsTotal.Inc()
+	return item
+}
+
+// put keeps a copy of the binary name, making room for it.
+func (mc *memoryCache) put(name string, data []byte, meta entryMeta, info os.FileInfo) {
+	if !mc.fits(int64(len(data))) {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el := mc.items[name]; el != nil {
+		mc.drop(el)
+	}
+	for mc.size+int64(len(data)) > mc.budget {
+		mc.drop(mc.order.Back())
+	}
+	mc.items[name] = mc.order.PushFront(&memoryItem{name: name, data: data, meta: meta, info: info})
+	mc.size += int64(len(data))
+	memoryCacheBytes.Set(float64(mc.size))
+}
+
+// forget drops the copy of the binary name, if there's one.
+func (mc *memoryCache) forget(name string) {
+	if mc == nil {
+		return
+	}
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	if el := mc.items[name]; el != nil {
+		mc.drop(el)
+		memoryCacheBytes.Set(float64(mc.size))
+	}
+}
+
+// drop removes el. The caller holds mc.mu.
+func (mc *memoryCache) drop(el *list.Element) {
+	item := mc.order.Remove(el).(*memoryItem)
+	delete(mc.items, item.name)
+	mc.size -= int64(len(item.data))
+}
@@ -0,0 +1,234 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// statusLocalProcessing is the status of an external service response
+// that hands out the streams of the media separately, for the client to
+// put together.
+const statusLocalProcessing = "local-processing"
+
+// mergeFormats are the ffmpeg muxers used for the containers cobalt names
+// its merged output after.
+var mergeFormats = map[string]string{
+	".mp4":  "mp4",
+	".m4v":  "mp4",
+	".mov":  "mov",
+	".webm": "webm",
+	".mkv":  "matroska",
+}
+
+// mergeStreams downloads the video and audio streams of a local-processing
+// response, muxes them into one file with ffmpeg, without re-encoding, and
+// stores that as e. It reports whether the AfterDownload hooks, which see
+// the video stream's response with the merged file as its body, let the
+// entry stay in the cache. progress counts the bytes of both streams.
+func (c *cache) mergeStreams(ctx context.Context, url string, e cacheEntry, serviceResp *ExternalServiceResponse, progress io.Writer) (bool, error) {
+	if c.merger == nil {
+		slog.InfoContext(ctx, "Local_processing_disabled", "url", url)
+		return false, &fetchError{http.StatusBadGateway, "External service asked for local processing, which is not enabled"}
+	}
+	if serviceResp.Type != "merge" || len(serviceResp.Tunnel) != 2 {
+		slog.InfoContext(ctx, "Local_processing_unsupported", "url", url, "type", serviceResp.Type, "tunnels", len(serviceResp.Tunnel))
+		return false, &fetchError{http.StatusBadGateway, "Unsupported local processing from external service"}
+	}
+
+	filename := serviceResp.Output.Filename
+	format, ok := mergeFormats[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		format = "mp4"
+	}
+	contentType := serviceResp.Output.Type
+	if contentType == "" {
+		contentType = mime.TypeByExtension("." + format)
+	}
+
+	video, audio := e.binaryFile+".video", e.binaryFile+".audio"
+	defer os.Remove(video)
+	defer os.Remove(audio)
+	videoResp, err := c.downloadStream(ctx, url, serviceResp.Tunnel[0], video, progress)
+	if err == nil {
+		_, err = c.downloadStream(ctx, url, serviceResp.Tunnel[1], audio, progress)
+	}
+	if err != nil {
+		c.resolutions.forget(c.resolveKey(ctx, url))
+		return false, err
+	}
+	tmp := e.binaryFile + ".tmp"
+	err = c.merger.mux([]string{video, audio}, format, tmp, e.hash)
+	checksum := sha256.New()
+	var written int64
+	if err == nil {
+		written, err = hashFile(tmp, checksum)
+	}
+	if err == nil {
+		// Each stream fit, but together they may not
+		if tooBig := c.tooLarge(url, written); tooBig != nil {
+			os.Remove(tmp)
+			slog.InfoContext(ctx, "Entry_too_large", "url", url, "size", written)
+			return false, tooBig
+		}
+	}
+	if err == nil {
+		err = syncPath(tmp, c.durable)
+	}
+	keep := true
+	if err == nil {
+		keep, err = c.afterDownload(url, videoResp, tmp)
+	}
+	if err == nil && keep {
+		keep = c.quota.keeps(tmp)
+	}
+	if !keep {
+		e = e.uncacheable()
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.binaryFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		slog.ErrorContext(ctx, "Merge_failure", "url", url, "error", err)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to merge media streams"}
+	}
+
+	meta := newMeta(http.Header{"Content-Type": {contentType}})
+	meta.URL = url
+	meta.Filename = filename
+	meta.ContentLength = written
+	meta.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	meta.ExpiresAt = c.expiry(url, videoResp.Header, meta.StoredAt)
+	if ttl := retentionFrom(ctx); ttl > 0 {
+		until := meta.StoredAt.Add(ttl)
+		meta.RetainUntil = &until
+	}
+	err = writeFile(e.headersFile, meta.encode(), c.durable)
+	if err == nil {
+		err = syncPath(c.storageDir, c.durable)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Write_headers_file_error", "filename", e.headersFile, "error", err)
+		os.Remove(e.headersFile)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to save headers file"}
+	}
+
+	slog.InfoContext(ctx, "Resource_stored", "binary_file", e.binaryFile, "headers_file", e.headersFile, "merged", true)
+
+	if keep && c.index.enabled() {
+		c.index.put(e.hash, indexEntry{URL: url, Size: written, StoredAt: time.Now()})
+	}
+	return keep, nil
+}
+
+// downloadStream saves the stream at url, part of the media of source, to
+// path, counting its bytes to progress, and returns the response it came in
+// (with its body consumed).
+func (c *cache) downloadStream(ctx context.Context, source, url, path string, progress io.Writer) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed_create_request", "error", err)
+		return nil, &fetchError{http.StatusInternalServerError, "Failed to download resource"}
+	}
+	setRequestID(ctx, req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Download_failure", "error", err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &fetchError{http.StatusGatewayTimeout, "Timed out downloading resource"}
+		}
+		return nil, &fetchError{http.StatusInternalServerError, "Failed to download resource"}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.ErrorContext(ctx, "Download_failure", "status", resp.StatusCode)
+		return nil, &fetchError{http.StatusBadGateway, fmt.Sprintf("Resource download returned %d", resp.StatusCode)}
+	}
+	if err := c.tooLarge(source, resp.ContentLength); err != nil {
+		slog.InfoContext(ctx, "Entry_too_large", "url", url, "size", resp.ContentLength)
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		slog.ErrorContext(ctx, "Create_binary_file_error", "filename", path, "error", err)
+		c.storage.failed(err)
+		return nil, errStorageUnwritable
+	}
+	written, err := c.downloadBuffers.copy(c.chaos.writer(io.MultiWriter(f, progress)), c.capSize(source, throttleReader(ctx, resp.Body, c.fetchLimiters()...), 0))
+	c.quota.add(written)
+	usageFrom(ctx).upstream(written)
+	if err == nil && resp.ContentLength > 0 && written != resp.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if errors.Is(err, errEntryTooLarge) {
+		slog.InfoContext(ctx, "Entry_too_large", "url", url, "stored", written)
+		return nil, c.tooLarge(source, written)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Write_binary_file_error", "filename", path, "error", err)
+		return nil, &fetchError{http.StatusInternalServerError, "Failed to write binary file"}
+	}
+	return resp, nil
+}
+
+// hashFile feeds the file at path to h and returns its size.
+func hashFile(path string, h io.Writer) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(h, f)
+}
+
+// mux puts the streams in inputs together into one file at dst, in format,
+// copying them as they are. hash names the entry in logs.
+func (mp *mediaProcessor) mux(inputs []string, format, dst, hash string) error {
+	mp.slots <- struct{}{}
+	defer func() { <-mp.slots }()
+
+	const kind = "merge"
+	start := time.Now()
+	cmdArgs := []string{"-hide_banner", "-loglevel", "error", "-y"}
+	for _, input := range inputs {
+		cmdArgs = append(cmdArgs, "-i", input)
+	}
+	for i := range inputs {
+		cmdArgs = append(cmdArgs, "-map", fmt.Sprint(i))
+	}
+	cmdArgs = append(cmdArgs, "-c", "copy", "-f", format, dst)
+
+	slog.Info("Ffmpeg_started", "kind", kind, "dst", hash)
+	var stderr bytes.Buffer
+	cmd := exec.Command(mp.ffmpeg, cmdArgs...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	mediaJobDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+	if err != nil {
+		slog.Error("Ffmpeg_failed", "kind", kind, "dst", hash, "error", err, "stderr", stderr.String())
+		mediaJobsTotal.WithLabelValues(kind, "failed").Inc()
+		return fmt.Errorf("ffmpeg %s: %v", kind, err)
+	}
+
+	slog.Info("Ffmpeg_finished", "kind", kind, "dst", hash, "duration", time.Since(start))
+	mediaJobsTotal.WithLabelValues(kind, "done").Inc()
+	return nil
+}
@@ -0,0 +1,217 @@
+package passthru
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// metaVersion is the version of the metadata format written to headers
+// files. Version 2 added the content type, upstream status and options.
+const metaVersion = 2
+
+// Limits on the headers stored from a media response, well above what real
+// media servers send.
+const (
+	maxStoredHeaders     = 100
+	maxStoredHeaderBytes = 64 * 1024
+)
+
+// connectionHeaders describe the connection a response came over rather
+// than the media, and mean nothing when the media is served again later.
+var connectionHeaders = []string{"Connection", "Date", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// entryMeta is what an entry's headers file records about it, as JSON.
+// Entries stored by older versions have a bare JSON object of headers or one
+// "Name: value" line per header instead; both are still read, and rewritten
+// in this format the first time they're served.
+type entryMeta struct {
+	Version       int        `json:"version"`
+	URL           string     `json:"url,omitempty"`
+	Filename      string     `json:"filename,omitempty"`
+	ContentType   string     `json:"contentType,omitempty"`
+	ContentLength int64      `json:"contentLength"`
+	Status        int        `json:"status,omitempty"` // upstream's, for the download
+	SHA256        string     `json:"sha256,omitempty"`
+	StoredAt      time.Time  `json:"storedAt"`
+	ExpiresAt     *time.Time `json:"expiresAt,omitempty"`
+	// Options are the cobalt options the media was resolved with, if the
+	// request asked for any.
+	Options *entryOptions `json:"options,omitempty"`
+	// RetainUntil is how long the client that stored the entry, or that
+	// asked for it since, wanted it kept. It wins over ExpiresAt and the
+	// cleanup TTL.
+	RetainUntil *time.Time  `json:"retainUntil,omitempty"`
+	Headers     http.Header `json:"headers"`
+}
+
+// newMeta returns the metadata of an entry with the given headers, stored
+// now.
+func newMeta(headers http.Header) entryMeta {
+	return entryMeta{Version: metaVersion, ContentType: headers.Get("Content-Type"), StoredAt: time.Now().UTC(), Headers: headers}
+}
+
+// migrateMeta brings the metadata m of an entry stored in a legacy format
+// up to date, with what can be told from its binary (info), and rewrites
+// its headers file with it if write is set.
+func migrateMeta(headersFileName string, m entryMeta, info os.FileInfo, write bool) entryMeta {
+	m.Version = metaVersion
+	m.ContentType = m.Headers.Get("Content-Type")
+	m.ContentLength = info.Size()
+	m.StoredAt = info.ModTime().UTC()
+	if !write {
+		return m
+	}
+
+	tmp := headersFileName + ".migrate"
+	err := os.WriteFile(tmp, m.encode(), 0644)
+	if err == nil {
+		err = os.Rename(tmp, headersFileName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		slog.Error("Headers_file_migration_error", "filename", headersFileName, "error", err)
+		return m
+	}
+	slog.Info("Headers_file_migrated", "filename", headersFileName)
+	headersMigratedTotal.Inc()
+	return m
+}
+
+// expired reports whether the entry m describes should no longer be served
+// at now.
+func (m entryMeta) expired(now time.Time) bool {
+	if m.RetainUntil != nil {
+		return now.After(*m.RetainUntil)
+	}
+	return m.ExpiresAt != nil && now.After(*m.ExpiresAt)
+}
+
+// retained reports whether the entry m describes is to be kept past the
+// cleanup TTL at now.
+func (m entryMeta) retained(now time.Time) bool {
+	return m.RetainUntil != nil && now.Before(*m.RetainUntil)
+}
+
+// sanitizeHeaders returns the headers of a media response worth storing:
+// without the per-connection ones, and cut down to maxStoredHeaders values
+// of maxStoredHeaderBytes in all, so an upstream can't bloat the metadata.
+// It reports how many values it dropped over the limits.
+func sanitizeHeaders(headers http.Header) (http.Header, int) {
+	skip := make(map[string]bool)
+	for _, name := range connectionHeaders {
+		skip[name] = true
+	}
+	for _, value := range headers.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		if !skip[http.CanonicalHeaderKey(name)] && validHeaderName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	stored := make(http.Header)
+	count, size, dropped := 0, 0, 0
+	for _, name := range names {
+		for _, value := range headers[name] {
+			if count == maxStoredHeaders || size+len(name)+len(value) > maxStoredHeaderBytes {
+				dropped++
+				continue
+			}
+			stored.Add(name, value)
+			count++
+			size += len(name) + len(value)
+		}
+	}
+	return stored, dropped
+}
+
+// encode encodes m for a headers file.
+func (m entryMeta) encode() []byte {
+	// Strings, numbers and string slices always marshal
+	data, _ := json.Marshal(m)
+	return append(data, '\n')
+}
+
+// readMeta reads an entry's headers file. A corrupted one reads as no
+// metadata.
+func readMeta(headersFileName string) (entryMeta, error) {
+	data, err := os.ReadFile(headersFileName)
+	if err != nil {
+		return entryMeta{}, err
+	}
+	m, ok := parseMeta(data)
+	if !ok {
+		m = entryMeta{Headers: make(http.Header)}
+	}
+	return m, nil
+}
+
+// readStoredHeaders reads the headers in an entry's headers file.
+func readStoredHeaders(headersFileName string) (http.Header, error) {
+	m, err := readMeta(headersFileName)
+	return m.Headers, err
+}
+
+// parseMeta decodes a headers file in any of the formats it has had, and
+// reports whether it really was one. Older formats come back as version 0,
+// with nothing but their headers.
+func parseMeta(data []byte) (entryMeta, bool) {
+	headers := make(http.Header)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		var probe struct {
+			Version int `json:"version"`
+		}
+		if json.Unmarshal(trimmed, &probe) == nil && probe.Version > 0 {
+			var m entryMeta
+			if err := json.Unmarshal(trimmed, &m); err != nil || !addHeaders(headers, m.Headers) {
+				return entryMeta{}, false
+			}
+			m.Headers = headers
+			return m, true
+		}
+
+		var stored map[string][]string
+		if err := json.Unmarshal(trimmed, &stored); err != nil || !addHeaders(headers, stored) {
+			return entryMeta{}, false
+		}
+		return entryMeta{Headers: headers}, true
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ": ", 2)
+		if len(parts) != 2 || !validHeaderName(parts[0]) {
+			return entryMeta{}, false
+		}
+		headers.Add(parts[0], parts[1])
+	}
+	return entryMeta{Headers: headers}, true
+}
+
+// addHeaders adds every value in stored to headers, canonicalising the names,
+// and reports whether they were all plausible header names.
+func addHeaders(headers http.Header, stored map[string][]string) bool {
+	for name, values := range stored {
+		if !validHeaderName(name) {
+			return false
+		}
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+	return true
+}
@@ -0,0 +1,795 @@
+package passthru
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Define Prometheus metrics
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_http_requests_total",
+			Help: "Total number of HTTP requests to the service",
+		},
+		[]string{"path", "cache_status"},
+	)
+
+	externalServiceRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_external_service_requests_total",
+			Help: "Total number of HTTP requests to the external service",
+		},
+	)
+
+	peerRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_peer_requests_total",
+			Help: "Total number of cache lookups sent to peers, by result",
+		},
+		[]string{"result"},
+	)
+
+	clusterRoutedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_cluster_routed_total",
+			Help: "Total number of requests routed to the owning instance, by mode",
+		},
+		[]string{"mode"},
+	)
+
+	prefetchQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_prefetch_queue_depth",
+			Help: "Number of prefetch jobs waiting to be processed",
+		},
+	)
+
+	prefetchJobsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_prefetch_jobs_total",
+			Help: "Total number of prefetch job attempts, by result",
+		},
+		[]string{"result"},
+	)
+
+	prefetchScheduleRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_prefetch_schedule_runs_total",
+			Help: "Total number of scheduled prefetch runs, by schedule",
+		},
+		[]string{"schedule"},
+	)
+
+	prefetchScheduleQueuedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_prefetch_schedule_queued_total",
+			Help: "Total number of URLs queued for prefetch by schedules, by schedule",
+		},
+		[]string{"schedule"},
+	)
+
+	batchItemsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_batch_items_total",
+			Help: "Total number of batch items processed, by result",
+		},
+		[]string{"result"},
+	)
+
+	mediaJobsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_media_jobs_total",
+			Help: "Total number of ffmpeg jobs run on cached media, by kind and result",
+		},
+		[]string{"kind", "result"},
+	)
+
+	mediaJobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cobalt_passthru_media_job_duration_seconds",
+			Help:    "Duration of ffmpeg jobs run on cached media, by kind",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+		},
+		[]string{"kind"},
+	)
+
+	webhookDeliveriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_webhook_deliveries_total",
+			Help: "Total number of webhook deliveries, by result",
+		},
+		[]string{"result"},
+	)
+
+	apiKeyRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_api_key_requests_total",
+			Help: "Total number of requests checked against the API keys file, by key name and result",
+		},
+		[]string{"key", "result"},
+	)
+	tenantRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_tenant_requests_total",
+			Help: "Total number of requests by tenant and result",
+		},
+		[]string{"tenant", "result"},
+	)
+
+	tenantStorageBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_tenant_storage_bytes",
+			Help: "Bytes stored in each tenant's storage directory",
+		},
+		[]string{"tenant"},
+	)
+
+	usageRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_usage_requests_total",
+			Help: "Total number of requests by tenant and API key",
+		},
+		[]string{"tenant", "key"},
+	)
+
+	usageCacheHitsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_usage_cache_hits_total",
+			Help: "Total number of cache hits by tenant and API key",
+		},
+		[]string{"tenant", "key"},
+	)
+
+	usageBytesServedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_usage_served_bytes_total",
+			Help: "Total number of bytes served by tenant and API key",
+		},
+		[]string{"tenant", "key"},
+	)
+
+	usageUpstreamBytesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_usage_upstream_bytes_total",
+			Help: "Total number of bytes downloaded from upstream by tenant and API key",
+		},
+		[]string{"tenant", "key"},
+	)
+
+	cdnUploadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_cdn_uploads_total",
+			Help: "Total number of uploads to the CDN origin by result",
+		},
+		[]string{"result"},
+	)
+
+	cdnRedirectsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_cdn_redirects_total",
+			Help: "Total number of requests redirected to the CDN",
+		},
+	)
+
+	mirrorEventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_mirror_events_total",
+			Help: "Total number of entries and purges replicated to the mirror by result",
+		},
+		[]string{"op", "result"},
+	)
+
+	sharedStorageRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_shared_storage_requests_total",
+			Help: "Total number of entries fetched from, put in or purged from the shared storage backend, and of files swept from it, by result",
+		},
+		[]string{"op", "result"},
+	)
+
+	upstreamRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_upstream_retries_total",
+			Help: "Total number of failed cobalt calls and media downloads tried again, by operation",
+		},
+		[]string{"op"},
+	)
+	upstreamTimeoutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_upstream_timeouts_total",
+			Help: "Total number of cobalt calls and media downloads that timed out or stopped sending, by operation",
+		},
+		[]string{"op"},
+	)
+	downloadsResumedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_downloads_resumed_total",
+			Help: "Total number of downloads picked up from what an earlier attempt left",
+		},
+	)
+
+	resumedBytesTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_resumed_bytes_total",
+			Help: "Total number of bytes resumed downloads didn't have to fetch again",
+		},
+	)
+
+	detachedDownloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_detached_downloads_total",
+			Help: "Total number of downloads finished in the background after their client went away, by result",
+		},
+		[]string{"result"},
+	)
+
+	streamedMissesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_streamed_misses_total",
+			Help: "Total number of misses sent to the client as they downloaded, by whether the download completed or failed",
+		},
+		[]string{"result"},
+	)
+
+	coalescedRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_coalesced_requests_total",
+			Help: "Total number of cache misses that waited for a download already under way instead of starting their own",
+		},
+	)
+
+	storageWritable = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_storage_writable",
+			Help: "Whether the storage directory can be written to (1) or misses are being passed through uncached (0)",
+		},
+	)
+
+	passthroughRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_passthrough_requests_total",
+			Help: "Total number of misses streamed to the client uncached because storage was unwritable",
+		},
+	)
+
+	startupScanRepairsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_startup_scan_repairs_total",
+			Help: "Total number of leftovers removed or quarantined by the startup scan, by kind",
+		},
+		[]string{"kind"},
+	)
+
+	panicTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_panic_total",
+			Help: "Total number of panics recovered while handling requests, by server",
+		},
+		[]string{"server"},
+	)
+
+	headersMigratedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_headers_migrated_total",
+			Help: "Total number of headers files in a legacy format rewritten as JSON metadata",
+		},
+	)
+	headersCorruptedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_headers_corrupted_total",
+			Help: "Total number of unreadable or corrupted headers files served with sniffed headers instead, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	corruptedEntriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_corrupted_entries_total",
+			Help: "Total number of entries found with a binary that doesn't match their headers file, and downloaded again, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	mirrorReceivedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_mirror_received_total",
+			Help: "Total number of entries and purges received from a primary",
+		},
+		[]string{"op"},
+	)
+
+	cleanupsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_cleanups_total",
+			Help: "Total number of cleanup operations run",
+		},
+	)
+
+	evictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_evictions_total",
+			Help: "Total number of entries removed by cleanup, by reason: ttl for their age, size to get the storage under its byte limit",
+		},
+		[]string{"reason"},
+	)
+
+	storageBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_storage_bytes",
+			Help: "Bytes taken up by the files of the storage directory and its tenants', as of the last size check",
+		},
+	)
+
+	cacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_cache_entries",
+			Help: "Number of entries in the storage directory and its tenants', as of the last size check",
+		},
+	)
+
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cobalt_passthru_request_duration_seconds",
+			Help:    "Duration of media requests from arrival to the last byte sent, by cache status",
+			Buckets: prometheus.ExponentialBuckets(0.005, 3, 12),
+		},
+		[]string{"cache_status"},
+	)
+
+	upstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "cobalt_passthru_upstream_request_duration_seconds",
+			Help:    "Duration of calls to the external service, retries included, by endpoint",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		},
+		[]string{"endpoint"},
+	)
+
+	downloadThroughput = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "cobalt_passthru_download_throughput_bytes_per_second",
+			Help:    "Speed of completed media downloads, in bytes per second",
+			Buckets: prometheus.ExponentialBuckets(64<<10, 2, 12),
+		},
+	)
+
+	filesCleanedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_files_cleaned_total",
+			Help: "Total number of files cleaned up",
+		},
+	)
+
+	filesTrashedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_files_trashed_total",
+			Help: "Total number of expired files moved to the trash directory",
+		},
+	)
+
+	rateLimitedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_rate_limited_total",
+			Help: "Total number of requests turned away for going over the per-client rate limit",
+		},
+	)
+	abuseBansTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_abuse_bans_total",
+			Help: "Total number of clients banned for abuse, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	activeBans = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_active_bans",
+			Help: "Number of clients currently banned for abuse",
+		},
+	)
+
+	bannedRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_banned_requests_total",
+			Help: "Total number of requests turned away from banned clients",
+		},
+	)
+
+	maintenanceActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_cache_only_mode",
+			Help: "Whether cache-only mode is on (1) or not (0)",
+		},
+	)
+
+	maintenanceRefusedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_cache_only_refused_total",
+			Help: "Total number of misses refused in cache-only mode",
+		},
+	)
+
+	resolveCacheTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_resolve_cache_requests_total",
+			Help: "Total number of external service resolutions looked up in the resolve cache, by result",
+		},
+		[]string{"result"},
+	)
+
+	failureCacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_failure_cache_hits_total",
+			Help: "Total number of requests answered with a kept external service failure instead of asking again",
+		},
+	)
+
+	resolveCacheEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_resolve_cache_entries",
+			Help: "Number of external service responses in the resolve cache",
+		},
+	)
+
+	upstreamAPIVersion = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_upstream_api_major_version",
+			Help: "Major API version each external service endpoint reported when last probed",
+		},
+		[]string{"endpoint"},
+	)
+
+	upstreamHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_upstream_healthy",
+			Help: "Whether each instance of an external service listing several passed its last health check",
+		},
+		[]string{"endpoint"},
+	)
+
+	upstreamFailoversTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_upstream_failovers_total",
+			Help: "Total number of requests to the external service tried again on another instance after one failed",
+		},
+	)
+
+	upstreamAPIUnsupported = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_upstream_api_unsupported",
+			Help: "Whether an external service endpoint runs an API version that isn't supported (1) or not (0)",
+		},
+		[]string{"endpoint"},
+	)
+
+	downloadsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_downloads_in_flight",
+			Help: "Number of downloads from the external service in progress",
+		},
+	)
+
+	downloadQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_download_queue_depth",
+			Help: "Number of downloads waiting for a download slot",
+		},
+	)
+
+	downloadSlotRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_download_slot_rejections_total",
+			Help: "Total number of downloads turned away waiting for a download slot, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	rejectedURLsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_rejected_urls_total",
+			Help: "Total number of URLs refused for their scheme, host or address, by reason",
+		},
+		[]string{"reason"},
+	)
+
+	upstreamAuthFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_upstream_auth_failures_total",
+			Help: "Total number of failures authenticating with the external service, by kind (session for failures getting a session token, rejected for credentials it refused)",
+		},
+		[]string{"kind"},
+	)
+
+	staleServedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_stale_served_total",
+			Help: "Total number of expired entries served while they're downloaded again",
+		},
+	)
+
+	staleRevalidationsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_stale_revalidations_total",
+			Help: "Total number of background downloads of entries served stale, by result (refreshed or failed)",
+		},
+		[]string{"result"},
+	)
+
+	domainRefusalsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_domain_refusals_total",
+			Help: "Total number of requests for media refused by a domain policy, by the policy's first domain and reason (disabled or rate)",
+		},
+		[]string{"domain", "reason"},
+	)
+
+	blockedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_blocked_requests_total",
+			Help: "Total number of requests for media refused by the blocklist, by blocked domain",
+		},
+		[]string{"domain"},
+	)
+
+	clientStallsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_client_stalls_total",
+			Help: "Total number of responses abandoned because the client stopped reading",
+		},
+	)
+
+	upstreamPrechecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_upstream_prechecks_total",
+			Help: "Total number of size and type checks of media before downloading it, by whether they learned its size",
+		},
+		[]string{"result"},
+	)
+
+	entriesTooLargeTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_entries_too_large_total",
+			Help: "Total number of downloads refused for media over the maximum entry size",
+		},
+	)
+
+	memoryCacheHitsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_memory_cache_hits_total",
+			Help: "Total number of hits served from the in-memory cache of small entries",
+		},
+	)
+
+	memoryCacheBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "cobalt_passthru_memory_cache_bytes",
+			Help: "Bytes of entries kept in the in-memory cache",
+		},
+	)
+
+	entriesWrongTypeTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_entries_wrong_type_total",
+			Help: "Total number of downloads refused for media of a type that isn't allowed",
+		},
+	)
+
+	chaosInjectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_chaos_injections_total",
+			Help: "Total number of faults injected in chaos mode, by fault",
+		},
+		[]string{"fault"},
+	)
+
+	entriesMigratedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_entries_migrated_total",
+			Help: "Total number of entries moved over from the previous key hash",
+		},
+	)
+
+	errorReportsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_error_reports_total",
+			Help: "Total number of error reports, by what became of them: queued, dropped, sent or failed",
+		},
+		[]string{"result"},
+	)
+
+	cleanupsDeferredTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "cobalt_passthru_cleanups_deferred_total",
+			Help: "Total number of scheduled cleanup operations deferred, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+var registerMetricsOnce sync.Once
+
+// registerMetrics registers the metrics with the default Prometheus registry
+// and initializes their label values. Metrics are shared by every Server in
+// the process, so this only happens once.
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		prometheus.MustRegister(
+			httpRequestsTotal,
+			externalServiceRequestsTotal,
+			peerRequestsTotal,
+			clusterRoutedTotal,
+			prefetchQueueDepth,
+			prefetchJobsTotal,
+			prefetchScheduleRunsTotal,
+			prefetchScheduleQueuedTotal,
+			batchItemsTotal,
+			mediaJobsTotal,
+			mediaJobDuration,
+			webhookDeliveriesTotal,
+			tenantRequestsTotal,
+			apiKeyRequestsTotal,
+			tenantStorageBytes,
+			evictionsTotal,
+			storageBytes,
+			cacheEntries,
+			requestDuration,
+			upstreamRequestDuration,
+			downloadThroughput,
+			usageRequestsTotal,
+			usageCacheHitsTotal,
+			usageBytesServedTotal,
+			usageUpstreamBytesTotal,
+			cdnUploadsTotal,
+			cdnRedirectsTotal,
+			mirrorEventsTotal,
+			sharedStorageRequestsTotal,
+			mirrorReceivedTotal,
+			headersCorruptedTotal,
+			corruptedEntriesTotal,
+			headersMigratedTotal,
+			upstreamRetriesTotal,
+			upstreamTimeoutsTotal,
+			downloadsResumedTotal,
+			resumedBytesTotal,
+			detachedDownloadsTotal,
+			coalescedRequestsTotal,
+			streamedMissesTotal,
+			panicTotal,
+			startupScanRepairsTotal,
+			storageWritable,
+			passthroughRequestsTotal,
+			cleanupsTotal,
+			filesCleanedTotal,
+			filesTrashedTotal,
+			cleanupsDeferredTotal,
+			abuseBansTotal,
+			rateLimitedTotal,
+			activeBans,
+			bannedRequestsTotal,
+			maintenanceActive,
+			maintenanceRefusedTotal,
+			resolveCacheTotal,
+			failureCacheHitsTotal,
+			resolveCacheEntries,
+			upstreamAPIVersion,
+			upstreamAPIUnsupported,
+			upstreamHealthy,
+			upstreamFailoversTotal,
+			downloadsInFlight,
+			downloadQueueDepth,
+			downloadSlotRejectionsTotal,
+			rejectedURLsTotal,
+			blockedRequestsTotal,
+			domainRefusalsTotal,
+			staleServedTotal,
+			staleRevalidationsTotal,
+			upstreamAuthFailuresTotal,
+			clientStallsTotal,
+			upstreamPrechecksTotal,
+			entriesTooLargeTotal,
+			entriesWrongTypeTotal,
+			memoryCacheHitsTotal,
+			memoryCacheBytes,
+			chaosInjectionsTotal,
+			entriesMigratedTotal,
+			errorReportsTotal,
+		)
+
+		// Initialize all label values
+		initMetrics()
+	})
+}
+
+func initMetrics() {
+	paths := []string{"/"} // Add more paths if needed
+	cacheStatuses := []string{"cached", "peer", "shared", "not_cached", "uncacheable"}
+
+	for _, path := range paths {
+		for _, cacheStatus := range cacheStatuses {
+			httpRequestsTotal.WithLabelValues(path, cacheStatus).Add(0)
+		}
+	}
+
+	for _, result := range []string{"hit", "miss", "error"} {
+		peerRequestsTotal.WithLabelValues(result).Add(0)
+		sharedStorageRequestsTotal.WithLabelValues("fetch", result).Add(0)
+	}
+	for _, result := range []string{"done", "error"} {
+		sharedStorageRequestsTotal.WithLabelValues("sweep", result).Add(0)
+	}
+
+	for _, mode := range []string{"proxy", "redirect", "fallback"} {
+		clusterRoutedTotal.WithLabelValues(mode).Add(0)
+	}
+
+	for _, result := range []string{"cached", "downloaded", "retried", "failed"} {
+		prefetchJobsTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, result := range []string{"ready", "failed"} {
+		batchItemsTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, kind := range []string{"transcode_mp4", "transcode_webm", "audio_m4a", "audio_mp3", "audio_opus", "thumbnail_jpg", "thumbnail_webp", "hls", "merge", "subtitles"} {
+		for _, result := range []string{"done", "failed"} {
+			mediaJobsTotal.WithLabelValues(kind, result).Add(0)
+		}
+	}
+
+	for _, result := range []string{"delivered", "failed"} {
+		webhookDeliveriesTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, reason := range []string{"paused", "schedule", "load", "follower"} {
+		cleanupsDeferredTotal.WithLabelValues(reason).Add(0)
+	}
+
+	for _, server := range []string{"public", "admin", "grpc"} {
+		panicTotal.WithLabelValues(server).Add(0)
+	}
+
+	for _, result := range []string{"cached", "uncacheable", "failed"} {
+		detachedDownloadsTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, reason := range []string{"ttl", "size"} {
+		evictionsTotal.WithLabelValues(reason).Add(0)
+	}
+
+	for _, result := range []string{"completed", "failed"} {
+		streamedMissesTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, reason := range []string{"unreadable", "invalid"} {
+		headersCorruptedTotal.WithLabelValues(reason).Add(0)
+	}
+	for _, status := range []string{"hit", "miss", "peer", "shared", "passthrough", "stale", "refreshed", "bypass"} {
+		requestDuration.WithLabelValues(status)
+	}
+	for _, reason := range []string{"size", "checksum"} {
+		corruptedEntriesTotal.WithLabelValues(reason).Add(0)
+	}
+
+	for _, result := range []string{"hit", "miss"} {
+		resolveCacheTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, reason := range []string{"queue_full", "timeout"} {
+		downloadSlotRejectionsTotal.WithLabelValues(reason).Add(0)
+	}
+
+	for _, result := range []string{"known", "unknown", "failed"} {
+		upstreamPrechecksTotal.WithLabelValues(result).Add(0)
+	}
+
+	for _, fault := range []string{"timeout", "slow", "truncate", "write_error"} {
+		chaosInjectionsTotal.WithLabelValues(fault).Add(0)
+	}
+	for _, op := range []string{"resolve", "download"} {
+		upstreamRetriesTotal.WithLabelValues(op).Add(0)
+		upstreamTimeoutsTotal.WithLabelValues(op).Add(0)
+	}
+	apiKeyRequestsTotal.WithLabelValues("", "unauthorized").Add(0)
+}
@@ -0,0 +1,269 @@
+package passthru
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// mirrorSecretHeader carries the shared secret on replication requests.
+	mirrorSecretHeader = "X-Passthru-Mirror-Secret"
+
+	mirrorQueueSize  = 1000
+	mirrorAttempts   = 3
+	mirrorBaseDelay  = 5 * time.Second
+	mirrorPutTimeout = 10 * time.Minute
+)
+
+// mirrorEvent is a change replicated to the secondary: an entry stored in,
+// or purged from, the cache of tenant ("" for none).
+type mirrorEvent struct {
+	op     string // put or purge
+	tenant string
+	entry  cacheEntry
+}
+
+// mirror streams newly cached entries and purges to a secondary instance,
+// in order, so it stays a warm standby. A nil mirror replicates nothing.
+type mirror struct {
+	url    string
+	secret string
+	events chan mirrorEvent
+	client *http.Client
+}
+
+// newMirror returns a mirror replicating to the instance at baseURL until
+// ctx is done, or nil if baseURL is empty.
+func newMirror(ctx context.Context, baseURL, secret string) *mirror {
+	if baseURL == "" {
+		return nil
+	}
+	m := &mirror{
+		url:    strings.TrimSuffix(baseURL, "/"),
+		secret: secret,
+		events: make(chan mirrorEvent, mirrorQueueSize),
+		client: &http.Client{Timeout: mirrorPutTimeout},
+	}
+	go m.run(ctx)
+	return m
+}
+
+func (m *mirror) enabled() bool {
+	return m != nil
+}
+
+// put replicates a newly stored entry.
+func (m *mirror) put(tenant string, e cacheEntry) {
+	m.send(mirrorEvent{op: "put", tenant: tenant, entry: e})
+}
+
+// purge replicates the removal of an entry.
+func (m *mirror) purge(tenant string, e cacheEntry) {
+	m.send(mirrorEvent{op: "purge", tenant: tenant, entry: e})
+}
+
+func (m *mirror) send(event mirrorEvent) {
+	if !m.enabled() {
+		return
+	}
+	select {
+	case m.events <- event:
+	default:
+		// Never hold up requests for the secondary; it'll fetch what it
+		// misses from cobalt
+		slog.Info("Mirror_queue_full", "op", event.op, "hash", event.entry.hash)
+		mirrorEventsTotal.WithLabelValues(event.op, "dropped").Inc()
+	}
+}
+
+func (m *mirror) run(ctx context.Context) {
+	for {
+		var event mirrorEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-m.events:
+		}
+		var err error
+		for attempt := 1; attempt <= mirrorAttempts; attempt++ {
+			if err = m.replicate(event); err == nil {
+				break
+			}
+			slog.Error("Mirror_attempt_failed", "op", event.op, "hash", event.entry.hash, "attempt", attempt, "error", err)
+			if attempt < mirrorAttempts {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(mirrorBaseDelay << (attempt - 1)):
+				}
+			}
+		}
+		if err != nil {
+			mirrorEventsTotal.WithLabelValues(event.op, "failed").Inc()
+		} else {
+			mirrorEventsTotal.WithLabelValues(event.op, "sent").Inc()
+		}
+	}
+}
+
+func (m *mirror) replicate(event mirrorEvent) error {
+	target := m.url + "/internal/mirror/" + event.entry.hash
+	if event.tenant != "" {
+		target += "?tenant=" + url.QueryEscape(event.tenant)
+	}
+
+	var req *http.Request
+	var err error
+	if event.op == "purge" {
+		req, err = http.NewRequest("DELETE", target, nil)
+		if err != nil {
+			return err
+		}
+	} else {
+		storedHeaders, err := os.ReadFile(event.entry.headersFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Gone already, so there's nothing to replicate
+				return nil
+			}
+			return err
+		}
+		f, err := os.Open(event.entry.binaryFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		req, err = http.NewRequest("PUT", target, f)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = info.Size()
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set(storedHeadersHeader, base64.StdEncoding.EncodeToString(storedHeaders))
+	}
+	if m.secret != "" {
+		req.Header.Set(mirrorSecretHeader, m.secret)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleMirrorRequest stores (PUT) or removes (DELETE) an entry replicated
+// from a primary. It is off unless a mirror secret is configured, since it
+// writes straight into the cache.
+func handleMirrorRequest(storageDir, secret string, locks *entryLocks, durable bool, buffers *bufferPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(mirrorSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		dir := storageDir
+		if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+			if strings.ContainsAny(tenant, `/\.`) {
+				http.Error(w, "Invalid tenant", http.StatusBadRequest)
+				return
+			}
+			dir = filepath.Join(storageDir, tenantsDirName, tenant)
+		}
+		hashStr := mux.Vars(r)["hash"]
+		e := cacheEntry{
+			hash:        hashStr,
+			binaryFile:  filepath.Join(dir, hashStr+".bin"),
+			headersFile: filepath.Join(dir, hashStr+".headers"),
+		}
+		unlock := locks.lock(e)
+		defer unlock()
+
+		if r.Method == "DELETE" {
+			os.Remove(e.binaryFile)
+			os.Remove(e.headersFile)
+			os.RemoveAll(hlsDir(dir, e.hash))
+			slog.InfoContext(r.Context(), "Mirror_purge_received", "hash", hashStr)
+			mirrorReceivedTotal.WithLabelValues("purge").Inc()
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		storedHeaders, err := base64.StdEncoding.DecodeString(r.Header.Get(storedHeadersHeader))
+		if err != nil {
+			http.Error(w, "Invalid stored headers", http.StatusBadRequest)
+			return
+		}
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			http.Error(w, "Failed to create storage directory", http.StatusInternalServerError)
+			return
+		}
+		if err := storeMirrored(e, r.Body, storedHeaders, durable, buffers); err != nil {
+			slog.ErrorContext(r.Context(), "Mirror_store_error", "hash", hashStr, "error", err)
+			http.Error(w, "Failed to store entry", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Mirror_put_received", "hash", hashStr)
+		mirrorReceivedTotal.WithLabelValues("put").Inc()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// storeMirrored writes a replicated entry, moving the binary into place only
+// once it has arrived in full so readers never see half of it.
+func storeMirrored(e cacheEntry, body io.Reader, storedHeaders []byte, durable bool, buffers *bufferPool) error {
+	tmp := e.binaryFile + ".mirror"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = buffers.copy(f, body)
+	if err == nil {
+		err = syncFile(f, durable)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := writeFile(e.headersFile, storedHeaders, durable); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, e.binaryFile); err != nil {
+		return err
+	}
+	return syncPath(filepath.Dir(e.binaryFile), durable)
+}
@@ -0,0 +1,129 @@
+package passthru
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// storageProbeInterval is how often unwritable storage is checked for having
+// recovered.
+const storageProbeInterval = 30 * time.Second
+
+// errStorageUnwritable is returned for downloads that can't be stored
+// because the storage directory can't be written to.
+var errStorageUnwritable = &fetchError{http.StatusServiceUnavailable, "Storage is unavailable"}
+
+// storageHealth tracks whether the storage directory can be written to. While
+// it can't, misses are streamed straight to the client instead of failing.
+type storageHealth struct {
+	ctx        context.Context
+	dir        string
+	unwritable atomic.Bool
+}
+
+// newStorageHealth tracks dir, probing it while it's unwritable until ctx
+// is done.
+func newStorageHealth(ctx context.Context, dir string) *storageHealth {
+	storageWritable.Set(1)
+	return &storageHealth{ctx: ctx, dir: dir}
+}
+
+// writable reports whether storage was writable when last tried.
+func (s *storageHealth) writable() bool {
+	return !s.unwritable.Load()
+}
+
+// failed records that writing to storage failed with err, and starts
+// probing for it to recover.
+func (s *storageHealth) failed(err error) {
+	if !s.unwritable.CompareAndSwap(false, true) {
+		return
+	}
+	storageWritable.Set(0)
+	slog.Info("Storage_unwritable", "dir", s.dir, "error", err)
+	go s.probe()
+}
+
+func (s *storageHealth) probe() {
+	probeFile := filepath.Join(s.dir, ".write-probe")
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-time.After(storageProbeInterval):
+		}
+		if err := os.WriteFile(probeFile, nil, 0644); err == nil {
+			os.Remove(probeFile)
+			s.unwritable.Store(false)
+			storageWritable.Set(1)
+			slog.Info("Storage_writable", "dir", s.dir)
+			return
+		}
+	}
+}
+
+// passthrough streams the media behind url to w without caching it, for when
+// storage can't be written to or a request asks for it not to be kept.
+func (c *cache) passthrough(ctx context.Context, w http.ResponseWriter, r *http.Request, url string) {
+	passthroughRequestsTotal.Inc()
+	ctx = withMediaDownload(ctx)
+	serviceResp, err := c.resolve(ctx, url)
+	if err != nil {
+		var fe *fetchError
+		if errors.As(err, &fe) {
+			http.Error(w, fe.message, fe.status)
+		} else {
+			http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+		}
+		return
+	}
+	if serviceResp.Status == statusLocalProcessing {
+		http.Error(w, "Media needing local processing can't be streamed uncached", http.StatusBadGateway)
+		return
+	}
+	if serviceResp.Status == statusPicker {
+		http.Error(w, "Picker media can't be archived uncached", http.StatusBadGateway)
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", serviceResp.URL, nil)
+	if err != nil {
+		http.Error(w, "Failed to download resource", http.StatusInternalServerError)
+		return
+	}
+	setRequestID(ctx, req)
+	resourceResp, err := c.client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Download_failure", "error", err)
+		c.resolutions.forget(c.resolveKey(ctx, url))
+		http.Error(w, "Failed to download resource", http.StatusBadGateway)
+		return
+	}
+	defer resourceResp.Body.Close()
+	if resourceResp.StatusCode < 200 || resourceResp.StatusCode > 299 {
+		c.resolutions.forget(c.resolveKey(ctx, url))
+		http.Error(w, "Failed to download resource", http.StatusBadGateway)
+		return
+	}
+	if err := decodeContent(resourceResp); err != nil {
+		slog.ErrorContext(ctx, "Download_failure", "content_encoding", resourceResp.Header.Get("Content-Encoding"), "error", err)
+		http.Error(w, "Failed to download resource", http.StatusBadGateway)
+		return
+	}
+
+	w = c.hooks.wrapServe(throttle(w, r, c.serveRate, c.egress), r)
+	addStoredHeaders(w.Header(), resourceResp.Header)
+	w.WriteHeader(resourceResp.StatusCode)
+	slog.InfoContext(ctx, "Streaming_uncached", "url", url)
+	written, err := c.serveBuffers.copy(w, throttleReader(ctx, resourceResp.Body, c.fetchLimiters()...))
+	usageFrom(ctx).upstream(written)
+	if err != nil {
+		slog.ErrorContext(ctx, "Stream_error", "url", url, "error", err)
+	}
+}
@@ -0,0 +1,1098 @@
+// Package passthru is a caching proxy in front of a cobalt instance: it
+// resolves URLs through cobalt, downloads the resulting media once and serves
+// it, with its original headers, from disk afterwards.
+//
+// The cobalt-passthru binary is a thin command-line wrapper around this
+// package; other Go services can embed the proxy by mounting a Server
+// wherever they like:
+//
+//	cfg := passthru.DefaultConfig()
+//	cfg.Endpoint = "http://localhost:9000/"
+//	srv, err := passthru.New(cfg)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	http.Handle("/media/", http.StripPrefix("/media", srv))
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
+)
+
+// Config configures a Server. Start from DefaultConfig, which holds the same
+// defaults as the command-line flags of the same names.
+type Config struct {
+	// Endpoint is the URL of the cobalt API, or a comma-separated list of
+	// the URLs of several cobalt instances to spread requests over.
+	Endpoint string
+	// UpstreamHealthInterval is how often each instance of an Endpoint
+	// listing several is checked; requests only go to healthy ones. 0
+	// disables checking.
+	UpstreamHealthInterval time.Duration
+	// UpstreamProbeInterval is how often every cobalt endpoint is asked
+	// for its API version, starting at startup, so requests to one still on
+	// the pre-10 API are adapted to it. 0 disables probing and assumes the
+	// current API.
+	UpstreamProbeInterval time.Duration
+	// VideoQuality and DisableMetadata are sent to cobalt with every
+	// request, unless it asks for another quality with ?quality= or for
+	// metadata with ?metadata=1, which makes an entry of its own.
+	VideoQuality    string
+	DisableMetadata bool
+	// SubtitleLang is the two-letter language of the subtitles served for
+	// asset=subtitles unless a request sets subs. Without it such requests
+	// have to.
+	SubtitleLang string
+	// StorageDir is the directory cached files are stored in. It is created
+	// if it doesn't exist.
+	StorageDir string
+	// DurableWrites fsyncs every file of an entry, and the directory it's
+	// in, before the entry counts as cached.
+	DurableWrites bool
+	// VerifyChecksums checks the SHA-256 of each entry against the one
+	// recorded when it was stored, the first time it's served after a
+	// start or a change, on top of its size, which is always checked.
+	// Corrupted entries are downloaded again.
+	VerifyChecksums bool
+	// DisconnectPolicy is what happens to a download when the client that
+	// asked for it goes away: cancel stops it, finish completes it in the
+	// background so the next request is a hit.
+	DisconnectPolicy string
+	// UpstreamTTL expires each entry when the Cache-Control or Expires of
+	// its media response says to, bounded by UpstreamTTLMin and
+	// UpstreamTTLMax, on top of the cleanup TTL.
+	UpstreamTTL    bool
+	UpstreamTTLMin time.Duration
+	UpstreamTTLMax time.Duration
+	// ServeBufferSize is the buffer size, in bytes, for streaming responses
+	// that don't come from a stored file. Hits are sent with sendfile.
+	ServeBufferSize int
+	// DownloadBufferSize is the size, in bytes, of the buffers downloads
+	// are copied to disk with.
+	DownloadBufferSize int
+	// ServeRateLimit caps every response at this many bytes per second,
+	// and FetchRateLimit every download from upstream (0 for no cap).
+	ServeRateLimit int
+	FetchRateLimit int
+	// MaxQueryLength refuses requests with a longer query string, in bytes
+	// (0 for no limit).
+	MaxQueryLength int
+	// ClientStallTimeout drops clients that stop reading a response for
+	// this long, so they can't hold its file open (0 waits forever).
+	ClientStallTimeout time.Duration
+	// EgressRateLimit and IngressRateLimit bound, in bytes per second, the
+	// bandwidth all responses and all downloads from upstream take
+	// together (0 for no bound).
+	EgressRateLimit  int
+	IngressRateLimit int
+	// DownloadParallelism, when above 1, downloads media bigger than
+	// DownloadChunkSize bytes from CDNs that serve ranges in chunks of that
+	// size, this many at a time.
+	DownloadParallelism int
+	DownloadChunkSize   int64
+	// MaxRequestTTL lets clients pick how long the entries they request are
+	// kept, up to this long, with a ttl query parameter or an X-Cache-TTL
+	// header (0 doesn't let them). With tenants only authenticated clients
+	// get that far.
+	MaxRequestTTL time.Duration
+	// StaleWhileRevalidate keeps serving entries for this long past their
+	// expiry (from UpstreamTTL, a domain policy or a client's TTL), while
+	// they're downloaded again in the background; 0 downloads them again
+	// before answering.
+	StaleWhileRevalidate time.Duration
+	// AllowRefresh lets clients have the entry they request downloaded
+	// again, replacing the cached copy, with refresh=1. With tenants only
+	// authenticated clients get that far.
+	AllowRefresh bool
+	// AllowNoCache lets clients have media streamed from upstream without
+	// it being looked up or stored, with nocache=1, for one-off private
+	// URLs.
+	AllowNoCache bool
+	// BypassToken, when set, must also be sent as an X-Bypass-Token header
+	// with refresh=1 or nocache=1.
+	BypassToken string
+	// ReadOnly serves the hits in StorageDir, which another instance
+	// writes to, without ever writing to it, calling the external service
+	// or cleaning up. Misses get a 503, and options that need to write are
+	// refused.
+	ReadOnly bool
+	// CacheOnly starts the instance in cache-only mode, serving hits but
+	// refusing misses with a 503. It can be switched at runtime through the
+	// admin API.
+	CacheOnly bool
+	// ResolveCacheTTL keeps the external service's answer for a URL this
+	// long, so info requests, playlists and retries don't ask it again.
+	// Keep it well under the lifetime of the links it hands out. 0 asks
+	// every time.
+	ResolveCacheTTL time.Duration
+	// NegativeCacheTTL keeps the external service's failure for a URL this
+	// long, answering requests for it with the same error instead of
+	// asking again. 0 asks every time.
+	NegativeCacheTTL time.Duration
+	// KeyHash is the hash entries are named after: sha256, blake3 or
+	// xxhash, optionally followed by a colon and how many hex digits to
+	// keep (e.g. blake3:32). KeyLength, if set, is that number of digits.
+	// KeyMigrateFrom is the KeyHash entries were stored under before, which
+	// they're moved over from as they're looked up. Every replica sharing
+	// storage or peering must use the same ones.
+	KeyHash        string
+	KeyLength      int
+	KeyMigrateFrom string
+	// MaxEntrySize refuses media over this many bytes, as soon as its size
+	// is known, and stops downloads of media without one once they pass it
+	// (0 for no limit).
+	MaxEntrySize int64
+	// MemoryCacheBytes keeps up to this many bytes of small entries served
+	// as plain hits in memory, so the ones served most are served without
+	// opening their files (0 to keep none). Entries over MemoryCacheMaxItem
+	// bytes aren't kept.
+	MemoryCacheBytes   int64
+	MemoryCacheMaxItem int64
+	// AllowedContentTypes is a comma-separated list of the media types
+	// entries may have, such as video/mp4 or video/*. Media of any other
+	// type, like an HTML error page, is refused rather than stored. Empty
+	// allows any.
+	AllowedContentTypes string
+	// UpstreamPrecheck asks the media host for the size and type of media
+	// with a HEAD before downloading it, so media over MaxEntrySize, or not
+	// of AllowedContentTypes, is refused before any of it flows.
+	UpstreamPrecheck bool
+	// ResumeDownloads keeps the part of a download that was cut short, by an
+	// error or a restart, and fetches only the rest if the upstream still
+	// has the same media: straight away, up to UpstreamRetries times, or
+	// else next time.
+	ResumeDownloads bool
+	// StreamMisses sends the media of a miss to the client as it's
+	// downloaded, while it's written to the cache, instead of once it's all
+	// stored. Misses with hooks, ranges or media processing aren't streamed.
+	StreamMisses bool
+	// Connection limits of the client used for cobalt, the media it points
+	// at and peers: idle connections kept in all and per host, connections
+	// per host (0 for no limit), how long idle ones are kept and how long a
+	// TLS handshake may take.
+	UpstreamMaxIdleConns        int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamMaxConnsPerHost     int
+	UpstreamIdleConnTimeout     time.Duration
+	UpstreamTLSHandshakeTimeout time.Duration
+	// UpstreamTimeout is how long cobalt, media hosts and peers get to
+	// start answering a request, and then to send each part of the body,
+	// before the request fails; 0 waits forever.
+	UpstreamTimeout time.Duration
+	// UpstreamRetries is how many more times a cobalt call or a media
+	// download is tried when it fails with a network error, a timeout, a
+	// 429 or a 5xx, first after UpstreamRetryBackoff and then after twice
+	// as long each time, with jitter. Downloads cut short part way are
+	// resumed instead, with ResumeDownloads, and otherwise fail.
+	UpstreamRetries      int
+	UpstreamRetryBackoff time.Duration
+	// UpstreamAPIKey is sent to cobalt instances requiring one, as
+	// Authorization: Api-Key.
+	UpstreamAPIKey string
+	// UpstreamTurnstileCommand, for cobalt instances handing out sessions
+	// instead, is a command printing a Turnstile response for the instance
+	// whose URL it gets as its last argument. It's traded for a session
+	// token at the instance's /session whenever one is needed.
+	UpstreamTurnstileCommand string
+
+	// Chaos turns on fault injection, for exercising the retry, fallback
+	// and cleanup paths in staging; never in production. The rates, from 0
+	// to 1, are the chances of an upstream request timing out, of its body
+	// trickling in, of its body ending early and of a download failing to
+	// write to disk. They're refused without Chaos.
+	Chaos               bool
+	ChaosTimeoutRate    float64
+	ChaosSlowRate       float64
+	ChaosTruncateRate   float64
+	ChaosWriteErrorRate float64
+
+	// CleanupPauseWindows is a comma-separated list of daily HH:MM-HH:MM
+	// windows (local time) during which cleanup is skipped.
+	CleanupPauseWindows string
+	// CleanupMaxInFlight defers cleanup while more downloads than this are in
+	// flight (0 disables).
+	CleanupMaxInFlight int64
+	// CacheTTL is the age cached files are removed at.
+	CacheTTL time.Duration
+	// CacheMaxBytes, when positive, caps the bytes the files of entries
+	// take up: once cleanup has removed the expired ones, it removes the
+	// least recently served entries until they fit.
+	CacheMaxBytes int64
+	// CleanupTrashGrace, when positive, moves expired files to a trash
+	// directory and keeps them this long before deleting them.
+	CleanupTrashGrace time.Duration
+	// PopularityBoost keeps entries past their age by this much for each
+	// doubling of their hits, up to 8 doublings, so hot entries outlive
+	// cold ones stored at the same time (0 expires by age alone).
+	PopularityBoost time.Duration
+	// CleanupWorkers is how many files of a directory cleanup stats and
+	// expires at a time.
+	CleanupWorkers int
+	// CleanupMaxErrors ends a cleanup pass early once it has run into this
+	// many errors (0 for no limit).
+	CleanupMaxErrors int
+	// CleanupHistory is the number of cleanup run summaries kept for the
+	// admin API.
+	CleanupHistory int
+	// CleanupLock elects one replica to run cleanup when several share the
+	// storage directory: file uses a lock file in it, redis a lease in
+	// Redis (requires RedisAddr). Empty runs cleanup on every replica.
+	CleanupLock string
+	// StartupScan checks the storage directory for leftovers of a crash
+	// (temp files, half-written entries, stale index entries) and removes
+	// them before serving.
+	StartupScan bool
+	// StartupScanQuarantine has the startup scan move what it finds into
+	// a .quarantine subdirectory of the storage directory instead of
+	// deleting it. Nothing removes the files from there.
+	StartupScanQuarantine bool
+	// WatchStorage keeps track of the files in storage from inotify events
+	// (Linux only), so cleanup doesn't list and stat every file each pass.
+	// Leave it off when other hosts write to the storage, as on NFS.
+	WatchStorage bool
+
+	// Peers is a comma-separated list of base URLs of sibling instances that
+	// are asked for a file before calling cobalt.
+	Peers string
+	// PeerSelf is this instance's own base URL as it appears in Peers.
+	PeerSelf string
+	// PeerSecret is the shared secret required on peer-to-peer requests. It
+	// must be set when Peers lists other instances.
+	PeerSecret string
+	// ClusterRouting sends each URL to the instance owning it: off, proxy or
+	// redirect (requires PeerSelf and PeerSecret).
+	ClusterRouting string
+
+	// MirrorURL is the base URL of a secondary instance every newly cached
+	// entry and purge is replicated to. MirrorSecret authenticates
+	// replication; an instance only accepts replicated entries when it is
+	// set.
+	MirrorURL    string
+	MirrorSecret string
+
+	// EntryLockFiles makes the per-entry locks serialising downloads,
+	// deletes and serves hold between replicas sharing the storage
+	// directory too, through flock(2)ed files in it.
+	EntryLockFiles bool
+
+	// RedisAddr (host:port) enables coordination through Redis between
+	// replicas sharing one storage directory.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	RedisPrefix   string
+
+	// PrefetchWorkers is the number of background prefetch workers.
+	PrefetchWorkers int
+	// PrefetchRate is the maximum number of cobalt calls per second made by
+	// prefetch workers.
+	PrefetchRate float64
+	// PrefetchRetries is how many times a failed prefetch is retried.
+	PrefetchRetries int
+	// PrefetchQueueFile is where the prefetch queue is persisted (defaults to
+	// .prefetch/queue.json in StorageDir).
+	PrefetchQueueFile string
+	// PrefetchWatchFile is a file of URLs, one per line, queued for prefetch
+	// whenever it changes.
+	PrefetchWatchFile string
+	// PrefetchScheduleFile is a JSON file of recurring prefetch schedules.
+	PrefetchScheduleFile string
+
+	// PlaylistResolver is a command printing the item URLs of the playlist
+	// or channel URL given as its last argument, one per line, used by
+	// /playlist. Without it /playlist only checks the URL with cobalt.
+	PlaylistResolver string
+	// PlaylistMaxItems caps the items queued from one playlist.
+	PlaylistMaxItems int
+
+	// MaxConcurrentDownloads caps the downloads from cobalt running at once
+	// (0 is unlimited).
+	MaxConcurrentDownloads int
+	// MaxQueuedDownloads caps the downloads waiting for one of those slots
+	// (0 is unlimited), and DownloadQueueTimeout how long each waits (0 is
+	// as long as its request lasts). Those turned away get a 503 with a
+	// Retry-After estimated from the queue and recent download durations.
+	MaxQueuedDownloads   int
+	DownloadQueueTimeout time.Duration
+
+	// BatchMaxURLs is the maximum number of URLs accepted in one batch.
+	BatchMaxURLs int
+	// BatchJournalFile is where batches are journaled (defaults to
+	// .batch/journal.log in StorageDir).
+	BatchJournalFile string
+
+	// FFmpeg and FFprobe are the binaries used for media processing.
+	FFmpeg  string
+	FFprobe string
+	// FFmpegWorkers is the number of ffmpeg processes run at once (0
+	// disables media processing).
+	FFmpegWorkers int
+	// MergeStreams has ffmpeg mux the separate video and audio streams of
+	// cobalt's local-processing responses into one file, which is cached
+	// like any other download. Without it those responses are refused.
+	MergeStreams bool
+
+	// WebhookURLs is a comma-separated list of URLs notified when a prefetch
+	// or batch download completes or fails.
+	WebhookURLs string
+	// WebhookSecret signs webhook bodies with HMAC-SHA256.
+	WebhookSecret string
+
+	// TenantsFile is a JSON file of tenants. When set, every request needs a
+	// tenant's API key and each tenant gets its own namespace, rate limit
+	// and storage quota.
+	TenantsFile string
+	// APIKeysFile is a file of API keys, one per line, optionally followed
+	// by a name for metrics. When set, every request needs one of them.
+	// It's read again by ReloadAPIKeys, and can't be combined with
+	// TenantsFile, whose tenants have keys of their own.
+	APIKeysFile string
+	// HostsFile is a JSON file of host profiles. Requests whose Host is one
+	// of a profile's get its cobalt endpoint, request options and cache
+	// namespace. It can't be combined with TenantsFile.
+	HostsFile string
+	// AllowedHosts, if set, is a comma-separated list of the only domains
+	// (and their subdomains) whose URLs are accepted, and DeniedHosts one of
+	// domains whose URLs aren't. URLs that aren't http or https, or are on
+	// private addresses, are refused either way.
+	AllowedHosts string
+	DeniedHosts  string
+	// CORSOrigins, if set, is a comma-separated list of the origins whose
+	// scripts may call the API (https://example.com, https://*.example.com
+	// for its subdomains, or * for any), with the methods in CORSMethods
+	// and the request headers in CORSHeaders.
+	CORSOrigins string
+	CORSMethods string
+	CORSHeaders string
+	// AllowPrivateDownloads lets media links from the external service lead
+	// to private addresses. Otherwise only the external service's own
+	// hosts may be on one.
+	AllowPrivateDownloads bool
+	// BlocklistFile is a JSON file of domains whose media isn't served,
+	// each with the status (451 or 403) and reason code requests for it
+	// are refused with.
+	BlocklistFile string
+	// DomainsFile is a JSON file of domain policies, overriding the video
+	// quality, entry TTL and maximum entry size for the media of some
+	// domains, limiting how fast it's resolved or refusing it.
+	DomainsFile string
+	// UsageExportDir, when set, gets a file with every API key's usage over
+	// the past UsageExportInterval, in UsageExportFormat (csv or json), at
+	// the end of each interval. It requires TenantsFile.
+	UsageExportDir      string
+	UsageExportInterval time.Duration
+	UsageExportFormat   string
+	// QuotaStateFile is where the usage counted against API keys' daily and
+	// monthly quotas is kept across restarts (defaults to
+	// .usage/quotas.json in StorageDir).
+	QuotaStateFile string
+
+	// LinkSecret enables signed, expiring links to cached files under /f/,
+	// minted through POST /links. LinkTTL is how long a link lasts unless
+	// asked otherwise, and LinkBaseURL is prepended to minted links, and to
+	// the short links of POST /shorten.
+	LinkSecret  string
+	LinkTTL     time.Duration
+	LinkBaseURL string
+
+	// CDNUploadURL, when set, pushes every downloaded entry to a CDN origin
+	// bucket under this URL (e.g.
+	// https://my-bucket.s3.eu-west-1.amazonaws.com/media), and once it's
+	// there requests for it are redirected to the same name under
+	// CDNPublicURL.
+	CDNUploadURL string
+	CDNPublicURL string
+	// CDNRegion, CDNAccessKey and CDNSecretKey sign uploads with AWS
+	// Signature Version 4, for S3 and S3-compatible stores.
+	CDNRegion    string
+	CDNAccessKey string
+	CDNSecretKey string
+	// CDNSignKey, when set, adds an expires and a signature parameter to
+	// redirects (the hex HMAC-SHA256 of "<path>\n<expires>") for the CDN to
+	// check. Redirects expire after CDNSignTTL.
+	CDNSignKey string
+	CDNSignTTL time.Duration
+	// CDNUploadWorkers is the number of uploads run at once.
+	CDNUploadWorkers int
+
+	// StorageBackend is where entries are kept besides StorageDir: local
+	// (nowhere else) or s3, a bucket every replica shares. Entries are
+	// still served from StorageDir, fetched from the bucket on a miss and
+	// uploaded to it once downloaded.
+	StorageBackend string
+	// S3BucketURL is the bucket of the s3 backend, e.g.
+	// https://my-bucket.s3.eu-west-1.amazonaws.com or, path-style,
+	// http://minio:9000/my-bucket, and S3Prefix is prepended to the names
+	// of its objects. S3Region, S3AccessKey and S3SecretKey sign requests
+	// with AWS Signature Version 4; without them requests aren't signed.
+	S3BucketURL string
+	S3Prefix    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	// Storage, if set, is the backend to use instead of StorageBackend's,
+	// e.g. one provided by a plugin.
+	Storage Storage
+
+	// AbuseBanDuration, when set, bans clients for that long once they get
+	// AbuseMaxErrors error responses, or errors for AbuseMaxFailingURLs
+	// different u values, within an AbuseWindow. Clients are told apart by
+	// IP address, the last X-Forwarded-For entry's with TrustForwardedFor.
+	AbuseBanDuration    time.Duration
+	AbuseWindow         time.Duration
+	AbuseMaxErrors      int
+	AbuseMaxFailingURLs int
+	TrustForwardedFor   bool
+	// ClientRateLimit caps each client IP at this many requests per
+	// second, in bursts of up to ClientRateBurst; 0 is unlimited. Clients
+	// over it get a 429.
+	ClientRateLimit float64
+	ClientRateBurst int
+
+	// SinglePort serves /metrics, /healthz and the admin API from the
+	// public handler as well, for when only one port can be exposed. It
+	// requires AdminToken.
+	SinglePort bool
+	// AdminToken, when set, must be sent as a bearer token to /metrics and
+	// the admin API, wherever they're served. /healthz needs none.
+	AdminToken string
+
+	// Hooks are run at fixed points of every request, in order.
+	Hooks []Hooks
+	// Middleware wraps the public API, the first entry outermost.
+	Middleware []func(http.Handler) http.Handler
+	// AccessLog gets a line for every request to the public API, if set.
+	AccessLog io.Writer
+	// CompressResponses compresses text, JSON, subtitles and playlists
+	// with zstd or gzip for clients that accept it. Media isn't compressed.
+	CompressResponses bool
+	// SentryDSN, if set, is the DSN of a Sentry compatible error tracker
+	// that panics and recurring download failures are reported to, tagged
+	// with SentryEnvironment.
+	SentryDSN         string
+	SentryEnvironment string
+	// Tracing exports OpenTelemetry spans of every request over OTLP/HTTP,
+	// set up by the standard OTEL_EXPORTER_OTLP_* environment variables.
+	Tracing bool
+}
+
+// DefaultConfig returns the default configuration.
+func DefaultConfig() Config {
+	return Config{
+		Endpoint:                    "http://external-service-endpoint",
+		UpstreamProbeInterval:       10 * time.Minute,
+		UpstreamHealthInterval:      10 * time.Second,
+		VideoQuality:                "max",
+		DisableMetadata:             true,
+		CompressResponses:           true,
+		MemoryCacheMaxItem:          1 << 20,
+		StorageDir:                  "./storage",
+		KeyHash:                     "sha256",
+		DisconnectPolicy:            disconnectCancel,
+		UpstreamTTLMin:              time.Minute,
+		UpstreamTTLMax:              12 * time.Hour,
+		ServeBufferSize:             32 * 1024,
+		DownloadBufferSize:          1024 * 1024,
+		MaxQueryLength:              8192,
+		CORSMethods:                 "GET, HEAD, POST",
+		CORSHeaders:                 "Authorization, Content-Type, Range, X-API-Key, X-Bypass-Token, X-Cache-TTL, X-Request-ID",
+		ClientStallTimeout:          time.Minute,
+		DownloadParallelism:         1,
+		DownloadChunkSize:           64 * 1024 * 1024,
+		ResumeDownloads:             true,
+		AbuseWindow:                 time.Minute,
+		AbuseMaxErrors:              100,
+		AbuseMaxFailingURLs:         20,
+		ClientRateBurst:             20,
+		UpstreamMaxIdleConns:        100,
+		UpstreamMaxIdleConnsPerHost: 16,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+		UpstreamTLSHandshakeTimeout: 10 * time.Second,
+		UpstreamTimeout:             30 * time.Second,
+		UpstreamRetries:             2,
+		UpstreamRetryBackoff:        500 * time.Millisecond,
+		NegativeCacheTTL:            time.Minute,
+		CleanupWorkers:              4,
+		CacheTTL:                    720 * time.Minute,
+		CleanupMaxErrors:            100,
+		CleanupHistory:              20,
+		StartupScan:                 true,
+		ClusterRouting:              routingOff,
+		RedisPrefix:                 "cobalt-passthru:",
+		PrefetchWorkers:             2,
+		PrefetchRate:                1,
+		PrefetchRetries:             3,
+		BatchMaxURLs:                50,
+		PlaylistMaxItems:            200,
+		FFmpeg:                      "ffmpeg",
+		FFprobe:                     "ffprobe",
+		FFmpegWorkers:               1,
+		UsageExportInterval:         24 * time.Hour,
+		UsageExportFormat:           "csv",
+		LinkTTL:                     24 * time.Hour,
+		CDNSignTTL:                  time.Hour,
+		CDNUploadWorkers:            2,
+		StorageBackend:              storageBackendLocal,
+	}
+}
+
+// shutdownPollInterval is how often Shutdown checks whether the downloads
+// have stopped.
+const shutdownPollInterval = 100 * time.Millisecond
+
+// Server is the caching proxy. It serves the public API as an http.Handler;
+// metrics and the admin API come from AdminHandler and belong on a private
+// port.
+type Server struct {
+	public     http.Handler
+	admin      http.Handler
+	grpc       *grpc.Server
+	singlePort bool
+	apiKeys    *apiKeySet
+	// stop cancels every download, for Shutdown.
+	stop context.CancelFunc
+	// inFlight counts the downloads Shutdown waits for.
+	inFlight *atomic.Int64
+	// access has its hit counts saved by Shutdown, unless the instance is
+	// read-only.
+	access *accessCounters
+	// flushTraces exports the spans still buffered, with tracing on.
+	flushTraces func(context.Context) error
+}
+
+// New sets up a Server from cfg and starts its background work: cleanup,
+// prefetch workers and schedules, and any batches left unfinished by a
+// previous run.
+func New(cfg Config) (_ *Server, err error) {
+	registerMetrics()
+
+	// Everything the Server runs in the background stops once ctx is done:
+	// on Shutdown, or straight away if the Server can't be set up
+	ctx, stop := context.WithCancel(context.Background())
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	pauseWindows, err := parsePauseWindows(cfg.CleanupPauseWindows)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cleanup pause windows: %v", err)
+	}
+	inFlight := new(atomic.Int64)
+	cleanup := &cleanupController{
+		windows:     pauseWindows,
+		maxInFlight: cfg.CleanupMaxInFlight,
+		inFlight:    inFlight,
+		historySize: cfg.CleanupHistory,
+	}
+
+	// Create the storage directory if it does not exist
+	if cfg.ReadOnly {
+		if err := checkReadOnly(cfg); err != nil {
+			return nil, fmt.Errorf("invalid read-only configuration: %v", err)
+		}
+	} else if err := os.MkdirAll(cfg.StorageDir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating storage directory: %v", err)
+	}
+
+	// Connect to Redis if replicas share the storage directory
+	var index *sharedIndex
+	if cfg.RedisAddr != "" {
+		index, err = newSharedIndex(cfg.RedisAddr, cfg.RedisPassword, cfg.RedisDB, cfg.RedisPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("connecting to redis: %v", err)
+		}
+	}
+	keys, err := newKeyHasher(cfg.KeyHash, cfg.KeyLength)
+	if err != nil {
+		return nil, err
+	}
+	var previousKeys *keyHasher
+	if cfg.KeyMigrateFrom != "" {
+		if previousKeys, err = newKeyHasher(cfg.KeyMigrateFrom, 0); err != nil {
+			return nil, fmt.Errorf("invalid key migration: %v", err)
+		}
+	}
+	if cfg.ServeBufferSize <= 0 || cfg.DownloadBufferSize <= 0 {
+		return nil, fmt.Errorf("buffer sizes must be positive")
+	}
+	if err := checkVideoQuality(cfg.VideoQuality); err != nil {
+		return nil, err
+	}
+	if cfg.SubtitleLang != "" && !subtitleLangPattern.MatchString(cfg.SubtitleLang) {
+		return nil, fmt.Errorf("invalid subtitle language %q, expected a two-letter code such as en", cfg.SubtitleLang)
+	}
+	if cfg.SinglePort && cfg.AdminToken == "" {
+		return nil, fmt.Errorf("single-port mode requires an admin token")
+	}
+	if cfg.CacheTTL <= 0 {
+		return nil, fmt.Errorf("cache TTL must be positive")
+	}
+	if cfg.StaleWhileRevalidate < 0 {
+		return nil, fmt.Errorf("stale-while-revalidate window can't be negative")
+	}
+	if cfg.UpstreamTimeout < 0 || cfg.UpstreamRetries < 0 || cfg.UpstreamRetryBackoff < 0 {
+		return nil, fmt.Errorf("upstream timeout, retries and retry backoff must not be negative")
+	}
+	if cfg.CleanupWorkers <= 0 {
+		return nil, fmt.Errorf("cleanup workers must be positive")
+	}
+	if cfg.DisconnectPolicy != disconnectCancel && cfg.DisconnectPolicy != disconnectFinish {
+		return nil, fmt.Errorf("unknown disconnect policy %q, expected cancel or finish", cfg.DisconnectPolicy)
+	}
+	if cfg.EntryLockFiles && !lockFilesSupported {
+		return nil, fmt.Errorf("entry lock files are not supported on this platform")
+	}
+	cleanup.lock, err = newCleanupLock(cfg.CleanupLock, cfg.StorageDir, index)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cleanup lock: %v", err)
+	}
+
+	reporter, err := newErrorReporter(ctx, cfg.SentryDSN, cfg.SentryEnvironment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid error reporting configuration: %v", err)
+	}
+	var flushTraces func(context.Context) error
+	if cfg.Tracing {
+		if flushTraces, err = setupTracing(context.Background()); err != nil {
+			return nil, fmt.Errorf("invalid tracing configuration: %v", err)
+		}
+	}
+
+	chaos, err := newChaos(cfg)
+	if err != nil {
+		return nil, err
+	}
+	guard := newDownloadGuard(cfg.AllowPrivateDownloads)
+	for _, endpoint := range splitEndpoints(cfg.Endpoint) {
+		guard.trust(endpoint)
+	}
+	client := &http.Client{Transport: chaos.transport(upstreamTransport(cfg, guard))}
+	urls, err := newURLPolicy(cfg.AllowedHosts, cfg.DeniedHosts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host lists: %v", err)
+	}
+	contentTypes, err := parseContentTypes(cfg.AllowedContentTypes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allowed content types: %v", err)
+	}
+	auth, err := newUpstreamAuth(cfg.UpstreamAPIKey, cfg.UpstreamTurnstileCommand, client)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream authentication: %v", err)
+	}
+	cors, err := newCORSPolicy(cfg.CORSOrigins, cfg.CORSMethods, cfg.CORSHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CORS origins: %v", err)
+	}
+
+	peers, err := newPeerSet(cfg.Peers, cfg.PeerSelf, cfg.PeerSecret, cfg.ClusterRouting, client)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cluster configuration: %v", err)
+	}
+
+	var media, merger *mediaProcessor
+	if cfg.FFmpegWorkers > 0 && !cfg.ReadOnly {
+		media = newMediaProcessor(cfg.FFmpeg, cfg.FFprobe, cfg.FFmpegWorkers, cfg.DurableWrites)
+	}
+	if cfg.MergeStreams && !cfg.ReadOnly {
+		if media == nil {
+			return nil, fmt.Errorf("merging streams requires ffmpeg and at least one ffmpeg worker")
+		}
+		merger = media
+	}
+
+	retry := upstreamRetry{retries: cfg.UpstreamRetries, backoff: cfg.UpstreamRetryBackoff}
+	c := &cache{
+		endpoint:         cfg.Endpoint,
+		upstreams:        newUpstreamPool(cfg.Endpoint, cfg.Hooks, client),
+		client:           client,
+		storageDir:       cfg.StorageDir,
+		inFlight:         inFlight,
+		peers:            peers,
+		index:            index,
+		keys:             keys,
+		previousKeys:     previousKeys,
+		access:           newAccessCounters(index, cfg.PopularityBoost, cfg.CacheMaxBytes > 0),
+		top:              newRequestTop(),
+		reporter:         reporter,
+		progress:         newProgressTracker(index, cfg.StorageDir, cfg.ReadOnly),
+		chaos:            chaos,
+		hooks:            cfg.Hooks,
+		mirror:           newMirror(ctx, cfg.MirrorURL, cfg.MirrorSecret),
+		locks:            newEntryLocks(cfg.EntryLockFiles),
+		flights:          newDownloadFlights(),
+		durable:          cfg.DurableWrites,
+		integrity:        newIntegrity(cfg.VerifyChecksums),
+		disconnect:       cfg.DisconnectPolicy,
+		storage:          newStorageHealth(ctx, cfg.StorageDir),
+		ttl:              newUpstreamTTL(cfg.UpstreamTTL, cfg.UpstreamTTLMin, cfg.UpstreamTTLMax),
+		downloadBuffers:  newBufferPool(cfg.DownloadBufferSize),
+		serveBuffers:     newBufferPool(cfg.ServeBufferSize),
+		chunks:           newChunkedDownloads(cfg.DownloadChunkSize, cfg.DownloadParallelism, retry, cfg.UpstreamTimeout, client),
+		retry:            retry,
+		upstreamTimeout:  cfg.UpstreamTimeout,
+		resume:           cfg.ResumeDownloads,
+		streamMisses:     cfg.StreamMisses,
+		maxEntrySize:     cfg.MaxEntrySize,
+		memory:           newMemoryCache(cfg.MemoryCacheBytes, cfg.MemoryCacheMaxItem),
+		contentTypes:     contentTypes,
+		upstreamPrecheck: cfg.UpstreamPrecheck,
+		maxRetention:     cfg.MaxRequestTTL,
+		staleWindow:      cfg.StaleWhileRevalidate,
+		revalidating:     &sync.Map{},
+		allowRefresh:     cfg.AllowRefresh,
+		allowNoCache:     cfg.AllowNoCache,
+		bypassToken:      cfg.BypassToken,
+		maintenance:      newMaintenanceMode(cfg.CacheOnly),
+		videoQuality:     cfg.VideoQuality,
+		subtitleLang:     cfg.SubtitleLang,
+		disableMetadata:  cfg.DisableMetadata,
+		resolutions:      newResolveCache(cfg.ResolveCacheTTL),
+		failures:         newFailureCache(cfg.NegativeCacheTTL),
+		urls:             urls,
+		merger:           merger,
+		apis:             newUpstreamAPIs(cfg.Hooks, client),
+		auth:             auth,
+		readOnly:         cfg.ReadOnly,
+		serveRate:        cfg.ServeRateLimit,
+		fetchRate:        cfg.FetchRateLimit,
+		egress:           newByteLimiter(cfg.EgressRateLimit),
+		ingress:          newByteLimiter(cfg.IngressRateLimit),
+	}
+	c.shutdown, c.stop = ctx, stop
+	peers.durable = cfg.DurableWrites
+	peers.buffers = c.downloadBuffers
+	c.cdn, err = newCDNPusher(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CDN configuration: %v", err)
+	}
+	c.shared, err = newSharedStorage(ctx, cfg, c.downloadBuffers)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage backend configuration: %v", err)
+	}
+	c.downloads = newDownloadLimiter(cfg.MaxConcurrentDownloads, cfg.MaxQueuedDownloads, cfg.DownloadQueueTimeout)
+
+	if cfg.BlocklistFile != "" {
+		c.blocklist, err = loadBlocklist(cfg.BlocklistFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading blocklist file %s: %v", cfg.BlocklistFile, err)
+		}
+	}
+	if cfg.DomainsFile != "" {
+		c.domains, err = loadDomainPolicies(cfg.DomainsFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading domains file %s: %v", cfg.DomainsFile, err)
+		}
+	}
+
+	if cfg.TenantsFile != "" {
+		c.tenants, err = loadTenants(cfg.TenantsFile, c)
+		if err != nil {
+			return nil, fmt.Errorf("loading tenants file %s: %v", cfg.TenantsFile, err)
+		}
+	}
+
+	if cfg.APIKeysFile != "" {
+		if c.tenants.enabled() {
+			return nil, fmt.Errorf("an API keys file can't be combined with tenants")
+		}
+		c.apiKeys, err = loadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading API keys file %s: %v", cfg.APIKeysFile, err)
+		}
+	}
+
+	if cfg.HostsFile != "" {
+		if c.tenants.enabled() {
+			return nil, fmt.Errorf("host profiles can't be combined with tenants")
+		}
+		c.hosts, err = loadHostProfiles(cfg.HostsFile, c)
+		if err != nil {
+			return nil, fmt.Errorf("loading hosts file %s: %v", cfg.HostsFile, err)
+		}
+		for _, p := range c.hosts.byName {
+			for _, endpoint := range splitEndpoints(p.Endpoint) {
+				guard.trust(endpoint)
+			}
+		}
+	}
+
+	if err := c.access.load(filepath.Join(cfg.StorageDir, ".usage", "hits.json"), cfg.DurableWrites); err != nil {
+		return nil, fmt.Errorf("loading hit counts: %v", err)
+	}
+
+	quotaFile := cfg.QuotaStateFile
+	if quotaFile == "" {
+		quotaFile = filepath.Join(cfg.StorageDir, ".usage", "quotas.json")
+	}
+	quotas, err := loadQuotaState(quotaFile, cfg.DurableWrites, c.tenants, c.apiKeys)
+	if err != nil {
+		return nil, fmt.Errorf("loading quota state %s: %v", quotaFile, err)
+	}
+
+	var usageExport *usageExporter
+	if cfg.UsageExportDir != "" {
+		if !c.tenants.enabled() {
+			return nil, fmt.Errorf("usage export requires a tenants file")
+		}
+		usageExport, err = newUsageExporter(c.tenants, cfg.UsageExportDir, cfg.UsageExportFormat, cfg.UsageExportInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid usage export configuration: %v", err)
+		}
+	}
+
+	playlists, err := newPlaylistExpander(cfg.PlaylistResolver, cfg.PlaylistMaxItems)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist resolver: %v", err)
+	}
+	links := newLinkSigner(cfg.LinkSecret, cfg.LinkTTL, cfg.LinkBaseURL)
+	shortLinks := newShortLinkStore(index, cfg.StorageDir, cfg.LinkBaseURL, cfg.ReadOnly)
+	notifier := newNotifier(cfg.WebhookURLs, cfg.WebhookSecret, links, guard)
+
+	// A read-only instance has no queue or batches, which would mean
+	// rewriting the writer's files, and so no prefetch schedules either
+	var queue *prefetchQueue
+	var batches *batchStore
+	if !cfg.ReadOnly {
+		queueFile := cfg.PrefetchQueueFile
+		if queueFile == "" {
+			queueFile = filepath.Join(cfg.StorageDir, ".prefetch", "queue.json")
+		}
+		queue, err = newPrefetchQueue(queueFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading prefetch queue %s: %v", queueFile, err)
+		}
+
+		journalFile := cfg.BatchJournalFile
+		if journalFile == "" {
+			journalFile = filepath.Join(cfg.StorageDir, ".batch", "journal.log")
+		}
+		batches, err = newBatchStore(ctx, c, cfg.BatchMaxURLs, notifier, journalFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading batch journal %s: %v", journalFile, err)
+		}
+	}
+	var schedules []*prefetchSchedule
+	if cfg.PrefetchScheduleFile != "" && !cfg.ReadOnly {
+		schedules, err = loadPrefetchSchedules(cfg.PrefetchScheduleFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefetch schedule file %s: %v", cfg.PrefetchScheduleFile, err)
+		}
+	}
+
+	if cfg.StartupScan && !cfg.ReadOnly {
+		scanStorage(cfg.StorageDir, index, cfg.StartupScanQuarantine)
+	}
+
+	// A read-only instance doesn't clean up, prefetch or save quota counts
+	if !cfg.ReadOnly {
+		// Start the file cleanup routine
+		go startFileCleanupRoutine(ctx, cleanup, &cleaner{
+			storageDir: cfg.StorageDir,
+			trashGrace: cfg.CleanupTrashGrace,
+			ttl:        cfg.CacheTTL,
+			maxBytes:   cfg.CacheMaxBytes,
+			index:      index,
+			shared:     c.shared,
+			access:     c.access,
+			locks:      c.locks,
+			tracker:    newStorageTracker(ctx, cfg.WatchStorage),
+			workers:    cfg.CleanupWorkers,
+			maxErrors:  cfg.CleanupMaxErrors,
+		})
+		c.progress.startPruning(ctx)
+
+		// Start the prefetch workers
+		prefetch := &prefetcher{
+			queue:    queue,
+			cache:    c,
+			limiter:  rate.NewLimiter(rate.Limit(cfg.PrefetchRate), 1),
+			retries:  cfg.PrefetchRetries,
+			notifier: notifier,
+		}
+		prefetch.start(ctx, cfg.PrefetchWorkers)
+		if cfg.PrefetchWatchFile != "" {
+			go watchPrefetchFile(ctx, cfg.PrefetchWatchFile, queue)
+		}
+		quotas.start(ctx)
+		c.access.start(ctx)
+		if cfg.UpstreamProbeInterval > 0 {
+			c.apis.watch(ctx, c.hosts.endpoints(c.endpoint), cfg.UpstreamProbeInterval)
+		}
+		if cfg.UpstreamHealthInterval > 0 {
+			c.upstreams.watch(ctx, cfg.UpstreamHealthInterval)
+			if c.hosts.enabled() {
+				for _, p := range c.hosts.byName {
+					if p.cache.upstreams != c.upstreams {
+						p.cache.upstreams.watch(ctx, cfg.UpstreamHealthInterval)
+					}
+				}
+			}
+		}
+	}
+	schedule := newScheduler(queue, schedules)
+	schedule.start(ctx)
+	abuse := newAbuseGuard(cfg.AbuseBanDuration, cfg.AbuseWindow, cfg.AbuseMaxErrors, cfg.AbuseMaxFailingURLs, cfg.TrustForwardedFor)
+	abuse.start(ctx)
+	clients := newClientLimiter(cfg.ClientRateLimit, cfg.ClientRateBurst, cfg.TrustForwardedFor)
+	clients.start(ctx)
+	if usageExport != nil {
+		usageExport.start(ctx)
+	}
+
+	// Set up the router for the application server. The routes that queue
+	// or store something are refused by a read-only instance.
+	writer := func(h http.HandlerFunc) http.HandlerFunc {
+		if cfg.ReadOnly {
+			return refuseReadOnly
+		}
+		return h
+	}
+	router := mux.NewRouter()
+	router.HandleFunc("/", handleRequest(c, media)).Methods("GET")
+	router.HandleFunc("/thumbnail", handleThumbnail(c, media)).Methods("GET")
+	router.HandleFunc("/info", handleInfo(c, media)).Methods("GET")
+	router.HandleFunc("/filename", handleFilename(c)).Methods("GET")
+	router.HandleFunc("/progress/{hash:[0-9a-f]{16,64}}", handleProgress(c, c.progress)).Methods("GET")
+	router.HandleFunc("/status/{hash:[0-9a-f]{16,64}}", handleStatus(c, queue)).Methods("GET")
+	router.HandleFunc("/play", handlePlay(c, links)).Methods("GET")
+	router.HandleFunc("/hls", handleHLSRequest(c, media)).Methods("GET")
+	router.HandleFunc(`/hls/{hash:[0-9a-f]{16,64}}/{file:index\.m3u8|seg[0-9]+\.ts}`, handleHLSFile(c, media)).Methods("GET")
+	router.HandleFunc("/prefetch", writer(handlePrefetch(queue, c))).Methods("POST")
+	router.HandleFunc("/playlist", writer(handlePlaylist(playlists, queue, c, links))).Methods("POST")
+	router.HandleFunc("/archive", handleArchive(c, media, cfg.BatchMaxURLs)).Methods("GET", "POST")
+	router.HandleFunc("/batch", writer(handleBatchSubmit(batches))).Methods("POST")
+	router.HandleFunc("/batch/{id}", writer(handleBatchStatus(batches))).Methods("GET")
+	router.HandleFunc("/batch/{id}/archive", writer(handleBatchArchive(batches))).Methods("GET")
+	router.HandleFunc("/batch/{id}/items/{item:[0-9]+}", writer(handleBatchItem(batches))).Methods("GET")
+	router.HandleFunc("/links", handleLinkCreate(c, links)).Methods("POST")
+	router.HandleFunc("/f/{hash:[0-9a-f]{16,64}}", handleLink(c, links)).Methods("GET")
+	router.HandleFunc("/shorten", writer(handleShorten(c, shortLinks))).Methods("POST")
+	router.HandleFunc("/s/{token:[A-Za-z0-9_-]{12}}", handleShortLink(c, shortLinks)).Methods("GET", "HEAD")
+	if peers.enabled() {
+		router.HandleFunc("/internal/cache/{hash:[0-9a-f]{16,64}}", handlePeerCacheRequest(cfg.StorageDir, cfg.PeerSecret, c.locks)).Methods("GET", "HEAD")
+	}
+	router.HandleFunc("/internal/mirror/{hash:[0-9a-f]{16,64}}", writer(handleMirrorRequest(cfg.StorageDir, cfg.MirrorSecret, c.locks, cfg.DurableWrites, c.downloadBuffers))).Methods("PUT", "DELETE")
+
+	// And the one for metrics and the admin API
+	admin := mux.NewRouter()
+	admin.Handle("/metrics", promhttp.Handler())
+	admin.HandleFunc(healthPath, handleHealthz).Methods("GET")
+	admin.HandleFunc(readyPath, handleReadyz(c)).Methods("GET")
+	admin.HandleFunc("/admin/cleanup", handleCleanupStatus(cleanup)).Methods("GET")
+	admin.HandleFunc("/admin/cleanup/history", handleCleanupHistory(cleanup)).Methods("GET")
+	admin.HandleFunc("/admin/cleanup/pause", handleCleanupPause(cleanup)).Methods("POST")
+	admin.HandleFunc("/admin/cleanup/resume", handleCleanupResume(cleanup)).Methods("POST")
+	admin.HandleFunc("/admin/cleanup/trash/restore", writer(handleTrashRestore(cfg.StorageDir))).Methods("POST")
+	admin.HandleFunc("/admin/prefetch/schedules", handleScheduleStatus(schedule)).Methods("GET")
+	admin.HandleFunc("/admin/usage", handleUsage(c.tenants)).Methods("GET")
+	admin.HandleFunc("/admin/popular", handlePopular(c.access)).Methods("GET")
+	admin.HandleFunc("/admin/top", handleTop(c.top)).Methods("GET")
+	admin.HandleFunc("/admin/analyze", handleAnalyze(cfg.StorageDir)).Methods("GET")
+	admin.HandleFunc("/admin/cache", handleCacheList(c)).Methods("GET")
+	admin.HandleFunc("/admin/cache/purge", writer(handleCachePurge(c))).Methods("POST")
+	admin.HandleFunc("/admin/cache/{hash:[0-9a-f]{16,64}}", writer(handleCacheEntryPurge(c))).Methods("DELETE")
+	admin.HandleFunc("/admin/maintenance", handleMaintenanceStatus(c.maintenance)).Methods("GET")
+	admin.HandleFunc("/admin/maintenance/on", handleMaintenanceOn(c.maintenance)).Methods("POST")
+	admin.HandleFunc("/admin/maintenance/off", handleMaintenanceOff(c.maintenance)).Methods("POST")
+	admin.HandleFunc("/admin/bans", handleBans(abuse)).Methods("GET")
+	admin.HandleFunc("/admin/bans/{client}", handleBanLift(abuse)).Methods("DELETE")
+
+	public := logRequests(traceRequests(cors.handle(compressWith(cfg.CompressResponses, limitRequests(cfg.MaxQueryLength, cfg.ClientStallTimeout, clients.protect(abuse.protect(c.maintenance.annotate(withRetryHints(c.apiKeys.authenticate(c.tenants.authenticate(c.hosts.route(c.blocklist.protect(router)))))))))))))
+	for i := len(cfg.Middleware) - 1; i >= 0; i-- {
+		public = cfg.Middleware[i](public)
+	}
+
+	var access *accessCounters
+	if !cfg.ReadOnly {
+		access = c.access
+	}
+	return &Server{
+		public:      accessLog(cfg.AccessLog, cfg.TrustForwardedFor, recoverPanics("public", reporter, public)),
+		admin:       recoverPanics("admin", reporter, requireAdminToken(cfg.AdminToken, admin)),
+		grpc:        newGRPCServer(c, queue, cfg.AdminToken),
+		singlePort:  cfg.SinglePort,
+		apiKeys:     c.apiKeys,
+		stop:        c.stop,
+		inFlight:    c.inFlight,
+		access:      access,
+		flushTraces: flushTraces,
+	}, nil
+}
+
+// ServeHTTP serves the public API, and in single-port mode the admin
+// handler's routes too.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.singlePort && adminPath(r.URL.Path) {
+		s.admin.ServeHTTP(w, r)
+		return
+	}
+	s.public.ServeHTTP(w, r)
+}
+
+// AdminHandler serves Prometheus metrics on /metrics, liveness checks on
+// /healthz and the admin API under /admin/.
+func (s *Server) AdminHandler() http.Handler {
+	return s.admin
+}
+
+// Shutdown stops the background loops (cleanup, prefetching, probes and the
+// like), cancels the downloads under way, detached and background ones
+// included, and waits until they've stopped and removed what they had
+// written (but for what's kept to resume them), or until ctx is done, and
+// then exports the spans still buffered. Call it once the servers have
+// stopped taking requests; downloads started after it are canceled straight
+// away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	if err := s.access.save(); err != nil {
+		slog.Error("Hit_counts_save_error", "error", err)
+	}
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for s.inFlight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d downloads still running: %w", s.inFlight.Load(), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	if s.flushTraces != nil {
+		if err := s.flushTraces(ctx); err != nil {
+			slog.Error("Trace_export_error", "error", err)
+		}
+	}
+	return nil
+}
+
+// ReloadAPIKeys reads the API keys file again, so keys can be added and
+// revoked without a restart. If it can't be read or is broken, the keys in
+// use stay as they were and the error is returned. Without an API keys
+// file it does nothing.
+func (s *Server) ReloadAPIKeys() error {
+	if !s.apiKeys.enabled() {
+		return nil
+	}
+	return s.apiKeys.reload()
+}
+
+// GRPCServer returns a gRPC server for the API described in
+// passthrupb/passthru.proto, ready to Serve on a listener of its own.
+func (s *Server) GRPCServer() *grpc.Server {
+	return s.grpc
+}
@@ -0,0 +1,108 @@
+package passthru
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"cobalt-passthru/pkg/mockcobalt"
+)
+
+// newTestServer runs a Server in front of a mock cobalt, with its storage
+// in a temporary directory and configure's changes to its config.
+func newTestServer(t *testing.T, configure ...func(*Config)) *httptest.Server {
+	t.Helper()
+	cobalt := httptest.NewServer(mockcobalt.New())
+	t.Cleanup(cobalt.Close)
+
+	cfg := DefaultConfig()
+	cfg.Endpoint = cobalt.URL + "/"
+	cfg.StorageDir = t.TempDir()
+	cfg.AllowPrivateDownloads = true
+	for _, f := range configure {
+		f(&cfg)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() {
+		srv.Close()
+		if err := s.Shutdown(context.Background()); err != nil {
+			t.Error(err)
+		}
+	})
+	return srv
+}
+
+func TestServerCachesMedia(t *testing.T) {
+	srv := newTestServer(t)
+	u := srv.URL + "/?u=" + url.QueryEscape("https://example.com/clip?size=5000")
+
+	for _, want := range []string{"MISS", "HIT"} {
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || n != 5000 {
+			t.Fatalf("got %d with %d bytes, want 200 with 5000", resp.StatusCode, n)
+		}
+		if got := resp.Header.Get(cacheHeader); got != want {
+			t.Errorf("%s = %q, want %q", cacheHeader, got, want)
+		}
+	}
+}
+
+func TestServersDontShareDownloads(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.Get(a.URL + "/?u=" + url.QueryEscape("https://example.com/clip?mock=slow&size=5000"))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	defer func() { <-done }()
+	for a.Config.Handler.(*Server).inFlight.Load() == 0 {
+		select {
+		case <-done:
+			t.Fatal("a's download finished before it was seen")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// With a's download running, b has none of its own to wait for
+	s := b.Config.Handler.(*Server)
+	if n := s.inFlight.Load(); n != 0 {
+		t.Errorf("b has %d downloads in flight, want 0", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*shutdownPollInterval)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("b's shutdown waited on a's download: %v", err)
+	}
+}
+
+func TestCleanupRoutineStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		startFileCleanupRoutine(ctx, &cleanupController{}, &cleaner{storageDir: t.TempDir()})
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup routine still running after its context was canceled")
+	}
+}
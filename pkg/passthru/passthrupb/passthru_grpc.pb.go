@@ -0,0 +1,304 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: passthru.proto
+
+// Package passthru.v1 is the gRPC API of cobalt-passthru, for services that
+// would rather not build query strings.
+
+package passthrupb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Passthru_Resolve_FullMethodName  = "/passthru.v1.Passthru/Resolve"
+	Passthru_Fetch_FullMethodName    = "/passthru.v1.Passthru/Fetch"
+	Passthru_Prefetch_FullMethodName = "/passthru.v1.Passthru/Prefetch"
+	Passthru_Purge_FullMethodName    = "/passthru.v1.Passthru/Purge"
+	Passthru_Stats_FullMethodName    = "/passthru.v1.Passthru/Stats"
+)
+
+// PassthruClient is the client API for Passthru service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type PassthruClient interface {
+	// Resolve asks cobalt where the media at url can be downloaded from,
+	// without downloading it.
+	Resolve(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*ResolveResponse, error)
+	// Fetch streams the media at url, downloading it into the cache first if
+	// needed. The first message carries the stored response headers, and every
+	// message after it a chunk of the body.
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (Passthru_FetchClient, error)
+	// Prefetch queues urls for download in the background.
+	Prefetch(ctx context.Context, in *PrefetchRequest, opts ...grpc.CallOption) (*PrefetchResponse, error)
+	// Purge removes a cached entry, by URL or hash.
+	Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error)
+	// Stats describes the cache.
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+}
+
+type passthruClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewPassthruClient(cc grpc.ClientConnInterface) PassthruClient {
+	return &passthruClient{cc}
+}
+
+func (c *passthruClient) Resolve(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*ResolveResponse, error) {
+	out := new(ResolveResponse)
+	err := c.cc.Invoke(ctx, Passthru_Resolve_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *passthruClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (Passthru_FetchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Passthru_ServiceDesc.Streams[0], Passthru_Fetch_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &passthruFetchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Passthru_FetchClient interface {
+	Recv() (*FetchResponse, error)
+	grpc.ClientStream
+}
+
+type passthruFetchClient struct {
+	grpc.ClientStream
+}
+
+func (x *passthruFetchClient) Recv() (*FetchResponse, error) {
+	m := new(FetchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *passthruClient) Prefetch(ctx context.Context, in *PrefetchRequest, opts ...grpc.CallOption) (*PrefetchResponse, error) {
+	out := new(PrefetchResponse)
+	err := c.cc.Invoke(ctx, Passthru_Prefetch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *passthruClient) Purge(ctx context.Context, in *PurgeRequest, opts ...grpc.CallOption) (*PurgeResponse, error) {
+	out := new(PurgeResponse)
+	err := c.cc.Invoke(ctx, Passthru_Purge_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *passthruClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, Passthru_Stats_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PassthruServer is the server API for Passthru service.
+// All implementations must embed UnimplementedPassthruServer
+// for forward compatibility
+type PassthruServer interface {
+	// Resolve asks cobalt where the media at url can be downloaded from,
+	// without downloading it.
+	Resolve(context.Context, *ResolveRequest) (*ResolveResponse, error)
+	// Fetch streams the media at url, downloading it into the cache first if
+	// needed. The first message carries the stored response headers, and every
+	// message after it a chunk of the body.
+	Fetch(*FetchRequest, Passthru_FetchServer) error
+	// Prefetch queues urls for download in the background.
+	Prefetch(context.Context, *PrefetchRequest) (*PrefetchResponse, error)
+	// Purge removes a cached entry, by URL or hash.
+	Purge(context.Context, *PurgeRequest) (*PurgeResponse, error)
+	// Stats describes the cache.
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+	mustEmbedUnimplementedPassthruServer()
+}
+
+// UnimplementedPassthruServer must be embedded to have forward compatible implementations.
+type UnimplementedPassthruServer struct {
+}
+
+func (UnimplementedPassthruServer) Resolve(context.Context, *ResolveRequest) (*ResolveResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Resolve not implemented")
+}
+func (UnimplementedPassthruServer) Fetch(*FetchRequest, Passthru_FetchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Fetch not implemented")
+}
+func (UnimplementedPassthruServer) Prefetch(context.Context, *PrefetchRequest) (*PrefetchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Prefetch not implemented")
+}
+func (UnimplementedPassthruServer) Purge(context.Context, *PurgeRequest) (*PurgeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Purge not implemented")
+}
+func (UnimplementedPassthruServer) Stats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stats not implemented")
+}
+func (UnimplementedPassthruServer) mustEmbedUnimplementedPassthruServer() {}
+
+// UnsafePassthruServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to PassthruServer will
+// result in compilation errors.
+type UnsafePassthruServer interface {
+	mustEmbedUnimplementedPassthruServer()
+}
+
+func RegisterPassthruServer(s grpc.ServiceRegistrar, srv PassthruServer) {
+	s.RegisterService(&Passthru_ServiceDesc, srv)
+}
+
+func _Passthru_Resolve_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PassthruServer).Resolve(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Passthru_Resolve_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PassthruServer).Resolve(ctx, req.(*ResolveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Passthru_Fetch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FetchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PassthruServer).Fetch(m, &passthruFetchServer{stream})
+}
+
+type Passthru_FetchServer interface {
+	Send(*FetchResponse) error
+	grpc.ServerStream
+}
+
+type passthruFetchServer struct {
+	grpc.ServerStream
+}
+
+func (x *passthruFetchServer) Send(m *FetchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Passthru_Prefetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PrefetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PassthruServer).Prefetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Passthru_Prefetch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PassthruServer).Prefetch(ctx, req.(*PrefetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Passthru_Purge_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PurgeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PassthruServer).Purge(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Passthru_Purge_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PassthruServer).Purge(ctx, req.(*PurgeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Passthru_Stats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PassthruServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Passthru_Stats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PassthruServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Passthru_ServiceDesc is the grpc.ServiceDesc for Passthru service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Passthru_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "passthru.v1.Passthru",
+	HandlerType: (*PassthruServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Resolve",
+			Handler:    _Passthru_Resolve_Handler,
+		},
+		{
+			MethodName: "Prefetch",
+			Handler:    _Passthru_Prefetch_Handler,
+		},
+		{
+			MethodName: "Purge",
+			Handler:    _Passthru_Purge_Handler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    _Passthru_Stats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Fetch",
+			Handler:       _Passthru_Fetch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "passthru.proto",
+}
@@ -0,0 +1,396 @@
+package passthru
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// peerSecretHeader carries the shared secret on peer-to-peer requests.
+	peerSecretHeader = "X-Passthru-Peer-Secret"
+
+	// storedHeadersHeader carries a peer's stored headers file, base64
+	// encoded, alongside the binary so both halves of the entry travel in
+	// one response.
+	storedHeadersHeader = "X-Passthru-Stored-Headers"
+
+	// forwardedHeader marks a request proxied to its owner by another
+	// instance, along with the peer secret, so the owner serves it rather
+	// than routing it again.
+	forwardedHeader = "X-Passthru-Forwarded"
+
+	// routedParam marks a client redirected to the owner of its URL, with a
+	// signature of the URL hash made with the peer secret, so the owner
+	// serves it rather than redirecting it again.
+	routedParam = "routed"
+
+	// peerSuffix is added to the name of a binary being copied from a peer.
+	peerSuffix = ".peer"
+
+	// ringReplicas is the number of points each member gets on the hash ring.
+	ringReplicas = 128
+)
+
+// Cluster routing modes.
+const (
+	routingOff      = "off"
+	routingProxy    = "proxy"
+	routingRedirect = "redirect"
+)
+
+// peerSet is the set of sibling instances asked for an entry on a local miss
+// before falling back to cobalt.
+type peerSet struct {
+	peers  []string
+	self   string
+	secret string
+
+	routing string
+	ring    *hashRing
+
+	// durable flushes entries fetched from peers to stable storage
+	durable bool
+	// buffers are the copy buffers for entries fetched from peers
+	buffers *bufferPool
+	client  *http.Client
+}
+
+// newPeerSet builds a peerSet from a comma-separated list of base URLs,
+// leaving out self so an instance can share the same list as its siblings.
+//
+// With routing set to proxy or redirect, every URL hash is owned by one member
+// of the cluster (chosen by consistent hashing over the peers and self), and
+// requests for it are sent to that member.
+func newPeerSet(list, self, secret, routing string, client *http.Client) (*peerSet, error) {
+	self = strings.TrimRight(self, "/")
+	ps := &peerSet{self: self, secret: secret, routing: routing, client: client}
+	for _, peer := range strings.Split(list, ",") {
+		peer = strings.TrimRight(strings.TrimSpace(peer), "/")
+		if peer == "" || peer == self {
+			continue
+		}
+		ps.peers = append(ps.peers, peer)
+	}
+	// Peers serve their whole cache to whoever has the secret, so there has
+	// to be one
+	if len(ps.peers) > 0 && secret == "" {
+		return nil, fmt.Errorf("peers require a peer secret")
+	}
+
+	switch routing {
+	case routingOff:
+	case routingProxy, routingRedirect:
+		if self == "" {
+			return nil, fmt.Errorf("cluster routing %q requires the instance's own URL", routing)
+		}
+		ps.ring = newHashRing(append([]string{self}, ps.peers...))
+	default:
+		return nil, fmt.Errorf("unknown cluster routing mode %q", routing)
+	}
+	return ps, nil
+}
+
+func (ps *peerSet) enabled() bool {
+	return ps != nil && len(ps.peers) > 0
+}
+
+// owner returns the member owning hashStr, or "" when routing is off or the
+// entry belongs to this instance.
+func (ps *peerSet) owner(hashStr string) string {
+	if ps == nil || ps.ring == nil {
+		return ""
+	}
+	owner := ps.ring.get(hashStr)
+	if owner == ps.self {
+		return ""
+	}
+	return owner
+}
+
+// routed reports whether r, for hashStr, was routed here by another
+// instance: proxied with the forwarded header and the peer secret, or
+// redirected with a signed routed parameter. Either way it is served here,
+// so a request takes at most one hop even while the instances disagree
+// about who owns what. Clients can't claim it for themselves.
+func (ps *peerSet) routed(r *http.Request, hashStr string) bool {
+	if ps == nil || ps.secret == "" {
+		return false
+	}
+	if r.Header.Get(forwardedHeader) != "" {
+		return subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(ps.secret)) == 1
+	}
+	if sig := r.URL.Query().Get(routedParam); sig != "" {
+		return subtle.ConstantTimeCompare([]byte(sig), []byte(ps.routeSignature(hashStr))) == 1
+	}
+	return false
+}
+
+// routeSignature signs the routed parameter of a redirect for hashStr.
+func (ps *peerSet) routeSignature(hashStr string) string {
+	return hex.EncodeToString(hmacSHA256([]byte(ps.secret), "routed:"+hashStr))
+}
+
+// route sends the request for hashStr to its owner, either by proxying it
+// or by redirecting the client. If the owner can't be reached while
+// proxying, the request is handled locally by fallback instead.
+func (ps *peerSet) route(w http.ResponseWriter, r *http.Request, hashStr, owner string, fallback http.HandlerFunc) {
+	if ps.routing == routingRedirect {
+		clusterRoutedTotal.WithLabelValues(routingRedirect).Inc()
+		target := *r.URL
+		query := target.Query()
+		query.Set(routedParam, ps.routeSignature(hashStr))
+		target.RawQuery = query.Encode()
+		http.Redirect(w, r, owner+target.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	// Marked as routed, the request is served by the owner, or here by
+	// fallback, without being routed again
+	r.Header.Set(forwardedHeader, ps.self)
+	r.Header.Set(peerSecretHeader, ps.secret)
+
+	target, err := url.Parse(owner)
+	if err != nil {
+		slog.InfoContext(r.Context(), "Invalid_owner_url", "owner", owner, "error", err)
+		fallback(w, r)
+		return
+	}
+
+	clusterRoutedTotal.WithLabelValues(routingProxy).Inc()
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		slog.ErrorContext(r.Context(), "Owner_proxy_error", "owner", owner, "error", err)
+		clusterRoutedTotal.WithLabelValues("fallback").Inc()
+		fallback(w, r)
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// hashRing maps keys onto members by consistent hashing, so adding or
+// removing a member only moves the keys adjacent to its points.
+type hashRing struct {
+	points  []uint64
+	members map[uint64]string
+}
+
+func newHashRing(members []string) *hashRing {
+	ring := &hashRing{members: make(map[uint64]string)}
+	for _, member := range members {
+		for i := 0; i < ringReplicas; i++ {
+			sum := sha256.Sum256([]byte(fmt.Sprintf("%s#%d", member, i)))
+			point := binary.BigEndian.Uint64(sum[:8])
+			ring.points = append(ring.points, point)
+			ring.members[point] = member
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// get returns the member owning hashStr, a hex-encoded URL hash.
+func (ring *hashRing) get(hashStr string) string {
+	var key uint64
+	if raw, err := hex.DecodeString(hashStr); err == nil && len(raw) >= 8 {
+		key = binary.BigEndian.Uint64(raw[:8])
+	} else {
+		sum := sha256.Sum256([]byte(hashStr))
+		key = binary.BigEndian.Uint64(sum[:8])
+	}
+
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= key })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.members[ring.points[i]]
+}
+
+// peerLookup is a peer's answer to whether it has an entry.
+type peerLookup struct {
+	peer string
+	has  bool
+	err  error
+}
+
+// fetch asks every peer at once whether it has the entry, and copies it
+// over from the first to say so, or the next if that fails. So a miss
+// waits on the slowest peer's answer instead of all of theirs in turn, and
+// only one peer sends the entry. It reports whether the entry is now in
+// the local cache.
+func (ps *peerSet) fetch(hashStr, binaryFileName, headersFileName string) bool {
+	lookups := make(chan peerLookup, len(ps.peers))
+	for _, peer := range ps.peers {
+		go func(peer string) {
+			has, err := ps.lookup(peer, hashStr)
+			lookups <- peerLookup{peer: peer, has: has, err: err}
+		}(peer)
+	}
+	for range ps.peers {
+		l := <-lookups
+		if l.err != nil {
+			slog.Error("Peer_lookup_error", "peer", l.peer, "hash", hashStr, "error", l.err)
+			peerRequestsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+		if !l.has {
+			peerRequestsTotal.WithLabelValues("miss").Inc()
+			continue
+		}
+		peer := l.peer
+		found, err := ps.fetchFrom(peer, hashStr, binaryFileName, headersFileName)
+		if err != nil {
+			slog.Error("Peer_fetch_error", "peer", peer, "hash", hashStr, "error", err)
+			peerRequestsTotal.WithLabelValues("error").Inc()
+			continue
+		}
+		if !found {
+			peerRequestsTotal.WithLabelValues("miss").Inc()
+			continue
+		}
+		slog.Info("Peer_fetch_hit", "peer", peer, "hash", hashStr)
+		peerRequestsTotal.WithLabelValues("hit").Inc()
+		return true
+	}
+	return false
+}
+
+// lookup asks peer whether it has the entry of hashStr, with a HEAD. A
+// peer too old to answer one is assumed to, and asked for it.
+func (ps *peerSet) lookup(peer, hashStr string) (bool, error) {
+	resp, err := ps.request("HEAD", peer, hashStr)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusMethodNotAllowed:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+}
+
+// request sends a method request for the entry of hashStr to peer.
+func (ps *peerSet) request(method, peer, hashStr string) (*http.Response, error) {
+	req, err := http.NewRequest(method, peer+"/internal/cache/"+hashStr, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(peerSecretHeader, ps.secret)
+	return ps.client.Do(req)
+}
+
+func (ps *peerSet) fetchFrom(peer, hashStr, binaryFileName, headersFileName string) (bool, error) {
+	resp, err := ps.request("GET", peer, hashStr)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	storedHeaders, err := base64.StdEncoding.DecodeString(resp.Header.Get(storedHeadersHeader))
+	if err != nil {
+		return false, fmt.Errorf("decoding stored headers: %v", err)
+	}
+
+	// Copy the binary under a temporary name and move it into place only
+	// once all of it has arrived, so a copy cut short never looks like an
+	// entry. Not the download's .tmp, which may hold the start of one to
+	// resume.
+	tmp := binaryFileName + peerSuffix
+	binaryFile, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	_, err = ps.buffers.copy(binaryFile, resp.Body)
+	if err == nil {
+		err = syncFile(binaryFile, ps.durable)
+	}
+	if closeErr := binaryFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, binaryFileName)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+
+	err = writeFile(headersFileName, storedHeaders, ps.durable)
+	if err == nil {
+		err = syncPath(filepath.Dir(headersFileName), ps.durable)
+	}
+	if err != nil {
+		os.Remove(binaryFileName)
+		os.Remove(headersFileName)
+		return false, err
+	}
+	return true, nil
+}
+
+// handlePeerCacheRequest serves a locally cached entry to a peer, or for a
+// HEAD just says whether it's there. Both need the peer secret, so the
+// HEAD can't be used to find out what's cached either. It never consults
+// other peers or cobalt, so lookups can't bounce around the cluster.
+func handlePeerCacheRequest(storageDir, secret string, locks *entryLocks) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(peerSecretHeader)), []byte(secret)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		hashStr := mux.Vars(r)["hash"]
+		binaryFileName := filepath.Join(storageDir, hashStr+".bin")
+		headersFileName := filepath.Join(storageDir, hashStr+".headers")
+		unlock := locks.rlock(cacheEntry{hash: hashStr, binaryFile: binaryFileName, headersFile: headersFileName})
+		defer unlock()
+
+		storedHeaders, err := os.ReadFile(headersFileName)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		binaryFile, err := os.Open(binaryFileName)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer binaryFile.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if r.Method == http.MethodHead {
+			if info, err := binaryFile.Stat(); err == nil {
+				w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+			}
+			return
+		}
+		slog.InfoContext(r.Context(), "Serving_peer_request", "hash", hashStr)
+		w.Header().Set(storedHeadersHeader, base64.StdEncoding.EncodeToString(storedHeaders))
+		if _, err := io.Copy(w, binaryFile); err != nil {
+			slog.ErrorContext(r.Context(), "Peer_response_error", "hash", hashStr, "error", err)
+		}
+	}
+}
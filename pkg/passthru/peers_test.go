@@ -0,0 +1,213 @@
+package passthru
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestPeersRequirePeerSecret(t *testing.T) {
+	for _, routing := range []string{routingOff, routingProxy, routingRedirect} {
+		if _, err := newPeerSet("http://a,http://b", "http://a", "", routing, nil); err == nil {
+			t.Errorf("peers with %s routing were allowed without a peer secret", routing)
+		}
+	}
+	if _, err := newPeerSet("", "", "", routingOff, nil); err != nil {
+		t.Errorf("an instance without peers needs no secret: %v", err)
+	}
+}
+
+func TestPeerCacheRequestNeedsSecret(t *testing.T) {
+	dir := t.TempDir()
+	e := cacheEntry{hash: "0123456789abcdef", binaryFile: filepath.Join(dir, "0123456789abcdef.bin"), headersFile: filepath.Join(dir, "0123456789abcdef.headers")}
+	storeEntry(t, e, 5)
+
+	for _, tc := range []struct {
+		name, secret, sent string
+		want               int
+	}{
+		{"right secret", "s3cret", "s3cret", http.StatusOK},
+		{"wrong secret", "s3cret", "guess", http.StatusForbidden},
+		{"no secret configured", "", "", http.StatusForbidden},
+	} {
+		router := mux.NewRouter()
+		router.HandleFunc("/internal/cache/{hash}", handlePeerCacheRequest(dir, tc.secret, newEntryLocks(false)))
+		for _, method := range []string{"GET", "HEAD"} {
+			r := httptest.NewRequest(method, "/internal/cache/"+e.hash, nil)
+			r.Header.Set(peerSecretHeader, tc.sent)
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, r)
+			if rec.Code != tc.want {
+				t.Errorf("%s: %s got %d, want %d", tc.name, method, rec.Code, tc.want)
+			}
+		}
+	}
+}
+
+func TestPeerLookupNeedsSecret(t *testing.T) {
+	dir := t.TempDir()
+	e := cacheEntry{hash: "0123456789abcdef", binaryFile: filepath.Join(dir, "0123456789abcdef.bin"), headersFile: filepath.Join(dir, "0123456789abcdef.headers")}
+	storeEntry(t, e, 5)
+	router := mux.NewRouter()
+	router.HandleFunc("/internal/cache/{hash}", handlePeerCacheRequest(dir, "s3cret", newEntryLocks(false))).Methods("GET", "HEAD")
+	peer := httptest.NewServer(router)
+	defer peer.Close()
+
+	// Without the secret a stored entry and a missing one look the same
+	for _, hash := range []string{e.hash, "fedcba9876543210"} {
+		req, _ := http.NewRequest("HEAD", peer.URL+"/internal/cache/"+hash, nil)
+		resp, err := peer.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("HEAD for %s without the secret got %d, want 403", hash, resp.StatusCode)
+		}
+	}
+
+	// A peer with the wrong secret is told so, rather than that it's a miss
+	ps := &peerSet{secret: "guess", client: peer.Client()}
+	if has, err := ps.lookup(peer.URL, e.hash); has || err == nil {
+		t.Errorf("lookup with the wrong secret = %v, %v, want an error", has, err)
+	}
+	ps.secret = "s3cret"
+	if has, err := ps.lookup(peer.URL, e.hash); !has || err != nil {
+		t.Errorf("lookup with the secret = %v, %v, want a hit", has, err)
+	}
+}
+
+func TestPeerCacheRouteNeedsPeers(t *testing.T) {
+	srv := newTestServer(t)
+	resp, err := http.Get(srv.URL + "/?u=" + url.QueryEscape("https://example.com/clip?size=5"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	hash := resp.Header.Get(cacheKeyHeader)
+	if hash == "" {
+		t.Fatal("no cache key in the response")
+	}
+
+	resp, err = http.Get(srv.URL + "/internal/cache/" + hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("an instance without peers answered a peer request with %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestRoutedNeedsPeerSecret(t *testing.T) {
+	const hash = "0123456789abcdef"
+	ps, err := newPeerSet("http://a,http://b", "http://a", "s3cret", routingProxy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		headers map[string]string
+		query   string
+		want    bool
+	}{
+		{"plain", nil, "", false},
+		{"forwarded", map[string]string{forwardedHeader: "http://b"}, "", false},
+		{"wrong secret", map[string]string{forwardedHeader: "http://b", peerSecretHeader: "guess"}, "", false},
+		{"proxied", map[string]string{forwardedHeader: "http://b", peerSecretHeader: "s3cret"}, "", true},
+		{"forged redirect", nil, "&" + routedParam + "=1", false},
+		{"other hash's redirect", nil, "&" + routedParam + "=" + ps.routeSignature("fedcba9876543210"), false},
+		{"redirected", nil, "&" + routedParam + "=" + ps.routeSignature(hash), true},
+	} {
+		r := httptest.NewRequest("GET", "/?u=https%3A%2F%2Fexample.com%2Fclip"+tc.query, nil)
+		for name, value := range tc.headers {
+			r.Header.Set(name, value)
+		}
+		if got := ps.routed(r, hash); got != tc.want {
+			t.Errorf("%s: routed = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRedirectIsOneHop(t *testing.T) {
+	const hash = "0123456789abcdef"
+	a, err := newPeerSet("http://a,http://b", "http://a", "s3cret", routingRedirect, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newPeerSet("http://a,http://b", "http://b", "s3cret", routingRedirect, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	a.route(rec, httptest.NewRequest("GET", "/?u=https%3A%2F%2Fexample.com%2Fclip", nil), hash, "http://b", nil)
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("status = %d, want 307", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Host != "b" || location.Query().Get("u") != "https://example.com/clip" {
+		t.Errorf("redirected to %s", location)
+	}
+
+	// However b sees the ring, it serves what a sent it
+	r := httptest.NewRequest("GET", location.RequestURI(), nil)
+	if !b.routed(r, hash) {
+		t.Error("b would route a redirected request again")
+	}
+}
+
+func TestFetchFromPeerCommitsOnlyWholeCopies(t *testing.T) {
+	stored := base64.StdEncoding.EncodeToString([]byte(`{"version":1}`))
+	for _, tc := range []struct {
+		name string
+		sent string
+		want bool
+	}{
+		{"whole", strings.Repeat("x", 100), true},
+		{"cut short", strings.Repeat("x", 10), false},
+	} {
+		dir := t.TempDir()
+		e := cacheEntry{binaryFile: filepath.Join(dir, "entry.bin"), headersFile: filepath.Join(dir, "entry.headers")}
+		var visible bool
+		peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(storedHeadersHeader, stored)
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte(tc.sent[:5]))
+			w.(http.Flusher).Flush()
+			// Wait for the copy to start, and look at it half done
+			for i := 0; i < 100 && !fileExists(e.binaryFile) && !fileExists(e.binaryFile+peerSuffix); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			visible = fileExists(e.binaryFile)
+			w.Write([]byte(tc.sent[5:]))
+		}))
+		ps := &peerSet{client: peer.Client(), buffers: newBufferPool(32 << 10)}
+
+		found, err := ps.fetchFrom(peer.URL, "0123456789abcdef", e.binaryFile, e.headersFile)
+		peer.Close()
+		if got := found && err == nil; got != tc.want {
+			t.Errorf("%s: fetched = %v (%v), want %v", tc.name, found, err, tc.want)
+		}
+		if visible {
+			t.Errorf("%s: the binary was in place before all of it arrived", tc.name)
+		}
+		if e.exists() != tc.want {
+			t.Errorf("%s: entry exists = %v, want %v", tc.name, e.exists(), tc.want)
+		}
+		if fileExists(e.binaryFile + peerSuffix) {
+			t.Errorf("%s: the temporary copy was left behind", tc.name)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package passthru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"time"
+)
+
+// statusPicker is the status of an external service response offering
+// several media, a post with more than one photo or video, for the client
+// to pick from.
+const statusPicker = "picker"
+
+// PickerItem is one of the media a picker response offers.
+type PickerItem struct {
+	Type  string `json:"type"` // photo, video or gif
+	URL   string `json:"url"`
+	Thumb string `json:"thumb,omitempty"`
+}
+
+// pickerList is what a request asking for the picker list gets back.
+type pickerList struct {
+	Status string       `json:"status"`
+	Picker []PickerItem `json:"picker"`
+	Audio  string       `json:"audio,omitempty"`
+}
+
+// pickerTypeExtensions are the extensions for items whose URL and
+// Content-Type don't give one away.
+var pickerTypeExtensions = map[string]string{
+	"photo": ".jpg",
+	"video": ".mp4",
+	"gif":   ".gif",
+}
+
+// wantsPickerList reads the picker query parameter, which is zip (the
+// default) to have the items of a picker response stored as one archive,
+// or list to have the items returned as they are.
+func wantsPickerList(query url.Values) (bool, error) {
+	switch query.Get("picker") {
+	case "", "zip":
+		return false, nil
+	case "list":
+		return true, nil
+	}
+	return false, fmt.Errorf("'picker' must be zip or list")
+}
+
+// storePicker downloads every item of a picker response, and the audio
+// that goes with them if there is any, and stores them as e, one zip
+// archive. It reports whether the AfterDownload hooks, which see the
+// first item's response with the zip as its body, let the entry stay in
+// the cache. progress counts
+// the bytes of every item.
+func (c *cache) storePicker(ctx context.Context, url string, e cacheEntry, serviceResp *ExternalServiceResponse, progress io.Writer) (bool, error) {
+	items := serviceResp.Picker
+	if serviceResp.Audio != "" {
+		items = append(items[:len(items):len(items)], PickerItem{Type: "audio", URL: serviceResp.Audio})
+	}
+	if len(items) == 0 {
+		slog.InfoContext(ctx, "Empty_picker", "url", url)
+		return false, &fetchError{http.StatusBadGateway, "External service offered nothing to download"}
+	}
+
+	var files []archiveFile
+	defer func() {
+		for _, file := range files {
+			os.Remove(file.entry.binaryFile)
+		}
+	}()
+	var first *http.Response
+	var total int64
+	for i, item := range items {
+		part := fmt.Sprintf("%s.%d.pick", e.binaryFile, i)
+		resp, err := c.downloadStream(ctx, url, item.URL, part, progress)
+		if err != nil {
+			os.Remove(part)
+			c.resolutions.forget(c.resolveKey(ctx, url))
+			return false, err
+		}
+		if i == 0 {
+			first = resp
+		}
+		name := plainFilename(serviceResp.AudioFilename)
+		if item.Type != "audio" || name == "" {
+			name = fmt.Sprintf("%02d%s", i+1, pickerItemExtension(item, resp))
+		}
+		files = append(files, archiveFile{name: name, entry: cacheEntry{binaryFile: part}})
+		if info, err := os.Stat(part); err == nil {
+			total += info.Size()
+		}
+		// Each item fit, but together they may not
+		if tooBig := c.tooLarge(url, total); tooBig != nil {
+			slog.InfoContext(ctx, "Entry_too_large", "url", url, "size", total)
+			return false, tooBig
+		}
+	}
+
+	tmp := e.binaryFile + ".tmp"
+	checksum := sha256.New()
+	var written int64
+	f, err := os.Create(tmp)
+	if err != nil {
+		slog.ErrorContext(ctx, "Create_binary_file_error", "filename", tmp, "error", err)
+		c.storage.failed(err)
+		return false, errStorageUnwritable
+	}
+	err = writeArchive(io.MultiWriter(f, checksum), "zip", files)
+	if err == nil {
+		err = syncFile(f, c.durable)
+	}
+	if err == nil {
+		var info os.FileInfo
+		if info, err = f.Stat(); err == nil {
+			written = info.Size()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	keep := true
+	if err == nil {
+		keep, err = c.afterDownload(url, first, tmp)
+	}
+	if err == nil && keep {
+		keep = c.quota.keeps(tmp)
+	}
+	if !keep {
+		e = e.uncacheable()
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.binaryFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		slog.ErrorContext(ctx, "Write_binary_file_error", "filename", e.binaryFile, "error", err)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to write binary file"}
+	}
+
+	meta := newMeta(http.Header{"Content-Type": {"application/zip"}})
+	meta.URL = url
+	meta.Filename = e.hash[:12] + ".zip"
+	meta.ContentLength = written
+	meta.Status = http.StatusOK
+	meta.Options = requestOptionsFrom(ctx).meta()
+	meta.SHA256 = hex.EncodeToString(checksum.Sum(nil))
+	meta.ExpiresAt = c.expiry(url, nil, meta.StoredAt)
+	if ttl := retentionFrom(ctx); ttl > 0 {
+		until := meta.StoredAt.Add(ttl)
+		meta.RetainUntil = &until
+	}
+	err = writeFile(e.headersFile, meta.encode(), c.durable)
+	if err == nil {
+		err = syncPath(c.storageDir, c.durable)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Write_headers_file_error", "filename", e.headersFile, "error", err)
+		os.Remove(e.headersFile)
+		return false, &fetchError{http.StatusInternalServerError, "Failed to save headers file"}
+	}
+
+	slog.InfoContext(ctx, "Resource_stored", "binary_file", e.binaryFile, "headers_file", e.headersFile, "picker_items", len(items))
+
+	if keep && c.index.enabled() {
+		c.index.put(e.hash, indexEntry{URL: url, Size: written, StoredAt: time.Now()})
+	}
+	return keep, nil
+}
+
+// pickerItemExtension returns the extension for item's file in the
+// archive: the one its URL ends in, or failing that the one for the type
+// it came as, or for the kind of item it is.
+func pickerItemExtension(item PickerItem, resp *http.Response) string {
+	if u, err := url.Parse(item.URL); err == nil {
+		if ext := path.Ext(u.Path); ext != "" && len(ext) <= 5 {
+			return ext
+		}
+	}
+	ext := pickerTypeExtensions[item.Type]
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		// The usual extension for the type, not whichever sorts first
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 && !slices.Contains(exts, ext) {
+			return exts[0]
+		}
+	}
+	return ext
+}
+
+// servePickerList answers with the items of url's picker response, if it
+// resolves to one, and reports whether it did. Anything else is left for
+// the request to fetch as usual.
+func (c *cache) servePickerList(w http.ResponseWriter, r *http.Request, url string) bool {
+	serviceResp, err := c.resolve(r.Context(), url)
+	if err != nil {
+		var fe *fetchError
+		if errors.As(err, &fe) {
+			http.Error(w, fe.message, fe.status)
+		} else {
+			http.Error(w, "Failed to resolve resource", http.StatusInternalServerError)
+		}
+		return true
+	}
+	if serviceResp.Status != statusPicker {
+		return false
+	}
+	writeJSON(w, http.StatusOK, pickerList{Status: serviceResp.Status, Picker: serviceResp.Picker, Audio: serviceResp.Audio})
+	return true
+}
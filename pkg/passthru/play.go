@@ -0,0 +1,108 @@
+package passthru
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+//go:embed templates/play.html
+var templateFS embed.FS
+
+var playTemplate = template.Must(template.ParseFS(templateFS, "templates/play.html"))
+
+type playPage struct {
+	URL         string
+	Title       string
+	Filename    string
+	Src         string
+	ContentType string
+	Size        string
+	Audio       bool
+}
+
+// handlePlay serves a bare HTML5 player for the media at u, downloading it
+// first if it isn't cached. The player streams from /?u= (or a signed link,
+// when those are on), which serves ranges, so seeking works.
+func handlePlay(c *cache, ls *linkSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := r.URL.Query().Get("u")
+		if u == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		c := c.forRequest(r)
+		e := c.entry(u)
+		cacheStatus, err := c.ensure(r.Context(), u, e)
+		httpRequestsTotal.WithLabelValues(r.URL.Path, cacheStatus).Inc()
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		headers, err := readStoredHeaders(e.headersFile)
+		if err != nil {
+			http.Error(w, "Failed to read headers file", http.StatusInternalServerError)
+			return
+		}
+		info, err := os.Stat(e.binaryFile)
+		if err != nil {
+			http.Error(w, "Failed to open binary file", http.StatusInternalServerError)
+			return
+		}
+
+		page := playPage{
+			URL:         u,
+			Title:       u,
+			Filename:    storedFilename(e.headersFile),
+			ContentType: headers.Get("Content-Type"),
+			Size:        formatSize(info.Size()),
+			Audio:       strings.HasPrefix(headers.Get("Content-Type"), "audio/"),
+		}
+		if page.Filename != "" {
+			page.Title = page.Filename
+		} else {
+			page.Filename = e.hash[:12] + storedExtension(e.headersFile)
+		}
+		if ls.enabled() {
+			page.Src = ls.link(c.namespace, e.hash, time.Now().Add(ls.ttl))
+		} else {
+			page.Src = "/?u=" + neturl.QueryEscape(u)
+			if key := r.URL.Query().Get("key"); key != "" {
+				page.Src += "&key=" + neturl.QueryEscape(key)
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := playTemplate.Execute(w, page); err != nil {
+			slog.ErrorContext(r.Context(), "Play_template_error", "error", err)
+		}
+	}
+}
+
+// formatSize formats n bytes for humans, e.g. 12.3 MB.
+func formatSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
@@ -0,0 +1,146 @@
+package passthru
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const playlistResolveTimeout = 2 * time.Minute
+
+// playlistExpander turns a playlist or channel URL into the URLs of its
+// items. cobalt has no notion of playlists, so that takes an external
+// resolver command, such as yt-dlp --flat-playlist --print url. The command
+// is run with -- and the URL as its last arguments and prints an item URL
+// per line.
+type playlistExpander struct {
+	resolver []string // nil without a resolver
+	maxItems int
+}
+
+func newPlaylistExpander(resolver string, maxItems int) (*playlistExpander, error) {
+	pe := &playlistExpander{resolver: strings.Fields(resolver), maxItems: maxItems}
+	if len(pe.resolver) > 0 {
+		path, err := exec.LookPath(pe.resolver[0])
+		if err != nil {
+			return nil, err
+		}
+		pe.resolver[0] = path
+	}
+	return pe, nil
+}
+
+// expand returns the item URLs of the playlist at u, at most maxItems of
+// them. Without a resolver, u is checked with cobalt and makes up the whole
+// playlist. u is refused unless it's an http(s) URL the instance serves, and
+// goes to the resolver after a --, so it can't pass as an option.
+func (pe *playlistExpander) expand(ctx context.Context, c *cache, u string) ([]string, error) {
+	if err := c.urls.check(u); err != nil {
+		return nil, err
+	}
+	if len(pe.resolver) == 0 {
+		if _, err := c.resolve(ctx, u); err != nil {
+			return nil, err
+		}
+		return []string{u}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, playlistResolveTimeout)
+	defer cancel()
+	args := append(append([]string{}, pe.resolver[1:]...), "--", u)
+	cmd := exec.CommandContext(ctx, pe.resolver[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		slog.ErrorContext(ctx, "Playlist_resolver_failed", "u", u, "error", err, "stderr", strings.TrimSpace(stderr.String()))
+		return nil, &fetchError{http.StatusBadGateway, "Failed to resolve playlist"}
+	}
+
+	var items []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		item := strings.TrimSpace(scanner.Text())
+		if parsed, err := url.Parse(item); err != nil || parsed.Scheme == "" || seen[item] {
+			continue
+		}
+		seen[item] = true
+		items = append(items, item)
+		if len(items) == pe.maxItems {
+			break
+		}
+	}
+	if len(items) == 0 {
+		return nil, &fetchError{http.StatusUnprocessableEntity, "Playlist has no items"}
+	}
+	return items, nil
+}
+
+type playlistItem struct {
+	URL    string `json:"url"`
+	Hash   string `json:"hash"`
+	Queued bool   `json:"queued"`
+	// Link fetches the item through the cache; SignedLink, when signed
+	// links are on, serves it once it's cached without an API key.
+	Link       string `json:"link"`
+	SignedLink string `json:"signedLink,omitempty"`
+}
+
+type playlistManifest struct {
+	URL   string         `json:"url"`
+	Items []playlistItem `json:"items"`
+}
+
+// handlePlaylist expands the playlist or channel at u, queues every item
+// for prefetch and answers 202 with a manifest of the items and their links.
+func handlePlaylist(pe *playlistExpander, q *prefetchQueue, c *cache, ls *linkSigner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u := r.URL.Query().Get("u")
+		if u == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+
+		c := c.forRequest(r)
+		items, err := pe.expand(r.Context(), c, u)
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to resolve playlist", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		usage := usageFrom(r.Context())
+		manifest := playlistManifest{URL: u, Items: make([]playlistItem, 0, len(items))}
+		for _, item := range items {
+			job := &prefetchJob{URL: item, Tenant: c.namespace}
+			if usage != nil {
+				job.Key = usage.key
+			}
+			hash := c.entry(item).hash
+			entry := playlistItem{
+				URL:    item,
+				Hash:   hash,
+				Queued: q.add(job),
+				Link:   "/?u=" + url.QueryEscape(item),
+			}
+			if ls.enabled() {
+				entry.SignedLink = ls.link(job.Tenant, hash, time.Now().Add(ls.ttl))
+			}
+			manifest.Items = append(manifest.Items, entry)
+		}
+		slog.InfoContext(r.Context(), "Playlist_expanded", "u", u, "count", len(items))
+		writeJSON(w, http.StatusAccepted, manifest)
+	}
+}
@@ -0,0 +1,281 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPopularityDoublings caps how many times an entry's hits double into
+// extra lifetime, so even the most watched entry expires eventually.
+const maxPopularityDoublings = 8
+
+// accessSaveInterval is how often hit counts kept in memory are written to
+// the storage directory, if they changed.
+const accessSaveInterval = time.Minute
+
+// entryAccess is how often an entry has been hit, and when last.
+type entryAccess struct {
+	Hash    string    `json:"hash"`
+	URL     string    `json:"url,omitempty"`
+	Hits    int64     `json:"hits"`
+	LastHit time.Time `json:"lastHit"`
+}
+
+// accessCounters count the hits of each entry: in the shared index when
+// there is one, so the hits of every replica count, and otherwise in
+// memory, saved to a file now and then so they survive restarts. With a
+// boost, each doubling of an entry's hits keeps
+// it that much longer past its age, so hot entries outlive cold ones stored
+// at the same time.
+type accessCounters struct {
+	index *sharedIndex
+	boost time.Duration
+	// touch records every hit in the entry binary's access time too, for
+	// size eviction to go by.
+	touch bool
+
+	// path is where the counts in memory are saved, if anywhere.
+	path    string
+	durable bool
+
+	mu      sync.Mutex
+	entries map[string]*localAccess
+	// dirty is whether entries changed since they were last saved.
+	dirty bool
+}
+
+// localAccess is an entry's hits when there's no shared index, along with
+// its headers file, which has its URL.
+type localAccess struct {
+	entryAccess
+	headersFile string
+}
+
+func newAccessCounters(index *sharedIndex, boost time.Duration, touch bool) *accessCounters {
+	return &accessCounters{index: index, boost: boost, touch: touch, entries: make(map[string]*localAccess)}
+}
+
+// hit counts a hit of e.
+func (ac *accessCounters) hit(e cacheEntry) {
+	if ac == nil {
+		return
+	}
+	if ac.touch {
+		touchAccessTime(e.binaryFile)
+	}
+	if ac.index.enabled() {
+		ac.index.hit(e.hash)
+		return
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	a := ac.entries[e.hash]
+	if a == nil {
+		a = &localAccess{entryAccess: entryAccess{Hash: e.hash}, headersFile: e.headersFile}
+		ac.entries[e.hash] = a
+	}
+	a.Hits++
+	a.LastHit = time.Now()
+	ac.dirty = true
+}
+
+// hits returns how many times the entry hashStr has been hit.
+func (ac *accessCounters) hits(hashStr string) int64 {
+	if ac.index.enabled() {
+		return ac.index.hits(hashStr)
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if a := ac.entries[hashStr]; a != nil {
+		return a.Hits
+	}
+	return 0
+}
+
+// forget drops the counts of an entry that has gone. The shared index
+// drops its own along with the entry.
+func (ac *accessCounters) forget(hashStr string) {
+	if ac == nil || ac.index.enabled() {
+		return
+	}
+	ac.mu.Lock()
+	if _, ok := ac.entries[hashStr]; ok {
+		delete(ac.entries, hashStr)
+		ac.dirty = true
+	}
+	ac.mu.Unlock()
+}
+
+// savedAccess is an entry's hits as they're saved.
+type savedAccess struct {
+	entryAccess
+	HeadersFile string `json:"headersFile"`
+}
+
+// load restores the counts saved at path by an earlier run, for the
+// entries that are still there, and has them saved there from then on.
+// With a shared index it does nothing, as the counts are kept there.
+func (ac *accessCounters) load(path string, durable bool) error {
+	if ac.index.enabled() {
+		return nil
+	}
+	ac.path, ac.durable = path, durable
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedAccess
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("invalid hit counts: %v", err)
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for _, a := range saved {
+		if fileExists(a.HeadersFile) {
+			ac.entries[a.Hash] = &localAccess{entryAccess: a.entryAccess, headersFile: a.HeadersFile}
+		}
+	}
+	return nil
+}
+
+// start saves the counts every accessSaveInterval, until ctx is done.
+func (ac *accessCounters) start(ctx context.Context) {
+	if ac.path == "" {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(accessSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := ac.save(); err != nil {
+				slog.Error("Hit_counts_save_error", "file", ac.path, "error", err)
+			}
+		}
+	}()
+}
+
+// save writes the counts, if they changed, replacing the previous file
+// whole.
+func (ac *accessCounters) save() error {
+	if ac == nil || ac.path == "" {
+		return nil
+	}
+	ac.mu.Lock()
+	if !ac.dirty {
+		ac.mu.Unlock()
+		return nil
+	}
+	saved := make([]savedAccess, 0, len(ac.entries))
+	for _, a := range ac.entries {
+		saved = append(saved, savedAccess{entryAccess: a.entryAccess, HeadersFile: a.headersFile})
+	}
+	ac.dirty = false
+	ac.mu.Unlock()
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(ac.path), os.ModePerm)
+	}
+	tmp := ac.path + ".tmp"
+	if err == nil {
+		err = writeFile(tmp, data, ac.durable)
+	}
+	if err == nil {
+		err = os.Rename(tmp, ac.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		// Try again next time
+		ac.mu.Lock()
+		ac.dirty = true
+		ac.mu.Unlock()
+	}
+	return err
+}
+
+// bonus returns how much longer than its age allows the entry hashStr is
+// kept for its popularity.
+func (ac *accessCounters) bonus(hashStr string) time.Duration {
+	if ac == nil || ac.boost <= 0 {
+		return 0
+	}
+	hits := ac.hits(hashStr)
+	if hits <= 0 {
+		return 0
+	}
+	doublings := math.Min(math.Log2(float64(hits+1)), maxPopularityDoublings)
+	return time.Duration(doublings * float64(ac.boost))
+}
+
+// top returns the n most hit entries, most hit first.
+func (ac *accessCounters) top(n int) ([]entryAccess, error) {
+	if ac.index.enabled() {
+		return ac.index.top(n)
+	}
+	ac.mu.Lock()
+	top := make([]*localAccess, 0, len(ac.entries))
+	for _, a := range ac.entries {
+		top = append(top, a)
+	}
+	ac.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Hits != top[j].Hits {
+			return top[i].Hits > top[j].Hits
+		}
+		return top[i].LastHit.After(top[j].LastHit)
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	entries := make([]entryAccess, 0, len(top))
+	for _, a := range top {
+		ac.mu.Lock()
+		entry := a.entryAccess
+		ac.mu.Unlock()
+		if meta, err := readMeta(a.headersFile); err == nil {
+			entry.URL = meta.URL
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// handlePopular lists the most hit entries, 20 of them unless n says
+// otherwise.
+func handlePopular(ac *accessCounters) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := 20
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n <= 0 || n > 1000 {
+				http.Error(w, "'n' must be a number from 1 to 1000", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := ac.top(n)
+		if err != nil {
+			http.Error(w, "Failed to list popular entries", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
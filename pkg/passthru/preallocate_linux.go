@@ -0,0 +1,25 @@
+//go:build linux
+
+package passthru
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE: allocate the blocks without
+// changing the file's size, so a download cut short isn't padded with zeros.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk for f, which keeps big files from
+// fragmenting and fails straight away when they won't fit. Filesystems that
+// can't preallocate are written to as usual; only running out of space is
+// an error.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	return nil
+}
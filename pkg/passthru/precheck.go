@@ -0,0 +1,169 @@
+package passthru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// upstreamMedia is what an upstream pre-check learned of the media at a URL.
+// A size of -1 is unknown.
+type upstreamMedia struct {
+	size        int64
+	contentType string
+}
+
+// precheck asks for the size and type of the media at mediaURL without
+// downloading it: with a HEAD, or where that isn't allowed a GET of its
+// first byte, whose Content-Range gives the size. Hosts that tell neither
+// give an unknown size rather than an error.
+func (c *cache) precheck(ctx context.Context, mediaURL string) upstreamMedia {
+	info := upstreamMedia{size: -1}
+	resp, err := c.probeMedia(ctx, "HEAD", mediaURL)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, err = c.probeMedia(ctx, "GET", mediaURL)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Upstream_precheck_failure", "error", err)
+		upstreamPrechecksTotal.WithLabelValues("failed").Inc()
+		return info
+	}
+
+	info.contentType = resp.Header.Get("Content-Type")
+	switch resp.StatusCode {
+	case http.StatusOK:
+		info.size = resp.ContentLength
+	case http.StatusPartialContent:
+		info.size = rangeTotal(resp.Header.Get("Content-Range"))
+	}
+	if info.size < 0 {
+		upstreamPrechecksTotal.WithLabelValues("unknown").Inc()
+	} else {
+		upstreamPrechecksTotal.WithLabelValues("known").Inc()
+	}
+	return info
+}
+
+// probeMedia sends a bodiless request for mediaURL; a GET only asks for
+// the first byte, and whatever comes back of it is thrown away.
+func (c *cache) probeMedia(ctx context.Context, method, mediaURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRequestID(ctx, req)
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	resp.Body.Close()
+	return resp, nil
+}
+
+// rangeTotal returns the complete length in a Content-Range header, or -1
+// if it doesn't give one.
+func rangeTotal(contentRange string) int64 {
+	_, total, ok := strings.Cut(contentRange, "/")
+	if !ok || !strings.HasPrefix(contentRange, "bytes ") {
+		return -1
+	}
+	size, err := strconv.ParseInt(total, 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// errEntryTooLarge is how a download finds out, part way through, that its
+// media is over the maximum entry size.
+var errEntryTooLarge = errors.New("media is over the maximum entry size")
+
+// tooLarge returns the error refusing media of size bytes for url, or nil
+// if c takes it. An unknown size is taken and checked as it arrives.
+func (c *cache) tooLarge(url string, size int64) error {
+	max := c.maxEntrySizeFor(url)
+	if max <= 0 || size <= max {
+		return nil
+	}
+	entriesTooLargeTotal.Inc()
+	return &fetchError{http.StatusRequestEntityTooLarge, fmt.Sprintf("Resource is larger than the %d bytes an entry may take", max)}
+}
+
+// parseContentTypes reads a comma-separated list of media types, such as
+// video/mp4, or whole families of them, such as video/*.
+func parseContentTypes(list string) ([]string, error) {
+	var types []string
+	for _, t := range strings.Split(list, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" {
+			continue
+		}
+		family, subtype, ok := strings.Cut(t, "/")
+		if !ok || family == "" || family == "*" || subtype == "" || strings.ContainsAny(t, "; ") {
+			return nil, fmt.Errorf("%q must be a media type such as video/mp4 or video/*", t)
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// wrongType returns the error refusing media of contentType, or nil if c
+// takes it. Media that doesn't say what it is is taken.
+func (c *cache) wrongType(contentType string) error {
+	if len(c.contentTypes) == 0 || contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		for _, allowed := range c.contentTypes {
+			if mediaType == allowed || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+				return nil
+			}
+		}
+	}
+	entriesWrongTypeTotal.Inc()
+	return &fetchError{http.StatusBadGateway, fmt.Sprintf("Resource is %s, which is not served here", contentType)}
+}
+
+// capSize returns r failing with errEntryTooLarge once it's read past the
+// maximum entry size of url, less the offset bytes already stored, for
+// media that turns out larger than it said or never said.
+func (c *cache) capSize(url string, r io.Reader, offset int64) io.Reader {
+	max := c.maxEntrySizeFor(url)
+	if max <= 0 {
+		return r
+	}
+	return &sizeCapReader{r: r, left: max - offset}
+}
+
+type sizeCapReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (r *sizeCapReader) Read(p []byte) (int, error) {
+	if r.left < 0 {
+		return 0, errEntryTooLarge
+	}
+	// Read one byte past the limit, to tell media of exactly the maximum
+	// from media that goes on
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, errEntryTooLarge
+	}
+	return n, err
+}
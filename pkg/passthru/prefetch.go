@@ -0,0 +1,391 @@
+package passthru
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	prefetchRetryBaseDelay = 30 * time.Second
+	prefetchRetryMaxDelay  = 30 * time.Minute
+	prefetchWatchInterval  = 30 * time.Second
+)
+
+// prefetchJob is a URL waiting to be pulled into the cache (of the tenant
+// or host profile Tenant names, if set) in the background. The download is charged to the API key with ID
+// Key, if set, and its outcome is posted to Callback, if set.
+type prefetchJob struct {
+	URL       string    `json:"url"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	Callback  string    `json:"callback,omitempty"`
+	Attempts  int       `json:"attempts"`
+	NotBefore time.Time `json:"notBefore,omitempty"`
+}
+
+// key identifies the job's URL within its tenant's cache.
+func (job *prefetchJob) key() string {
+	return job.Tenant + "\x00" + job.URL
+}
+
+// prefetchQueue holds pending prefetch jobs. Its contents, including jobs
+// being worked on, are written to path after every change so the queue
+// survives restarts.
+type prefetchQueue struct {
+	mu      sync.Mutex
+	pending []*prefetchJob
+	active  map[string]*prefetchJob
+	wake    chan struct{}
+	path    string
+}
+
+// newPrefetchQueue creates a queue persisted at path, loading any jobs left
+// over from a previous run.
+func newPrefetchQueue(path string) (*prefetchQueue, error) {
+	q := &prefetchQueue{
+		active: make(map[string]*prefetchJob),
+		wake:   make(chan struct{}, 1),
+		path:   path,
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &q.pending); err != nil {
+			return nil, err
+		}
+	}
+	prefetchQueueDepth.Set(float64(len(q.pending)))
+	return q, nil
+}
+
+// add queues a job unless its URL is already queued or being fetched for the
+// same tenant, and reports whether it was added.
+func (q *prefetchQueue) add(added *prefetchJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.active[added.key()]; ok {
+		return false
+	}
+	for _, job := range q.pending {
+		if job.key() == added.key() {
+			return false
+		}
+	}
+	q.pending = append(q.pending, added)
+	q.changed()
+	return true
+}
+
+// queued returns the job for the entry with hash in c, if there's one
+// waiting or being worked on.
+func (q *prefetchQueue) queued(c *cache, hash string) (prefetchJob, bool) {
+	if q == nil {
+		return prefetchJob{}, false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, job := range q.active {
+		if job.Tenant == c.namespace && c.entry(job.URL).hash == hash {
+			return *job, true
+		}
+	}
+	for _, job := range q.pending {
+		if job.Tenant == c.namespace && c.entry(job.URL).hash == hash {
+			return *job, true
+		}
+	}
+	return prefetchJob{}, false
+}
+
+// depth returns the number of jobs waiting in the queue.
+func (q *prefetchQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// next blocks until a job is due and hands it out, or returns nil once ctx is
+// done.
+func (q *prefetchQueue) next(ctx context.Context) *prefetchJob {
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		wait := time.Duration(-1)
+		for i, job := range q.pending {
+			if !job.NotBefore.After(now) {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				q.active[job.key()] = job
+				q.changed()
+				q.mu.Unlock()
+				return job
+			}
+			if d := job.NotBefore.Sub(now); wait < 0 || d < wait {
+				wait = d
+			}
+		}
+		q.mu.Unlock()
+
+		var timer *time.Timer
+		var due <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			due = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.wake:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// done removes a finished job.
+func (q *prefetchQueue) done(job *prefetchJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.active, job.key())
+	q.changed()
+}
+
+// retry puts a failed job back in the queue to run again after delay.
+func (q *prefetchQueue) retry(job *prefetchJob, delay time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.active, job.key())
+	job.NotBefore = time.Now().Add(delay)
+	q.pending = append(q.pending, job)
+	q.changed()
+}
+
+// changed persists the queue, updates the depth metric and wakes a waiting
+// worker. It must be called with q.mu held.
+func (q *prefetchQueue) changed() {
+	prefetchQueueDepth.Set(float64(len(q.pending)))
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	jobs := make([]*prefetchJob, 0, len(q.pending)+len(q.active))
+	for _, job := range q.active {
+		jobs = append(jobs, job)
+	}
+	jobs = append(jobs, q.pending...)
+
+	data, err := json.Marshal(jobs)
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		slog.Error("Prefetch_queue_save_error", "file", q.path, "error", err)
+	}
+}
+
+// prefetcher works through the prefetch queue with a pool of workers, rate
+// limiting the calls it makes to the external service.
+type prefetcher struct {
+	queue    *prefetchQueue
+	cache    *cache
+	limiter  *rate.Limiter
+	retries  int
+	notifier *notifier
+}
+
+func (p *prefetcher) start(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				job := p.queue.next(ctx)
+				if job == nil {
+					return
+				}
+				p.process(ctx, job)
+			}
+		}()
+	}
+}
+
+func (p *prefetcher) process(ctx context.Context, job *prefetchJob) {
+	c := p.cache.forTenant(job.Tenant)
+	if c == nil {
+		slog.InfoContext(ctx, "Prefetch_unknown_tenant", "u", job.URL, "tenant", job.Tenant)
+		prefetchJobsTotal.WithLabelValues("failed").Inc()
+		p.queue.done(job)
+		return
+	}
+	e := c.entry(job.URL)
+	if e.exists() {
+		prefetchJobsTotal.WithLabelValues("cached").Inc()
+		p.queue.done(job)
+		return
+	}
+
+	if err := p.limiter.Wait(ctx); err != nil {
+		p.queue.retry(job, 0)
+		return
+	}
+
+	job.Attempts++
+	slog.InfoContext(ctx, "Prefetch_started", "u", job.URL, "attempt", job.Attempts)
+	status, err := c.ensure(withUsage(ctx, p.cache.tenants.usageFor(job.Key)), job.URL, e)
+	if err == nil {
+		slog.InfoContext(ctx, "Prefetch_finished", "u", job.URL, "cache_status", status)
+		prefetchJobsTotal.WithLabelValues("downloaded").Inc()
+		p.queue.done(job)
+		event := webhookEvent{Event: eventDownloadCompleted, Source: "prefetch", URL: job.URL, Hash: e.hash, CacheStatus: status}
+		p.notifier.describe(&event, c, e)
+		p.notifier.notify(event, job.Callback)
+		return
+	}
+
+	if job.Attempts > p.retries {
+		slog.ErrorContext(ctx, "Prefetch_failed", "u", job.URL, "attempts", job.Attempts, "error", err)
+		prefetchJobsTotal.WithLabelValues("failed").Inc()
+		p.queue.done(job)
+		p.notifier.notify(webhookEvent{Event: eventDownloadFailed, Source: "prefetch", URL: job.URL, Hash: e.hash, Error: err.Error()}, job.Callback)
+		return
+	}
+
+	delay := prefetchRetryBaseDelay << (job.Attempts - 1)
+	if delay > prefetchRetryMaxDelay || delay <= 0 {
+		delay = prefetchRetryMaxDelay
+	}
+	slog.InfoContext(ctx, "Prefetch_retry_scheduled", "u", job.URL, "attempt", job.Attempts, "delay", delay, "error", err)
+	prefetchJobsTotal.WithLabelValues("retried").Inc()
+	p.queue.retry(job, delay)
+}
+
+type prefetchRequest struct {
+	URLs     []string `json:"urls"`
+	Callback string   `json:"callback"`
+}
+
+type prefetchResult struct {
+	URL    string `json:"url"`
+	Hash   string `json:"hash"`
+	Queued bool   `json:"queued"`
+	Status string `json:"status"` // where to follow the download
+}
+
+// handlePrefetch queues the URLs given as repeated "u" query parameters or
+// as a JSON body of the form {"urls": [...]} and answers 202 right away.
+// The outcome of each download is posted to the "callback" URL, if given.
+func handlePrefetch(q *prefetchQueue, c *cache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		urls := r.URL.Query()["u"]
+		callback := r.URL.Query().Get("callback")
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var body prefetchRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+				return
+			}
+			urls = append(urls, body.URLs...)
+			if body.Callback != "" {
+				callback = body.Callback
+			}
+		}
+		if len(urls) == 0 {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+		if callback != "" {
+			if fe := checkCallback(callback); fe != nil {
+				http.Error(w, fe.message, fe.status)
+				return
+			}
+		}
+
+		c := c.forRequest(r)
+		usage := usageFrom(r.Context())
+		results := make([]prefetchResult, 0, len(urls))
+		for _, url := range urls {
+			job := &prefetchJob{URL: url, Tenant: c.namespace, Callback: callback}
+			if usage != nil {
+				job.Key = usage.key
+			}
+			hash := c.entry(url).hash
+			results = append(results, prefetchResult{
+				URL:    url,
+				Hash:   hash,
+				Queued: q.add(job),
+				Status: "/status/" + hash,
+			})
+		}
+		slog.InfoContext(r.Context(), "Prefetch_requested", "count", len(urls))
+		writeJSON(w, http.StatusAccepted, results)
+	}
+}
+
+// watchPrefetchFile queues every URL in path (one per line, # for comments)
+// whenever the file changes, until ctx is done.
+func watchPrefetchFile(ctx context.Context, path string, q *prefetchQueue) {
+	var lastMod time.Time
+	for {
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Error("Prefetch_watch_file_error", "file", path, "error", err)
+		} else if info.ModTime() != lastMod {
+			lastMod = info.ModTime()
+			added, err := queueURLsFromFile(path, q)
+			if err != nil {
+				slog.Error("Prefetch_watch_file_error", "file", path, "error", err)
+			} else {
+				slog.Info("Prefetch_watch_file_loaded", "file", path, "queued", added)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(prefetchWatchInterval):
+		}
+	}
+}
+
+func queueURLsFromFile(path string, q *prefetchQueue) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	added := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if q.add(&prefetchJob{URL: line}) {
+			added++
+		}
+	}
+	return added, scanner.Err()
+}
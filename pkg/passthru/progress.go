@@ -0,0 +1,333 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	progressDirName = ".progress"
+	// progressSaveInterval is how often a download's progress is saved.
+	progressSaveInterval = time.Second
+	// A download whose progress hasn't been saved for progressStale was cut
+	// short by its replica going away, and the record of a download that
+	// ended without an entry is kept for progressRetention.
+	progressStale     = 10 * progressSaveInterval
+	progressRetention = time.Hour
+)
+
+// Download states.
+const (
+	progressDownloading = "downloading"
+	progressDone        = "done"
+	progressFailed      = "failed"
+	progressInterrupted = "interrupted"
+)
+
+// progressRecord is what GET /progress/{hash} says about the download of
+// an entry. A total of -1 is unknown.
+type progressRecord struct {
+	Hash    string    `json:"hash"`
+	URL     string    `json:"url,omitempty"`
+	State   string    `json:"state"`
+	Done    int64     `json:"done"`
+	Total   int64     `json:"total"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+}
+
+// progressTracker saves the progress of downloads as they go: in the
+// shared index when there is one, so any replica can report on any
+// download, and in files under the storage directory otherwise. Either way
+// it outlives the download, the request that started it and a restart.
+type progressTracker struct {
+	index *sharedIndex
+	dir   string // "" keeps progress in memory only
+
+	mu   sync.Mutex
+	live map[string]*downloadProgress
+}
+
+func newProgressTracker(index *sharedIndex, storageDir string, readOnly bool) *progressTracker {
+	pt := &progressTracker{index: index, live: make(map[string]*downloadProgress)}
+	if !index.enabled() && !readOnly {
+		pt.dir = filepath.Join(storageDir, progressDirName)
+		if err := os.MkdirAll(pt.dir, os.ModePerm); err != nil {
+			slog.Error("Create_progress_directory_error", "dir", pt.dir, "error", err)
+			pt.dir = ""
+		}
+	}
+	return pt
+}
+
+// downloadProgress counts the bytes of one download as they're written.
+type downloadProgress struct {
+	tracker *progressTracker
+	hash    string
+	url     string
+	total   atomic.Int64
+	done    atomic.Int64
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// start begins tracking the download of the entry hashStr for url, of an
+// unknown size until at says otherwise. The caller must call finish.
+func (pt *progressTracker) start(hashStr, url string) *downloadProgress {
+	p := &downloadProgress{tracker: pt, hash: hashStr, url: url, stop: make(chan struct{})}
+	p.total.Store(-1)
+	pt.mu.Lock()
+	pt.live[hashStr] = p
+	pt.mu.Unlock()
+	pt.save(p.record(progressDownloading, ""))
+
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(progressSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				pt.save(p.record(progressDownloading, ""))
+			}
+		}
+	}()
+	return p
+}
+
+// Write counts p's bytes without keeping them, so p can sit beside the file
+// a download goes to.
+func (p *downloadProgress) Write(b []byte) (int, error) {
+	p.done.Add(int64(len(b)))
+	return len(b), nil
+}
+
+// at sets how many bytes the download starts with, those a resumed one
+// already has, and how many it has in all (-1 if unknown).
+func (p *downloadProgress) at(offset, total int64) {
+	p.done.Store(offset)
+	p.total.Store(total)
+}
+
+func (p *downloadProgress) record(state, errMessage string) progressRecord {
+	return progressRecord{
+		Hash:    p.hash,
+		URL:     p.url,
+		State:   state,
+		Done:    p.done.Load(),
+		Total:   p.total.Load(),
+		Error:   errMessage,
+		Updated: time.Now(),
+	}
+}
+
+// finish saves how the download ended: done once the entry is stored, and
+// failed with err otherwise.
+func (p *downloadProgress) finish(err error) {
+	close(p.stop)
+	p.stopped.Wait()
+	pt := p.tracker
+	pt.mu.Lock()
+	if pt.live[p.hash] == p {
+		delete(pt.live, p.hash)
+	}
+	pt.mu.Unlock()
+
+	if err != nil {
+		pt.save(p.record(progressFailed, errorMessage(err)))
+		return
+	}
+	rec := p.record(progressDone, "")
+	rec.Total = rec.Done
+	pt.save(rec)
+}
+
+// errorMessage is what a client is told of a download that failed with
+// err.
+func errorMessage(err error) string {
+	var fe *fetchError
+	if errors.As(err, &fe) {
+		return fe.message
+	}
+	return "Download failed"
+}
+
+// save stores rec where other requests, replicas and restarts find it.
+func (pt *progressTracker) save(rec progressRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	if pt.index.enabled() {
+		pt.index.putProgress(rec.Hash, data, progressRetention)
+		return
+	}
+	if pt.dir == "" {
+		return
+	}
+	path := filepath.Join(pt.dir, rec.Hash+".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		slog.Error("Save_progress_error", "file", path, "error", err)
+	}
+}
+
+// get returns the progress of the download of the entry hashStr, the one
+// running here or the last one saved. A download saved as running that
+// stopped being saved was interrupted.
+func (pt *progressTracker) get(hashStr string) (progressRecord, bool) {
+	pt.mu.Lock()
+	p := pt.live[hashStr]
+	pt.mu.Unlock()
+	if p != nil {
+		return p.record(progressDownloading, ""), true
+	}
+
+	var data []byte
+	if pt.index.enabled() {
+		data = pt.index.getProgress(hashStr)
+	} else if pt.dir != "" {
+		data, _ = os.ReadFile(filepath.Join(pt.dir, hashStr+".json"))
+	}
+	var rec progressRecord
+	if data == nil || json.Unmarshal(data, &rec) != nil {
+		return rec, false
+	}
+	if rec.State == progressDownloading && time.Since(rec.Updated) > progressStale {
+		rec.State = progressInterrupted
+	}
+	return rec, true
+}
+
+// prune removes the saved progress of downloads that ended, or stopped
+// being saved, over progressRetention ago. The shared index expires its
+// own.
+func (pt *progressTracker) prune() {
+	if pt.dir == "" {
+		return
+	}
+	files, err := os.ReadDir(pt.dir)
+	if err != nil {
+		slog.Error("Read_progress_directory_error", "dir", pt.dir, "error", err)
+		return
+	}
+	cutoff := time.Now().Add(-progressRetention)
+	for _, file := range files {
+		if info, err := file.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(pt.dir, file.Name()))
+		}
+	}
+}
+
+// startPruning prunes saved progress every progressRetention, until ctx is
+// done.
+func (pt *progressTracker) startPruning(ctx context.Context) {
+	pt.prune()
+	go func() {
+		ticker := time.NewTicker(progressRetention)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				pt.prune()
+			}
+		}
+	}()
+}
+
+// handleProgress reports on the download of the entry with the hash in the
+// path: bytes done, the total if known and its state. Entries that are
+// cached and have no download on record are done.
+func handleProgress(c *cache, pt *progressTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := c.forRequest(r)
+		hashStr := mux.Vars(r)["hash"]
+		if rec, ok := pt.get(hashStr); ok {
+			writeJSON(w, http.StatusOK, rec)
+			return
+		}
+		e := c.entryForHash(hashStr)
+		if stat, err := os.Stat(e.binaryFile); err == nil && c.cached(e) {
+			rec := progressRecord{Hash: hashStr, State: progressDone, Done: stat.Size(), Total: stat.Size(), Updated: stat.ModTime()}
+			if meta, err := readMeta(e.headersFile); err == nil {
+				rec.URL = meta.URL
+			}
+			writeJSON(w, http.StatusOK, rec)
+			return
+		}
+		http.Error(w, "No download on record for this hash", http.StatusNotFound)
+	}
+}
+
+// Entry states, as GET /status/{hash} reports them.
+const (
+	statusPending     = "pending"
+	statusDownloading = "downloading"
+	statusReady       = "ready"
+	statusFailed      = "failed"
+)
+
+// entryStatus is what GET /status/{hash} says about an entry.
+type entryStatus struct {
+	Hash     string `json:"hash"`
+	URL      string `json:"url,omitempty"`
+	State    string `json:"state"`
+	Done     int64  `json:"done,omitempty"`
+	Total    int64  `json:"total,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// handleStatus tells a client that asked for an entry to be prefetched how
+// it's getting on: pending while it waits in the queue (or to be retried),
+// then downloading, and ready or failed in the end. Entries neither cached,
+// queued nor on record are a 404.
+func handleStatus(c *cache, q *prefetchQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := c.forRequest(r)
+		hashStr := mux.Vars(r)["hash"]
+		status := entryStatus{Hash: hashStr}
+		e := c.entryForHash(hashStr)
+		if stat, err := os.Stat(e.binaryFile); err == nil && c.cached(e) {
+			status.State, status.Done, status.Total = statusReady, stat.Size(), stat.Size()
+			if meta, err := readMeta(e.headersFile); err == nil {
+				status.URL = meta.URL
+			}
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+
+		rec, recorded := c.progress.get(hashStr)
+		job, queued := q.queued(c, hashStr)
+		switch {
+		case recorded && rec.State == progressDownloading:
+			status.State, status.URL, status.Done, status.Total = statusDownloading, rec.URL, rec.Done, rec.Total
+		case queued:
+			status.State, status.URL, status.Attempts = statusPending, job.URL, job.Attempts
+			status.Error = rec.Error
+		case recorded && rec.State != progressDone:
+			status.State, status.URL, status.Error = statusFailed, rec.URL, rec.Error
+		default:
+			http.Error(w, "No download on record for this hash", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
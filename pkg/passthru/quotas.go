@@ -0,0 +1,287 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaSaveInterval is how often the usage counted against quotas is written
+// to disk, and so at most how much of it a crash forgets.
+const quotaSaveInterval = time.Minute
+
+// usageQuotas caps what an API key may use per calendar day and month, in
+// UTC. Zero is unlimited.
+type usageQuotas struct {
+	DailyRequests   int64 `json:"dailyRequests"`
+	DailyBytes      int64 `json:"dailyBytes"`
+	MonthlyRequests int64 `json:"monthlyRequests"`
+	MonthlyBytes    int64 `json:"monthlyBytes"`
+}
+
+func (q usageQuotas) set() bool {
+	return q.DailyRequests > 0 || q.DailyBytes > 0 || q.MonthlyRequests > 0 || q.MonthlyBytes > 0
+}
+
+// quotaPeriod is what a key used in the day or month beginning at Start.
+type quotaPeriod struct {
+	Start    time.Time `json:"start"`
+	Requests int64     `json:"requests"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// roll starts the period over if start is a later one.
+func (p *quotaPeriod) roll(start time.Time) {
+	if !p.Start.Equal(start) {
+		*p = quotaPeriod{Start: start}
+	}
+}
+
+func dayStart(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func monthStart(now time.Time) time.Time {
+	y, m, _ := now.UTC().Date()
+	return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// keyQuota counts a key's requests and served bytes in the current day and
+// month against its quotas. A nil keyQuota is a key without quotas.
+type keyQuota struct {
+	limits usageQuotas
+
+	mu    sync.Mutex
+	day   quotaPeriod
+	month quotaPeriod
+}
+
+func newKeyQuota(limits usageQuotas) *keyQuota {
+	if !limits.set() {
+		return nil
+	}
+	return &keyQuota{limits: limits}
+}
+
+// rollLocked moves the counters on to the periods containing now.
+func (q *keyQuota) rollLocked(now time.Time) {
+	q.day.roll(dayStart(now))
+	q.month.roll(monthStart(now))
+}
+
+func (q *keyQuota) request() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.rollLocked(time.Now())
+	q.day.Requests++
+	q.month.Requests++
+	q.mu.Unlock()
+}
+
+func (q *keyQuota) served(n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.rollLocked(time.Now())
+	q.day.Bytes += n
+	q.month.Bytes += n
+	q.mu.Unlock()
+}
+
+// quotaBreach is a quota a key has used up, or is using.
+type quotaBreach struct {
+	name  string // e.g. daily_bytes
+	limit int64
+	used  int64
+	reset time.Time
+}
+
+// exceeded returns the first of the key's quotas used up at now, if any.
+// Bytes are counted once a response is done, so the request that goes over
+// a byte quota is served in full and the next one is refused.
+func (q *keyQuota) exceeded(now time.Time) (quotaBreach, bool) {
+	if q == nil {
+		return quotaBreach{}, false
+	}
+	for _, b := range q.usage(now) {
+		if b.used >= b.limit {
+			return b, true
+		}
+	}
+	return quotaBreach{}, false
+}
+
+// tightest returns the one of the key's quotas with the least of it left
+// at now, if it has any.
+func (q *keyQuota) tightest(now time.Time) (quotaBreach, bool) {
+	if q == nil {
+		return quotaBreach{}, false
+	}
+	var tightest quotaBreach
+	left := 2.0
+	for _, b := range q.usage(now) {
+		if l := 1 - float64(b.used)/float64(b.limit); l < left {
+			tightest, left = b, l
+		}
+	}
+	return tightest, left <= 1
+}
+
+// usage returns how much of each of the key's quotas it has used at now.
+func (q *keyQuota) usage(now time.Time) []quotaBreach {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollLocked(now)
+
+	nextDay := q.day.Start.AddDate(0, 0, 1)
+	nextMonth := q.month.Start.AddDate(0, 1, 0)
+	var usage []quotaBreach
+	for _, b := range []quotaBreach{
+		{"daily_requests", q.limits.DailyRequests, q.day.Requests, nextDay},
+		{"daily_bytes", q.limits.DailyBytes, q.day.Bytes, nextDay},
+		{"monthly_requests", q.limits.MonthlyRequests, q.month.Requests, nextMonth},
+		{"monthly_bytes", q.limits.MonthlyBytes, q.month.Bytes, nextMonth},
+	} {
+		if b.limit > 0 {
+			usage = append(usage, b)
+		}
+	}
+	return usage
+}
+
+// setUsageHeaders tells the client how much of quota b it has left, so it
+// can slow down before being refused.
+func (b quotaBreach) setUsageHeaders(h http.Header) {
+	h.Set("X-Quota-Name", b.name)
+	h.Set("X-Quota-Limit", strconv.FormatInt(b.limit, 10))
+	h.Set("X-Quota-Used", strconv.FormatInt(b.used, 10))
+	h.Set("X-Quota-Remaining", strconv.FormatInt(max(b.limit-b.used, 0), 10))
+	h.Set("X-Quota-Reset", strconv.FormatInt(b.reset.Unix(), 10))
+}
+
+// setHeaders describes b to the client refused over it.
+func (b quotaBreach) setHeaders(h http.Header, now time.Time) {
+	h.Set("X-Quota-Exceeded", b.name)
+	b.setUsageHeaders(h)
+	h.Set("Retry-After", strconv.FormatInt(int64(b.reset.Sub(now).Seconds())+1, 10))
+}
+
+// quotaCounters is a key's saved counters.
+type quotaCounters struct {
+	Day   quotaPeriod `json:"day"`
+	Month quotaPeriod `json:"month"`
+}
+
+// quotaState keeps the usage counted against every key's quotas in a file,
+// so restarting doesn't start anyone's day or month over. Keys are saved by
+// their ID, not the key itself.
+type quotaState struct {
+	path    string
+	durable bool
+	quotas  map[string]*keyQuota
+	// apiKeys has quotas of its own, which change as the keys file is
+	// reread.
+	apiKeys *apiKeySet
+}
+
+// all returns every key's quota by ID.
+func (s *quotaState) all() map[string]*keyQuota {
+	all := s.apiKeys.quotas()
+	for id, q := range s.quotas {
+		all[id] = q
+	}
+	return all
+}
+
+// loadQuotaState restores the counters of the keys in ts and ks with quotas
+// from path, if it exists. It returns nil if no key has quotas, and none can
+// be added without a restart.
+func loadQuotaState(path string, durable bool, ts *tenantSet, ks *apiKeySet) (*quotaState, error) {
+	s := &quotaState{path: path, durable: durable, quotas: make(map[string]*keyQuota), apiKeys: ks}
+	if ts.enabled() {
+		for _, k := range ts.keys {
+			if k.usage.quota != nil {
+				s.quotas[k.usage.key] = k.usage.quota
+			}
+		}
+	}
+	if len(s.quotas) == 0 && !ks.enabled() {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved map[string]quotaCounters
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("invalid quota state: %v", err)
+	}
+	quotas := s.all()
+	for id, counters := range saved {
+		if q := quotas[id]; q != nil {
+			q.day, q.month = counters.Day, counters.Month
+		}
+	}
+	return s, nil
+}
+
+// start saves the counters every quotaSaveInterval, until ctx is done.
+func (s *quotaState) start(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(quotaSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := s.save(); err != nil {
+				slog.Error("Quota_state_save_error", "file", s.path, "error", err)
+			}
+		}
+	}()
+}
+
+// save writes every key's counters, replacing the previous file whole.
+func (s *quotaState) save() error {
+	quotas := s.all()
+	saved := make(map[string]quotaCounters, len(quotas))
+	for id, q := range quotas {
+		q.mu.Lock()
+		saved[id] = quotaCounters{Day: q.day, Month: q.month}
+		q.mu.Unlock()
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := writeFile(tmp, data, s.durable); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
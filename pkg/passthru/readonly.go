@@ -0,0 +1,52 @@
+package passthru
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// A read-only instance serves the hits in a storage directory another
+// instance writes to, but never writes to it itself, calls the external
+// service or cleans up, so read capacity can be added behind a single
+// writer. The storage can be mounted read-only.
+
+// errReadOnly is returned for anything a read-only instance would have to
+// download or store.
+var errReadOnly = &fetchError{http.StatusServiceUnavailable, "Only cached media is served by this instance"}
+
+// checkReadOnly returns an error if cfg asks a read-only instance for
+// anything that writes to storage, and makes sure the storage is there.
+func checkReadOnly(cfg Config) error {
+	for _, option := range []struct {
+		set  bool
+		name string
+	}{
+		{cfg.Peers != "", "copy entries from peers"},
+		{cfg.MirrorURL != "" || cfg.MirrorSecret != "", "mirror entries"},
+		{cfg.CDNUploadURL != "", "push entries to a CDN"},
+		{cfg.EntryLockFiles, "take entry lock files"},
+		{cfg.AllowRefresh, "refresh entries"},
+		{cfg.MaxRequestTTL > 0, "record client TTLs"},
+		{cfg.PrefetchScheduleFile != "" || cfg.PrefetchWatchFile != "", "prefetch"},
+	} {
+		if option.set {
+			return fmt.Errorf("a read-only instance can't %s", option.name)
+		}
+	}
+
+	info, err := os.Stat(cfg.StorageDir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", cfg.StorageDir)
+	}
+	return nil
+}
+
+// refuseReadOnly answers the requests a read-only instance has no business
+// with, those that queue or store something.
+func refuseReadOnly(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "Not available on a read-only instance", http.StatusForbidden)
+}
@@ -0,0 +1,33 @@
+package passthru
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+)
+
+// recoverPanics wraps next so a panic while handling a request is logged
+// with its stack, reported to reporter and answered with a 500, instead of
+// taking the process down with it.
+func recoverPanics(server string, reporter *errorReporter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Deliberately aborted response, which net/http handles
+				panic(p)
+			}
+			panicTotal.WithLabelValues(server).Inc()
+			slog.ErrorContext(r.Context(), "Handler_panic", "server", server, "method", r.Method, "path", r.URL.Path, "panic", p, "stack", strconv.Quote(string(debug.Stack())))
+			reporter.panicked(server, r, p)
+			// If the response was already under way this only gets logged by
+			// net/http, and the client sees it cut short
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
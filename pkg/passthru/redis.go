@@ -0,0 +1,355 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisLockTTL bounds how long a download lock survives a replica that
+	// died without releasing it.
+	redisLockTTL = 15 * time.Minute
+
+	// redisPollInterval is how often a waiting replica checks whether the
+	// download lock holder has finished.
+	redisPollInterval = 500 * time.Millisecond
+
+	redisOpTimeout = 2 * time.Second
+
+	// indexSettleTimeout is how long an entry the shared index has is
+	// waited for to show up in the shared storage, which over NFS can lag
+	// behind the replica that stored it by a few seconds.
+	indexSettleTimeout = 5 * time.Second
+)
+
+// releaseLockScript deletes a lock only if it is still held by the caller, so
+// a replica can't release a lock that expired and was taken by another one.
+var releaseLockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`)
+
+// sharedIndex coordinates replicas that mount the same storage through Redis:
+// it holds the index of stored entries, per-entry download locks so only one
+// replica downloads a given URL, and hit counters. A nil *sharedIndex is
+// valid and does nothing.
+type sharedIndex struct {
+	client *redis.Client
+	prefix string
+	owner  string
+}
+
+// indexEntry is what the shared index records about a stored entry.
+type indexEntry struct {
+	URL      string
+	Size     int64
+	StoredAt time.Time
+}
+
+func newSharedIndex(addr, password string, db int, prefix string) (*sharedIndex, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     addr,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to redis at %s: %v", addr, err)
+	}
+
+	return &sharedIndex{
+		client: client,
+		prefix: prefix,
+		owner:  replicaID(),
+	}, nil
+}
+
+func (si *sharedIndex) enabled() bool {
+	return si != nil
+}
+
+func (si *sharedIndex) key(kind, hashStr string) string {
+	return si.prefix + kind + ":" + hashStr
+}
+
+// acquire tries to take the download lock for hashStr. Redis errors are
+// logged and treated as success, so an unavailable Redis degrades to each
+// replica downloading on its own rather than failing requests.
+func (si *sharedIndex) acquire(hashStr string) bool {
+	if si == nil {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	ok, err := si.client.SetNX(ctx, si.key("lock", hashStr), si.owner, redisLockTTL).Result()
+	if err != nil {
+		slog.Error("Redis_lock_error", "hash", hashStr, "error", err)
+		return true
+	}
+	return ok
+}
+
+func (si *sharedIndex) release(hashStr string) {
+	if si == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	if err := releaseLockScript.Run(ctx, si.client, []string{si.key("lock", hashStr)}, si.owner).Err(); err != nil {
+		slog.Error("Redis_unlock_error", "hash", hashStr, "error", err)
+	}
+}
+
+// waitForRelease blocks until the download lock for hashStr is gone, which
+// means the replica holding it has finished (or given up), or until ctx is
+// done. It reports whether the lock was released.
+func (si *sharedIndex) waitForRelease(ctx context.Context, hashStr string) bool {
+	ticker := time.NewTicker(redisPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			n, err := si.client.Exists(ctx, si.key("lock", hashStr)).Result()
+			if err != nil {
+				slog.ErrorContext(ctx, "Redis_lock_poll_error", "hash", hashStr, "error", err)
+				return false
+			}
+			if n == 0 {
+				return true
+			}
+		}
+	}
+}
+
+// put records a stored entry in the shared index.
+func (si *sharedIndex) put(hashStr string, entry indexEntry) {
+	if si == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	err := si.client.HSet(ctx, si.key("entry", hashStr),
+		"url", entry.URL,
+		"size", strconv.FormatInt(entry.Size, 10),
+		"stored_at", entry.StoredAt.Format(time.RFC3339),
+	).Err()
+	if err != nil {
+		slog.Error("Redis_index_put_error", "hash", hashStr, "error", err)
+	}
+}
+
+// has reports whether the shared index records an entry for hashStr.
+// Errors count as no, so a miss goes on as it would without the index.
+func (si *sharedIndex) has(hashStr string) bool {
+	if si == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	n, err := si.client.Exists(ctx, si.key("entry", hashStr)).Result()
+	if err != nil {
+		slog.Error("Redis_index_get_error", "hash", hashStr, "error", err)
+		return false
+	}
+	return n > 0
+}
+
+// remove drops an entry and its hit counters from the shared index.
+func (si *sharedIndex) remove(hashStr string) {
+	if si == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	pipe := si.client.TxPipeline()
+	pipe.Del(ctx, si.key("entry", hashStr), si.key("hits", hashStr), si.key("lasthit", hashStr))
+	pipe.ZRem(ctx, si.prefix+"popular", hashStr)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Redis_index_remove_error", "hash", hashStr, "error", err)
+	}
+}
+
+// entryHashes lists the hashes of every entry in the shared index.
+func (si *sharedIndex) entryHashes() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var hashes []string
+	prefix := si.key("entry", "")
+	iter := si.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		hashes = append(hashes, strings.TrimPrefix(iter.Val(), prefix))
+	}
+	return hashes, iter.Err()
+}
+
+// hit increments the shared hit counter for an entry, and records when it
+// was hit and how it ranks among the others.
+func (si *sharedIndex) hit(hashStr string) {
+	if si == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	pipe := si.client.TxPipeline()
+	pipe.Incr(ctx, si.key("hits", hashStr))
+	pipe.Set(ctx, si.key("lasthit", hashStr), time.Now().Format(time.RFC3339), 0)
+	pipe.ZIncrBy(ctx, si.prefix+"popular", 1, hashStr)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("Redis_hit_error", "hash", hashStr, "error", err)
+	}
+}
+
+// hits returns the shared hit counter for an entry. Errors count as no
+// hits.
+func (si *sharedIndex) hits(hashStr string) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	n, err := si.client.Get(ctx, si.key("hits", hashStr)).Int64()
+	if err != nil && err != redis.Nil {
+		slog.Error("Redis_hits_error", "hash", hashStr, "error", err)
+	}
+	return n
+}
+
+// top returns the n most hit entries in the shared index, most hit first.
+func (si *sharedIndex) top(n int) ([]entryAccess, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	ranked, err := si.client.ZRevRangeWithScores(ctx, si.prefix+"popular", 0, int64(n-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]entryAccess, 0, len(ranked))
+	for _, z := range ranked {
+		hashStr, _ := z.Member.(string)
+		entry := entryAccess{Hash: hashStr, Hits: int64(z.Score)}
+		entry.URL, _ = si.client.HGet(ctx, si.key("entry", hashStr), "url").Result()
+		if last, err := si.client.Get(ctx, si.key("lasthit", hashStr)).Result(); err == nil {
+			entry.LastHit, _ = time.Parse(time.RFC3339, last)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// putProgress saves the progress of the download of an entry, for ttl.
+func (si *sharedIndex) putProgress(hashStr string, data []byte, ttl time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	if err := si.client.Set(ctx, si.key("progress", hashStr), data, ttl).Err(); err != nil {
+		slog.Error("Redis_progress_error", "hash", hashStr, "error", err)
+	}
+}
+
+// getProgress returns the saved progress of the download of an entry, or
+// nil if there is none.
+func (si *sharedIndex) getProgress(hashStr string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	data, err := si.client.Get(ctx, si.key("progress", hashStr)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("Redis_progress_error", "hash", hashStr, "error", err)
+		}
+		return nil
+	}
+	return data
+}
+
+// putShortLink saves a short link, for ttl (0 for ever).
+func (si *sharedIndex) putShortLink(token string, data []byte, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	return si.client.Set(ctx, si.key("shortlink", token), data, ttl).Err()
+}
+
+// getShortLink returns a saved short link, or nil if there is none.
+func (si *sharedIndex) getShortLink(token string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	data, err := si.client.Get(ctx, si.key("shortlink", token)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			slog.Error("Redis_short_link_error", "token", token, "error", err)
+		}
+		return nil
+	}
+	return data
+}
+
+// shortLinkDownloads returns how many times a short link has been
+// downloaded, counting one more download first if count is set. The count
+// expires along with the link, after ttl (0 for never).
+func (si *sharedIndex) shortLinkDownloads(token string, count bool, ttl time.Duration) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+
+	key := si.key("shortlink-downloads", token)
+	var n int64
+	var err error
+	if count {
+		n, err = si.client.Incr(ctx, key).Result()
+		if err == nil && n == 1 && ttl > 0 {
+			si.client.Expire(ctx, key, ttl)
+		}
+	} else {
+		n, err = si.client.Get(ctx, key).Int64()
+		if err == redis.Nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		slog.Error("Redis_short_link_error", "token", token, "error", err)
+	}
+	return n
+}
+
+func (si *sharedIndex) removeShortLink(token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	if err := si.client.Del(ctx, si.key("shortlink", token), si.key("shortlink-downloads", token)).Err(); err != nil {
+		slog.Error("Redis_short_link_error", "token", token, "error", err)
+	}
+}
+
+// locked reports whether some replica holds the download lock for hashStr.
+// Errors count as locked, so cleanup leaves the entry alone for now.
+func (si *sharedIndex) locked(hashStr string) bool {
+	if !si.enabled() {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisOpTimeout)
+	defer cancel()
+	n, err := si.client.Exists(ctx, si.key("lock", hashStr)).Result()
+	if err != nil {
+		slog.Error("Redis_lock_check_error", "hash", hashStr, "error", err)
+		return true
+	}
+	return n > 0
+}
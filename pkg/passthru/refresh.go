@@ -0,0 +1,83 @@
+package passthru
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// refresh downloads url again, ignoring e if it is cached, and swaps the new
+// copy in once all of it has been stored. Until then e keeps being served
+// as it was, and a refresh that fails leaves it alone. HLS renditions of the
+// old copy are dropped with it.
+func (c *cache) refresh(ctx context.Context, url string, e cacheEntry) (string, error) {
+	staging := cacheEntry{
+		hash:        e.hash,
+		binaryFile:  e.binaryFile + ".refresh",
+		headersFile: e.headersFile + ".refresh",
+	}
+
+	// One refresh of an entry at a time, here and across replicas
+	unlockStaging := c.locks.lock(staging)
+	defer unlockStaging()
+	if !c.index.acquire(e.hash) {
+		return statusNotCached, &fetchError{http.StatusConflict, "Resource is already being downloaded"}
+	}
+	defer c.index.release(e.hash)
+
+	if c.quota.exceeded(c.storageDir) {
+		return statusNotCached, &fetchError{http.StatusInsufficientStorage, "Storage quota exceeded"}
+	}
+	release, err := c.downloads.acquire(ctx)
+	if err != nil {
+		return statusNotCached, err
+	}
+	defer release()
+
+	// A refresh wants cobalt's answer as it is now
+	c.failures.forget(c.resolveKey(ctx, url))
+	keep, err := c.download(ctx, url, staging)
+	if err != nil {
+		return statusNotCached, err
+	}
+
+	// A new copy a hook kept out of the cache is set aside to be served
+	// once, and the old one goes, being out of date
+	from, to := staging, e
+	if !keep {
+		from, to = staging.uncacheable(), e.uncacheable()
+	}
+	unlock := c.locks.lock(e)
+	if !keep {
+		c.remove(e)
+	}
+	err = os.Rename(from.binaryFile, to.binaryFile)
+	if err == nil {
+		err = os.Rename(from.headersFile, to.headersFile)
+	}
+	if err != nil {
+		// Half swapped is neither copy, so drop both
+		c.remove(e)
+		discardUncacheable(e)
+	} else {
+		os.Remove(cdnMarker(e))
+		os.RemoveAll(hlsDir(c.storageDir, e.hash))
+	}
+	unlock()
+	os.Remove(from.binaryFile)
+	os.Remove(from.headersFile)
+	if err != nil {
+		slog.ErrorContext(ctx, "Refresh_swap_error", "hash", e.hash, "error", err)
+		return statusNotCached, &fetchError{http.StatusInternalServerError, "Failed to write binary file"}
+	}
+	slog.InfoContext(ctx, "Entry_refreshed", "hash", e.hash)
+
+	if !keep {
+		return statusUncacheable, nil
+	}
+	c.cdn.push(e)
+	c.mirror.put(c.namespace, e)
+	c.shared.put(e)
+	return statusRefreshed, nil
+}
@@ -0,0 +1,222 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// videoQualities are the values cobalt takes for videoQuality.
+var videoQualities = map[string]bool{
+	"144": true, "240": true, "360": true, "480": true, "720": true,
+	"1080": true, "1440": true, "2160": true, "4320": true, "max": true,
+}
+
+// downloadModes, cobaltAudioFormats and filenameStyles are the values cobalt
+// takes for downloadMode, audioFormat and filenameStyle.
+var (
+	downloadModes      = []string{"auto", "audio", "mute"}
+	cobaltAudioFormats = []string{"best", "mp3", "ogg", "wav", "opus"}
+	filenameStyles     = []string{"classic", "pretty", "basic", "nerdy"}
+)
+
+func checkVideoQuality(quality string) error {
+	if !videoQualities[quality] {
+		return fmt.Errorf("video quality must be max or one of 144, 240, 360, 480, 720, 1080, 1440, 2160 and 4320")
+	}
+	return nil
+}
+
+// requestOptions are what a request asks cobalt for beyond the instance's
+// defaults, which makes the media it gets an entry of its own.
+type requestOptions struct {
+	videoQuality    string // "" for the instance's
+	disableMetadata *bool  // nil for the instance's
+	subtitleLang    string // "" for none
+	// downloadMode, audioFormat and filenameStyle are passed on to cobalt
+	// as they are, "" for cobalt's own default.
+	downloadMode  string
+	audioFormat   string
+	filenameStyle string
+}
+
+// parseRequestOptions reads the quality, metadata, downloadMode (or mode,
+// or audio=1 for downloadMode=audio), audioFormat and filenameStyle query
+// parameters.
+func parseRequestOptions(query url.Values) (requestOptions, error) {
+	var o requestOptions
+	if quality := query.Get("quality"); quality != "" {
+		if err := checkVideoQuality(quality); err != nil {
+			return o, fmt.Errorf("'quality': %v", err)
+		}
+		o.videoQuality = quality
+	}
+	switch query.Get("metadata") {
+	case "":
+	case "0":
+		disable := true
+		o.disableMetadata = &disable
+	case "1":
+		disable := false
+		o.disableMetadata = &disable
+	default:
+		return o, fmt.Errorf("'metadata' must be 0 or 1")
+	}
+	for _, option := range []struct {
+		name   string
+		values []string
+		value  *string
+	}{
+		{"downloadMode", downloadModes, &o.downloadMode},
+		{"audioFormat", cobaltAudioFormats, &o.audioFormat},
+		{"filenameStyle", filenameStyles, &o.filenameStyle},
+	} {
+		value := query.Get(option.name)
+		if value == "" {
+			continue
+		}
+		if !slices.Contains(option.values, value) {
+			return o, fmt.Errorf("'%s' must be one of %s", option.name, strings.Join(option.values, ", "))
+		}
+		*option.value = value
+	}
+
+	// Shorthands for those who just want the audio
+	mode := query.Get("mode")
+	if mode != "" && !slices.Contains(downloadModes, mode) {
+		return o, fmt.Errorf("'mode' must be one of %s", strings.Join(downloadModes, ", "))
+	}
+	switch query.Get("audio") {
+	case "", "0":
+	case "1":
+		if mode != "" && mode != "audio" {
+			return o, fmt.Errorf("'audio' can't be combined with 'mode=%s'", mode)
+		}
+		mode = "audio"
+	default:
+		return o, fmt.Errorf("'audio' must be 0 or 1")
+	}
+	if mode != "" {
+		if o.downloadMode != "" && o.downloadMode != mode {
+			return o, fmt.Errorf("'downloadMode' and 'mode' or 'audio' disagree")
+		}
+		o.downloadMode = mode
+	}
+	return o, nil
+}
+
+// wantsAudioOnly reports whether query asks cobalt for just the audio.
+func wantsAudioOnly(query url.Values) bool {
+	return query.Get("audio") == "1" || query.Get("mode") == "audio" || query.Get("downloadMode") == "audio"
+}
+
+// relativeTo returns o without the options that are c's defaults for url
+// anyway, so asking for those explicitly doesn't make another entry.
+func (o requestOptions) relativeTo(c *cache, url string) requestOptions {
+	if o.videoQuality == c.videoQualityFor(url) {
+		o.videoQuality = ""
+	}
+	if o.disableMetadata != nil && *o.disableMetadata == c.disableMetadata {
+		o.disableMetadata = nil
+	}
+	return o
+}
+
+// key describes the options set, for the keys of what they make; it is ""
+// when none is.
+func (o requestOptions) key() string {
+	var parts []string
+	if o.videoQuality != "" {
+		parts = append(parts, "videoQuality="+o.videoQuality)
+	}
+	if o.disableMetadata != nil {
+		parts = append(parts, fmt.Sprintf("disableMetadata=%t", *o.disableMetadata))
+	}
+	if o.subtitleLang != "" {
+		parts = append(parts, "subtitleLang="+o.subtitleLang)
+	}
+	if o.downloadMode != "" {
+		parts = append(parts, "downloadMode="+o.downloadMode)
+	}
+	if o.audioFormat != "" {
+		parts = append(parts, "audioFormat="+o.audioFormat)
+	}
+	if o.filenameStyle != "" {
+		parts = append(parts, "filenameStyle="+o.filenameStyle)
+	}
+	return strings.Join(parts, "&")
+}
+
+// entryOptions are the options an entry was resolved with, as its
+// metadata records them.
+type entryOptions struct {
+	VideoQuality    string `json:"videoQuality,omitempty"`
+	DisableMetadata *bool  `json:"disableMetadata,omitempty"`
+	SubtitleLang    string `json:"subtitleLang,omitempty"`
+	DownloadMode    string `json:"downloadMode,omitempty"`
+	AudioFormat     string `json:"audioFormat,omitempty"`
+	FilenameStyle   string `json:"filenameStyle,omitempty"`
+}
+
+// meta returns o for an entry's metadata, or nil if none is set.
+func (o requestOptions) meta() *entryOptions {
+	if o.key() == "" {
+		return nil
+	}
+	return &entryOptions{
+		VideoQuality:    o.videoQuality,
+		DisableMetadata: o.disableMetadata,
+		SubtitleLang:    o.subtitleLang,
+		DownloadMode:    o.downloadMode,
+		AudioFormat:     o.audioFormat,
+		FilenameStyle:   o.filenameStyle,
+	}
+}
+
+// request returns the request to the external service for url from c.
+func (o requestOptions) request(c *cache, url string) ExternalServiceRequest {
+	req := ExternalServiceRequest{
+		URL:             url,
+		VideoQuality:    c.videoQualityFor(url),
+		DisableMetadata: c.disableMetadata,
+		SubtitleLang:    o.subtitleLang,
+		DownloadMode:    o.downloadMode,
+		AudioFormat:     o.audioFormat,
+		FilenameStyle:   o.filenameStyle,
+	}
+	if o.videoQuality != "" {
+		req.VideoQuality = o.videoQuality
+	}
+	if o.disableMetadata != nil {
+		req.DisableMetadata = *o.disableMetadata
+	}
+	return req
+}
+
+type requestOptionsContextKey struct{}
+
+// withRequestOptions returns a copy of ctx under which media is resolved
+// with o.
+func withRequestOptions(ctx context.Context, o requestOptions) context.Context {
+	if o.key() == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestOptionsContextKey{}, o)
+}
+
+// requestOptionsFrom returns the options media is resolved with under ctx.
+func requestOptionsFrom(ctx context.Context) requestOptions {
+	o, _ := ctx.Value(requestOptionsContextKey{}).(requestOptions)
+	return o
+}
+
+// mediaEntry returns the entry of the media at url resolved with the
+// options in ctx.
+func (c *cache) mediaEntry(ctx context.Context, url string) cacheEntry {
+	if key := requestOptionsFrom(ctx).key(); key != "" {
+		return c.variant(url, key)
+	}
+	return c.entry(url)
+}
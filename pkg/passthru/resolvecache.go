@@ -0,0 +1,93 @@
+package passthru
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxCachedResolutions bounds the resolve cache. Once it is full new
+// resolutions aren't kept until old ones expire.
+const maxCachedResolutions = 10000
+
+// resolveCache keeps cobalt's answers for a short while, so the info
+// endpoint, playlists and retries after a failed download don't all ask
+// cobalt again. Answers are short-lived links, so the TTL should be well
+// under theirs. A nil resolveCache asks every time.
+type resolveCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	answers map[string]cachedResolution
+}
+
+type cachedResolution struct {
+	resp    ExternalServiceResponse
+	expires time.Time
+}
+
+func newResolveCache(ttl time.Duration) *resolveCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &resolveCache{ttl: ttl, answers: make(map[string]cachedResolution)}
+}
+
+// resolveKey is what cobalt's answer for url from c depends on: the
+// endpoint asked and the options sent, which differ between host profiles
+// and with the request options in ctx.
+func (c *cache) resolveKey(ctx context.Context, url string) string {
+	return c.endpoint + "\x00" + c.namespace + "\x00" + requestOptionsFrom(ctx).key() + "\x00" + url
+}
+
+// get returns the answer kept for key, if it hasn't expired.
+func (rc *resolveCache) get(key string) (*ExternalServiceResponse, bool) {
+	if rc == nil {
+		return nil, false
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	answer, ok := rc.answers[key]
+	if !ok || time.Now().After(answer.expires) {
+		delete(rc.answers, key)
+		resolveCacheTotal.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	resolveCacheTotal.WithLabelValues("hit").Inc()
+	resp := answer.resp
+	return &resp, true
+}
+
+// put keeps resp as the answer for key.
+func (rc *resolveCache) put(key string, resp *ExternalServiceResponse) {
+	if rc == nil {
+		return
+	}
+	now := time.Now()
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if len(rc.answers) >= maxCachedResolutions {
+		for k, answer := range rc.answers {
+			if now.After(answer.expires) {
+				delete(rc.answers, k)
+			}
+		}
+		if len(rc.answers) >= maxCachedResolutions {
+			return
+		}
+	}
+	rc.answers[key] = cachedResolution{resp: *resp, expires: now.Add(rc.ttl)}
+	resolveCacheEntries.Set(float64(len(rc.answers)))
+}
+
+// forget drops the answer for key, once the link in it turned out not to
+// work.
+func (rc *resolveCache) forget(key string) {
+	if rc == nil {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.answers, key)
+	resolveCacheEntries.Set(float64(len(rc.answers)))
+}
@@ -0,0 +1,126 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errDownloadInterrupted fails a download cut short with what arrived kept
+// to be resumed.
+var errDownloadInterrupted = &fetchError{http.StatusInternalServerError, "Download was cut short"}
+
+// resumeSuffix is added to the name of a download's temp file to name the
+// file recording how to resume it.
+const resumeSuffix = ".resume"
+
+// resumeState is what's recorded next to a download's temp file so a later
+// attempt, after a failure or a restart, can pick it up where it stopped
+// instead of starting over.
+type resumeState struct {
+	Size         int64       `json:"size"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+	Headers      http.Header `json:"headers"`
+}
+
+// newResumeState returns the resume state of the download answered with
+// resp, or nil if it couldn't be resumed: the upstream must take ranges and
+// name the version of the media it sends, so a later attempt can tell it is
+// still the same.
+func newResumeState(resp *http.Response) *resumeState {
+	etag := resp.Header.Get("ETag")
+	if strings.HasPrefix(etag, "W/") {
+		// Weak validators don't promise the same bytes
+		etag = ""
+	}
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != http.StatusOK ||
+		resp.ContentLength <= 0 ||
+		resp.Header.Get("Accept-Ranges") != "bytes" ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		resp.Uncompressed ||
+		etag == "" && lastModified == "" {
+		return nil
+	}
+	return &resumeState{Size: resp.ContentLength, ETag: etag, LastModified: lastModified, Headers: resp.Header.Clone()}
+}
+
+func (s *resumeState) save(name string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
+
+func loadResumeState(name string) (*resumeState, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var s resumeState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// matches reports whether resp, the answer to a HEAD request, is for the
+// same media as s.
+func (s *resumeState) matches(resp *http.Response) bool {
+	return resp.StatusCode == http.StatusOK &&
+		resp.ContentLength == s.Size &&
+		resp.Header.Get("Accept-Ranges") == "bytes" &&
+		(s.ETag == "" || resp.Header.Get("ETag") == s.ETag) &&
+		(s.LastModified == "" || resp.Header.Get("Last-Modified") == s.LastModified)
+}
+
+// continues reports whether resp, the answer to a request for the media
+// from offset on, carries exactly the rest of it.
+func (s *resumeState) continues(resp *http.Response, offset int64) bool {
+	return resp.StatusCode == http.StatusPartialContent &&
+		resp.Header.Get("Content-Encoding") == "" &&
+		resp.Header.Get("Content-Range") == fmt.Sprintf("bytes %d-%d/%d", offset, s.Size-1, s.Size)
+}
+
+// resumable returns how much of e an earlier download of it from mediaURL
+// left in its temp file, and that download's state, if the media hasn't
+// changed since and the rest can be fetched. Anything else it left behind
+// is removed, and the download starts over.
+func (c *cache) resumable(ctx context.Context, mediaURL string, e cacheEntry) (int64, *resumeState) {
+	tmp := e.binaryFile + ".tmp"
+	state, err := loadResumeState(tmp + resumeSuffix)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err == nil {
+		if info, err := os.Stat(tmp); err == nil && info.Size() > 0 && info.Size() < state.Size && c.unchanged(ctx, mediaURL, state) {
+			return info.Size(), state
+		}
+	}
+	os.Remove(tmp)
+	os.Remove(tmp + resumeSuffix)
+	return 0, nil
+}
+
+// unchanged asks the upstream whether the media at mediaURL is still what
+// state was recorded for.
+func (c *cache) unchanged(ctx context.Context, mediaURL string, state *resumeState) bool {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", mediaURL, nil)
+	if err != nil {
+		return false
+	}
+	setRequestID(ctx, req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Resume_check_failure", "error", err)
+		return false
+	}
+	resp.Body.Close()
+	return state.matches(resp)
+}
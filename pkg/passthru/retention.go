@@ -0,0 +1,98 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// retentionHeader lets a client pick how long the entry it asks for is kept,
+// like the ttl query parameter.
+const retentionHeader = "X-Cache-TTL"
+
+// requestRetention returns how long r asks for its entry to be kept, as a
+// ttl query parameter or an X-Cache-TTL header, or 0 if it doesn't. It's an
+// error to ask when retention can't be picked (max is 0) or for longer than
+// max.
+func requestRetention(r *http.Request, max time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get("ttl")
+	if value == "" {
+		value = r.Header.Get(retentionHeader)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	if max <= 0 {
+		return 0, fmt.Errorf("'ttl' is not accepted")
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("'ttl' must be a positive duration, like 2h")
+	}
+	if ttl > max {
+		return 0, fmt.Errorf("'ttl' can't be longer than %v", max)
+	}
+	return ttl, nil
+}
+
+type retentionContextKey struct{}
+
+// withRetention returns a copy of ctx under which entries are stored to be
+// kept for ttl.
+func withRetention(ctx context.Context, ttl time.Duration) context.Context {
+	if ttl <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, retentionContextKey{}, ttl)
+}
+
+// retentionFrom returns how long entries stored under ctx are to be kept, or
+// 0 for the usual.
+func retentionFrom(ctx context.Context) time.Duration {
+	ttl, _ := ctx.Value(retentionContextKey{}).(time.Duration)
+	return ttl
+}
+
+// checksExpiry reports whether entries can expire before cleanup removes
+// them, which takes reading their metadata.
+func (c *cache) checksExpiry() bool {
+	return c.ttl.enabled() || c.maxRetention > 0 || c.domains.enabled() && c.domains.expires
+}
+
+// expired reports whether e expired before cleanup got to it.
+func (c *cache) expired(e cacheEntry) bool {
+	if !c.checksExpiry() {
+		return false
+	}
+	meta, err := readMeta(e.headersFile)
+	return err == nil && meta.expired(time.Now())
+}
+
+// retain records in e, already stored, that it is to be kept for ttl from
+// now. The caller holds e's write lock.
+func (c *cache) retain(e cacheEntry, ttl time.Duration) error {
+	meta, err := readMeta(e.headersFile)
+	if err != nil {
+		return err
+	}
+	if meta.Version == 0 {
+		meta.Version = metaVersion
+	}
+	until := time.Now().UTC().Add(ttl)
+	meta.RetainUntil = &until
+
+	tmp := e.headersFile + ".retain"
+	if err := os.WriteFile(tmp, meta.encode(), 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, e.headersFile); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	slog.Info("Entry_retention_set", "hash", e.hash, "until", until.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,137 @@
+package passthru
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errUpstreamStalled fails reading an upstream body that stopped sending.
+var errUpstreamStalled = errors.New("upstream stopped sending")
+
+// upstreamRetry tries upstream requests again when they fail in ways that
+// may well not last: network errors, timeouts, 429s and 5xx answers.
+type upstreamRetry struct {
+	retries int
+	backoff time.Duration
+}
+
+// do sends a request with send, and again up to r.retries more times while
+// it fails in a way worth retrying, waiting r.backoff, doubled each time,
+// with jitter, in between. op (resolve or download) is what the request is
+// for, in logs and metrics. It returns the last response or error.
+func (r upstreamRetry) do(ctx context.Context, op string, send func() (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if timedOut(err) {
+			upstreamTimeoutsTotal.WithLabelValues(op).Inc()
+		}
+		if attempt >= r.retries || ctx.Err() != nil || !retryable(resp, err) {
+			return resp, err
+		}
+
+		wait := r.delay(attempt)
+		if err != nil {
+			slog.InfoContext(ctx, "Upstream_retry", "op", op, "attempt", attempt+1, "wait", wait, "error", err)
+		} else {
+			slog.InfoContext(ctx, "Upstream_retry", "op", op, "attempt", attempt+1, "wait", wait, "status", resp.StatusCode)
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		upstreamRetriesTotal.WithLabelValues(op).Inc()
+
+		if !sleepContext(ctx, wait) {
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// delay returns how long to wait before the retry after attempt: the
+// backoff, doubled for each attempt before, with jitter.
+func (r upstreamRetry) delay(attempt int) time.Duration {
+	wait := r.backoff << attempt
+	return wait/2 + time.Duration(rand.Int63n(int64(wait)+1))
+}
+
+// wait waits for the backoff after attempt, and reports whether ctx let it.
+func (r upstreamRetry) wait(ctx context.Context, attempt int) bool {
+	return sleepContext(ctx, r.delay(attempt))
+}
+
+// sleepContext sleeps for d, and reports whether ctx let it.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// retryable reports whether a request that got resp or err may do better
+// if sent again.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, errPrivateAddress)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// timedOut reports whether err is an upstream request running out of time.
+func timedOut(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// stallReader fails reads of an upstream body that sends nothing for
+// timeout, rather than leaving the download hanging on it forever. Only
+// the time spent waiting on upstream counts, not the time between reads,
+// so a download held back by a slow client or a rate limit isn't taken for
+// a stalled one.
+type stallReader struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// newStallReader returns body failing with errUpstreamStalled once a read
+// waits longer than timeout, or body itself if timeout is 0. op is what the
+// body is for, in metrics.
+func newStallReader(body io.ReadCloser, timeout time.Duration, op string) io.ReadCloser {
+	if timeout <= 0 {
+		return body
+	}
+	r := &stallReader{body: body, timeout: timeout}
+	r.timer = time.AfterFunc(timeout, func() {
+		r.stalled.Store(true)
+		upstreamTimeoutsTotal.WithLabelValues(op).Inc()
+		// Unblocks the read under way
+		body.Close()
+	})
+	r.timer.Stop()
+	return r
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.timer.Reset(r.timeout)
+	n, err := r.body.Read(p)
+	r.timer.Stop()
+	if r.stalled.Load() {
+		return n, errUpstreamStalled
+	}
+	return n, err
+}
+
+func (r *stallReader) Close() error {
+	r.timer.Stop()
+	return r.body.Close()
+}
@@ -0,0 +1,164 @@
+package passthru
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Storage is a Storage in an S3 bucket, or anything speaking its API
+// (MinIO, R2, GCS through its XML API with HMAC keys, ...). Files are
+// objects named prefix + name.
+type s3Storage struct {
+	bucketURL string // https://<bucket>.s3.<region>.amazonaws.com, or a path-style http://minio:9000/<bucket>
+	prefix    string
+
+	// Credentials. Without them requests aren't signed.
+	region    string
+	accessKey string
+	secretKey string
+
+	client *http.Client
+}
+
+// newS3Storage returns the storage in the bucket at bucketURL, with
+// objects named under prefix.
+func newS3Storage(bucketURL, prefix, region, accessKey, secretKey string) (*s3Storage, error) {
+	if bucketURL == "" {
+		return nil, fmt.Errorf("the S3 backend needs a bucket URL")
+	}
+	u, err := url.Parse(bucketURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid S3 bucket URL %q", bucketURL)
+	}
+	if (accessKey != "") != (secretKey != "") || (accessKey != "" && region == "") {
+		return nil, fmt.Errorf("signed S3 requests need a region, an access key and a secret key")
+	}
+	return &s3Storage{
+		bucketURL: strings.TrimSuffix(bucketURL, "/"),
+		prefix:    prefix,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: sharedStorageTimeout},
+	}, nil
+}
+
+// do sends a request for the object called name, or for the bucket itself
+// with query if name is empty, and returns the response unless it failed.
+// A 404 is os.ErrNotExist.
+func (s *s3Storage) do(ctx context.Context, method, name string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	target := s.bucketURL + "/"
+	if name != "" {
+		target += s.prefix + name
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		req.URL.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if s.accessKey != "" {
+		signS3(req, s.region, s.accessKey, s.secretKey, time.Now().UTC())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: name, Err: os.ErrNotExist}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s answered %s", method, target, resp.Status)
+	}
+	return resp, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, name, nil, r, size)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+func (s *s3Storage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (StorageInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, name, nil, nil, 0)
+	if err != nil {
+		return StorageInfo{}, err
+	}
+	resp.Body.Close()
+	info := StorageInfo{Name: name, Size: resp.ContentLength}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return info, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, name, nil, nil, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// s3ListResult is the part of a ListObjectsV2 answer List reads.
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string, fn func(StorageInfo) bool) error {
+	query := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("decoding object list: %v", err)
+		}
+		for _, object := range result.Contents {
+			if !fn(StorageInfo{Name: strings.TrimPrefix(object.Key, s.prefix), Size: object.Size, ModTime: object.LastModified}) {
+				return nil
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
@@ -0,0 +1,184 @@
+package passthru
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// startupScanGrace is how recently a file must have been modified for the
+// startup scan to leave it alone, since another replica sharing the storage
+// may be in the middle of writing it.
+const startupScanGrace = 10 * time.Minute
+
+// quarantineDirName is the storage subdirectory the startup scan moves what
+// it finds to, rather than deleting it, when asked to. Nothing empties it.
+const quarantineDirName = ".quarantine"
+
+// tempSuffixes are the suffixes of the files entries are written to before
+// being moved into place.
+var tempSuffixes = []string{".bin.tmp", ".bin.peer", ".bin.shared", ".bin.mirror", ".headers.repair", ".headers.migrate", ".headers.retain", ".bin.refresh", ".bin.refresh.tmp", ".headers.refresh", ".bin.video", ".bin.audio", ".bin.refresh.video", ".bin.refresh.audio", ".pick", uncacheableSuffix}
+
+// scanReport sums up what the startup scan repaired.
+type scanReport struct {
+	Entries       int
+	TempFiles     int
+	OrphanHeaders int
+	OrphanBinary  int
+	Empty         int
+	Truncated     int
+	IndexEntries  int
+}
+
+// scanStorage checks the storage directory of every tenant for what a crash
+// leaves behind and removes it before the cache is used: leftover temp files
+// of downloads that can't be resumed, binaries without headers (which may be
+// cut short) and headers without binaries, empty binaries or ones of
+// another size than their headers file records, and shared index entries
+// whose files are gone. With quarantine the files are moved to each
+// directory's quarantine directory instead, for a look at what went wrong.
+func scanStorage(storageDir string, index *sharedIndex, quarantine bool) scanReport {
+	start := time.Now()
+	var report scanReport
+	cutoff := start.Add(-startupScanGrace)
+	onDisk := make(map[string]bool)
+	for _, dir := range storageDirs(storageDir) {
+		s := storageScan{dir: dir, cutoff: cutoff}
+		if quarantine {
+			s.quarantineDir = filepath.Join(dir, quarantineDirName)
+		}
+		s.run(onDisk, &report)
+	}
+
+	if index.enabled() {
+		hashes, err := index.entryHashes()
+		if err != nil {
+			slog.Error("Startup_scan_index_error", "error", err)
+		}
+		for _, hashStr := range hashes {
+			if !onDisk[hashStr] {
+				index.remove(hashStr)
+				report.IndexEntries++
+			}
+		}
+	}
+
+	startupScanRepairsTotal.WithLabelValues("temp").Add(float64(report.TempFiles))
+	startupScanRepairsTotal.WithLabelValues("orphan_headers").Add(float64(report.OrphanHeaders))
+	startupScanRepairsTotal.WithLabelValues("orphan_binary").Add(float64(report.OrphanBinary))
+	startupScanRepairsTotal.WithLabelValues("empty").Add(float64(report.Empty))
+	startupScanRepairsTotal.WithLabelValues("truncated").Add(float64(report.Truncated))
+	startupScanRepairsTotal.WithLabelValues("index").Add(float64(report.IndexEntries))
+	slog.Info("Startup_scan_done", "entries", report.Entries, "temp_files", report.TempFiles, "orphan_headers", report.OrphanHeaders, "orphan_binaries", report.OrphanBinary, "empty", report.Empty, "truncated", report.Truncated, "index_entries", report.IndexEntries, "duration", time.Since(start))
+	return report
+}
+
+// storageScan is the startup scan of one storage directory.
+type storageScan struct {
+	dir    string
+	cutoff time.Time
+	// quarantineDir is where files are moved to, or "" to delete them.
+	quarantineDir string
+}
+
+func (s storageScan) run(onDisk map[string]bool, report *scanReport) {
+	dir, cutoff := s.dir, s.cutoff
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Error("Read_storage_directory_error", "dir", dir, "error", err)
+		return
+	}
+
+	binaries := make(map[string]os.FileInfo)
+	headers := make(map[string]os.FileInfo)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		name := file.Name()
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		for _, suffix := range tempSuffixes {
+			if strings.HasSuffix(name, suffix) {
+				// Downloads that can be resumed are kept for that
+				resumable := fileExists(filepath.Join(dir, name+resumeSuffix))
+				if !resumable && info.ModTime().Before(cutoff) && s.remove(filepath.Join(dir, name), "temp") {
+					report.TempFiles++
+				}
+				break
+			}
+		}
+		if hashStr := strings.TrimSuffix(name, ".bin"); hashStr != name {
+			binaries[hashStr] = info
+		} else if hashStr := strings.TrimSuffix(name, ".headers"); hashStr != name {
+			headers[hashStr] = info
+		}
+	}
+
+	for hashStr, info := range binaries {
+		binaryFile := filepath.Join(dir, hashStr+".bin")
+		_, paired := headers[hashStr]
+		switch {
+		case info.ModTime().After(cutoff):
+			onDisk[hashStr] = true
+		case !paired:
+			if s.remove(binaryFile, "orphan_binary") {
+				report.OrphanBinary++
+			}
+		case info.Size() == 0:
+			if s.remove(binaryFile, "empty") {
+				s.remove(filepath.Join(dir, hashStr+".headers"), "empty")
+				report.Empty++
+			}
+		case s.truncated(hashStr, info):
+			if s.remove(binaryFile, "truncated") {
+				s.remove(filepath.Join(dir, hashStr+".headers"), "truncated")
+				report.Truncated++
+			}
+		default:
+			onDisk[hashStr] = true
+			report.Entries++
+		}
+	}
+	for hashStr, info := range headers {
+		if _, paired := binaries[hashStr]; !paired && info.ModTime().Before(cutoff) {
+			if s.remove(filepath.Join(dir, hashStr+".headers"), "orphan_headers") {
+				report.OrphanHeaders++
+			}
+		}
+	}
+}
+
+// truncated reports whether the binary of hashStr, as info describes it, is
+// of another size than its headers file records, as one cut short by a
+// crash before it was synced to disk is.
+func (s storageScan) truncated(hashStr string, info os.FileInfo) bool {
+	meta, err := readMeta(filepath.Join(s.dir, hashStr+".headers"))
+	return err == nil && meta.ContentLength > 0 && info.Size() != meta.ContentLength
+}
+
+// remove deletes the file name, or moves it into quarantine.
+func (s storageScan) remove(name, reason string) bool {
+	if s.quarantineDir != "" {
+		err := os.MkdirAll(s.quarantineDir, os.ModePerm)
+		if err == nil {
+			err = moveFileTouched(name, filepath.Join(s.quarantineDir, filepath.Base(name)))
+		}
+		if err != nil {
+			slog.Error("Startup_scan_quarantine_error", "file", name, "error", err)
+			return false
+		}
+		slog.Info("Startup_scan_quarantined", "file", name, "reason", reason)
+		return true
+	}
+	if err := os.Remove(name); err != nil {
+		slog.Error("Startup_scan_remove_error", "file", name, "error", err)
+		return false
+	}
+	slog.Info("Startup_scan_removed", "file", name, "reason", reason)
+	return true
+}
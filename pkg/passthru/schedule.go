@@ -0,0 +1,300 @@
+package passthru
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prefetchSchedule is an entry of the -prefetch-schedule-file: a set of URLs
+// queued for prefetch every interval or on a cron schedule.
+type prefetchSchedule struct {
+	Name  string   `json:"name"`
+	Every string   `json:"every,omitempty"` // a duration such as 6h
+	Cron  string   `json:"cron,omitempty"`  // minute hour day-of-month month day-of-week
+	URLs  []string `json:"urls"`
+
+	every time.Duration
+	cron  *cronSpec
+}
+
+// next returns the first time after t the schedule is due.
+func (s *prefetchSchedule) next(t time.Time) time.Time {
+	if s.cron != nil {
+		return s.cron.next(t)
+	}
+	return t.Add(s.every)
+}
+
+// loadPrefetchSchedules reads and validates a JSON list of schedules.
+func loadPrefetchSchedules(path string) ([]*prefetchSchedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var schedules []*prefetchSchedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for i, s := range schedules {
+		if s.Name == "" {
+			s.Name = strconv.Itoa(i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate schedule name %q", s.Name)
+		}
+		names[s.Name] = true
+
+		switch {
+		case s.Every != "" && s.Cron != "":
+			return nil, fmt.Errorf("schedule %q: only one of every and cron can be set", s.Name)
+		case s.Every != "":
+			s.every, err = time.ParseDuration(s.Every)
+			if err != nil || s.every < time.Minute {
+				return nil, fmt.Errorf("schedule %q: every must be a duration of at least 1m", s.Name)
+			}
+		case s.Cron != "":
+			s.cron, err = parseCron(s.Cron)
+			if err != nil {
+				return nil, fmt.Errorf("schedule %q: %v", s.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("schedule %q: one of every and cron is required", s.Name)
+		}
+		if len(s.URLs) == 0 {
+			return nil, fmt.Errorf("schedule %q has no URLs", s.Name)
+		}
+	}
+	return schedules, nil
+}
+
+// scheduleStatus is the state of a schedule reported by the admin API.
+type scheduleStatus struct {
+	Name          string     `json:"name"`
+	URLs          int        `json:"urls"`
+	Runs          int        `json:"runs"`
+	LastRun       *time.Time `json:"lastRun,omitempty"`
+	LastQueued    int        `json:"lastQueued"`
+	LastDuplicate int        `json:"lastDuplicate"`
+	NextRun       time.Time  `json:"nextRun"`
+}
+
+// scheduler queues each schedule's URLs for prefetch whenever it comes due.
+type scheduler struct {
+	queue     *prefetchQueue
+	schedules []*prefetchSchedule
+
+	mu     sync.Mutex
+	status map[string]*scheduleStatus
+}
+
+func newScheduler(queue *prefetchQueue, schedules []*prefetchSchedule) *scheduler {
+	s := &scheduler{
+		queue:     queue,
+		schedules: schedules,
+		status:    make(map[string]*scheduleStatus),
+	}
+	now := time.Now()
+	for _, sched := range schedules {
+		// Interval schedules start with a run, so a restart doesn't push them
+		// back by a whole interval
+		next := now
+		if sched.cron != nil {
+			next = sched.cron.next(now)
+		}
+		s.status[sched.Name] = &scheduleStatus{Name: sched.Name, URLs: len(sched.URLs), NextRun: next}
+		prefetchScheduleRunsTotal.WithLabelValues(sched.Name).Add(0)
+		prefetchScheduleQueuedTotal.WithLabelValues(sched.Name).Add(0)
+	}
+	return s
+}
+
+// start runs the schedules until ctx is done, unless there's no queue to
+// add to, as on a read-only instance.
+func (s *scheduler) start(ctx context.Context) {
+	if s.queue == nil {
+		return
+	}
+	for _, sched := range s.schedules {
+		go s.loop(ctx, sched)
+	}
+}
+
+func (s *scheduler) loop(ctx context.Context, sched *prefetchSchedule) {
+	for {
+		s.mu.Lock()
+		next := s.status[sched.Name].NextRun
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.run(sched)
+	}
+}
+
+// run queues every URL of sched.
+func (s *scheduler) run(sched *prefetchSchedule) {
+	queued := 0
+	for _, url := range sched.URLs {
+		if s.queue.add(&prefetchJob{URL: url}) {
+			queued++
+		}
+	}
+	slog.Info("Prefetch_schedule_run", "schedule", sched.Name, "queued", queued, "duplicate", len(sched.URLs)-queued)
+	prefetchScheduleRunsTotal.WithLabelValues(sched.Name).Inc()
+	prefetchScheduleQueuedTotal.WithLabelValues(sched.Name).Add(float64(queued))
+
+	now := time.Now()
+	s.mu.Lock()
+	status := s.status[sched.Name]
+	status.Runs++
+	status.LastRun = &now
+	status.LastQueued = queued
+	status.LastDuplicate = len(sched.URLs) - queued
+	status.NextRun = sched.next(now)
+	s.mu.Unlock()
+}
+
+func (s *scheduler) statuses() []scheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]scheduleStatus, 0, len(s.schedules))
+	for _, sched := range s.schedules {
+		statuses = append(statuses, *s.status[sched.Name])
+	}
+	return statuses
+}
+
+func handleScheduleStatus(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.statuses())
+	}
+}
+
+// cronSpec is a parsed five-field cron expression. Each field is the set of
+// values it matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow map[int]bool
+
+	// Like cron, when both day fields are restricted a day matching either
+	// one is due
+	domStar, dowStar bool
+}
+
+// parseCron parses "minute hour day-of-month month day-of-week", where each
+// field is *, a number, a range a-b, a step */n or a-b/n, or a comma-separated
+// list of those. Day-of-week runs from 0 (Sunday) to 6; 7 is also Sunday.
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	spec := &cronSpec{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := [5]*map[int]bool{&spec.minute, &spec.hour, &spec.dom, &spec.month, &spec.dow}
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", expr, err)
+		}
+		*sets[i] = set
+	}
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	return spec, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// next returns the first whole minute after t matching the spec, or a year
+// after t if none does (e.g. February 30th).
+func (c *cronSpec) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(1, 0, 0)
+	for t.Before(limit) {
+		if !c.month[int(t.Month())] {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.day(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.hour[t.Hour()] {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.minute[t.Minute()] {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return limit
+}
+
+func (c *cronSpec) day(t time.Time) bool {
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
@@ -0,0 +1,162 @@
+package passthru
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// copyingWriter hides the ReadFrom of the writer it wraps, as the usage and
+// BeforeServe writers did before they passed it through, so hits are
+// copied through userspace instead of sent with sendfile.
+type copyingWriter struct {
+	http.ResponseWriter
+}
+
+// hitWrappers are the writers a hit can go through on its way out.
+func hitWrappers(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	hooks := hookChain{{BeforeServe: func(http.ResponseWriter, *http.Request) {}}}
+	return hooks.wrapServe(&countingWriter{ResponseWriter: w}, r)
+}
+
+func TestHitWrappersKeepReadFrom(t *testing.T) {
+	rec := httptest.NewRecorder()
+	for name, w := range map[string]http.ResponseWriter{
+		"usage":       &countingWriter{ResponseWriter: rec},
+		"BeforeServe": hitWrappers(rec, httptest.NewRequest("GET", "/", nil)),
+	} {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Errorf("the %s writer hides ReadFrom, which sendfile needs", name)
+		}
+	}
+}
+
+// storeEntry writes e to disk as a download would: size bytes of media and
+// a current headers file.
+func storeEntry(tb testing.TB, e cacheEntry, size int) {
+	tb.Helper()
+	if err := os.WriteFile(e.binaryFile, make([]byte, size), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	headers := http.Header{"Content-Type": {"video/mp4"}}
+	data, err := json.Marshal(entryMeta{Version: metaVersion, ContentLength: int64(size), StoredAt: time.Now().UTC(), Headers: headers})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.WriteFile(e.headersFile, data, 0644); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// quietLogs drops log lines until tb is done, so that writing them doesn't
+// swamp what's measured.
+func quietLogs(tb testing.TB) {
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tb.Cleanup(func() { slog.SetDefault(old) })
+}
+
+// newHitCache returns a cache with nothing but storage, in which every
+// stored entry is a plain hit.
+func newHitCache(tb testing.TB) *cache {
+	return &cache{storageDir: tb.TempDir(), locks: newEntryLocks(false), integrity: newIntegrity(false)}
+}
+
+func BenchmarkServeHit(b *testing.B) {
+	const size = 16 << 20
+	e := newHitCache(b).entryForHash("entry")
+	binaryFile, headersFile := e.binaryFile, e.headersFile
+	storeEntry(b, e, size)
+	quietLogs(b)
+
+	for _, bc := range []struct {
+		name string
+		wrap func(http.ResponseWriter, *http.Request) http.ResponseWriter
+	}{
+		{"direct", func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return w }},
+		{"wrapped", hitWrappers},
+		{"copying", func(w http.ResponseWriter, r *http.Request) http.ResponseWriter { return copyingWriter{w} }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveBinaryFile(bc.wrap(w, r), r, binaryFile, headersFile, false)
+			}))
+			defer srv.Close()
+			client := srv.Client()
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := client.Get(srv.URL)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n, _ := io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if n != size {
+					b.Fatalf("got %d bytes, want %d", n, size)
+				}
+			}
+		})
+	}
+}
+
+func TestServeHitFastPath(t *testing.T) {
+	c := newHitCache(t)
+	e := c.entryForHash("entry")
+	storeEntry(t, e, 5)
+
+	rec := httptest.NewRecorder()
+	if !c.serveHit(rec, httptest.NewRequest("GET", "/", nil), e) {
+		t.Fatal("a plain hit wasn't served from the fast path")
+	}
+	if rec.Code != http.StatusOK || rec.Body.Len() != 5 {
+		t.Errorf("got %d with %d bytes, want 200 with 5", rec.Code, rec.Body.Len())
+	}
+
+	// Legacy headers files are left to the regular path, which upgrades them
+	if err := os.WriteFile(e.headersFile, []byte("Content-Type: video/mp4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	if c.serveHit(rec, httptest.NewRequest("GET", "/", nil), e) {
+		t.Fatal("a legacy headers file was served from the fast path")
+	}
+	if rec.Body.Len() != 0 || len(rec.Header()) != 0 {
+		t.Error("the fast path wrote to the response before giving up")
+	}
+}
+
+// BenchmarkHitPaths compares the fast path for plain hits, one open of each
+// file, with the regular one, which stats both files before opening them
+// again. The entry is small, so the time per hit is mostly syscalls.
+func BenchmarkHitPaths(b *testing.B) {
+	c := newHitCache(b)
+	e := c.entryForHash("entry")
+	storeEntry(b, e, 4<<10)
+	r := httptest.NewRequest("GET", "/", nil)
+	quietLogs(b)
+
+	b.Run("fast", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !c.serveHit(httptest.NewRecorder(), r, e) {
+				b.Fatal("hit not served")
+			}
+		}
+	})
+	b.Run("regular", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if !c.cached(e) {
+				b.Fatal("hit not found")
+			}
+			c.serve(httptest.NewRecorder(), r, e)
+		}
+	})
+}
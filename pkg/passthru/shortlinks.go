@@ -0,0 +1,263 @@
+package passthru
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const shortLinksDirName = ".links"
+
+// shortLink is what a /s/{token} link stands for: the media at URL in the
+// cache of Tenant, until Expires (if set) or MaxDownloads downloads (if
+// set).
+type shortLink struct {
+	Token        string     `json:"token"`
+	URL          string     `json:"url"`
+	Tenant       string     `json:"tenant,omitempty"`
+	Hash         string     `json:"hash"`
+	Created      time.Time  `json:"created"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int64      `json:"maxDownloads,omitempty"`
+	Downloads    int64      `json:"downloads"`
+}
+
+// shortLinkStore keeps short links to cache entries, so a long source URL
+// needn't be passed around to get at its media: in the shared index when
+// there is one, so every replica can follow every link, and in files under
+// the storage directory otherwise. A link's token is random, so unlike a
+// signed link it needs no secret, and it outlives the entry it points to:
+// following it downloads the media again if it has been cleaned up.
+type shortLinkStore struct {
+	index   *sharedIndex
+	dir     string
+	baseURL string
+
+	mu sync.Mutex // serializes the downloads counted in files
+}
+
+func newShortLinkStore(index *sharedIndex, storageDir, baseURL string, readOnly bool) *shortLinkStore {
+	s := &shortLinkStore{index: index, dir: filepath.Join(storageDir, shortLinksDirName), baseURL: strings.TrimSuffix(baseURL, "/")}
+	if !index.enabled() && !readOnly {
+		if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+			slog.Error("Create_short_links_directory_error", "dir", s.dir, "error", err)
+		}
+	}
+	return s
+}
+
+// ttl returns how long the index should keep l, 0 for ever.
+func (l shortLink) ttl() time.Duration {
+	if l.Expires == nil {
+		return 0
+	}
+	return time.Until(*l.Expires)
+}
+
+// create saves a new short link to the entry hashStr for url in the cache
+// of tenant.
+func (s *shortLinkStore) create(tenant, url, hashStr string, expires *time.Time, maxDownloads int64) (shortLink, error) {
+	token := make([]byte, 9)
+	rand.Read(token)
+	l := shortLink{
+		Token:        base64.RawURLEncoding.EncodeToString(token),
+		URL:          url,
+		Tenant:       tenant,
+		Hash:         hashStr,
+		Created:      time.Now().Truncate(time.Second),
+		Expires:      expires,
+		MaxDownloads: maxDownloads,
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return l, err
+	}
+	if s.index.enabled() {
+		return l, s.index.putShortLink(l.Token, data, l.ttl())
+	}
+	return l, s.write(l.Token, data)
+}
+
+func (s *shortLinkStore) path(token string) string {
+	return filepath.Join(s.dir, token+".json")
+}
+
+func (s *shortLinkStore) write(token string, data []byte) error {
+	path := s.path(token)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// link returns the URL of the short link with token.
+func (s *shortLinkStore) link(token string) string {
+	return s.baseURL + "/s/" + token
+}
+
+// claim looks up the short link with token and, if count is set, counts a
+// download of it. It fails with a 404 for links that don't exist and a 410
+// for those that have expired or been downloaded as many times as they
+// may; those are forgotten.
+func (s *shortLinkStore) claim(token string, count bool) (shortLink, error) {
+	var l shortLink
+	if s.index.enabled() {
+		data := s.index.getShortLink(token)
+		if data == nil || json.Unmarshal(data, &l) != nil {
+			return l, &fetchError{http.StatusNotFound, "Link not found"}
+		}
+		l.Downloads = s.index.shortLinkDownloads(token, count, l.ttl())
+	} else {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		data, err := os.ReadFile(s.path(token))
+		if err != nil || json.Unmarshal(data, &l) != nil {
+			return l, &fetchError{http.StatusNotFound, "Link not found"}
+		}
+		if count {
+			l.Downloads++
+		}
+	}
+
+	if l.Expires != nil && time.Now().After(*l.Expires) {
+		s.forget(token)
+		return l, &fetchError{http.StatusGone, "Link has expired"}
+	}
+	if l.MaxDownloads > 0 && l.Downloads > l.MaxDownloads {
+		s.forget(token)
+		return l, &fetchError{http.StatusGone, "Link has been downloaded as many times as it may be"}
+	}
+	if count && !s.index.enabled() {
+		data, _ := json.Marshal(l)
+		if err := s.write(token, data); err != nil {
+			slog.Error("Save_short_link_error", "token", token, "error", err)
+		}
+	}
+	return l, nil
+}
+
+func (s *shortLinkStore) forget(token string) {
+	if s.index.enabled() {
+		s.index.removeShortLink(token)
+		return
+	}
+	os.Remove(s.path(token))
+}
+
+type shortLinkResponse struct {
+	URL          string     `json:"url"`
+	Hash         string     `json:"hash"`
+	Link         string     `json:"link"`
+	Expires      *time.Time `json:"expires,omitempty"`
+	MaxDownloads int64      `json:"maxDownloads,omitempty"`
+}
+
+// handleShorten mints a short link to the media at u, downloading it first
+// if it isn't cached. ttl, a duration, makes the link expire and max caps
+// how many times it may be downloaded.
+func handleShorten(c *cache, s *shortLinkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		u := query.Get("u")
+		if u == "" {
+			http.Error(w, "'u' parameter is required", http.StatusBadRequest)
+			return
+		}
+		var expires *time.Time
+		if ttlStr := query.Get("ttl"); ttlStr != "" {
+			ttl, err := time.ParseDuration(ttlStr)
+			if err != nil || ttl <= 0 {
+				http.Error(w, "'ttl' must be a positive duration such as 1h", http.StatusBadRequest)
+				return
+			}
+			exp := time.Now().Add(ttl).Truncate(time.Second)
+			expires = &exp
+		}
+		var maxDownloads int64
+		if maxStr := query.Get("max"); maxStr != "" {
+			var err error
+			if maxDownloads, err = strconv.ParseInt(maxStr, 10, 64); err != nil || maxDownloads <= 0 {
+				http.Error(w, "'max' must be a positive number of downloads", http.StatusBadRequest)
+				return
+			}
+		}
+
+		c := c.forRequest(r)
+		e := c.entry(u)
+		if _, err := c.ensure(r.Context(), u, e); err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		l, err := s.create(c.namespace, u, e.hash, expires, maxDownloads)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Save_short_link_error", "hash", e.hash, "error", err)
+			http.Error(w, "Failed to save link", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Short_link_created", "token", l.Token, "hash", e.hash)
+		writeJSON(w, http.StatusCreated, shortLinkResponse{
+			URL:          u,
+			Hash:         e.hash,
+			Link:         s.link(l.Token),
+			Expires:      expires,
+			MaxDownloads: maxDownloads,
+		})
+	}
+}
+
+// handleShortLink serves the media behind a short link, downloading it
+// again if it has left the cache. Only requests for the start of the file
+// count as downloads, so a player's range requests don't use one up.
+func handleShortLink(c *cache, s *shortLinkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader := r.Header.Get("Range")
+		count := r.Method == http.MethodGet && (rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-"))
+		l, err := s.claim(mux.Vars(r)["token"], count)
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to read short link", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		c := c.forTenant(l.Tenant)
+		if c == nil {
+			http.NotFound(w, r)
+			return
+		}
+		e := c.entryForHash(l.Hash)
+		cacheStatus, err := c.ensure(r.Context(), l.URL, e)
+		httpRequestsTotal.WithLabelValues("/s", cacheStatus).Inc()
+		if err != nil {
+			var fe *fetchError
+			if errors.As(err, &fe) {
+				http.Error(w, fe.message, fe.status)
+			} else {
+				http.Error(w, "Failed to fetch resource", http.StatusInternalServerError)
+			}
+			return
+		}
+		setCacheHeaders(w, e, cacheStatus)
+		c.serve(w, r, e)
+	}
+}
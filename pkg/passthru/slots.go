@@ -0,0 +1,175 @@
+package passthru
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultDownloadEstimate is how long a download is assumed to hold its
+	// slot until one has finished.
+	defaultDownloadEstimate = 10 * time.Second
+	// Retry-After is kept between these, whatever the estimate says.
+	minRetryAfter = time.Second
+	maxRetryAfter = 10 * time.Minute
+)
+
+var errDownloadQueueFull = &fetchError{http.StatusServiceUnavailable, "Too many downloads waiting for a slot"}
+
+// downloadLimiter bounds concurrent downloads. Downloads over the limit
+// wait for a slot, for at most maxWait if set, and with maxQueued set only
+// that many wait at once. Those turned away are told to come back once the
+// queue ahead of them should have drained, judging by how long downloads
+// have been taking. A nil downloadLimiter doesn't limit anything.
+type downloadLimiter struct {
+	slots     chan struct{}
+	maxQueued int
+	maxWait   time.Duration
+	queued    atomic.Int64
+
+	mu  sync.Mutex
+	avg time.Duration // moving average of how long a slot is held
+}
+
+// newDownloadLimiter returns a limiter of max concurrent downloads, or nil
+// if max isn't positive.
+func newDownloadLimiter(max, maxQueued int, maxWait time.Duration) *downloadLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &downloadLimiter{slots: make(chan struct{}, max), maxQueued: maxQueued, maxWait: maxWait}
+}
+
+// acquire waits for a download slot and returns the function giving it
+// back. When it gives up it sets the Retry-After of the request in ctx.
+func (dl *downloadLimiter) acquire(ctx context.Context) (func(), error) {
+	if dl == nil {
+		return func() {}, nil
+	}
+	select {
+	case dl.slots <- struct{}{}:
+		return dl.release(time.Now()), nil
+	default:
+	}
+
+	queued := dl.queued.Add(1)
+	defer func() { downloadQueueDepth.Set(float64(dl.queued.Add(-1))) }()
+	downloadQueueDepth.Set(float64(queued))
+	if dl.maxQueued > 0 && queued > int64(dl.maxQueued) {
+		downloadSlotRejectionsTotal.WithLabelValues("queue_full").Inc()
+		setRetryAfter(ctx, dl.retryAfter(queued-1))
+		return nil, errDownloadQueueFull
+	}
+
+	var timeout <-chan time.Time
+	if dl.maxWait > 0 {
+		timer := time.NewTimer(dl.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case dl.slots <- struct{}{}:
+		return dl.release(time.Now()), nil
+	case <-timeout:
+		downloadSlotRejectionsTotal.WithLabelValues("timeout").Inc()
+	case <-ctx.Done():
+	}
+	setRetryAfter(ctx, dl.retryAfter(dl.queued.Load()-1))
+	return nil, &fetchError{http.StatusServiceUnavailable, "Gave up waiting for a download slot"}
+}
+
+// release returns the function giving back a slot taken at start.
+func (dl *downloadLimiter) release(start time.Time) func() {
+	return func() {
+		<-dl.slots
+		held := time.Since(start)
+		dl.mu.Lock()
+		if dl.avg == 0 {
+			dl.avg = held
+		} else {
+			dl.avg = (4*dl.avg + held) / 5
+		}
+		dl.mu.Unlock()
+	}
+}
+
+// retryAfter estimates when a slot frees up for a download with ahead
+// others waiting before it: once the downloads running and those ahead
+// have gone through the slots, at the average time a download takes.
+func (dl *downloadLimiter) retryAfter(ahead int64) time.Duration {
+	dl.mu.Lock()
+	avg := dl.avg
+	dl.mu.Unlock()
+	if avg == 0 {
+		avg = defaultDownloadEstimate
+	}
+	rounds := math.Ceil(float64(ahead+1) / float64(cap(dl.slots)))
+	wait := time.Duration(rounds * float64(avg))
+	if wait < minRetryAfter {
+		return minRetryAfter
+	}
+	if wait > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return wait
+}
+
+// retryHint carries the Retry-After decided for a request up to its
+// response, which the code turning the request away has no access to.
+type retryHint struct {
+	mu    sync.Mutex
+	after time.Duration
+}
+
+type retryHintContextKey struct{}
+
+// setRetryAfter sets the Retry-After of the request in ctx, if it has one.
+func setRetryAfter(ctx context.Context, d time.Duration) {
+	if hint, ok := ctx.Value(retryHintContextKey{}).(*retryHint); ok {
+		hint.mu.Lock()
+		hint.after = d
+		hint.mu.Unlock()
+	}
+}
+
+// withRetryHints wraps next so 503 responses that lack a Retry-After get
+// the one set for their request with setRetryAfter.
+func withRetryHints(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hint := &retryHint{}
+		r = r.WithContext(context.WithValue(r.Context(), retryHintContextKey{}, hint))
+		next.ServeHTTP(&retryHintWriter{ResponseWriter: w, hint: hint}, r)
+	})
+}
+
+type retryHintWriter struct {
+	http.ResponseWriter
+	hint *retryHint
+}
+
+func (w *retryHintWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		w.hint.mu.Lock()
+		after := w.hint.after
+		w.hint.mu.Unlock()
+		if after > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(after.Seconds())), 10))
+		}
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// ReadFrom keeps sendfile working through the writer.
+func (w *retryHintWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *retryHintWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
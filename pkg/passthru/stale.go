@@ -0,0 +1,52 @@
+package passthru
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// servableStale reports whether the entry meta describes, expired at now,
+// may still be served while it's downloaded again: whether it expired less
+// than the stale-while-revalidate window ago. It takes knowing the entry's
+// URL to download it again.
+func (c *cache) servableStale(meta entryMeta, now time.Time) bool {
+	return c.staleWindow > 0 && !c.readOnly && meta.URL != "" && !meta.expired(now.Add(-c.staleWindow))
+}
+
+// stale reports whether e is stored and expired, but may still be served
+// while it's downloaded again.
+func (c *cache) stale(e cacheEntry) bool {
+	if c.staleWindow <= 0 || !c.checksExpiry() || !e.exists() {
+		return false
+	}
+	meta, err := readMeta(e.headersFile)
+	now := time.Now()
+	return err == nil && meta.expired(now) && c.servableStale(meta, now)
+}
+
+// revalidate downloads url again in the background, for e just served
+// stale, and swaps the new copy in once it's all stored. Only one
+// revalidation of an entry runs at a time; the requests meanwhile keep
+// getting the stale copy.
+func (c *cache) revalidate(ctx context.Context, url string, e cacheEntry) {
+	staleServedTotal.Inc()
+	if _, running := c.revalidating.LoadOrStore(e.hash, true); running {
+		return
+	}
+	ctx = detachedContext{ctx}
+	go func() {
+		defer c.revalidating.Delete(e.hash)
+		slog.InfoContext(ctx, "Entry_revalidating", "hash", e.hash)
+		status, err := c.refresh(ctx, url, e)
+		if status == statusUncacheable {
+			discardUncacheable(e)
+		}
+		if err != nil {
+			staleRevalidationsTotal.WithLabelValues("failed").Inc()
+			slog.WarnContext(ctx, "Entry_revalidation_failed", "hash", e.hash, "error", err)
+			return
+		}
+		staleRevalidationsTotal.WithLabelValues("refreshed").Inc()
+	}()
+}
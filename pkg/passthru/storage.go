@@ -0,0 +1,295 @@
+package passthru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	storageBackendLocal = "local"
+	storageBackendS3    = "s3"
+
+	sharedStorageQueue   = 1000
+	sharedStorageTimeout = 10 * time.Minute
+
+	// sharedSuffix is added to the name of a binary being copied from the
+	// shared storage.
+	sharedSuffix = ".shared"
+)
+
+// Storage is a store of files shared by every replica, which entries are
+// kept in on top of the local storage directory, so a replica can take an
+// entry another one downloaded instead of going to cobalt for it. Files are
+// named by their path under the storage directory, with forward slashes
+// (e.g. 3f2a....bin, or tenants/acme/3f2a....headers). A missing file is
+// an error satisfying errors.Is(err, os.ErrNotExist).
+type Storage interface {
+	// Put stores the size bytes of r as name, replacing any file of that
+	// name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get opens the file called name for reading.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// Stat describes the file called name.
+	Stat(ctx context.Context, name string) (StorageInfo, error)
+	// Delete removes the file called name. Deleting a missing file isn't
+	// an error.
+	Delete(ctx context.Context, name string) error
+	// List calls fn with every file whose name starts with prefix, until
+	// fn returns false.
+	List(ctx context.Context, prefix string, fn func(StorageInfo) bool) error
+}
+
+// StorageInfo describes a file in a Storage.
+type StorageInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// sharedStorage keeps entries in a Storage as well as on local disk, which
+// stays where entries are served from. Entries are fetched from it on a
+// local miss, and uploaded to it in the background once downloaded. A nil
+// sharedStorage shares nothing.
+type sharedStorage struct {
+	backend Storage
+	root    string // the storage directory names are relative to
+	durable bool
+	buffers *bufferPool
+	events  chan mirrorEvent
+}
+
+// newSharedStorage returns the shared storage of cfg, uploading and purging
+// in the background until ctx is done, or nil if entries are kept on local
+// disk only.
+func newSharedStorage(ctx context.Context, cfg Config, buffers *bufferPool) (*sharedStorage, error) {
+	backend := cfg.Storage
+	if backend == nil {
+		switch cfg.StorageBackend {
+		case "", storageBackendLocal:
+			return nil, nil
+		case storageBackendS3:
+			var err error
+			backend, err = newS3Storage(cfg.S3BucketURL, cfg.S3Prefix, cfg.S3Region, cfg.S3AccessKey, cfg.S3SecretKey)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown storage backend %q, expected local or s3", cfg.StorageBackend)
+		}
+	}
+	s := &sharedStorage{
+		backend: backend,
+		root:    cfg.StorageDir,
+		durable: cfg.DurableWrites,
+		buffers: buffers,
+		events:  make(chan mirrorEvent, sharedStorageQueue),
+	}
+	go s.run(ctx)
+	return s, nil
+}
+
+func (s *sharedStorage) enabled() bool {
+	return s != nil
+}
+
+// name returns the name of the local file in the backend.
+func (s *sharedStorage) name(file string) string {
+	rel, err := filepath.Rel(s.root, file)
+	if err != nil {
+		rel = filepath.Base(file)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// fetch copies e from the backend to local disk, and reports whether it's
+// now there. The caller holds e's write lock.
+func (s *sharedStorage) fetch(ctx context.Context, e cacheEntry) bool {
+	if !s.enabled() {
+		return false
+	}
+	found, err := s.fetchEntry(ctx, e)
+	switch {
+	case err != nil:
+		slog.ErrorContext(ctx, "Shared_storage_fetch_error", "hash", e.hash, "error", err)
+		sharedStorageRequestsTotal.WithLabelValues("fetch", "error").Inc()
+	case !found:
+		sharedStorageRequestsTotal.WithLabelValues("fetch", "miss").Inc()
+	default:
+		slog.InfoContext(ctx, "Shared_storage_hit", "hash", e.hash)
+		sharedStorageRequestsTotal.WithLabelValues("fetch", "hit").Inc()
+	}
+	return found
+}
+
+func (s *sharedStorage) fetchEntry(ctx context.Context, e cacheEntry) (bool, error) {
+	// The headers file goes up last, so an entry without one isn't all
+	// there yet
+	headers, err := s.backend.Get(ctx, s.name(e.headersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	storedHeaders, err := io.ReadAll(io.LimitReader(headers, maxHeadersFileSize+1))
+	headers.Close()
+	if err != nil {
+		return false, err
+	}
+	if len(storedHeaders) > maxHeadersFileSize {
+		return false, fmt.Errorf("headers file too large")
+	}
+	binary, err := s.backend.Get(ctx, s.name(e.binaryFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer binary.Close()
+
+	// Not the download's .tmp, which may hold the start of one to resume
+	tmp := e.binaryFile + sharedSuffix
+	binaryFile, err := os.Create(tmp)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.buffers.copy(binaryFile, binary)
+	if err == nil {
+		err = syncFile(binaryFile, s.durable)
+	}
+	if closeErr := binaryFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, e.binaryFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	err = writeFile(e.headersFile, storedHeaders, s.durable)
+	if err == nil {
+		err = syncPath(filepath.Dir(e.headersFile), s.durable)
+	}
+	if err != nil {
+		os.Remove(e.binaryFile)
+		os.Remove(e.headersFile)
+		return false, err
+	}
+	// Cleanup ages files by their modification time, so the copy is as
+	// old as the entry rather than starting the TTL over
+	if meta, ok := parseMeta(storedHeaders); ok && !meta.StoredAt.IsZero() {
+		for _, file := range []string{e.binaryFile, e.headersFile} {
+			os.Chtimes(file, time.Now(), meta.StoredAt)
+		}
+	}
+	return true, nil
+}
+
+// sweep deletes the files of the backend last modified before cutoff, as
+// cleanup does with local files, and returns how many it deleted. Replicas
+// only expire the entries on their own disk, so without it the backend would
+// keep every entry any of them ever uploaded.
+func (s *sharedStorage) sweep(ctx context.Context, cutoff time.Time) (int, error) {
+	if !s.enabled() {
+		return 0, nil
+	}
+	var expired []string
+	err := s.backend.List(ctx, "", func(info StorageInfo) bool {
+		if info.ModTime.Before(cutoff) {
+			expired = append(expired, info.Name)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	for i, name := range expired {
+		if err := s.backend.Delete(ctx, name); err != nil {
+			return i, err
+		}
+	}
+	return len(expired), nil
+}
+
+// put uploads a newly stored entry in the background.
+func (s *sharedStorage) put(e cacheEntry) {
+	s.send(mirrorEvent{op: "put", entry: e})
+}
+
+// purge deletes an entry from the backend in the background.
+func (s *sharedStorage) purge(e cacheEntry) {
+	s.send(mirrorEvent{op: "purge", entry: e})
+}
+
+func (s *sharedStorage) send(event mirrorEvent) {
+	if !s.enabled() {
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		// Never hold up requests for it; a replica missing the entry
+		// downloads it itself
+		slog.Info("Shared_storage_queue_full", "op", event.op, "hash", event.entry.hash)
+		sharedStorageRequestsTotal.WithLabelValues(event.op, "dropped").Inc()
+	}
+}
+
+func (s *sharedStorage) run(ctx context.Context) {
+	for {
+		var event mirrorEvent
+		select {
+		case <-ctx.Done():
+			return
+		case event = <-s.events:
+		}
+		ctx, cancel := context.WithTimeout(ctx, sharedStorageTimeout)
+		var err error
+		if event.op == "purge" {
+			err = s.backend.Delete(ctx, s.name(event.entry.headersFile))
+			if err == nil {
+				err = s.backend.Delete(ctx, s.name(event.entry.binaryFile))
+			}
+		} else {
+			err = s.upload(ctx, event.entry)
+		}
+		cancel()
+		if err != nil {
+			slog.Error("Shared_storage_error", "op", event.op, "hash", event.entry.hash, "error", err)
+			sharedStorageRequestsTotal.WithLabelValues(event.op, "error").Inc()
+			continue
+		}
+		sharedStorageRequestsTotal.WithLabelValues(event.op, "done").Inc()
+	}
+}
+
+// upload puts e's binary and then its headers file in the backend.
+func (s *sharedStorage) upload(ctx context.Context, e cacheEntry) error {
+	for _, file := range []string{e.binaryFile, e.headersFile} {
+		f, err := os.Open(file)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Gone already, so there's nothing to share
+				return nil
+			}
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = s.backend.Put(ctx, s.name(file), f, info.Size())
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStorage is a Storage in memory.
+type memStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	times map[string]time.Time
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string][]byte), times: make(map[string]time.Time)}
+}
+
+func (m *memStorage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = data
+	m.times[name] = time.Now()
+	return nil
+}
+
+func (m *memStorage) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memStorage) Stat(ctx context.Context, name string) (StorageInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return StorageInfo{}, os.ErrNotExist
+	}
+	return StorageInfo{Name: name, Size: int64(len(data)), ModTime: m.times[name]}, nil
+}
+
+func (m *memStorage) Delete(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files, name)
+	delete(m.times, name)
+	return nil
+}
+
+func (m *memStorage) List(ctx context.Context, prefix string, fn func(StorageInfo) bool) error {
+	m.mu.Lock()
+	var infos []StorageInfo
+	for name, data := range m.files {
+		if strings.HasPrefix(name, prefix) {
+			infos = append(infos, StorageInfo{Name: name, Size: int64(len(data)), ModTime: m.times[name]})
+		}
+	}
+	m.mu.Unlock()
+	for _, info := range infos {
+		if !fn(info) {
+			break
+		}
+	}
+	return nil
+}
+
+func TestSharedFetchLeavesResumableDownloadAlone(t *testing.T) {
+	dir := t.TempDir()
+	backend := newMemStorage()
+	s := &sharedStorage{backend: backend, root: dir, buffers: newBufferPool(32 << 10)}
+	e := cacheEntry{hash: "entry", binaryFile: filepath.Join(dir, "entry.bin"), headersFile: filepath.Join(dir, "entry.headers")}
+	backend.Put(context.Background(), "entry.bin", strings.NewReader("media"), 5)
+	backend.Put(context.Background(), "entry.headers", strings.NewReader(`{"version":1}`), 13)
+
+	// An interrupted download of the same entry, waiting to be resumed
+	partial := e.binaryFile + ".tmp"
+	for name, data := range map[string]string{partial: "med", partial + resumeSuffix: "{}"} {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if found, err := s.fetchEntry(context.Background(), e); !found || err != nil {
+		t.Fatalf("fetchEntry = %v, %v, want the entry", found, err)
+	}
+	if data, err := os.ReadFile(partial); err != nil || string(data) != "med" {
+		t.Errorf("the partial download is now %q (%v), want it untouched", data, err)
+	}
+	if !fileExists(partial + resumeSuffix) {
+		t.Error("the partial download's resume state is gone")
+	}
+	if data, err := os.ReadFile(e.binaryFile); err != nil || string(data) != "media" {
+		t.Errorf("the fetched binary is %q (%v), want %q", data, err, "media")
+	}
+	if fileExists(e.binaryFile + sharedSuffix) {
+		t.Error("the temporary copy was left behind")
+	}
+}
+
+func TestSharedFetchKeepsEntryAge(t *testing.T) {
+	dir := t.TempDir()
+	backend := newMemStorage()
+	s := &sharedStorage{backend: backend, root: dir, buffers: newBufferPool(32 << 10)}
+	e := cacheEntry{hash: "entry", binaryFile: filepath.Join(dir, "entry.bin"), headersFile: filepath.Join(dir, "entry.headers")}
+	storedAt := time.Now().Add(-5 * time.Hour).Truncate(time.Second)
+	meta := entryMeta{Version: metaVersion, ContentLength: 5, StoredAt: storedAt}
+	backend.Put(context.Background(), "entry.bin", strings.NewReader("media"), 5)
+	backend.Put(context.Background(), "entry.headers", bytes.NewReader(meta.encode()), 0)
+
+	if found, err := s.fetchEntry(context.Background(), e); !found || err != nil {
+		t.Fatalf("fetchEntry = %v, %v, want the entry", found, err)
+	}
+	for _, file := range []string{e.binaryFile, e.headersFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(storedAt) {
+			t.Errorf("%s was modified at %v, want when the entry was stored, %v", filepath.Base(file), info.ModTime(), storedAt)
+		}
+	}
+}
+
+func TestSharedSweepDeletesExpiredFiles(t *testing.T) {
+	backend := newMemStorage()
+	s := &sharedStorage{backend: backend}
+	for _, name := range []string{"old.bin", "old.headers", "tenants/acme/old.bin", "new.bin", "new.headers"} {
+		backend.Put(context.Background(), name, strings.NewReader("x"), 1)
+	}
+	for _, name := range []string{"old.bin", "old.headers", "tenants/acme/old.bin"} {
+		backend.times[name] = time.Now().Add(-13 * time.Hour)
+	}
+
+	deleted, err := s.sweep(context.Background(), time.Now().Add(-12*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 3 {
+		t.Errorf("swept %d files, want 3", deleted)
+	}
+	for _, name := range []string{"new.bin", "new.headers"} {
+		if _, err := backend.Stat(context.Background(), name); err != nil {
+			t.Errorf("%s was swept before its time", name)
+		}
+	}
+	if len(backend.files) != 2 {
+		t.Errorf("%d files left, want 2", len(backend.files))
+	}
+}
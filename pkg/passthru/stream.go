@@ -0,0 +1,87 @@
+package passthru
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// missStream sends a download to the client that missed on it as it
+// arrives, instead of once all of it is on disk. The download is teed to
+// it: the cache file is still written in full under its temporary name and
+// only renamed into place once complete, so nothing changes for the cache.
+// A client that stops taking the response stops being written to, but the
+// download goes on as it would have.
+type missStream struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	e       cacheEntry
+	started bool
+	// finished is set once the handler has moved on and w can't be written
+	// to anymore, and failed once writing to the client has failed.
+	finished bool
+	failed   bool
+}
+
+type missStreamContextKey struct{}
+
+// withMissStream returns a copy of ctx under which a download of e is
+// streamed to w as it arrives.
+func withMissStream(ctx context.Context, w http.ResponseWriter, e cacheEntry) (context.Context, *missStream) {
+	s := &missStream{w: w, e: e}
+	return context.WithValue(ctx, missStreamContextKey{}, s), s
+}
+
+// missStreamFrom returns the stream downloads under ctx are sent to, or nil.
+func missStreamFrom(ctx context.Context) *missStream {
+	s, _ := ctx.Value(missStreamContextKey{}).(*missStream)
+	return s
+}
+
+// start sends the response headers, from the media's headers, and returns
+// the stream to tee the media to. A nil stream, or one the handler is done
+// with, starts nothing and returns nil.
+func (s *missStream) start(headers http.Header) *missStream {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished {
+		return nil
+	}
+	headers, _ = sanitizeHeaders(headers)
+	addStoredHeaders(s.w.Header(), headers)
+	// The entry's ETag is its checksum, not known until it's all here, and
+	// upstream's would change under an If-Range once it is
+	s.w.Header().Del("ETag")
+	setCacheHeaders(s.w, s.e, statusNotCached)
+	s.w.WriteHeader(http.StatusOK)
+	s.started = true
+	slog.Info("Streaming_download", "hash", s.e.hash)
+	return s
+}
+
+// Write sends p to the client. It never fails, so the client going away
+// doesn't fail the download it's teed from.
+func (s *missStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.finished || s.failed {
+		return len(p), nil
+	}
+	if _, err := s.w.Write(p); err != nil {
+		s.failed = true
+	}
+	return len(p), nil
+}
+
+// finish stops the stream, for the handler to move on, and reports whether
+// it got as far as sending the response.
+func (s *missStream) finish() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finished = true
+	return s.started
+}
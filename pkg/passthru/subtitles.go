@@ -0,0 +1,90 @@
+package passthru
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Subtitles are asked of cobalt with the media, which it embeds as a
+// subtitle track. The media with the track is an entry of its own, and the
+// track is extracted from it as WebVTT, or SubRip, like any other derived
+// rendition.
+
+// subtitleLangPattern matches the ISO 639-1 codes cobalt takes.
+var subtitleLangPattern = regexp.MustCompile(`^[a-z]{2}$`)
+
+// subtitleOptions is a requested subtitle file of an entry.
+type subtitleOptions struct {
+	lang   string
+	format string // vtt or srt
+}
+
+// parseSubtitleOptions reads the subs query parameter, or asset=subtitles
+// for those in defaultLang, and subsformat. It returns nil if neither is
+// set.
+func parseSubtitleOptions(query url.Values, defaultLang string) (*subtitleOptions, error) {
+	lang := query.Get("subs")
+	switch query.Get("asset") {
+	case "":
+	case "subtitles":
+		if lang == "" {
+			lang = defaultLang
+		}
+		if lang == "" {
+			return nil, fmt.Errorf("'asset=subtitles' needs 'subs', since there's no default subtitle language")
+		}
+	default:
+		return nil, fmt.Errorf("'asset' must be subtitles")
+	}
+	if lang == "" {
+		return nil, nil
+	}
+	if !subtitleLangPattern.MatchString(lang) {
+		return nil, fmt.Errorf("'subs' must be a two-letter language code such as en")
+	}
+	format := query.Get("subsformat")
+	switch format {
+	case "":
+		format = "vtt"
+	case "vtt", "srt":
+	default:
+		return nil, fmt.Errorf("'subsformat' must be vtt or srt")
+	}
+	return &subtitleOptions{lang: lang, format: format}, nil
+}
+
+// language returns the language asked for, or "" if o is nil.
+func (o *subtitleOptions) language() string {
+	if o == nil {
+		return ""
+	}
+	return o.lang
+}
+
+func (o *subtitleOptions) derivation() *derivation {
+	if o.format == "srt" {
+		return &derivation{
+			key:          "subs=" + o.lang + ".srt",
+			kind:         "subtitles",
+			contentType:  "application/x-subrip; charset=utf-8",
+			args:         []string{"-map", "0:s:0", "-c:s", "srt", "-f", "srt"},
+			subtitleLang: o.lang,
+		}
+	}
+	return &derivation{
+		key:          "subs=" + o.lang,
+		kind:         "subtitles",
+		contentType:  "text/vtt; charset=utf-8",
+		args:         []string{"-map", "0:s:0", "-c:s", "webvtt", "-f", "webvtt"},
+		subtitleLang: o.lang,
+	}
+}
+
+// name names the subtitle file of the media named name, as players pick it
+// up next to the media.
+func (o *subtitleOptions) name(name string) string {
+	return strings.TrimSuffix(name, path.Ext(name)) + "." + o.lang + "." + o.format
+}
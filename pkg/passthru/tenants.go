@@ -0,0 +1,341 @@
+package passthru
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// tenantsDirName is the storage subdirectory holding one storage
+	// directory per tenant.
+	tenantsDirName = "tenants"
+
+	apiKeyHeader = "X-API-Key"
+
+	// quotaRecheckInterval is how long a tenant's measured storage usage is
+	// trusted before the directory is measured again.
+	quotaRecheckInterval = 30 * time.Second
+)
+
+// tenant is a team sharing the instance. Each tenant has its own cache
+// namespace and storage directory, request rate limit and storage quota.
+type tenant struct {
+	Name string   `json:"name"`
+	Keys []string `json:"keys"`
+	// Rate is the number of requests per second allowed (0 is unlimited),
+	// with bursts of up to Burst requests.
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+	// QuotaBytes caps the tenant's cached data (0 is unlimited).
+	QuotaBytes int64 `json:"quotaBytes"`
+	// Quotas caps the requests and bytes served per day and month of each
+	// of the tenant's keys, unless KeyQuotas has quotas of the key's own.
+	Quotas    usageQuotas            `json:"quotas"`
+	KeyQuotas map[string]usageQuotas `json:"keyQuotas"`
+
+	limiter *rate.Limiter
+	cache   *cache
+}
+
+// tenantSet is every configured tenant. A nil tenantSet means multi-tenancy
+// is off and requests need no API key.
+type tenantSet struct {
+	byName map[string]*tenant
+	keys   []tenantKey
+}
+
+type tenantKey struct {
+	key    []byte
+	tenant *tenant
+	usage  *keyUsage
+}
+
+// loadTenants reads a JSON list of tenants, giving each one a cache of its
+// own derived from root.
+func loadTenants(path string, root *cache) (*tenantSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tenants []*tenant
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, err
+	}
+
+	ts := &tenantSet{byName: make(map[string]*tenant)}
+	seenKeys := make(map[string]bool)
+	for _, t := range tenants {
+		if t.Name == "" || strings.ContainsAny(t.Name, `/\.`) {
+			return nil, fmt.Errorf("tenant name %q must be non-empty and can't contain '/', '\\' or '.'", t.Name)
+		}
+		if ts.byName[t.Name] != nil {
+			return nil, fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		if len(t.Keys) == 0 {
+			return nil, fmt.Errorf("tenant %q has no keys", t.Name)
+		}
+		for _, key := range t.Keys {
+			if key == "" || seenKeys[key] {
+				return nil, fmt.Errorf("tenant %q has an empty or duplicate key", t.Name)
+			}
+			seenKeys[key] = true
+			usage := newKeyUsage(t.Name, key)
+			quotas, ok := t.KeyQuotas[key]
+			if !ok {
+				quotas = t.Quotas
+			}
+			usage.quota = newKeyQuota(quotas)
+			ts.keys = append(ts.keys, tenantKey{key: []byte(key), tenant: t, usage: usage})
+		}
+		for key := range t.KeyQuotas {
+			if !seenKeys[key] {
+				return nil, fmt.Errorf("tenant %q has quotas for a key it doesn't have", t.Name)
+			}
+		}
+
+		if t.Rate > 0 {
+			burst := t.Burst
+			if burst < 1 {
+				burst = 1
+			}
+			t.limiter = rate.NewLimiter(rate.Limit(t.Rate), burst)
+		}
+
+		t.cache = root.namespaced(t.Name, filepath.Join(root.storageDir, tenantsDirName, t.Name))
+		t.cache.quota = &storageQuota{tenant: t.Name, limit: t.QuotaBytes}
+		if !root.readOnly {
+			if err := os.MkdirAll(t.cache.storageDir, os.ModePerm); err != nil {
+				return nil, err
+			}
+		}
+		ts.byName[t.Name] = t
+
+		for _, result := range []string{"allowed", "rate_limited", "quota_exceeded"} {
+			tenantRequestsTotal.WithLabelValues(t.Name, result).Add(0)
+		}
+		tenantStorageBytes.WithLabelValues(t.Name).Set(float64(dirSize(t.cache.storageDir)))
+	}
+	tenantRequestsTotal.WithLabelValues("", "unauthorized").Add(0)
+	return ts, nil
+}
+
+func (ts *tenantSet) enabled() bool {
+	return ts != nil
+}
+
+// lookup finds key among the tenants' keys.
+func (ts *tenantSet) lookup(key string) *tenantKey {
+	var found *tenantKey
+	for i := range ts.keys {
+		if subtle.ConstantTimeCompare(ts.keys[i].key, []byte(key)) == 1 {
+			found = &ts.keys[i]
+		}
+	}
+	return found
+}
+
+// requestKey returns the API key sent with r, as an X-API-Key header, a
+// bearer token or a key or apikey query parameter (for players that can't
+// set headers).
+func requestKey(r *http.Request) string {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("apikey")
+}
+
+type tenantContextKey struct{}
+
+// tenantFrom returns the tenant a request was authenticated as, if any.
+func tenantFrom(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// admit checks key, its tenant's rate limit and its quotas and counts the
+// result: allowed, unauthorized, rate_limited or quota_exceeded. Allowed
+// requests are charged to the key, which is returned, along with the quota
+// used up by a quota_exceeded one.
+func (ts *tenantSet) admit(key string) (*tenantKey, string, quotaBreach) {
+	k := ts.lookup(key)
+	if k == nil {
+		tenantRequestsTotal.WithLabelValues("", "unauthorized").Inc()
+		return nil, "unauthorized", quotaBreach{}
+	}
+	if k.tenant.limiter != nil && !k.tenant.limiter.Allow() {
+		tenantRequestsTotal.WithLabelValues(k.tenant.Name, "rate_limited").Inc()
+		return k, "rate_limited", quotaBreach{}
+	}
+	if breach, over := k.usage.quota.exceeded(time.Now()); over {
+		tenantRequestsTotal.WithLabelValues(k.tenant.Name, "quota_exceeded").Inc()
+		return k, "quota_exceeded", breach
+	}
+	tenantRequestsTotal.WithLabelValues(k.tenant.Name, "allowed").Inc()
+	k.usage.request()
+	return k, "allowed", quotaBreach{}
+}
+
+// setRateLimitHeaders tells the client how much of t's rate limit it has
+// left at now: the burst, the requests it may make right away and the
+// seconds until it may make a full burst again.
+func (t *tenant) setRateLimitHeaders(h http.Header, now time.Time) {
+	if t.limiter == nil {
+		return
+	}
+	burst := float64(t.limiter.Burst())
+	tokens := t.limiter.TokensAt(now)
+	h.Set("X-RateLimit-Limit", strconv.Itoa(t.limiter.Burst()))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(int(math.Max(math.Floor(tokens), 0))))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil((burst-tokens)/t.Rate))))
+}
+
+// retryAfter returns the seconds from now until t's rate limit allows
+// another request, at least 1.
+func (t *tenant) retryAfter(now time.Time) int {
+	return int(math.Max(math.Ceil((1-t.limiter.TokensAt(now))/t.Rate), 1))
+}
+
+// authenticate wraps next so every request must carry a tenant's API key
+// and stay within its rate limit and the key's quotas, and charges the request to the key.
+// Responses to a key say how much of its rate limit and tightest quota it
+// has left.
+// Peer-to-peer requests, signed links and short links have their own
+// authentication and skip this.
+func (ts *tenantSet) authenticate(next http.Handler) http.Handler {
+	if !ts.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/internal/") || strings.HasPrefix(r.URL.Path, "/f/") || strings.HasPrefix(r.URL.Path, "/s/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		k, result, breach := ts.admit(requestKey(r))
+		if k != nil {
+			setAccessKey(r.Context(), k.usage.tenant+"/"+k.usage.key)
+			now := time.Now()
+			k.tenant.setRateLimitHeaders(w.Header(), now)
+			if b, ok := k.usage.quota.tightest(now); ok {
+				b.setUsageHeaders(w.Header())
+			}
+		}
+		switch result {
+		case "unauthorized":
+			http.Error(w, "A valid API key is required", http.StatusUnauthorized)
+			return
+		case "rate_limited":
+			w.Header().Set("Retry-After", strconv.Itoa(k.tenant.retryAfter(time.Now())))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		case "quota_exceeded":
+			breach.setHeaders(w.Header(), time.Now())
+			http.Error(w, "Quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		ctx := withUsage(context.WithValue(r.Context(), tenantContextKey{}, k.tenant), k.usage)
+		cw := &countingWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r.WithContext(ctx))
+		k.usage.served(cw.n)
+	})
+}
+
+// storageQuota tracks the bytes stored in a tenant's storage directory and
+// caps them. Usage is measured from disk, at most every quotaRecheckInterval,
+// and bumped by each download in between.
+type storageQuota struct {
+	tenant string
+	limit  int64 // 0 is unlimited
+
+	mu       sync.Mutex
+	used     int64
+	measured time.Time
+}
+
+// exceeded reports whether the tenant storing in dir is at or over its quota.
+func (q *storageQuota) exceeded(dir string) bool {
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if time.Since(q.measured) > quotaRecheckInterval {
+		q.used = dirSize(dir)
+		q.measured = time.Now()
+		tenantStorageBytes.WithLabelValues(q.tenant).Set(float64(q.used))
+	}
+	return q.limit > 0 && q.used >= q.limit
+}
+
+// keeps reports whether the finished download at name, whose bytes add has
+// already counted, leaves the tenant within its quota. Downloads that started
+// under the quota but went over it are served once and not kept, so their
+// bytes are taken off again.
+func (q *storageQuota) keeps(name string) bool {
+	if q == nil || q.limit <= 0 {
+		return true
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used <= q.limit {
+		return true
+	}
+	if info, err := os.Stat(name); err == nil {
+		q.used -= info.Size()
+		tenantStorageBytes.WithLabelValues(q.tenant).Set(float64(q.used))
+	}
+	slog.Info("Storage_quota_exceeded", "tenant", q.tenant, "filename", name)
+	return false
+}
+
+// add records n newly stored bytes.
+func (q *storageQuota) add(n int64) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.used += n
+	tenantStorageBytes.WithLabelValues(q.tenant).Set(float64(q.used))
+	q.mu.Unlock()
+}
+
+// storageDirs returns storageDir followed by the storage directory of every
+// tenant found in it.
+func storageDirs(storageDir string) []string {
+	dirs := []string{storageDir}
+	tenantsRoot := filepath.Join(storageDir, tenantsDirName)
+	entries, err := os.ReadDir(tenantsRoot)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Read_storage_directory_error", "dir", tenantsRoot, "error", err)
+		}
+		return dirs
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			dirs = append(dirs, filepath.Join(tenantsRoot, e.Name()))
+		}
+	}
+	return dirs
+}
@@ -0,0 +1,72 @@
+package passthru
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirSizeCountsSubdirectories(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, hlsDirName, "entry")
+	if err := os.MkdirAll(sub, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int{filepath.Join(dir, "entry.bin"): 100, filepath.Join(sub, "seg0.ts"): 50} {
+		if err := os.WriteFile(name, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dirSize(dir); got != 150 {
+		t.Errorf("dirSize = %d, want 150", got)
+	}
+}
+
+func TestTenantQuotaCheckedWhenDownloadFinishes(t *testing.T) {
+	tenantsFile := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(tenantsFile, []byte(`[{"name": "web", "keys": ["k1"], "quotaBytes": 8000}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var storageDir string
+	srv := newTestServer(t, func(cfg *Config) {
+		cfg.TenantsFile = tenantsFile
+		storageDir = cfg.StorageDir
+	})
+	get := func(media string) (string, int64) {
+		t.Helper()
+		req, err := http.NewRequest("GET", srv.URL+"/?u="+url.QueryEscape(media), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(apiKeyHeader, "k1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		n, _ := io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		return resp.Header.Get(cacheHeader), n
+	}
+
+	// The first fits, and the second starts under the quota but ends over it
+	for _, media := range []string{"https://example.com/one?size=5000", "https://example.com/two?size=5000"} {
+		if _, n := get(media); n != 5000 {
+			t.Fatalf("%s: got %d bytes, want 5000", media, n)
+		}
+	}
+	if status, _ := get("https://example.com/one?size=5000"); status != "HIT" {
+		t.Errorf("the entry within the quota wasn't kept: %s = %q", cacheHeader, status)
+	}
+	if status, _ := get("https://example.com/two?size=5000"); status == "HIT" {
+		t.Error("the entry that went over the quota was kept")
+	}
+	if used := dirSize(filepath.Join(storageDir, tenantsDirName, "web")); used > 8000 {
+		t.Errorf("the tenant stores %d bytes, over its 8000 byte quota", used)
+	}
+}
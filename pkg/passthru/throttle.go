@@ -0,0 +1,124 @@
+package passthru
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"golang.org/x/time/rate"
+)
+
+// throttleBurst is the most a throttled response writes in one go.
+const throttleBurst = 64 * 1024
+
+// newByteLimiter returns a limiter of bytesPerSecond, or nil when that is 0.
+func newByteLimiter(bytesPerSecond int) *rate.Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := throttleBurst
+	if bytesPerSecond < burst {
+		burst = bytesPerSecond
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// throttle returns w capped at bytesPerSecond and by the shared limiter, or
+// w itself when neither applies. Each response gets its own bytesPerSecond,
+// so one client pulling a huge file can't take all the bandwidth, while
+// shared bounds what all of them take together. A throttled response can't
+// use sendfile.
+func throttle(w http.ResponseWriter, r *http.Request, bytesPerSecond int, shared *rate.Limiter) http.ResponseWriter {
+	limiters := nonNilLimiters(newByteLimiter(bytesPerSecond), shared)
+	if len(limiters) == 0 {
+		return w
+	}
+	return &throttledWriter{ResponseWriter: w, r: r, limiters: limiters}
+}
+
+// throttleReader returns r read no faster than all of limiters allow, or r
+// itself when they're all nil. Like throttle, a download gets a limiter of
+// its own (see fetchLimiters) on top of the one all of them share.
+func throttleReader(ctx context.Context, r io.Reader, limiters ...*rate.Limiter) io.Reader {
+	limiters = nonNilLimiters(limiters...)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &throttledReader{Reader: r, ctx: ctx, limiters: limiters}
+}
+
+func nonNilLimiters(limiters ...*rate.Limiter) []*rate.Limiter {
+	var nonNil []*rate.Limiter
+	for _, l := range limiters {
+		if l != nil {
+			nonNil = append(nonNil, l)
+		}
+	}
+	return nonNil
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	limiters []*rate.Limiter
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		for _, l := range w.limiters {
+			if n > l.Burst() {
+				n = l.Burst()
+			}
+		}
+		for _, l := range w.limiters {
+			if err := l.WaitN(w.r.Context(), n); err != nil {
+				return written, err
+			}
+		}
+		m, err := w.ResponseWriter.Write(b[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type throttledReader struct {
+	io.Reader
+	ctx      context.Context
+	limiters []*rate.Limiter
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	for _, l := range r.limiters {
+		if len(b) > l.Burst() {
+			b = b[:l.Burst()]
+		}
+	}
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if waitErr := l.WaitN(r.ctx, n); waitErr != nil {
+				if err == nil {
+					err = waitErr
+				}
+				break
+			}
+		}
+	}
+	return n, err
+}
+
+// fetchLimiters returns the limiters a download from upstream is held to:
+// its own, of the per-download rate, and the one all of them share.
+func (c *cache) fetchLimiters() []*rate.Limiter {
+	return []*rate.Limiter{newByteLimiter(c.fetchRate), c.ingress}
+}
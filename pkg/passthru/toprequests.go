@@ -0,0 +1,240 @@
+package passthru
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Requests are counted in topBucketSpan buckets over topRetention, the
+	// longest window they can be asked about.
+	topBucketSpan = 10 * time.Minute
+	topRetention  = 24 * time.Hour
+	topBuckets    = int(topRetention/topBucketSpan) + 1
+	// topSketchWidth and topSketchDepth size the count-min sketches, and
+	// topCandidates is how many of the busiest URLs and domains each bucket
+	// keeps track of. Together they bound the memory used at about 5MiB
+	// however many URLs are requested.
+	topSketchWidth = 1024
+	topSketchDepth = 4
+	topCandidates  = 100
+)
+
+// countMinSketch estimates how often each key was counted in constant
+// space. Estimates are never too low, and only too high by the collisions
+// of a key with busier ones.
+type countMinSketch [topSketchDepth][topSketchWidth]uint32
+
+// cells returns the cell of key in each row of a sketch, by double hashing.
+func cells(key string) [topSketchDepth]int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	var cells [topSketchDepth]int
+	for i := range cells {
+		cells[i] = int((h1 + uint32(i)*h2) % topSketchWidth)
+	}
+	return cells
+}
+
+func (s *countMinSketch) add(cells [topSketchDepth]int) {
+	for i, cell := range cells {
+		s[i][cell]++
+	}
+}
+
+func (s *countMinSketch) estimate(cells [topSketchDepth]int) int64 {
+	n := s[0][cells[0]]
+	for i, cell := range cells[1:] {
+		n = min(n, s[i+1][cell])
+	}
+	return int64(n)
+}
+
+// topBucket is the requests of a topBucketSpan starting at start.
+type topBucket struct {
+	start          time.Time
+	hits, misses   countMinSketch
+	urls, domains  map[string]int64 // candidates, with their estimated requests
+	hitsN, missesN int64
+}
+
+// offer makes key a candidate of candidates if it's among the busiest
+// topCandidates, evicting the least busy one if need be.
+func offer(candidates map[string]int64, key string, requests int64) {
+	if _, ok := candidates[key]; ok || len(candidates) < topCandidates {
+		candidates[key] = requests
+		return
+	}
+	var leastKey string
+	least := int64(-1)
+	for k, n := range candidates {
+		if least < 0 || n < least {
+			leastKey, least = k, n
+		}
+	}
+	if requests > least {
+		delete(candidates, leastKey)
+		candidates[key] = requests
+	}
+}
+
+// requestTop counts the requests for each URL and domain, hits and misses
+// apart, over a sliding window, to find the most requested ones. Counts are
+// approximate and kept in memory, in bounded space, so they start over on
+// restart. A nil requestTop counts nothing.
+type requestTop struct {
+	mu      sync.Mutex
+	buckets [topBuckets]*topBucket
+}
+
+func newRequestTop() *requestTop {
+	return &requestTop{}
+}
+
+// domainKey is the sketch key of a domain, set apart from those of URLs.
+func domainKey(domain string) string {
+	return "domain\x00" + domain
+}
+
+// record counts a request for url, a hit if it was served from the cache.
+func (rt *requestTop) record(url string, hit bool) {
+	if rt == nil {
+		return
+	}
+	now := time.Now()
+	start := now.Truncate(topBucketSpan)
+	domain := entryDomain(url)
+	urlCells, domainCells := cells(url), cells(domainKey(domain))
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	i := int(start.Unix()/int64(topBucketSpan.Seconds())) % topBuckets
+	b := rt.buckets[i]
+	if b == nil || !b.start.Equal(start) {
+		b = &topBucket{start: start, urls: make(map[string]int64), domains: make(map[string]int64)}
+		rt.buckets[i] = b
+	}
+	if hit {
+		b.hits.add(urlCells)
+		b.hits.add(domainCells)
+		b.hitsN++
+	} else {
+		b.misses.add(urlCells)
+		b.misses.add(domainCells)
+		b.missesN++
+	}
+	offer(b.urls, url, b.hits.estimate(urlCells)+b.misses.estimate(urlCells))
+	offer(b.domains, domain, b.hits.estimate(domainCells)+b.misses.estimate(domainCells))
+}
+
+// topCount is the requests for a URL or domain over a window.
+type topCount struct {
+	Name     string `json:"name"`
+	Requests int64  `json:"requests"`
+	Hits     int64  `json:"hits"`
+	Misses   int64  `json:"misses"`
+}
+
+// topReport is what GET /admin/top returns.
+type topReport struct {
+	Window  string     `json:"window"`
+	Since   time.Time  `json:"since"`
+	Hits    int64      `json:"hits"`
+	Misses  int64      `json:"misses"`
+	URLs    []topCount `json:"urls"`
+	Domains []topCount `json:"domains"`
+}
+
+// top returns the n most requested URLs and domains in the window up to
+// now, which is rounded up to whole buckets.
+func (rt *requestTop) top(window time.Duration, n int) topReport {
+	now := time.Now()
+	since := now.Add(-window).Truncate(topBucketSpan)
+	report := topReport{Window: window.String(), Since: since, URLs: []topCount{}, Domains: []topCount{}}
+	if rt == nil {
+		return report
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var buckets []*topBucket
+	urls, domains := make(map[string]bool), make(map[string]bool)
+	for _, b := range rt.buckets {
+		if b == nil || b.start.Before(since) {
+			continue
+		}
+		buckets = append(buckets, b)
+		report.Hits += b.hitsN
+		report.Misses += b.missesN
+		for url := range b.urls {
+			urls[url] = true
+		}
+		for domain := range b.domains {
+			domains[domain] = true
+		}
+	}
+
+	count := func(name, key string) topCount {
+		c := topCount{Name: name}
+		keyCells := cells(key)
+		for _, b := range buckets {
+			c.Hits += b.hits.estimate(keyCells)
+			c.Misses += b.misses.estimate(keyCells)
+		}
+		c.Requests = c.Hits + c.Misses
+		return c
+	}
+	for url := range urls {
+		report.URLs = append(report.URLs, count(url, url))
+	}
+	for domain := range domains {
+		report.Domains = append(report.Domains, count(domain, domainKey(domain)))
+	}
+	report.URLs = busiest(report.URLs, n)
+	report.Domains = busiest(report.Domains, n)
+	return report
+}
+
+// busiest returns the n of counts with the most requests, most first.
+func busiest(counts []topCount, n int) []topCount {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Requests != counts[j].Requests {
+			return counts[i].Requests > counts[j].Requests
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// handleTop lists the most requested URLs and domains over the window
+// parameter (default and at most 24h), with their hits and misses.
+func handleTop(rt *requestTop) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window := topRetention
+		if s := r.URL.Query().Get("window"); s != "" {
+			var err error
+			if window, err = time.ParseDuration(s); err != nil || window <= 0 || window > topRetention {
+				http.Error(w, "'window' must be a duration of up to 24h", http.StatusBadRequest)
+				return
+			}
+		}
+		n := 20
+		if s := r.URL.Query().Get("n"); s != "" {
+			var err error
+			if n, err = strconv.Atoi(s); err != nil || n <= 0 || n > topCandidates {
+				http.Error(w, "'n' must be a number from 1 to 100", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, rt.top(window, n))
+	}
+}
@@ -0,0 +1,98 @@
+package passthru
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans of a request's way through the cache: the lookup,
+// the call to cobalt, the download, writing it to disk and serving it.
+// Until setupTracing installs an exporter they go nowhere, at next to no
+// cost.
+var tracer = otel.Tracer("cobalt-passthru")
+
+// setupTracing exports spans over OTLP/HTTP, to wherever the standard
+// OTEL_EXPORTER_OTLP_* environment variables say, and has traces carry on
+// from the traceparent of incoming requests and on to cobalt's. The
+// service is named cobalt-passthru unless OTEL_SERVICE_NAME says
+// otherwise, and OTEL_TRACES_SAMPLER picks what's sampled. It returns the
+// function flushing the spans still buffered, for shutdown.
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "cobalt-passthru")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// traceRequests wraps next so each request is a span, continuing the trace
+// of a caller that sent a traceparent, and logs the trace's ID with it.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+routeName(r.URL.Path), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+		))
+		defer span.End()
+		if sc := span.SpanContext(); sc.IsSampled() {
+			addLogFields(ctx, "trace_id", sc.TraceID().String())
+		}
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if cacheStatus := w.Header().Get(cacheHeader); cacheStatus != "" {
+			span.SetAttributes(attribute.String("cache.status", strings.ToLower(cacheStatus)))
+		}
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// routeName returns the first segment of path, which names its route
+// without the hashes and IDs that follow, so span names stay few.
+func routeName(path string) string {
+	if i := strings.IndexByte(strings.TrimPrefix(path, "/"), '/'); i >= 0 {
+		return path[:i+1]
+	}
+	return path
+}
+
+// injectTrace passes the trace in ctx on with req, so the service it goes
+// to can put its spans in the same trace.
+func injectTrace(ctx context.Context, req *http.Request) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+// endSpan ends span, marking it failed with err if there is one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,185 @@
+package passthru
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// storageTracker keeps the modification times of the files in the storage
+// directories up to date from filesystem events, so a cleanup pass only
+// stats the files old enough to expire instead of listing and stat-ing every
+// file. Each directory is listed once, on the first pass that looks at it,
+// and again only if events for it were lost. A nil storageTracker leaves
+// cleanup to list the directories every pass.
+type storageTracker struct {
+	watcher *dirWatcher
+
+	mu     sync.Mutex
+	dirs   map[string]*trackedDir
+	broken bool
+}
+
+// trackedDir is what a storageTracker knows of one directory. Once stale it
+// is listed again before being trusted.
+type trackedDir struct {
+	files map[string]time.Time
+	stale bool
+}
+
+// newStorageTracker returns a tracker watching for events until ctx is done,
+// or nil if enabled is false or storage can't be watched.
+func newStorageTracker(ctx context.Context, enabled bool) *storageTracker {
+	if !enabled {
+		return nil
+	}
+	t := &storageTracker{dirs: make(map[string]*trackedDir)}
+	watcher, err := newDirWatcher(t)
+	if err != nil {
+		slog.Info("Storage_watch_unavailable", "error", err)
+		return nil
+	}
+	t.watcher = watcher
+	go watcher.run(ctx)
+	return t
+}
+
+// eachCandidate calls fn with the name of each file in dir that may have been
+// last modified before cutoff, until fn returns false. Without a tracker
+// that's every file in dir, read a batch at a time.
+func (t *storageTracker) eachCandidate(dir string, cutoff time.Time, fn func(name string) bool) error {
+	names, tracked, err := t.candidates(dir, cutoff)
+	if err != nil {
+		return err
+	}
+	if !tracked {
+		return readDirBatched(dir, func(files []os.DirEntry) bool {
+			for _, file := range files {
+				if !file.IsDir() && !fn(file.Name()) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	for _, name := range names {
+		if !fn(name) {
+			break
+		}
+	}
+	return nil
+}
+
+// candidates returns the names of the tracked files in dir last modified
+// before cutoff, or reports that dir isn't tracked.
+func (t *storageTracker) candidates(dir string, cutoff time.Time) ([]string, bool, error) {
+	if t == nil {
+		return nil, false, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.broken {
+		return nil, false, nil
+	}
+	d := t.dirs[dir]
+	if d == nil || d.stale {
+		if d == nil {
+			if err := t.watcher.add(dir); err != nil {
+				slog.Error("Storage_watch_error", "dir", dir, "error", err)
+				return nil, false, nil
+			}
+		}
+		// Watch before listing, so nothing changed in between is missed
+		files, err := listModTimes(dir)
+		if err != nil {
+			return nil, false, err
+		}
+		d = &trackedDir{files: files}
+		t.dirs[dir] = d
+		slog.Info("Storage_watch_started", "dir", dir, "files", len(files))
+	}
+
+	var names []string
+	for name, modTime := range d.files {
+		if modTime.Before(cutoff) {
+			names = append(names, name)
+		}
+	}
+	return names, true, nil
+}
+
+// changed records that the file name in dir was created, written, renamed
+// into place or had its times changed.
+func (t *storageTracker) changed(dir, name string) {
+	info, err := os.Lstat(filepath.Join(dir, name))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := t.dirs[dir]
+	if d == nil {
+		return
+	}
+	if err != nil || !info.Mode().IsRegular() {
+		delete(d.files, name)
+		return
+	}
+	d.files[name] = info.ModTime()
+}
+
+// removed records that the file name in dir was deleted or renamed away.
+func (t *storageTracker) removed(dir, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if d := t.dirs[dir]; d != nil {
+		delete(d.files, name)
+	}
+}
+
+// unwatched records that dir is no longer watched, because it was deleted or
+// moved. It is watched again the next time a pass looks at it.
+func (t *storageTracker) unwatched(dir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.dirs, dir)
+}
+
+// lost records that events were dropped, so every directory is listed again
+// on the next pass.
+func (t *storageTracker) lost() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slog.Info("Storage_watch_events_lost")
+	for _, d := range t.dirs {
+		d.stale = true
+	}
+}
+
+// fail gives up on events, after which every pass lists the directories.
+func (t *storageTracker) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slog.Error("Storage_watch_failed", "error", err)
+	t.broken = true
+	t.dirs = nil
+}
+
+// listModTimes returns the modification times of the regular files in dir.
+func listModTimes(dir string) (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	err := readDirBatched(dir, func(files []os.DirEntry) bool {
+		for _, file := range files {
+			if !file.Type().IsRegular() {
+				continue
+			}
+			if info, err := file.Info(); err == nil {
+				modTimes[file.Name()] = info.ModTime()
+			}
+		}
+		return true
+	})
+	return modTimes, err
+}
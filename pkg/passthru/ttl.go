@@ -0,0 +1,86 @@
+package passthru
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// upstreamTTL derives each entry's expiry from the Cache-Control or Expires
+// of its media response, within bounds, so entries from short-lived signed
+// CDN URLs are downloaded again instead of living out the cleanup TTL. A nil
+// upstreamTTL leaves expiry to cleanup alone.
+type upstreamTTL struct {
+	min, max time.Duration
+}
+
+func newUpstreamTTL(enabled bool, min, max time.Duration) *upstreamTTL {
+	if !enabled {
+		return nil
+	}
+	return &upstreamTTL{min: min, max: max}
+}
+
+func (t *upstreamTTL) enabled() bool {
+	return t != nil
+}
+
+// expiry returns when an entry downloaded now with the given response
+// headers expires, or nil if they don't say or t is nil.
+func (t *upstreamTTL) expiry(headers http.Header, now time.Time) *time.Time {
+	if !t.enabled() {
+		return nil
+	}
+	ttl, ok := responseTTL(headers, now)
+	if !ok {
+		return nil
+	}
+	if ttl < t.min {
+		ttl = t.min
+	}
+	if t.max > 0 && ttl > t.max {
+		ttl = t.max
+	}
+	at := now.Add(ttl).UTC()
+	return &at
+}
+
+// responseTTL returns how long a response with the given headers may be
+// cached by a shared cache, going by s-maxage, max-age, no-store and no-cache,
+// or Expires relative to Date.
+func responseTTL(headers http.Header, now time.Time) (time.Duration, bool) {
+	var maxAge, sMaxAge string
+	for _, directive := range strings.Split(strings.Join(headers.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			maxAge = strings.Trim(value, `"`)
+		case "s-maxage":
+			sMaxAge = strings.Trim(value, `"`)
+		}
+	}
+	for _, age := range []string{sMaxAge, maxAge} {
+		if seconds, err := strconv.ParseInt(age, 10, 64); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+
+	if expires := headers.Get("Expires"); expires != "" {
+		at, err := http.ParseTime(expires)
+		if err != nil {
+			// An invalid Expires means already expired
+			return 0, true
+		}
+		if date, err := http.ParseTime(headers.Get("Date")); err == nil {
+			now = date
+		}
+		if ttl := at.Sub(now); ttl > 0 {
+			return ttl, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
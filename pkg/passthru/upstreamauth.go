@@ -0,0 +1,185 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// sessionPath is where cobalt hands out session tokens.
+	sessionPath = "/session"
+	// sessionRefreshMargin is how long before it expires a session token
+	// is replaced.
+	sessionRefreshMargin = time.Minute
+	turnstileTimeout     = 2 * time.Minute
+)
+
+// upstreamAuth authenticates requests to cobalt instances that want it:
+// with an API key, or with the session token (a JWT) an instance hands out
+// at /session in exchange for a Turnstile response. Getting one of those
+// takes a browser, so an external command, such as a solver service's
+// client, prints them. It's run with the instance's URL as its last
+// argument. A nil upstreamAuth sends no credentials.
+type upstreamAuth struct {
+	apiKey    string
+	turnstile []string // nil without sessions
+	client    *http.Client
+
+	mu       sync.Mutex
+	sessions map[string]*upstreamSession
+}
+
+// upstreamSession is the session token of an instance.
+type upstreamSession struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// sessionResponse is cobalt's answer at /session.
+type sessionResponse struct {
+	Token string `json:"token"`
+	// Exp is how many seconds the token lasts.
+	Exp int64 `json:"exp"`
+}
+
+func newUpstreamAuth(apiKey, turnstileCommand string, client *http.Client) (*upstreamAuth, error) {
+	turnstile := strings.Fields(turnstileCommand)
+	if apiKey == "" && len(turnstile) == 0 {
+		return nil, nil
+	}
+	if apiKey != "" && len(turnstile) > 0 {
+		return nil, errors.New("an API key and sessions can't be used together")
+	}
+	if len(turnstile) > 0 {
+		path, err := exec.LookPath(turnstile[0])
+		if err != nil {
+			return nil, err
+		}
+		turnstile[0] = path
+	}
+	for _, kind := range []string{"session", "rejected"} {
+		upstreamAuthFailuresTotal.WithLabelValues(kind).Add(0)
+	}
+	return &upstreamAuth{apiKey: apiKey, turnstile: turnstile, client: client, sessions: make(map[string]*upstreamSession)}, nil
+}
+
+func (a *upstreamAuth) enabled() bool {
+	return a != nil
+}
+
+// authorization returns the Authorization header of a request to the
+// instance at endpoint, or "" for none.
+func (a *upstreamAuth) authorization(ctx context.Context, endpoint string) (string, error) {
+	if !a.enabled() {
+		return "", nil
+	}
+	if a.apiKey != "" {
+		return "Api-Key " + a.apiKey, nil
+	}
+	token, err := a.session(endpoint).get(ctx, a, endpoint)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
+
+// rejected is told the instance at endpoint refused a request's
+// credentials, so a session token it no longer takes is replaced.
+func (a *upstreamAuth) rejected(ctx context.Context, endpoint string) {
+	if !a.enabled() {
+		return
+	}
+	upstreamAuthFailuresTotal.WithLabelValues("rejected").Inc()
+	slog.WarnContext(ctx, "Upstream_credentials_rejected", "endpoint", endpoint)
+	if a.apiKey == "" {
+		a.session(endpoint).forget()
+	}
+}
+
+func (a *upstreamAuth) session(endpoint string) *upstreamSession {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.sessions[endpoint]
+	if s == nil {
+		s = &upstreamSession{}
+		a.sessions[endpoint] = s
+	}
+	return s
+}
+
+// get returns the session token, getting a new one if it has none or it's
+// about to expire. Requests needing one meanwhile wait for it.
+func (s *upstreamSession) get(ctx context.Context, a *upstreamAuth, endpoint string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && time.Until(s.expires) > sessionRefreshMargin {
+		return s.token, nil
+	}
+	token, expires, err := a.newSession(ctx, endpoint)
+	if err != nil {
+		upstreamAuthFailuresTotal.WithLabelValues("session").Inc()
+		slog.ErrorContext(ctx, "Upstream_session_error", "endpoint", endpoint, "error", err)
+		return "", err
+	}
+	s.token, s.expires = token, expires
+	slog.InfoContext(ctx, "Upstream_session_started", "endpoint", endpoint, "expires", expires.Format(time.RFC3339))
+	return token, nil
+}
+
+func (s *upstreamSession) forget() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+// newSession exchanges a Turnstile response for a session token of the
+// instance at endpoint.
+func (a *upstreamAuth) newSession(ctx context.Context, endpoint string) (string, time.Time, error) {
+	base := strings.TrimSuffix(strings.TrimSuffix(endpoint, legacyRequestPath), "/")
+
+	cmdCtx, cancel := context.WithTimeout(ctx, turnstileTimeout)
+	defer cancel()
+	args := append(append([]string{}, a.turnstile[1:]...), base+"/")
+	cmd := exec.CommandContext(cmdCtx, a.turnstile[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("turnstile command: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	response := strings.TrimSpace(string(out))
+	if response == "" {
+		return "", time.Time{}, errors.New("turnstile command printed nothing")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", base+sessionPath, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("cf-turnstile-response", response)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer resp.Body.Close()
+	var session sessionResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&session); err != nil && resp.StatusCode == http.StatusOK {
+		return "", time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK || session.Token == "" {
+		return "", time.Time{}, fmt.Errorf("%s returned %d", base+sessionPath, resp.StatusCode)
+	}
+	return session.Token, time.Now().Add(time.Duration(session.Exp) * time.Second), nil
+}
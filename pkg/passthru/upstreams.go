@@ -0,0 +1,169 @@
+package passthru
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamPool spreads requests to the external service over the cobalt
+// instances of an endpoint that lists several. Each request goes to the
+// least busy healthy instance, taking turns among equally busy ones, and
+// on to the next if that one fails. Instances are probed for their health
+// now and then. A nil upstreamPool sends everything to the one endpoint.
+type upstreamPool struct {
+	hooks     hookChain
+	client    *http.Client
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+// upstream is one instance of a pool.
+type upstream struct {
+	endpoint string
+	healthy  atomic.Bool
+	// inFlight counts the requests it's answering.
+	inFlight atomic.Int64
+}
+
+// upstreamFailure is an error from an instance that failed to answer, or
+// answered with a server error, which another instance may well not fail
+// with. answered is whether it answered.
+type upstreamFailure struct {
+	err      *fetchError
+	answered bool
+}
+
+func (f *upstreamFailure) Error() string {
+	return f.err.message
+}
+
+// splitEndpoints returns the endpoints of a comma-separated list.
+func splitEndpoints(endpoint string) []string {
+	var endpoints []string
+	for _, e := range strings.Split(endpoint, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// newUpstreamPool returns the pool of the instances endpoint lists, or nil
+// if it's just the one.
+func newUpstreamPool(endpoint string, hooks hookChain, client *http.Client) *upstreamPool {
+	endpoints := splitEndpoints(endpoint)
+	if len(endpoints) < 2 {
+		return nil
+	}
+	p := &upstreamPool{hooks: hooks, client: client}
+	for _, e := range endpoints {
+		up := &upstream{endpoint: e}
+		up.healthy.Store(true)
+		upstreamHealthy.WithLabelValues(e).Set(1)
+		p.upstreams = append(p.upstreams, up)
+	}
+	return p
+}
+
+// order returns the instances to try a request on, in turn: the healthy
+// ones, least busy first, or all of them if none is, in case the probes
+// are wrong. A nil pool returns endpoint alone.
+func (p *upstreamPool) order(endpoint string) []*upstream {
+	if p == nil {
+		up := &upstream{endpoint: endpoint}
+		up.healthy.Store(true)
+		return []*upstream{up}
+	}
+	var healthy []*upstream
+	for _, up := range p.upstreams {
+		if up.healthy.Load() {
+			healthy = append(healthy, up)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = append(healthy, p.upstreams...)
+	}
+	// Take turns, then put the least busy first
+	start := int(p.next.Add(1) % uint64(len(healthy)))
+	healthy = append(healthy[start:], healthy[:start]...)
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return healthy[i].inFlight.Load() < healthy[j].inFlight.Load()
+	})
+	return healthy
+}
+
+// watch probes every instance now and then every interval, until ctx is
+// done.
+func (p *upstreamPool) watch(ctx context.Context, interval time.Duration) {
+	if p == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, up := range p.upstreams {
+				up.probe(p.client, p.hooks)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// probe asks the instance whether it's up.
+func (up *upstream) probe(client *http.Client, hooks hookChain) {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamProbeTimeout)
+	err := reachable(ctx, client, hooks, up.endpoint)
+	cancel()
+	healthy := err == nil
+	if up.healthy.Swap(healthy) == healthy {
+		return
+	}
+	if healthy {
+		upstreamHealthy.WithLabelValues(up.endpoint).Set(1)
+		slog.Info("Upstream_recovered", "endpoint", up.endpoint)
+	} else {
+		upstreamHealthy.WithLabelValues(up.endpoint).Set(0)
+		slog.Warn("Upstream_unhealthy", "endpoint", up.endpoint, "error", err)
+	}
+}
+
+// reachable asks the info route of the instance at endpoint, / for the
+// current API or /api/serverInfo for the legacy one, whether it's up.
+func reachable(ctx context.Context, client *http.Client, hooks hookChain, endpoint string) error {
+	base := strings.TrimSuffix(endpoint, legacyRequestPath)
+	err := checkHealth(ctx, client, hooks, base)
+	if err != nil && ctx.Err() == nil {
+		err = checkHealth(ctx, client, hooks, strings.TrimSuffix(base, "/")+legacyInfoPath)
+	}
+	return err
+}
+
+// checkHealth GETs url with client, which must answer 200.
+func checkHealth(ctx context.Context, client *http.Client, hooks hookChain, url string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	hooks.beforeUpstream(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package passthru
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress fails dialing a media host that resolves to an address
+// that isn't on the public internet.
+var errPrivateAddress = errors.New("media host resolves to a private address")
+
+// sharedAddressSpace is carrier-grade NAT space, which netip doesn't count
+// as private but isn't public either.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// urlPolicy decides which URLs clients may ask for: http and https ones
+// only, not on private addresses, on the allowed domains if there are any,
+// and not on the denied ones. A domain covers its subdomains.
+type urlPolicy struct {
+	allowed []string
+	denied  []string
+}
+
+// newURLPolicy reads comma-separated lists of allowed and denied domains.
+func newURLPolicy(allowed, denied string) (*urlPolicy, error) {
+	p := &urlPolicy{}
+	for _, list := range []struct {
+		domains string
+		to      *[]string
+	}{{allowed, &p.allowed}, {denied, &p.denied}} {
+		for _, domain := range strings.Split(list.domains, ",") {
+			domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+			if domain == "" {
+				continue
+			}
+			if strings.ContainsAny(domain, "/:") {
+				return nil, fmt.Errorf("%q must be a bare domain name", domain)
+			}
+			*list.to = append(*list.to, domain)
+		}
+	}
+	for _, reason := range []string{"invalid", "scheme", "private_address", "denied_host", "unlisted_host", "private_download"} {
+		rejectedURLsTotal.WithLabelValues(reason).Add(0)
+	}
+	return p, nil
+}
+
+// check returns the error refusing rawURL, counting the refusal, or nil if
+// it may be asked for.
+func (p *urlPolicy) check(rawURL string) error {
+	reason, err := p.refuse(rawURL)
+	if err == nil {
+		return nil
+	}
+	rejectedURLsTotal.WithLabelValues(reason).Inc()
+	slog.Info("URL_rejected", "reason", reason, "url", rawURL)
+	return err
+}
+
+func (p *urlPolicy) refuse(rawURL string) (string, error) {
+	u, err := neturl.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return "invalid", &fetchError{http.StatusBadRequest, "'u' must be an absolute URL"}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "scheme", &fetchError{http.StatusBadRequest, "'u' must be an http or https URL"}
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if addr, err := netip.ParseAddr(host); err == nil && !publicAddr(addr) {
+		return "private_address", &fetchError{http.StatusForbidden, "URLs on private addresses are not served"}
+	}
+	if p == nil {
+		return "", nil
+	}
+	if matchDomain(host, p.denied) {
+		return "denied_host", &fetchError{http.StatusForbidden, "Media from " + host + " is not served here"}
+	}
+	if len(p.allowed) > 0 && !matchDomain(host, p.allowed) {
+		return "unlisted_host", &fetchError{http.StatusForbidden, "Media from " + host + " is not served here"}
+	}
+	return "", nil
+}
+
+// matchDomain reports whether host is one of domains or a subdomain of one.
+func matchDomain(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// publicAddr reports whether addr is on the public internet.
+func publicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// downloadGuard keeps media downloads off private addresses, so a link
+// handed back by the external service (or a redirect from the media host)
+// can't point the service at something on its own network. The address is
+// checked once the host is resolved, as the connection is made, so DNS
+// can't change between the check and the download. The external service's
+// own hosts are trusted, since its tunnel links point back at it.
+type downloadGuard struct {
+	allowPrivate bool
+
+	mu      sync.RWMutex
+	trusted map[string]bool
+}
+
+type mediaDownloadContextKey struct{}
+
+// withMediaDownload marks ctx as downloading media, which the guard checks.
+func withMediaDownload(ctx context.Context) context.Context {
+	return context.WithValue(ctx, mediaDownloadContextKey{}, true)
+}
+
+func newDownloadGuard(allowPrivate bool) *downloadGuard {
+	return &downloadGuard{allowPrivate: allowPrivate, trusted: make(map[string]bool)}
+}
+
+// trust lets media be downloaded from the host of endpoint, wherever it is.
+func (g *downloadGuard) trust(endpoint string) {
+	u, err := neturl.Parse(endpoint)
+	if err != nil || u.Hostname() == "" {
+		return
+	}
+	g.mu.Lock()
+	g.trusted[strings.ToLower(u.Hostname())] = true
+	g.mu.Unlock()
+}
+
+// dialContext dials addr like the default transport does, refusing
+// private addresses to media downloads from hosts that aren't trusted.
+func (g *downloadGuard) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if media, _ := ctx.Value(mediaDownloadContextKey{}).(bool); media && !g.allowPrivate {
+		host, _, _ := net.SplitHostPort(addr)
+		g.mu.RLock()
+		trusted := g.trusted[strings.ToLower(host)]
+		g.mu.RUnlock()
+		if !trusted {
+			d.Control = func(network, address string, _ syscall.RawConn) error {
+				ap, err := netip.ParseAddrPort(address)
+				if err != nil || !publicAddr(ap.Addr()) {
+					rejectedURLsTotal.WithLabelValues("private_download").Inc()
+					slog.WarnContext(ctx, "Private_download_refused", "host", host, "address", address)
+					return errPrivateAddress
+				}
+				return nil
+			}
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
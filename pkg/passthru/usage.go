@@ -0,0 +1,314 @@
+package passthru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyUsage counts what one API key has used since startup.
+type keyUsage struct {
+	tenant string
+	key    string // see keyID
+	quota  *keyQuota
+
+	requests      atomic.Int64
+	cacheHits     atomic.Int64
+	bytesServed   atomic.Int64
+	upstreamBytes atomic.Int64
+}
+
+// keyID identifies an API key in metrics, the usage API and exports without
+// giving the key away: it is the start of the key's SHA-256.
+func keyID(key string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(key)))[:12]
+}
+
+func newKeyUsage(tenant, key string) *keyUsage {
+	u := &keyUsage{tenant: tenant, key: keyID(key)}
+	usageRequestsTotal.WithLabelValues(u.tenant, u.key).Add(0)
+	usageCacheHitsTotal.WithLabelValues(u.tenant, u.key).Add(0)
+	usageBytesServedTotal.WithLabelValues(u.tenant, u.key).Add(0)
+	usageUpstreamBytesTotal.WithLabelValues(u.tenant, u.key).Add(0)
+	return u
+}
+
+// The counting methods do nothing on a nil keyUsage, so callers needn't
+// care whether the request was made with a key.
+
+func (u *keyUsage) request() {
+	if u == nil {
+		return
+	}
+	u.requests.Add(1)
+	usageRequestsTotal.WithLabelValues(u.tenant, u.key).Inc()
+	u.quota.request()
+}
+
+func (u *keyUsage) hit() {
+	if u == nil {
+		return
+	}
+	u.cacheHits.Add(1)
+	usageCacheHitsTotal.WithLabelValues(u.tenant, u.key).Inc()
+}
+
+func (u *keyUsage) served(n int64) {
+	if u == nil || n == 0 {
+		return
+	}
+	u.bytesServed.Add(n)
+	usageBytesServedTotal.WithLabelValues(u.tenant, u.key).Add(float64(n))
+	u.quota.served(n)
+}
+
+func (u *keyUsage) upstream(n int64) {
+	if u == nil || n == 0 {
+		return
+	}
+	u.upstreamBytes.Add(n)
+	usageUpstreamBytesTotal.WithLabelValues(u.tenant, u.key).Add(float64(n))
+}
+
+// usageRecord is the usage of one key, as served by /admin/usage and written
+// to exports.
+type usageRecord struct {
+	Tenant        string `json:"tenant"`
+	Key           string `json:"key"`
+	Requests      int64  `json:"requests"`
+	CacheHits     int64  `json:"cacheHits"`
+	BytesServed   int64  `json:"bytesServed"`
+	UpstreamBytes int64  `json:"upstreamBytes"`
+}
+
+func (u *keyUsage) snapshot() usageRecord {
+	return usageRecord{
+		Tenant:        u.tenant,
+		Key:           u.key,
+		Requests:      u.requests.Load(),
+		CacheHits:     u.cacheHits.Load(),
+		BytesServed:   u.bytesServed.Load(),
+		UpstreamBytes: u.upstreamBytes.Load(),
+	}
+}
+
+// usage returns the current totals of every key, in the order of the
+// tenants file.
+func (ts *tenantSet) usage() []usageRecord {
+	records := []usageRecord{}
+	if !ts.enabled() {
+		return records
+	}
+	for _, k := range ts.keys {
+		records = append(records, k.usage.snapshot())
+	}
+	return records
+}
+
+// usageFor returns the usage of the key with the given ID, or nil.
+func (ts *tenantSet) usageFor(id string) *keyUsage {
+	if !ts.enabled() || id == "" {
+		return nil
+	}
+	for _, k := range ts.keys {
+		if k.usage.key == id {
+			return k.usage
+		}
+	}
+	return nil
+}
+
+type usageContextKey struct{}
+
+// withUsage returns a copy of ctx charging the work done under it to u.
+func withUsage(ctx context.Context, u *keyUsage) context.Context {
+	if u == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, usageContextKey{}, u)
+}
+
+// usageFrom returns the key the work done under ctx is charged to, if any.
+func usageFrom(ctx context.Context) *keyUsage {
+	u, _ := ctx.Value(usageContextKey{}).(*keyUsage)
+	return u
+}
+
+// countingWriter counts the body bytes sent to the client.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// ReadFrom lets http.ServeFile hand the file to the connection with
+// sendfile through the writer, as it would without it.
+func (w *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.n += n
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func writeUsageCSV(w io.Writer, from, to *time.Time, records []usageRecord) error {
+	cw := csv.NewWriter(w)
+	header := []string{"tenant", "key", "requests", "cache_hits", "bytes_served", "upstream_bytes"}
+	if from != nil {
+		header = append([]string{"from", "to"}, header...)
+	}
+	cw.Write(header)
+	for _, rec := range records {
+		row := []string{
+			rec.Tenant,
+			rec.Key,
+			strconv.FormatInt(rec.Requests, 10),
+			strconv.FormatInt(rec.CacheHits, 10),
+			strconv.FormatInt(rec.BytesServed, 10),
+			strconv.FormatInt(rec.UpstreamBytes, 10),
+		}
+		if from != nil {
+			row = append([]string{from.Format(time.RFC3339), to.Format(time.RFC3339)}, row...)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// handleUsage serves every key's usage since startup as JSON or, with
+// ?format=csv, as CSV.
+func handleUsage(ts *tenantSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		records := ts.usage()
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			writeJSON(w, http.StatusOK, records)
+		case "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			if err := writeUsageCSV(w, nil, nil, records); err != nil {
+				slog.ErrorContext(r.Context(), "Usage_export_error", "error", err)
+			}
+		default:
+			http.Error(w, "'format' must be json or csv", http.StatusBadRequest)
+		}
+	}
+}
+
+// usageExporter periodically writes the usage of every key over the past
+// period to a file of its own in dir, for chargeback.
+type usageExporter struct {
+	tenants  *tenantSet
+	dir      string
+	format   string // csv or json
+	interval time.Duration
+
+	mu       sync.Mutex
+	from     time.Time
+	previous map[string]usageRecord
+}
+
+func newUsageExporter(ts *tenantSet, dir, format string, interval time.Duration) (*usageExporter, error) {
+	if format != "csv" && format != "json" {
+		return nil, fmt.Errorf("unknown usage export format %q", format)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("usage export interval must be positive")
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &usageExporter{
+		tenants:  ts,
+		dir:      dir,
+		format:   format,
+		interval: interval,
+		from:     time.Now(),
+		previous: make(map[string]usageRecord),
+	}, nil
+}
+
+// start exports the usage every interval, until ctx is done.
+func (ue *usageExporter) start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(ue.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := ue.export(); err != nil {
+				slog.Error("Usage_export_error", "dir", ue.dir, "error", err)
+			}
+		}
+	}()
+}
+
+// export writes the usage since the previous export.
+func (ue *usageExporter) export() error {
+	ue.mu.Lock()
+	defer ue.mu.Unlock()
+
+	to := time.Now()
+	var period []usageRecord
+	current := make(map[string]usageRecord)
+	for _, rec := range ue.tenants.usage() {
+		current[rec.Key] = rec
+		prev := ue.previous[rec.Key]
+		rec.Requests -= prev.Requests
+		rec.CacheHits -= prev.CacheHits
+		rec.BytesServed -= prev.BytesServed
+		rec.UpstreamBytes -= prev.UpstreamBytes
+		period = append(period, rec)
+	}
+
+	path := filepath.Join(ue.dir, "usage-"+to.UTC().Format("20060102T150405Z")+"."+ue.format)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if ue.format == "csv" {
+		err = writeUsageCSV(f, &ue.from, &to, period)
+	} else {
+		err = json.NewEncoder(f).Encode(struct {
+			From  time.Time     `json:"from"`
+			To    time.Time     `json:"to"`
+			Usage []usageRecord `json:"usage"`
+		}{ue.from, to, period})
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	slog.Info("Usage_exported", "file", path, "keys", len(period))
+	ue.from, ue.previous = to, current
+	return nil
+}
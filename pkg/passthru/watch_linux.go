@@ -0,0 +1,110 @@
+//go:build linux
+
+package passthru
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask is the inotify events that change what a storageTracker knows of
+// a directory.
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR | syscall.IN_EXCL_UNLINK
+
+// dirWatcher feeds inotify events for the directories it watches to a
+// storageTracker. Reads go through file, which is non-blocking so that
+// closing it ends a read in progress.
+type dirWatcher struct {
+	fd      int
+	file    *os.File
+	tracker *storageTracker
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+func newDirWatcher(tracker *storageTracker) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWatcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), tracker: tracker, dirs: make(map[int32]string)}, nil
+}
+
+// add starts watching dir.
+func (w *dirWatcher) add(dir string) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.dirs[int32(wd)] = dir
+	w.mu.Unlock()
+	return nil
+}
+
+// run feeds events to the tracker until ctx is done, and then stops
+// watching.
+func (w *dirWatcher) run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		w.file.Close()
+	}()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.tracker.fail(err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			if offset > n {
+				break
+			}
+			w.handle(event, strings.TrimRight(string(buf[nameStart:offset]), "\x00"))
+		}
+	}
+}
+
+func (w *dirWatcher) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.tracker.lost()
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.dirs[event.Wd]
+	if ok && event.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, event.Wd)
+	}
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	switch {
+	case event.Mask&syscall.IN_IGNORED != 0:
+		w.tracker.unwatched(dir)
+	case event.Mask&syscall.IN_MOVE_SELF != 0:
+		// The path no longer leads here; dropping the watch ends in
+		// IN_IGNORED
+		syscall.InotifyRmWatch(w.fd, uint32(event.Wd))
+	case event.Mask&syscall.IN_ISDIR != 0 || name == "":
+	case event.Mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		w.tracker.removed(dir, name)
+	default:
+		w.tracker.changed(dir, name)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package passthru
+
+import (
+	"context"
+	"errors"
+)
+
+type dirWatcher struct{}
+
+func newDirWatcher(tracker *storageTracker) (*dirWatcher, error) {
+	return nil, errors.New("watching storage is only supported on Linux")
+}
+
+func (w *dirWatcher) add(dir string) error {
+	return nil
+}
+
+func (w *dirWatcher) run(ctx context.Context) {}
@@ -0,0 +1,177 @@
+package passthru
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookSignatureHeader carries "sha256=" followed by the hex HMAC-SHA256
+	// of the request body, keyed with -webhook-secret.
+	webhookSignatureHeader = "X-Passthru-Signature"
+	webhookEventHeader     = "X-Passthru-Event"
+
+	webhookAttempts  = 3
+	webhookTimeout   = 10 * time.Second
+	webhookBaseDelay = 5 * time.Second
+)
+
+// Webhook event types.
+const (
+	eventDownloadCompleted = "download.completed"
+	eventDownloadFailed    = "download.failed"
+	eventBatchCompleted    = "batch.completed"
+)
+
+// webhookEvent is the JSON body posted to every webhook URL.
+type webhookEvent struct {
+	Event       string    `json:"event"`
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"` // prefetch or batch
+	URL         string    `json:"url,omitempty"`
+	Hash        string    `json:"hash,omitempty"`
+	CacheStatus string    `json:"cacheStatus,omitempty"`
+	// Size, ContentType and Link describe a completed download. Link is a
+	// signed link to it, if signed links are enabled.
+	Size        int64  `json:"size,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Link        string `json:"link,omitempty"`
+	Error       string `json:"error,omitempty"`
+	Batch       string `json:"batch,omitempty"`
+	Failed      int    `json:"failed,omitempty"`
+}
+
+// notifier posts webhook events for background downloads, to the
+// configured webhook URLs and to the callback URL a client gave along with
+// the download, if any.
+type notifier struct {
+	urls   []string
+	secret []byte
+	client *http.Client
+	// callbacks posts to the URLs clients give, which are kept off private
+	// addresses like media downloads are.
+	callbacks *http.Client
+	links     *linkSigner
+}
+
+// newNotifier returns a notifier posting to the comma-separated list of
+// URLs, and to callbacks through guard. Completed downloads are described
+// with a link minted by links, if enabled.
+func newNotifier(urlList, secret string, links *linkSigner, guard *downloadGuard) *notifier {
+	var urls []string
+	for _, u := range strings.Split(urlList, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = guard.dialContext
+	return &notifier{
+		urls:      urls,
+		secret:    []byte(secret),
+		client:    &http.Client{Timeout: webhookTimeout},
+		callbacks: &http.Client{Timeout: webhookTimeout, Transport: transport},
+		links:     links,
+	}
+}
+
+// checkCallback returns the error refusing rawURL as a callback URL, or nil
+// if it's an absolute http or https URL.
+func checkCallback(rawURL string) *fetchError {
+	u, err := neturl.Parse(rawURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return &fetchError{http.StatusBadRequest, "'callback' must be an absolute http or https URL"}
+	}
+	return nil
+}
+
+// describe adds the size and type of the download e of c to event, and a
+// signed link to it.
+func (n *notifier) describe(event *webhookEvent, c *cache, e cacheEntry) {
+	if meta, err := readMeta(e.headersFile); err == nil {
+		event.Size, event.ContentType = meta.ContentLength, meta.ContentType
+	}
+	if n.links.enabled() {
+		event.Link = n.links.link(c.namespace, e.hash, time.Now().Add(n.links.ttl).Truncate(time.Second))
+	}
+}
+
+// notify sends event to every webhook URL, and to callback if it isn't "",
+// in the background.
+func (n *notifier) notify(event webhookEvent, callback string) {
+	if len(n.urls) == 0 && callback == "" {
+		return
+	}
+	event.Time = time.Now()
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Webhook_encode_error", "event", event.Event, "error", err)
+		return
+	}
+	for _, u := range n.urls {
+		go n.deliver(n.client, u, event.Event, body)
+	}
+	if callback != "" {
+		go n.deliver(n.callbacks, callback, event.Event, body)
+	}
+}
+
+// deliver posts body to url with client, retrying with backoff on errors
+// and non-2xx responses.
+func (n *notifier) deliver(client *http.Client, url, event string, body []byte) {
+	delay := webhookBaseDelay
+	for attempt := 1; ; attempt++ {
+		err := n.post(client, url, event, body)
+		if err == nil {
+			webhookDeliveriesTotal.WithLabelValues("delivered").Inc()
+			return
+		}
+		if attempt == webhookAttempts {
+			slog.Error("Webhook_failed", "url", url, "event", event, "attempts", attempt, "error", err)
+			webhookDeliveriesTotal.WithLabelValues("failed").Inc()
+			return
+		}
+		slog.Info("Webhook_retry_scheduled", "url", url, "event", event, "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (n *notifier) post(client *http.Client, url, event string, body []byte) error {
+	req, err := http.NewRequestWithContext(withMediaDownload(context.Background()), "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	if len(n.secret) > 0 {
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(n.secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of body keyed with secret.
+func signWebhook(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
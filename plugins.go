@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"plugin"
+	"strings"
+
+	"cobalt-passthru/pkg/passthru"
+)
+
+// loadPlugins opens each Go plugin in the comma-separated list and adds what
+// it exports to cfg: a `Hooks` variable of type passthru.Hooks, a
+// `Middleware` function of type func(http.Handler) http.Handler and/or a
+// `Storage` variable of type passthru.Storage, the storage backend.
+//
+// Plugins must be built with `go build -buildmode=plugin` against the same
+// version of this module and its dependencies.
+func loadPlugins(list string, cfg *passthru.Config) error {
+	for _, path := range strings.Split(list, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		p, err := plugin.Open(path)
+		if err != nil {
+			return err
+		}
+
+		found := false
+		if sym, err := p.Lookup("Hooks"); err == nil {
+			hooks, ok := sym.(*passthru.Hooks)
+			if !ok {
+				return fmt.Errorf("%s: Hooks is a %T, not a passthru.Hooks", path, sym)
+			}
+			cfg.Hooks = append(cfg.Hooks, *hooks)
+			found = true
+		}
+		if sym, err := p.Lookup("Middleware"); err == nil {
+			mw, ok := sym.(func(http.Handler) http.Handler)
+			if !ok {
+				return fmt.Errorf("%s: Middleware is a %T, not a func(http.Handler) http.Handler", path, sym)
+			}
+			cfg.Middleware = append(cfg.Middleware, mw)
+			found = true
+		}
+		if sym, err := p.Lookup("Storage"); err == nil {
+			storage, ok := sym.(*passthru.Storage)
+			if !ok {
+				return fmt.Errorf("%s: Storage is a %T, not a passthru.Storage", path, sym)
+			}
+			cfg.Storage = *storage
+			found = true
+		}
+		if !found {
+			return fmt.Errorf("%s exports none of Hooks, Middleware or Storage", path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settingsEnvPrefix prefixes the environment variables that stand in for
+// flags: -cache-ttl is COBALT_PASSTHRU_CACHE_TTL.
+const settingsEnvPrefix = "COBALT_PASSTHRU_"
+
+// settingEnvName returns the environment variable for the flag name.
+func settingEnvName(name string) string {
+	return settingsEnvPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applySettings sets the flags of fs that weren't given on the command
+// line from their environment variables, or failing that from the YAML
+// file configPath points at, if any. So flags win over the environment,
+// which wins over the file. configPath is the -config flag, which can
+// come from the environment too.
+func applySettings(fs *flag.FlagSet, configPath *string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if !given["config"] {
+		if path, ok := os.LookupEnv(settingEnvName("config")); ok {
+			*configPath = path
+		}
+	}
+
+	file := make(map[string]string)
+	if *configPath != "" {
+		var err error
+		if file, err = readSettingsFile(*configPath); err != nil {
+			return err
+		}
+		for name := range file {
+			if name == "config" || fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown setting %q", *configPath, name)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || given[f.Name] || f.Name == "config" {
+			return
+		}
+		source := settingEnvName(f.Name)
+		value, ok := os.LookupEnv(source)
+		if !ok {
+			source = *configPath
+			if value, ok = file[f.Name]; !ok {
+				return
+			}
+		}
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: invalid value %q for %s: %v", source, value, f.Name, setErr)
+		}
+	})
+	return err
+}
+
+// readSettingsFile reads a YAML file of flag names and their values. A
+// list stands for a comma-separated value, like -allowed-hosts takes.
+func readSettingsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case nil:
+			settings[name] = ""
+		case map[string]any:
+			return nil, fmt.Errorf("%s: %s must be a value or a list, not a mapping", path, name)
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			settings[name] = strings.Join(items, ",")
+		default:
+			settings[name] = fmt.Sprint(v)
+		}
+	}
+	return settings, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdListenFDsStart is the first file descriptor systemd passes sockets in.
+const sdListenFDsStart = 3
+
+// systemdListeners returns the sockets systemd passed the process through
+// socket activation, by the name given with FileDescriptorName= in the
+// socket unit. Unnamed sockets are named after their order: "http",
+// "metrics" and "grpc", in the order the unit's Listen*= lines give them.
+// It returns nil when the process wasn't socket activated.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	byOrder := []string{"http", "metrics", "grpc"}
+
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		} else if i < len(byOrder) {
+			name = byOrder[i]
+		} else {
+			return nil, fmt.Errorf("socket %d from systemd has no name", i)
+		}
+		if listeners[name] != nil {
+			return nil, fmt.Errorf("systemd passed two sockets named %q", name)
+		}
+
+		f := os.NewFile(uintptr(sdListenFDsStart+i), name)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %q from systemd: %v", name, err)
+		}
+		listeners[name] = lis
+	}
+	return listeners, nil
+}
+
+// listen returns the listener systemd passed under name, or listens on addr
+// if it passed none.
+func listen(inherited map[string]net.Listener, name, addr string) (net.Listener, error) {
+	if lis := inherited[name]; lis != nil {
+		slog.Info("Using_systemd_socket", "name", name, "addr", lis.Addr())
+		return lis, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// sdNotify sends state to systemd's notification socket, and reports
+// whether there was one to send it to.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval returns how often systemd expects to be told the
+// process is alive (half its WatchdogSec=), or 0 if it doesn't watch it.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// notifyReady tells systemd the servers are listening, and keeps its
+// watchdog fed from then on if it has one.
+func notifyReady() {
+	sent, err := sdNotify("READY=1")
+	if err != nil {
+		slog.Error("Systemd_notify_error", "error", err)
+		return
+	}
+	if !sent {
+		return
+	}
+	slog.Info("Systemd_notified", "state", "READY")
+
+	interval := sdWatchdogInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Error("Systemd_watchdog_error", "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverTLS returns the TLS configuration of the listeners: the certificate
+// and key in certFile and keyFile, or certificates Let's Encrypt issues for
+// the comma-separated autocertHosts, kept in autocertDir. It's nil, for
+// plain HTTP, with neither. Listeners serving TLS speak HTTP/2 too.
+func serverTLS(certFile, keyFile, autocertHosts, autocertDir string) (*tls.Config, error) {
+	switch {
+	case autocertHosts != "":
+		if certFile != "" || keyFile != "" {
+			return nil, errors.New("-tls-autocert-hosts can't be used with -tls-cert and -tls-key")
+		}
+		var hosts []string
+		for _, host := range strings.Split(autocertHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      autocert.DirCache(autocertDir),
+		}
+		// Answers the TLS-ALPN-01 challenge on the listener itself, which
+		// must be reachable on port 443 for that
+		return m.TLSConfig(), nil
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("-tls-cert and -tls-key go together")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}, nil
+	}
+	return nil, nil
+}